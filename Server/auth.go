@@ -0,0 +1,172 @@
+package Server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"ipfs-alpha-entanglement-code/auth"
+	"ipfs-alpha-entanglement-code/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+const MaxSignedBodySize = 32 << 20 // size of the largest body of a signed request
+
+const signerKey = "signer" // key of the peer ID of the node which signed the request in the gin context
+
+const signerCacheDuration = time.Minute // how long the address of the node of a signing peer is kept
+
+// Access is who may call an endpoint once the node has a secret
+type Access int
+
+const (
+	PublicAccess   Access = iota // anyone
+	SignedAccess                 // clients and community nodes holding the secret
+	OperatorAccess               // clients holding the secret, and the node itself
+	PeerAccess                   // community nodes holding the secret and the key of their cluster peer
+)
+
+// SetSecret makes the node sign its requests to the other community nodes with the secret they share and the
+// key of its cluster peer, and reject the requests to its endpoints which are not signed with the secret or
+// which are signed by a community node without the key of its peer. Without a secret, every request is accepted
+func (s *Server) SetSecret(secret []byte, key crypto.PrivKey) {
+	s.secret = secret
+	s.identity = key
+}
+
+// enableAuth sets up the signer and the verifier of the node once its address is known
+func (s *Server) enableAuth() error {
+	if len(s.secret) == 0 {
+		util.LogPrintf("No secret set, the endpoints of the node accept any request")
+		return nil
+	}
+	signer, err := auth.NewNodeSigner(s.secret, s.identity)
+	if err != nil {
+		return err
+	}
+	s.signer = signer
+	s.verifier = auth.NewVerifier(s.secret)
+	s.signers = make(map[string]signerAddress)
+	util.LogPrintf("Signing the requests of the node as cluster peer %s", signer.Node())
+	return nil
+}
+
+// authorize returns the middleware checking that the request is signed by someone allowed to call the endpoint
+func (s *Server) authorize(access Access) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if access == PublicAccess || s.verifier == nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, MaxSignedBodySize+1))
+		if err != nil || len(body) > MaxSignedBodySize {
+			c.AbortWithStatusJSON(413, gin.H{"message": "Request body too large"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		node, err := s.verifier.Verify(c.Request, body, time.Now())
+		if err != nil {
+			util.LogPrintf("Rejecting request to %s from %s - %s", c.FullPath(), c.ClientIP(), err)
+			c.AbortWithStatusJSON(401, gin.H{"message": err.Error()})
+			return
+		}
+
+		if (access == PeerAccess && node == "") || (access == OperatorAccess && node != "" && node != s.signer.Node()) {
+			util.LogPrintf("Rejecting request to %s signed by %q - not allowed", c.FullPath(), node)
+			c.AbortWithStatusJSON(403, gin.H{"message": "Not allowed"})
+			return
+		}
+
+		c.Set(signerKey, node)
+		c.Next()
+	}
+}
+
+// signedBy tells whether the request was signed by the community node of the address, which always holds
+// when the node has no secret
+func (s *Server) signedBy(c *gin.Context, address string) bool {
+	if s.verifier == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), MonitorRequestTimeout)
+	defer cancel()
+	signer, err := s.signerAddress(ctx, c.GetString(signerKey))
+	if err != nil {
+		util.LogPrintf("Cannot find the node of the signer %s - %s", c.GetString(signerKey), err)
+		return false
+	}
+	return signer == address
+}
+
+// signerAddress is the address of the community node of a signing peer, with the time it is kept until
+type signerAddress struct {
+	address string
+	expiry  time.Time
+}
+
+var errSignerUnknown = errors.New("signing peer not in the cluster")
+
+// signerAddress returns the address of the community node of the cluster peer which signed a request
+func (s *Server) signerAddress(ctx context.Context, peerID string) (string, error) {
+	if peerID == s.signer.Node() {
+		return s.address, nil
+	}
+
+	s.signersMux.Lock()
+	cached, ok := s.signers[peerID]
+	s.signersMux.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.address, nil
+	}
+
+	client := s.currentClient()
+	if client == nil {
+		return "", errSignerUnknown
+	}
+	name := client.IPFSClusterConnector.GetPeerName(ctx, peerID)
+	if name == "" {
+		return "", errSignerUnknown
+	}
+	address, err := s.getCommunityAddress(name)
+	if err != nil {
+		return "", err
+	}
+
+	s.signersMux.Lock()
+	s.signers[peerID] = signerAddress{address: address, expiry: time.Now().Add(signerCacheDuration)}
+	s.signersMux.Unlock()
+	return address, nil
+}
+
+// postJSON sends a request signed by the node
+func (s *Server) postJSON(url string, body []byte) (int, error) {
+	return PostSignedJSON(url, body, s.signer)
+}
+
+var errViewSourceUnknown = errors.New("view sender not allocated the strand")
+
+// checkViewSource checks that the sender of a view of a file is a community node whose cluster peer is allocated
+// the strand of the file, which always holds when the node has no secret
+func (s *Server) checkViewSource(ctx context.Context, c *gin.Context, strandRootCID string) error {
+	if s.verifier == nil {
+		return nil
+	}
+	node := c.GetString(signerKey)
+	client := s.currentClient()
+	if client == nil {
+		return errViewSourceUnknown
+	}
+
+	for _, peer := range client.IPFSClusterConnector.GetPinAllocationIDs(ctx, strandRootCID) {
+		if peer == node {
+			return nil
+		}
+	}
+	return errViewSourceUnknown
+}
@@ -1,157 +1,143 @@
 package Server
 
 import (
-	"encoding/json"
+	"context"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
 	"time"
 )
 
 const InspectionInterval = 30 * time.Second
 const ViewSharingInterval = 4 * time.Minute
+const ViewFullSyncRounds = 15                       // rounds of view sharing sending the changes only, between two sending the whole views
+const MonitorTimeout = 1 * time.Minute              // deadline of a monitoring operation
+const MonitorRequestTimeout = 5 * time.Second       // deadline of a single IPFS request while monitoring
+const RepairTimeout = 30 * time.Minute              // deadline of a repair operation
+const RepairRequestTimeout = 100 * time.Millisecond // deadline of a single IPFS request while repairing, so that missing blocks are skipped quickly
+
+// monitorContext returns the context of a monitoring operation of the daemon
+func monitorContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), MonitorTimeout)
+	return ipfsconnector.WithBlockTimeout(ctx, MonitorRequestTimeout), cancel
+}
+
+// repairContext returns the context of a repair operation of the daemon
+func repairContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), RepairTimeout)
+	return ipfsconnector.WithBlockTimeout(ctx, RepairRequestTimeout), cancel
+}
 
+// Daemon owns the state of the node: it runs the state operations one at a time and hands the inspections,
+// view sharing and repair checks to the worker pools when their timers fire
 func Daemon(s *Server) {
 	timerFiles := time.NewTimer(InspectionInterval)
 	timerShareView := time.NewTimer(ViewSharingInterval)
+	timerRepairs := time.NewTimer(RepairCheckInterval)
+
+	s.submit(s.pools.Collab, s.recoverRepairs)
 
 	for {
 		select {
 		case <-s.ctx:
 			return
-		case op := <-s.collabOps:
-			s.StartCollabRepair(op)
-		case op := <-s.unitOps:
-			s.StartUnitRepair(op)
-		case op := <-s.collabDone:
-			s.ContinueStrandRepair(op)
-		case op := <-s.unitDone:
-			s.ReportUnitRepair(op)
-		case op := <-s.strandOps:
-			s.StartStrandRepair(op)
-
-		case op := <-s.operations:
-			switch {
-			case op.operationType == START_MONITOR_FILE:
-
-				var request StartMonitoringRequest
-				// parse args
-				if err := json.Unmarshal(op.parameter, &request); err != nil {
-					println("Error parsing StartMonitoringRequest: ", err.Error())
-					continue
-				}
+		case op := <-s.stateOps:
+			op.fn()
+			close(op.done)
 
-				s.stateMux.Lock()
-				_, in := s.state.files[request.FileCID]
-				if !in {
-					// If not already monitoring this file
-
-					s.RefreshClient()
-					s.client.SetTimeout(5 * time.Second)
-
-					metaData, err := s.client.GetMetaData(request.MetadataCID)
-					if err != nil {
-						println("Could not fetch the metadata: ", err.Error())
-						continue
-					}
-
-					strandNumber := 0
-					for i, root := range metaData.TreeCIDs {
-						if root == request.StrandRootCID {
-							strandNumber = i
-							break
-						}
-					}
-
-					s.state.files[request.FileCID] = &FileStats{request.FileCID, request.MetadataCID, request.StrandRootCID,
-						strandNumber, make(map[uint]*WatchedBlock), make(map[uint]*WatchedBlock),
-						make(map[uint]*WatchedBlock), 1.0, 1.0}
-				}
-				s.stateMux.Unlock()
-
-			case op.operationType == STOP_MONITOR_FILE:
-
-				var request StopMonitoringRequest
-				// parse args
-				if err := json.Unmarshal(op.parameter, &request); err != nil {
-					println("Error parsing StopMonitoringRequest: ", err.Error())
-					continue
-				}
-				s.stateMux.Lock()
-				delete(s.state.files, request.FileCID)
-				s.stateMux.Unlock()
-
-			case op.operationType == RESET_MONITOR_FILE:
+		case <-timerFiles.C:
+			s.submit(s.pools.Inspection, s.InspectFiles)
+			timerFiles.Reset(InspectionInterval)
 
-				var request ResetMonitoringRequest
-				// parse args
-				if err := json.Unmarshal(op.parameter, &request); err != nil {
-					println("Error parsing StopMonitoringRequest: ", err.Error())
-					continue
+		case <-timerRepairs.C:
+			if s.checkingRepairs.CompareAndSwap(false, true) {
+				if s.submit(s.pools.Collab, s.CheckRepairJobs) != nil {
+					s.checkingRepairs.Store(false)
 				}
+			}
+			timerRepairs.Reset(RepairCheckInterval)
 
-				s.stateMux.Lock()
-
-				parityBlocksMissing := make(map[uint]*WatchedBlock)
-				validParityBlocksHistory := make(map[uint]*WatchedBlock)
-				dataBlocksMissing := make(map[uint]*WatchedBlock)
-
-				blocProb := s.state.files[request.FileCID].EstimatedBlockProb
-				health := s.state.files[request.FileCID].Health
+		case <-timerShareView.C:
+			s.submit(s.pools.ViewShare, s.ShareViews)
+			timerShareView.Reset(ViewSharingInterval)
+		}
+	}
+}
 
-				// Keep old values for parity blocks if only data blocks were repaired
-				if request.IsData {
-					parityBlocksMissing = s.state.files[request.FileCID].ParityBlocksMissing
-					validParityBlocksHistory = s.state.files[request.FileCID].validParityBlocksHistory
-				} else {
-					dataBlocksMissing = s.state.files[request.FileCID].DataBlocksMissing
-				}
+// startMonitoring starts monitoring a file, unless it is already monitored. It runs on an inspection worker
+func (s *Server) startMonitoring(request StartMonitoringRequest) {
+	var in bool
+	s.do(func() { _, in = s.state.files[request.FileCID] })
+	if in {
+		return
+	}
 
-				s.state.files[request.FileCID] = &FileStats{
-					fileCID:                  request.FileCID,
-					MetadataCID:              s.state.files[request.FileCID].MetadataCID,
-					StrandRootCID:            s.state.files[request.FileCID].StrandRootCID,
-					strandNumber:             s.state.files[request.FileCID].strandNumber,
-					DataBlocksMissing:        dataBlocksMissing,
-					ParityBlocksMissing:      parityBlocksMissing,
-					validParityBlocksHistory: validParityBlocksHistory,
-					EstimatedBlockProb:       (blocProb + 1) / 2,
-					Health:                   (health + 1) / 2,
-				}
+	ctx, cancel := monitorContext()
+	defer cancel()
+	client, err := s.RefreshClient(ctx)
+	if err != nil {
+		println("Could not connect to the cluster: ", err.Error())
+		return
+	}
 
-				s.stateMux.Unlock()
+	metaData, err := client.GetMetaData(ctx, request.MetadataCID)
+	if err != nil {
+		println("Could not fetch the metadata: ", err.Error())
+		return
+	}
 
-			default:
-				println("Unknown operation type (", op.operationType, "), please fix...")
-			}
+	strandNumber := 0
+	for i, root := range metaData.TreeCIDs {
+		if root == request.StrandRootCID {
+			strandNumber = i
 			break
+		}
+	}
 
-		case <-timerFiles.C:
-			s.stateMux.Lock()
-			s.RefreshClient()
-			s.client.SetTimeout(5 * time.Second)
-
-			// check a block for each file
-			for file, stats := range s.state.files {
-				println("Checking file: ", file, "with strandRoot: ", stats.StrandRootCID, "\n")
-				s.InspectFile(stats)
-			}
-			s.stateMux.Unlock()
-
-			timerFiles.Reset(InspectionInterval)
-			s.client.SetTimeout(0)
-
-		case <-timerShareView.C:
-			s.stateMux.Lock()
+	s.do(func() {
+		// the file may have started being monitored meanwhile
+		if _, in := s.state.files[request.FileCID]; in {
+			return
+		}
+		s.state.files[request.FileCID] = &FileStats{request.FileCID, request.MetadataCID, request.StrandRootCID,
+			strandNumber, make(map[uint]*WatchedBlock), make(map[uint]*WatchedBlock),
+			make(map[uint]*WatchedBlock), 1.0, 1.0, NewView()}
+		s.saveFile(request.FileCID)
+	})
+}
 
-			// share view for each file
-			for file, stats := range s.state.files {
-				println("Sharing view for file: ", file, "with strandRoot: ", stats.StrandRootCID, "\n")
+// stopMonitoring stops monitoring a file. It runs on the daemon
+func (s *Server) stopMonitoring(fileCID string) {
+	delete(s.state.files, fileCID)
+	delete(s.state.viewAcks, fileCID)
+	s.saveFile(fileCID)
+}
 
-				// Check allocation list for fs.strandRootCID
-				//   send a view of the stats to each CommunityNode corresponding to a peer in the allocation list
-				s.ShareView(file, stats)
-			}
-			s.stateMux.Unlock()
+// resetMonitoring resets the stats of a file after a repair, keeping those of the kind of blocks not repaired.
+// The missing blocks of the kind repaired are observed available, so that the other monitors forget them too.
+// It runs on the daemon
+func (s *Server) resetMonitoring(request ResetMonitoringRequest) bool {
+	stats, in := s.state.files[request.FileCID]
+	if !in {
+		println("File not monitored: ", request.FileCID)
+		return false
+	}
 
-			timerShareView.Reset(ViewSharingInterval)
+	// Keep old values for parity blocks if only data blocks were repaired
+	reset := stats.clone()
+	if request.IsData {
+		for blockNumber := range stats.DataBlocksMissing {
+			reset.observeAvailable(s.address, true, blockNumber)
 		}
+	} else {
+		for blockNumber := range stats.ParityBlocksMissing {
+			reset.observeAvailable(s.address, false, blockNumber)
+		}
+		reset.validParityBlocksHistory = make(map[uint]*WatchedBlock)
 	}
+	reset.EstimatedBlockProb = (stats.EstimatedBlockProb + 1) / 2
+	reset.Health = (stats.Health + 1) / 2
+	reset.shareEstimate(s.address)
+
+	s.state.files[request.FileCID] = reset
+	s.saveFile(request.FileCID)
+	return true
 }
@@ -0,0 +1,301 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	ipfscluster "ipfs-alpha-entanglement-code/ipfs-cluster"
+)
+
+// names of the discovery backends
+const (
+	HTTPDiscoveryBackend    = "http"
+	StaticDiscoveryBackend  = "static"
+	DNSDiscoveryBackend     = "dns"
+	ClusterDiscoveryBackend = "cluster"
+)
+
+const DefaultCommunityTag = "community" // cluster tag holding the address of the community node of a peer
+
+const clusterTXTKey = "cluster=" // prefix of the TXT record giving the cluster peer of a community node
+
+var ErrUnknownCommunity = errors.New("no community node known for the cluster peer")
+
+// Discovery finds the community nodes of the community, and the one running next to a cluster peer
+type Discovery interface {
+	// Announce makes the node known to the other community nodes
+	Announce(ctx context.Context, self CommunityNodeAnnouncement) error
+	// Peers returns the community nodes, including the node itself, keyed by address
+	Peers(ctx context.Context) (CommunitiesMap, error)
+	// CommunityAddress returns the address of the community node of a cluster peer, or ErrUnknownCommunity
+	CommunityAddress(ctx context.Context, clusterIP string) (string, error)
+}
+
+// DiscoveryConfig selects the discovery backend of a community node and its settings
+type DiscoveryConfig struct {
+	Backend     string // http, static, dns or cluster
+	Address     string // address of the discovery service, for http
+	PeersFile   string // JSON file of the community nodes in the format of the discovery service, for static
+	Service     string // name of the SRV records of the community nodes, e.g. _community._tcp.example.org, for dns
+	Tag         string // cluster tag holding the address of the community nodes, for cluster
+	ClusterIP   string // cluster peer of the node, for cluster
+	ClusterPort int
+}
+
+// NewDiscovery returns the discovery backend selected by the configuration
+func NewDiscovery(config DiscoveryConfig) (Discovery, error) {
+	switch config.Backend {
+	case "", HTTPDiscoveryBackend:
+		if config.Address == "" {
+			return nil, fmt.Errorf("no address of the discovery service")
+		}
+		return &HTTPDiscovery{Address: config.Address}, nil
+	case StaticDiscoveryBackend:
+		if config.PeersFile == "" {
+			return nil, fmt.Errorf("no peers file for the static discovery")
+		}
+		return &StaticDiscovery{Path: config.PeersFile}, nil
+	case DNSDiscoveryBackend:
+		if config.Service == "" {
+			return nil, fmt.Errorf("no SRV name for the DNS discovery")
+		}
+		return &DNSDiscovery{Service: config.Service, Resolver: net.DefaultResolver}, nil
+	case ClusterDiscoveryBackend:
+		tag := config.Tag
+		if tag == "" {
+			tag = DefaultCommunityTag
+		}
+		return &ClusterDiscovery{Tag: tag, ClusterIP: config.ClusterIP, ClusterPort: config.ClusterPort}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery backend %s", config.Backend)
+	}
+}
+
+// communityOf returns the address of the community node of a cluster peer among the community nodes
+func communityOf(nodes CommunitiesMap, clusterIP string) (string, error) {
+	for address, node := range nodes {
+		if node.ClusterIP == clusterIP {
+			return address, nil
+		}
+	}
+	return "", ErrUnknownCommunity
+}
+
+// HTTPDiscovery uses the discovery service, which the community nodes announce themselves to
+type HTTPDiscovery struct {
+	Address string // address of the discovery service with port
+}
+
+func (d *HTTPDiscovery) Announce(ctx context.Context, self CommunityNodeAnnouncement) error {
+	body, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+
+	status, err := PostJSON(fmt.Sprintf("http://%s/announce", d.Address), body)
+	if err != nil {
+		return fmt.Errorf("error announcing oneself: %v", err)
+	}
+	if status != 200 {
+		return fmt.Errorf("error announcing oneself, status not 200 but: %d", status)
+	}
+	return nil
+}
+
+func (d *HTTPDiscovery) Peers(ctx context.Context) (CommunitiesMap, error) {
+	body, err := d.get(ctx, fmt.Sprintf("http://%s/peers", d.Address))
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes CommunitiesMap
+	if err := json.Unmarshal(body, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (d *HTTPDiscovery) CommunityAddress(ctx context.Context, clusterIP string) (string, error) {
+	params := url.Values{}
+	params.Add("clusterIP", clusterIP)
+
+	body, err := d.get(ctx, fmt.Sprintf("http://%s/cluster-to-community?%s", d.Address, params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	if len(body) == 0 {
+		return "", ErrUnknownCommunity
+	}
+	return string(body), nil
+}
+
+func (d *HTTPDiscovery) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s answered with status %d", url, resp.StatusCode)
+	}
+	return body, nil
+}
+
+// StaticDiscovery reads the community nodes from a JSON file in the format of the peers of the discovery
+// service. The file is read again on every lookup, so that it can be edited while the node runs
+type StaticDiscovery struct {
+	Path string
+}
+
+// Announce does nothing, the community nodes are listed in the file
+func (d *StaticDiscovery) Announce(ctx context.Context, self CommunityNodeAnnouncement) error {
+	return nil
+}
+
+func (d *StaticDiscovery) Peers(ctx context.Context) (CommunitiesMap, error) {
+	data, err := os.ReadFile(d.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes CommunitiesMap
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("invalid peers file %s: %v", d.Path, err)
+	}
+	return nodes, nil
+}
+
+func (d *StaticDiscovery) CommunityAddress(ctx context.Context, clusterIP string) (string, error) {
+	nodes, err := d.Peers(ctx)
+	if err != nil {
+		return "", err
+	}
+	return communityOf(nodes, clusterIP)
+}
+
+// Resolver looks up the DNS records of the community nodes, implemented by net.Resolver
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DNSDiscovery finds the community nodes in the SRV records of a name, each record giving the host and the
+// port of a node. The cluster peer of a node is given by a TXT record "cluster=<peer name>" on its host
+type DNSDiscovery struct {
+	Service  string
+	Resolver Resolver
+}
+
+// Announce does nothing, the records of the community nodes are managed with the DNS zone
+func (d *DNSDiscovery) Announce(ctx context.Context, self CommunityNodeAnnouncement) error {
+	return nil
+}
+
+func (d *DNSDiscovery) Peers(ctx context.Context) (CommunitiesMap, error) {
+	_, records, err := d.Resolver.LookupSRV(ctx, "", "", d.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(CommunitiesMap)
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		node := CommunityNode{}
+
+		txts, err := d.Resolver.LookupTXT(ctx, record.Target)
+		if err == nil {
+			for _, txt := range txts {
+				if strings.HasPrefix(txt, clusterTXTKey) {
+					node.ClusterIP = strings.TrimPrefix(txt, clusterTXTKey)
+				}
+			}
+		}
+		nodes[net.JoinHostPort(host, fmt.Sprint(record.Port))] = node
+	}
+	return nodes, nil
+}
+
+func (d *DNSDiscovery) CommunityAddress(ctx context.Context, clusterIP string) (string, error) {
+	nodes, err := d.Peers(ctx)
+	if err != nil {
+		return "", err
+	}
+	return communityOf(nodes, clusterIP)
+}
+
+// ClusterDiscovery finds the community nodes in the metadata of the cluster peers: every peer publishes the
+// address of its community node as a tag of its tags informer
+type ClusterDiscovery struct {
+	Tag         string
+	ClusterIP   string
+	ClusterPort int
+
+	connector *ipfscluster.Connector // created on first use
+	mux       sync.Mutex
+}
+
+// Announce does nothing, the address of the node is published by its cluster peer
+func (d *ClusterDiscovery) Announce(ctx context.Context, self CommunityNodeAnnouncement) error {
+	return nil
+}
+
+func (d *ClusterDiscovery) Peers(ctx context.Context) (CommunitiesMap, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.connector == nil {
+		connector, err := ipfscluster.CreateIPFSClusterConnector(ctx, d.ClusterPort, d.ClusterIP)
+		if err != nil {
+			return nil, err
+		}
+		d.connector = connector
+	} else if _, err := d.connector.GetLatestPeers(ctx); err != nil {
+		return nil, err
+	}
+
+	addresses, err := d.connector.GetPeerTags(ctx, d.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(CommunitiesMap)
+	for peerID, address := range addresses {
+		name := d.connector.GetPeerName(ctx, peerID)
+		if name == "" || address == "" {
+			continue
+		}
+		nodes[address] = CommunityNode{ClusterIP: name}
+	}
+	return nodes, nil
+}
+
+func (d *ClusterDiscovery) CommunityAddress(ctx context.Context, clusterIP string) (string, error) {
+	nodes, err := d.Peers(ctx)
+	if err != nil {
+		return "", err
+	}
+	return communityOf(nodes, clusterIP)
+}
+
+// SetDiscovery sets the discovery backend of the node, the discovery service by default
+func (s *Server) SetDiscovery(discovery Discovery) {
+	s.discovery = discovery
+}
@@ -1,32 +1,40 @@
 package Server
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	"ipfs-alpha-entanglement-code/entangler"
+	ipfscluster "ipfs-alpha-entanglement-code/ipfs-cluster"
 	"net/http"
-	"net/url"
 )
 
-func (s *Server) getAllPeers() (map[string]string, map[string]CommunityNode, []string, error) {
-	url := fmt.Sprintf("http://%s/peers", s.discoveryAddress)
-	resp, err := http.Get(url)
-
-	if err != nil {
-		return nil, nil, nil, err
+// errorStatus returns the HTTP status answering a request that failed with the error
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, entangler.ErrInvalidParameters):
+		return http.StatusBadRequest
+	case errors.Is(err, ipfscluster.ErrPeerUnreachable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ipfscluster.ErrMalformedResponse), errors.Is(err, ipfscluster.ErrRequestRejected):
+		return http.StatusBadGateway
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
 	}
+}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+// getAllPeers returns the other community nodes known to the discovery, with the community node of each
+// cluster peer and the addresses of the nodes
+func (s *Server) getAllPeers() (map[string]string, map[string]CommunityNode, []string, error) {
+	ctx, cancel := monitorContext()
+	defer cancel()
+	nodes, err := s.discovery.Peers(ctx)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	var nodes CommunitiesMap
-	if err := json.Unmarshal(body, &nodes); err != nil {
-		return nil, nil, nil, err
-	}
-
 	// remove self from the list
 	delete(nodes, s.address)
 
@@ -43,35 +51,13 @@ func (s *Server) getAllPeers() (map[string]string, map[string]CommunityNode, []s
 
 // convert cluster ip to community address
 func (s *Server) getCommunityAddress(clusterIP string) (string, error) {
-	baseURL := fmt.Sprintf("http://%s/cluster-to-community", s.discoveryAddress)
-
-	// Build the query parameters
-	params := url.Values{}
-	params.Add("clusterIP", clusterIP)
-
-	// Construct the final URL with query parameters
-	fullURL := fmt.Sprintf("%s?%s", baseURL, params.Encode())
-
-	// Send the GET request
-	resp, err := http.Get(fullURL)
-	if err != nil {
-		return "", fmt.Errorf("error making request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading response body: %v", err)
-	}
-
-	return string(body), nil
+	ctx, cancel := monitorContext()
+	defer cancel()
+	return s.discovery.CommunityAddress(ctx, clusterIP)
 }
 
 func (s *Server) printState() {
-	s.stateMux.Lock()
-	defer s.stateMux.Unlock()
-
-	fmt.Printf("State: %+v\n", s.state.String())
+	s.do(func() { fmt.Printf("State: %+v\n", s.state.String()) })
 }
 
 func (state *State) String() string {
@@ -1,6 +1,8 @@
 package Server
 
 import (
+	"context"
+	"ipfs-alpha-entanglement-code/client"
 	"ipfs-alpha-entanglement-code/entangler"
 	"ipfs-alpha-entanglement-code/util"
 	"log"
@@ -17,22 +19,133 @@ const HealthDepth = 2
 const RepairDepth = 5
 const RepairNumPeers = 2
 
+// inspection is what an inspection of a file running on a worker found besides the stats of the file, applied
+// to the state by the daemon once the inspection is done
+type inspection struct {
+	client        *client.Client
+	failedRegions map[string][]string // failed regions when the inspection started
+	failedPeers   []ClusterPeer       // cluster peers found hosting missing parity blocks
+	missingTimes  []int64             // times at which missing blocks were found, use UnixNano
+	repairData    bool                // whether the data of the file needs a repair
+	repairParity  bool                // whether the strand of the file needs a repair
+}
+
+// newInspection returns an inspection starting from the current state. It runs on the daemon
+func (s *Server) newInspection(client *client.Client) *inspection {
+	regions := make(map[string][]string, len(s.state.potentialFailedRegions))
+	for region, peers := range s.state.potentialFailedRegions {
+		regions[region] = append([]string(nil), peers...)
+	}
+	return &inspection{client: client, failedRegions: regions}
+}
+
+// clone returns a copy of the stats, which an inspection can update while the daemon keeps the original
+func (fs *FileStats) clone() *FileStats {
+	cloned := *fs
+	cloned.DataBlocksMissing = cloneWatchedBlocks(fs.DataBlocksMissing)
+	cloned.ParityBlocksMissing = cloneWatchedBlocks(fs.ParityBlocksMissing)
+	cloned.validParityBlocksHistory = cloneWatchedBlocks(fs.validParityBlocksHistory)
+	cloned.view = fs.view.clone()
+	return &cloned
+}
+
+func cloneWatchedBlocks(blocks map[uint]*WatchedBlock) map[uint]*WatchedBlock {
+	cloned := make(map[uint]*WatchedBlock, len(blocks))
+	for i, block := range blocks {
+		copied := *block
+		cloned[i] = &copied
+	}
+	return cloned
+}
+
+// InspectFiles inspects a block of each monitored file not being inspected yet, each on its own inspection
+// worker. It runs on an inspection worker
+func (s *Server) InspectFiles() {
+	ctx, cancel := monitorContext()
+	defer cancel()
+	client, err := s.RefreshClient(ctx)
+	if err != nil {
+		println("Could not connect to the cluster: ", err.Error())
+		return
+	}
+
+	s.do(func() {
+		for file, stats := range s.state.files {
+			if _, busy := s.state.inspecting[file]; busy {
+				continue
+			}
+
+			file, base, in := file, stats, s.newInspection(client)
+			err := s.submit(s.pools.Inspection, func() { s.inspect(file, base, in) })
+			if err != nil {
+				return
+			}
+			s.state.inspecting[file] = struct{}{}
+		}
+	})
+}
+
+// inspect inspects a block of a file on a copy of its stats, then hands the result to the daemon
+func (s *Server) inspect(fileCID string, base *FileStats, in *inspection) {
+	println("Checking file: ", fileCID, "with strandRoot: ", base.StrandRootCID, "\n")
+	ctx, cancel := monitorContext()
+	defer cancel()
+
+	stats := base.clone()
+	s.InspectFile(ctx, stats, in)
+	s.do(func() {
+		delete(s.state.inspecting, fileCID)
+		s.commitInspection(fileCID, base, stats, in)
+	})
+}
+
+// commitInspection applies an inspection of a file to the state. If the stats of the file changed during the
+// inspection, as the daemon replaces the stats of a file rather than updating them, the observations of the
+// inspection are merged into the new ones. It runs on the daemon
+func (s *Server) commitInspection(fileCID string, base *FileStats, stats *FileStats, in *inspection) {
+	for _, peer := range in.failedPeers {
+		s.state.potentialFailedRegions[peer.Region] = append(s.state.potentialFailedRegions[peer.Region], peer.Name)
+	}
+	s.state.unavailableBlocksTimestamps = append(s.state.unavailableBlocksTimestamps, in.missingTimes...)
+
+	stats.shareEstimate(s.address)
+	if current, ok := s.state.files[fileCID]; ok {
+		if current != base {
+			merged := current.clone()
+			merged.mergeView(stats.view)
+			for blockNumber, block := range stats.validParityBlocksHistory {
+				merged.validParityBlocksHistory[blockNumber] = block
+			}
+			stats = merged
+		}
+		s.state.files[fileCID] = stats
+		s.saveFile(fileCID)
+	}
+
+	if in.repairData {
+		s.repairFile(stats)
+	}
+	if in.repairParity {
+		s.repairStrand(stats)
+	}
+}
+
 // ComputeHealth
 // @Description: Computes the estimated health of the file, equivalent to its repairability
 // HealthSampleSize blocks are sampled at random
-func (s *Server) ComputeHealth(fs *FileStats, lattice *entangler.Lattice) float32 {
+func (s *Server) ComputeHealth(ctx context.Context, fs *FileStats, lattice *entangler.Lattice, in *inspection) float32 {
 	validCount := 0
 
 	for _, blockNumber := range rand.Perm(len(lattice.DataBlocks))[:HealthSampleSize] {
-		_, _, err := lattice.GetChunkDepth(blockNumber+1, HealthDepth)
+		_, _, err := lattice.GetChunkDepth(ctx, blockNumber+1, HealthDepth)
 		if err == nil {
 			validCount++
 			fs.updateBlockProb(1.0, false)
-			delete(fs.DataBlocksMissing, uint(blockNumber))
+			fs.observeAvailable(s.address, true, uint(blockNumber))
 		} else {
-			blockCID := lattice.Getter.GetDataCID(blockNumber)
+			blockCID := lattice.Getter.GetDataCID(ctx, blockNumber)
 			if blockCID != "" {
-				s.handleMissingBlock(fs, true, uint(blockNumber), blockCID, false)
+				s.handleMissingBlock(ctx, fs, true, uint(blockNumber), blockCID, false, in)
 			}
 		}
 	}
@@ -139,7 +252,7 @@ func pickRetry(fs *FileStats, blockNum *int, isData bool) bool {
 
 // selectBlockHeuristic
 // @Description: Selects a block to inspect based on the current view of the file.
-func (s *Server) selectBlockHeuristic(fs *FileStats, lattice *entangler.Lattice) (uint, bool, bool) {
+func (s *Server) selectBlockHeuristic(fs *FileStats, lattice *entangler.Lattice, badRegions map[string][]string) (uint, bool, bool) {
 	n := rand.Intn(2)
 	isData := true
 	fromInsights := true
@@ -151,7 +264,7 @@ func (s *Server) selectBlockHeuristic(fs *FileStats, lattice *entangler.Lattice)
 
 		if n < 2 && pickNeighbour(fs, &blockNumber, true, lattice) {
 			// 1/4 chance to pick a neighbour of a missing block (if exists, else fallback to other methods)
-		} else if n < 4 && pickInFailedRegion(s.state.potentialFailedRegions, fs, &blockNumber, true) {
+		} else if n < 4 && pickInFailedRegion(badRegions, fs, &blockNumber, true) {
 			// 1/4 chance to try using tag:region to find new missing blocks (if exists, else fallback to other methods)
 		} else if n < 5 && pickRetry(fs, &blockNumber, true) {
 			// 1/8 chance to retry a missing block (if exists, else fallback to other methods)
@@ -167,7 +280,7 @@ func (s *Server) selectBlockHeuristic(fs *FileStats, lattice *entangler.Lattice)
 		n = rand.Intn(8)
 		// same selection as above but for parity blocks
 		if n < 2 && pickNeighbour(fs, &blockNumber, false, lattice) {
-		} else if n < 4 && pickInFailedRegion(s.state.potentialFailedRegions, fs, &blockNumber, false) {
+		} else if n < 4 && pickInFailedRegion(badRegions, fs, &blockNumber, false) {
 		} else if n < 5 && pickRetry(fs, &blockNumber, false) {
 		} else {
 			blockNumber = rand.Intn(len(lattice.ParityBlocks[fs.strandNumber]))
@@ -179,11 +292,12 @@ func (s *Server) selectBlockHeuristic(fs *FileStats, lattice *entangler.Lattice)
 }
 
 // InspectFile
-// @Description: Inspect a block of the file (parity or data) and update the stats
-func (s *Server) InspectFile(fs *FileStats) {
+// @Description: Inspect a block of the file (parity or data) and update the stats, which are not shared
+// with the daemon
+func (s *Server) InspectFile(ctx context.Context, fs *FileStats, in *inspection) {
 
 	// get lattice
-	_, _, lattice, _, _, err := s.client.PrepareRepair(fs.fileCID, fs.MetadataCID, 2)
+	_, _, lattice, _, _, err := in.client.PrepareRepair(ctx, fs.fileCID, fs.MetadataCID, 2)
 
 	if err != nil {
 		println("Error in PrepareRepair: ", err.Error())
@@ -191,33 +305,35 @@ func (s *Server) InspectFile(fs *FileStats) {
 	}
 
 	// select block heuristically
-	blockNumber, isData, fromInsights := s.selectBlockHeuristic(fs, lattice)
+	blockNumber, isData, fromInsights := s.selectBlockHeuristic(fs, lattice, in.failedRegions)
 
 	var blockCID string
 	// check block
 	if isData {
 		blockNumber = uint(math.Min(float64(blockNumber), float64(len(lattice.DataBlocks)-1))) // safeguard
 		// fill block CID in lattice
-		_, _, err = lattice.GetChunkDepth(int(blockNumber)+1, 1)
-		blockCID = lattice.Getter.GetDataCID(int(blockNumber))
+		_, _, err = lattice.GetChunkDepth(ctx, int(blockNumber)+1, 1)
+		blockCID = lattice.Getter.GetDataCID(ctx, int(blockNumber))
 	} else {
 		blockNumber = uint(math.Min(float64(blockNumber), float64(len(lattice.ParityBlocks[fs.strandNumber])-1))) // safeguard
 		// fill block CID in lattice
-		_, _, err = lattice.GetParity(int(blockNumber)+1, fs.strandNumber)
+		_, _, err = lattice.GetParity(ctx, int(blockNumber)+1, fs.strandNumber)
 		blockCID = lattice.Getter.GetParityCID(int(blockNumber), fs.strandNumber)
 	}
 
 	if blockCID == "" {
+		s.metrics.ObserveInspection(isData, "unreachable")
 		if isData {
-			s.repairFile(fs)
+			in.repairData = true
 		} else {
-			s.repairStrand(fs)
+			in.repairParity = true
 		}
 		println("Error: unreachable intermediary node, repair triggered")
 		return
 	}
 
 	if err == nil {
+		s.metrics.ObserveInspection(isData, "available")
 		fs.updateBlockProb(1.0, false)
 		watchedBlock := WatchedBlock{
 			CID:         blockCID,
@@ -225,19 +341,20 @@ func (s *Server) InspectFile(fs *FileStats) {
 			Probability: 1,
 		}
 
-		if isData {
-			delete(fs.DataBlocksMissing, blockNumber)
-		} else {
-			_, in := fs.validParityBlocksHistory[blockNumber]
-			delete(fs.ParityBlocksMissing, blockNumber)
+		fs.observeAvailable(s.address, isData, blockNumber)
+		if !isData {
+			_, known := fs.validParityBlocksHistory[blockNumber]
 
-			if !in || watchedBlock.Peer.Region == "" {
-				allocations, err := s.client.IPFSClusterConnector.GetPinAllocations(blockCID)
+			if !known || watchedBlock.Peer.Region == "" {
+				allocations, err := in.client.IPFSClusterConnector.GetPinAllocations(ctx, blockCID)
 				if err == nil && len(allocations) > 0 {
 					watchedBlock.Peer.Name = allocations[0]
 
 					if watchedBlock.Peer.Name != "" {
-						watchedBlock.Peer.Region = s.client.IPFSClusterConnector.GetPeerRegionTag(watchedBlock.Peer.Name)
+						watchedBlock.Peer.Region, err = in.client.IPFSClusterConnector.GetPeerRegionTag(ctx, watchedBlock.Peer.Name)
+						if err != nil {
+							log.Printf("Unable to get the region of peer %s: %s", watchedBlock.Peer.Name, err)
+						}
 					}
 				}
 				fs.validParityBlocksHistory[blockNumber] = &watchedBlock
@@ -245,56 +362,62 @@ func (s *Server) InspectFile(fs *FileStats) {
 		}
 
 	} else {
-		if s.handleMissingBlock(fs, isData, blockNumber, blockCID, fromInsights) {
+		s.metrics.ObserveInspection(isData, "missing")
+		if s.handleMissingBlock(ctx, fs, isData, blockNumber, blockCID, fromInsights, in) {
 			return
 		}
 
-		if fs.EstimatedBlockProb < BlockProbThreshold {
-			fs.Health = s.ComputeHealth(fs, lattice)
+		if fs.SharedBlockProb() < BlockProbThreshold {
+			fs.Health = s.ComputeHealth(ctx, fs, lattice, in)
 			if fs.Health < s.repairThreshold {
-				s.repairFile(fs)
+				in.repairData = true
 			}
 		}
 	}
 }
 
-func (s *Server) handleMissingBlock(fs *FileStats, isData bool, blockNumber uint, blockCID string, fromInsights bool) bool {
+func (s *Server) handleMissingBlock(ctx context.Context, fs *FileStats, isData bool, blockNumber uint, blockCID string, fromInsights bool, in *inspection) bool {
 	log.Println("Block[index:", blockNumber, ", CID:", blockCID, "] is missing")
 	var watchedBlock *WatchedBlock
-	var in bool
+	var known bool
 	if isData {
-		watchedBlock, in = fs.DataBlocksMissing[blockNumber]
+		watchedBlock, known = fs.DataBlocksMissing[blockNumber]
 	} else {
-		watchedBlock, in = fs.ParityBlocksMissing[blockNumber]
+		watchedBlock, known = fs.ParityBlocksMissing[blockNumber]
 	}
 
-	if in {
+	if known {
 		watchedBlock.Probability /= 3
+		fs.observeMissing(s.address, isData, blockNumber, watchedBlock)
 	} else {
 		watchedBlock = &WatchedBlock{CID: blockCID, Probability: 0.33}
 
 		// register time at which missing block was found
-		s.state.unavailableBlocksTimestamps = append(s.state.unavailableBlocksTimestamps, time.Now().UnixNano())
+		in.missingTimes = append(in.missingTimes, time.Now().UnixNano())
 
 		if isData {
-			fs.DataBlocksMissing[blockNumber] = watchedBlock
+			fs.observeMissing(s.address, true, blockNumber, watchedBlock)
 		} else {
 			// parity blocks are pinned => can retrieve region of peer hosting the parity
-			allocations, err := s.client.IPFSClusterConnector.GetPinAllocations(blockCID)
+			allocations, err := in.client.IPFSClusterConnector.GetPinAllocations(ctx, blockCID)
 			if err != nil || len(allocations) == 0 {
 				return true
 			}
 			watchedBlock.Peer.Name = allocations[0]
 
 			if watchedBlock.Peer.Name != "" {
-				watchedBlock.Peer.Region = s.client.IPFSClusterConnector.GetPeerRegionTag(watchedBlock.Peer.Name)
+				watchedBlock.Peer.Region, err = in.client.IPFSClusterConnector.GetPeerRegionTag(ctx, watchedBlock.Peer.Name)
+				if err != nil {
+					log.Printf("Unable to get the region of peer %s: %s", watchedBlock.Peer.Name, err)
+				}
 
 				// watchedBlock.Peer.Region = ...
 				if watchedBlock.Peer.Region != "" {
-					s.state.potentialFailedRegions[watchedBlock.Peer.Region] = append(s.state.potentialFailedRegions[watchedBlock.Peer.Region], watchedBlock.Peer.Name)
+					in.failedRegions[watchedBlock.Peer.Region] = append(in.failedRegions[watchedBlock.Peer.Region], watchedBlock.Peer.Name)
+					in.failedPeers = append(in.failedPeers, watchedBlock.Peer)
 				}
 			}
-			fs.ParityBlocksMissing[blockNumber] = watchedBlock
+			fs.observeMissing(s.address, false, blockNumber, watchedBlock)
 		}
 	}
 
@@ -311,6 +434,19 @@ func (fs *FileStats) updateBlockProb(testedBlockProb float32, fromInsights bool)
 	}
 }
 
+// MissingBlockRefs returns the blocks known to be missing, to be passed to the lattice repair planner
+func (fs *FileStats) MissingBlockRefs() []entangler.BlockRef {
+	refs := make([]entangler.BlockRef, 0, len(fs.DataBlocksMissing)+len(fs.ParityBlocksMissing))
+	for blockNumber := range fs.DataBlocksMissing {
+		refs = append(refs, entangler.BlockRef{Index: int(blockNumber) + 1})
+	}
+	for blockNumber := range fs.ParityBlocksMissing {
+		refs = append(refs, entangler.BlockRef{Index: int(blockNumber) + 1, IsParity: true, Strand: fs.strandNumber})
+	}
+	return refs
+}
+
+// repairFile queues a collaborative repair of the data of the file. It never waits, so it can run on the daemon
 func (s *Server) repairFile(fs *FileStats) {
 	op := CollaborativeRepairOperation{
 		FileCID:  fs.fileCID,
@@ -318,12 +454,14 @@ func (s *Server) repairFile(fs *FileStats) {
 		Depth:    RepairDepth,
 		Origin:   s.address,
 		NumPeers: RepairNumPeers,
+		missing:  fs.MissingBlockRefs(),
 	}
 
 	util.LogPrintf("Repair triggered (data) for file: %s", fs.fileCID)
-	s.StartCollabRepair(&op)
+	s.submit(s.pools.Collab, func() { s.StartCollabRepair(&op) })
 }
 
+// repairStrand queues a repair of the strand of the file. It never waits, so it can run on the daemon
 func (s *Server) repairStrand(fs *FileStats) {
 	op := StrandRepairOperation{
 		FileCID: fs.fileCID,
@@ -333,5 +471,5 @@ func (s *Server) repairStrand(fs *FileStats) {
 	}
 
 	util.LogPrintf("Repair triggered (parity) for file: %s", fs.fileCID)
-	s.StartStrandRepair(&op)
+	s.submit(s.pools.Strand, func() { s.StartStrandRepair(&op) })
 }
@@ -0,0 +1,178 @@
+package Server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const UnitRepairDeadline = 10 * time.Minute  // time given to a peer to report the repair of a unit
+const UnitRepairBackoff = 5 * time.Second    // wait before giving a unit to a peer again, doubled on every attempt
+const UnitRepairBackoffMax = 5 * time.Minute // longest wait before giving a unit to a peer again
+const MaxUnitRepairAttempts = 4              // number of peers a unit is given to before it fails
+const RepairCheckInterval = 10 * time.Second // interval of the checks of the deadlines of the units
+
+// RepairUnit is the share of the failed leaves of a collaborative repair handed to a single peer
+type RepairUnit struct {
+	ID            string       `json:"id"`
+	FailedIndices []int        `json:"failedIndices"`
+	Status        RepairStatus `json:"status"`
+	Peer          string       `json:"peer"`        // peer repairing the unit, empty while waiting for one
+	Assignees     []string     `json:"assignees"`   // every peer the unit was given to, latest last
+	Attempts      int          `json:"attempts"`    // number of times the unit was given to peers
+	Deadline      time.Time    `json:"deadline"`    // when the current peer is given up on
+	NextAttempt   time.Time    `json:"nextAttempt"` // when the unit can be given to a peer again
+
+	dispatching bool // whether a worker is offering the unit to peers
+}
+
+// NewRepairJobID returns a random identifier for a collaborative repair
+func NewRepairJobID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// RepairBackoff returns the wait before the next attempt of a unit given to peers a number of times
+func RepairBackoff(attempts int) time.Duration {
+	backoff := UnitRepairBackoff
+	for i := 1; i < attempts && backoff < UnitRepairBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > UnitRepairBackoffMax {
+		backoff = UnitRepairBackoffMax
+	}
+	return backoff
+}
+
+// SplitUnits splits the failed leaves of the repair into units, to be given to peers
+func (job *CollaborativeRepairData) SplitUnits(leaves []int, numUnits int) {
+	job.Units = make(map[string]*RepairUnit, numUnits)
+	leavesPerUnit := len(leaves) / numUnits
+	for i := 0; i < numUnits; i++ {
+		unit := &RepairUnit{
+			ID:            fmt.Sprintf("%s-%d", job.JobID, i),
+			FailedIndices: leaves[i*leavesPerUnit : (i+1)*leavesPerUnit],
+			Status:        PENDING,
+		}
+		if i == numUnits-1 {
+			unit.FailedIndices = leaves[i*leavesPerUnit:]
+		}
+		job.Units[unit.ID] = unit
+	}
+}
+
+// Assign records that the unit was accepted by a peer
+func (job *CollaborativeRepairData) Assign(unit *RepairUnit, peer string, now time.Time) {
+	unit.Peer = peer
+	unit.Assignees = append(unit.Assignees, peer)
+	unit.Attempts++
+	unit.Deadline = now.Add(UnitRepairDeadline)
+}
+
+// Withdraw takes back the unit offered to a peer which did not accept it, as if it was never given to the peer
+func (job *CollaborativeRepairData) Withdraw(unit *RepairUnit, peer string) {
+	if unit.Status != PENDING || unit.Peer != peer {
+		return
+	}
+	unit.Peer = ""
+	unit.Assignees = unit.Assignees[:len(unit.Assignees)-1]
+	unit.Attempts--
+}
+
+// Retry puts the unit back to wait for another peer, or fails it once it was tried too many times
+func (job *CollaborativeRepairData) Retry(unit *RepairUnit, now time.Time) {
+	unit.Peer = ""
+	if unit.Attempts >= MaxUnitRepairAttempts {
+		unit.Status = FAILURE
+		return
+	}
+	unit.NextAttempt = now.Add(RepairBackoff(unit.Attempts))
+}
+
+// DispatchFailed records that no peer accepted the unit, which counts as an attempt
+func (job *CollaborativeRepairData) DispatchFailed(unit *RepairUnit, now time.Time) {
+	unit.Attempts++
+	job.Retry(unit, now)
+}
+
+// Expire gives up on the peers which missed the deadline of their unit, and returns the peers given up on
+// with the units waiting for a peer, leaving out those being offered to peers
+func (job *CollaborativeRepairData) Expire(now time.Time) (expired []string, ready []*RepairUnit) {
+	for _, unit := range job.Units {
+		if unit.Status != PENDING {
+			continue
+		}
+		if unit.Peer != "" && now.After(unit.Deadline) {
+			expired = append(expired, unit.Peer)
+			job.Retry(unit, now)
+		}
+		if unit.Status == PENDING && unit.Peer == "" && !unit.dispatching && !now.Before(unit.NextAttempt) {
+			ready = append(ready, unit)
+		}
+	}
+	return expired, ready
+}
+
+// CandidatePeers returns the peers to offer the unit to in turn, starting with those it was never given to
+func (unit *RepairUnit) CandidatePeers(peers []string, start int) []string {
+	tried := make(map[string]struct{}, len(unit.Assignees))
+	for _, peer := range unit.Assignees {
+		tried[peer] = struct{}{}
+	}
+
+	var fresh, again []string
+	for i := range peers {
+		peer := peers[(start+i)%len(peers)]
+		if _, ok := tried[peer]; ok {
+			again = append(again, peer)
+		} else {
+			fresh = append(fresh, peer)
+		}
+	}
+	return append(fresh, again...)
+}
+
+// Report records the result of a unit sent by a peer and tells whether it was accepted. A unit is settled
+// once: later reports are ignored, as are failures reported by a peer the unit was taken from, while a
+// success reported by such a peer still settles the unit
+func (job *CollaborativeRepairData) Report(unitID string, peer string, status map[int]bool) bool {
+	unit, ok := job.Units[unitID]
+	if !ok || unit.Status != PENDING {
+		return false
+	}
+
+	success := true
+	for _, repaired := range status {
+		success = success && repaired
+	}
+
+	if peer != unit.Peer {
+		assigned := false
+		for _, assignee := range unit.Assignees {
+			assigned = assigned || assignee == peer
+		}
+		if !assigned || !success {
+			return false
+		}
+	}
+
+	unit.Peer = peer
+	if success {
+		unit.Status = SUCCESS
+	} else {
+		unit.Status = FAILURE
+	}
+	return true
+}
+
+// Done tells whether every unit of the repair is settled, and whether they all succeeded
+func (job *CollaborativeRepairData) Done() (done bool, success bool) {
+	done, success = true, true
+	for _, unit := range job.Units {
+		done = done && unit.Status != PENDING
+		success = success && unit.Status == SUCCESS
+	}
+	return done, success
+}
@@ -0,0 +1,302 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"ipfs-alpha-entanglement-code/client"
+	"ipfs-alpha-entanglement-code/lease"
+	"ipfs-alpha-entanglement-code/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+const LeaseDuration = 30 * time.Second      // lease of the coordination of a repair, renewed while the repair runs
+const LeaseRenewInterval = 10 * time.Second // interval of the renewals of the leases, and of the checks for failed coordinators
+
+// RepairTask is the repair coordinated under a lease, which a monitor of the file takes over if the coordinator
+// fails to renew the lease
+type RepairTask struct {
+	Collab *CollaborativeRepairOperation `json:"collab,omitempty"`
+	Strand *StrandRepairOperation        `json:"strand,omitempty"`
+}
+
+// collabResource is the resource of the lease of the collaborative repairs of a file
+func collabResource(fileCID string) string {
+	return "collab/" + fileCID
+}
+
+// strandResource is the resource of the lease of the repairs of a strand of a file
+func strandResource(fileCID string, strand int) string {
+	return "strand/" + fileCID + "/" + strconv.Itoa(strand)
+}
+
+// leaseTransport sends the requests of the elector to the other community nodes, signed by the node
+type leaseTransport struct {
+	s *Server
+}
+
+func (t *leaseTransport) Request(ctx context.Context, address string, l *lease.Lease) (*lease.Grant, error) {
+	var grant lease.Grant
+	if err := t.s.sendLease(ctx, "http://"+address+"/lease/request", l, &grant); err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func (t *leaseTransport) Release(ctx context.Context, address string, l *lease.Lease) error {
+	return t.s.sendLease(ctx, "http://"+address+"/lease/release", l, nil)
+}
+
+// sendLease posts a lease and decodes the answer into out, if not nil
+func (s *Server) sendLease(ctx context.Context, url string, l *lease.Lease, out interface{}) error {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	req, err := s.signer.NewRequest("POST", url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s answered with status %d", url, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// enableLeases sets up the election of the coordinators of the repairs once the address of the node is known
+func (s *Server) enableLeases() {
+	s.leases = lease.NewTable()
+	s.elector = lease.NewElector(s.address, s.leases, &leaseTransport{s}, LeaseDuration)
+}
+
+// runLeases renews the leases held by the node until the server stops, and takes over the repairs of the
+// coordinators which failed to renew theirs
+func (s *Server) runLeases() {
+	ticker := time.NewTicker(LeaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), LeaseRenewInterval)
+		s.elector.Renew(ctx)
+		cancel()
+		s.takeOverRepairs()
+	}
+}
+
+// takeOverRepairs restarts the repairs whose lease granted by the node expired without being released, unless
+// their coordinator still answers that they ended. The monitors of a file wait a random delay before doing so,
+// and the election lets only one of them coordinate
+func (s *Server) takeOverRepairs() {
+	grace := time.Duration(rand.Int63n(int64(LeaseDuration)))
+	for _, expired := range s.leases.Expire(time.Now(), grace) {
+		if expired.Holder == s.address || len(expired.Task) == 0 {
+			continue
+		}
+		var task RepairTask
+		if err := json.Unmarshal(expired.Task, &task); err != nil {
+			util.LogPrintf("Invalid task of the lease of %s - %s", expired.Resource, err)
+			continue
+		}
+
+		if !s.repairPending(expired.Holder, expired.Resource) {
+			util.LogPrintf("Coordinator %s of %s did not release its lease of an ended repair", expired.Holder, expired.Resource)
+			continue
+		}
+
+		util.LogPrintf("Coordinator %s of %s did not renew its lease, taking over", expired.Holder, expired.Resource)
+		switch {
+		case task.Collab != nil:
+			op := *task.Collab
+			if op.Origin == expired.Holder {
+				op.Origin = s.address
+			}
+			s.submit(s.pools.Collab, func() { s.StartCollabRepair(&op) })
+		case task.Strand != nil:
+			op := *task.Strand
+			s.submit(s.pools.Strand, func() { s.StartStrandRepair(&op) })
+		}
+	}
+}
+
+// repairPending tells whether the repair of a resource is still pending for its coordinator, which is asked for
+// its repairs. A coordinator which does not answer is taken as failed with the repair pending
+func (s *Server) repairPending(holder string, resource string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), MonitorRequestTimeout)
+	defer cancel()
+
+	url := "http://" + holder + "/repairs"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return true
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true
+	}
+	defer resp.Body.Close()
+
+	var answer struct {
+		Repairs []*RepairView `json:"repairs"`
+	}
+	if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&answer) != nil {
+		return true
+	}
+	for _, view := range answer.Repairs {
+		if view.Finished() {
+			continue
+		}
+		if (view.Kind == CollabRepairKind && collabResource(view.FileCID) == resource) ||
+			(view.Kind == StrandRepairKind && strandResource(view.FileCID, view.Strand) == resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileMonitors returns the community nodes monitoring a file, those of the cluster peers allocated one of its
+// strands, and the node itself
+func (s *Server) fileMonitors(ctx context.Context, client *client.Client, metaCID string) ([]string, error) {
+	metaData, err := client.GetMetaData(ctx, metaCID)
+	if err != nil {
+		return nil, err
+	}
+
+	monitors := map[string]struct{}{s.address: {}}
+	for _, root := range metaData.TreeCIDs {
+		peers, err := client.IPFSClusterConnector.GetPinAllocations(ctx, root)
+		if err != nil {
+			return nil, err
+		}
+		for _, peer := range peers {
+			if address, err := s.getCommunityAddress(peer); err == nil && address != "" {
+				monitors[address] = struct{}{}
+			}
+		}
+	}
+
+	group := make([]string, 0, len(monitors))
+	for address := range monitors {
+		group = append(group, address)
+	}
+	sort.Strings(group)
+	return group, nil
+}
+
+// coordinate elects the node to coordinate the repair of a resource among the monitors of the file, and tells
+// whether it was. The task is taken over by another monitor if the node fails, none if nil
+func (s *Server) coordinate(ctx context.Context, client *client.Client, resource string, metaCID string, task *RepairTask) bool {
+	if s.elector == nil {
+		return true
+	}
+
+	monitors, err := s.fileMonitors(ctx, client, metaCID)
+	if err != nil {
+		util.LogPrintf("Unable to get the monitors to coordinate %s - %s", resource, err)
+		return false
+	}
+	var body []byte
+	if task != nil {
+		if body, err = json.Marshal(task); err != nil {
+			return false
+		}
+	}
+
+	granted, err := s.elector.Acquire(ctx, resource, monitors, body, func() { s.coordinationLost(resource) })
+	if err != nil {
+		util.LogPrintf("Not coordinating %s - %s", resource, err)
+		return false
+	}
+	util.LogPrintf("Coordinating %s with term %d among %d monitors", resource, granted.Term, len(monitors))
+	return true
+}
+
+// releaseCoordination releases the lease of a repair which ended. It never waits, so it can run on the daemon
+func (s *Server) releaseCoordination(resource string) {
+	if s.elector != nil {
+		s.elector.Release(resource)
+	}
+}
+
+// coordinationLost cancels the repair whose lease the node could not renew, as another monitor may take it over
+func (s *Server) coordinationLost(resource string) {
+	util.LogPrintf("Lost the lease of %s, cancelling its repair", resource)
+
+	var id string
+	s.do(func() {
+		for fileCID, job := range s.collabData {
+			if job.Status == PENDING && collabResource(fileCID) == resource {
+				id = job.JobID
+			}
+		}
+		for fileCID, job := range s.strandData {
+			if job.Status == PENDING && strandResource(fileCID, job.Strand) == resource {
+				id = job.JobID
+			}
+		}
+	})
+	if id != "" {
+		s.CancelRepair(id)
+	}
+}
+
+// requestLease
+// Grants a lease to another community node, or renews it
+func requestLease(s *Server, c *gin.Context) {
+	var l lease.Lease
+	if err := c.ShouldBindJSON(&l); err != nil || l.Resource == "" || l.Duration <= 0 {
+		c.JSON(400, gin.H{"message": "Missing parameters"})
+		return
+	}
+	if !s.signedBy(c, l.Holder) {
+		c.JSON(403, gin.H{"message": "Holder does not match the signer of the request"})
+		return
+	}
+
+	c.JSON(200, s.leases.Grant(&l, time.Now()))
+}
+
+// releaseLease
+// Forgets a lease released by its holder
+func releaseLease(s *Server, c *gin.Context) {
+	var l lease.Lease
+	if err := c.ShouldBindJSON(&l); err != nil || l.Resource == "" {
+		c.JSON(400, gin.H{"message": "Missing parameters"})
+		return
+	}
+	if !s.signedBy(c, l.Holder) {
+		c.JSON(403, gin.H{"message": "Holder does not match the signer of the request"})
+		return
+	}
+
+	s.leases.Release(&l)
+	c.JSON(200, gin.H{"message": "lease released"})
+}
+
+// listLeases
+// Lists the leases granted by the node and those it holds
+func listLeases(s *Server, c *gin.Context) {
+	c.JSON(200, gin.H{"granted": s.leases.Leases(), "held": s.elector.Held()})
+}
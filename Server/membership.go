@@ -0,0 +1,221 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"ipfs-alpha-entanglement-code/membership"
+	"ipfs-alpha-entanglement-code/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+const MembershipProbeInterval = 1 * time.Second // protocol period of the failure detector
+const MembershipSeedInterval = 1 * time.Minute  // interval of the refresh of the members from the discovery
+
+// swimTransport sends the messages of the failure detector to the other community nodes, signed by the node
+type swimTransport struct {
+	s *Server
+}
+
+func (t *swimTransport) Ping(ctx context.Context, address string, msg *membership.Message) (*membership.Message, error) {
+	return t.s.sendSwim(ctx, "http://"+address+"/swim/ping", msg)
+}
+
+func (t *swimTransport) PingReq(ctx context.Context, address string, msg *membership.Message) (*membership.Message, error) {
+	return t.s.sendSwim(ctx, "http://"+address+"/swim/ping-req", msg)
+}
+
+// sendSwim posts a message of the failure detector and returns the acknowledgement
+func (s *Server) sendSwim(ctx context.Context, url string, msg *membership.Message) (*membership.Message, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.signer.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s answered with status %d", url, resp.StatusCode)
+	}
+
+	var ack membership.Message
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// enableMembership sets up the failure detector of the node once its address is known
+func (s *Server) enableMembership() {
+	s.members = membership.NewDetector(s.address, s.clusterIP, membership.DefaultConfig(), &swimTransport{s})
+	s.members.OnChange(func(member membership.Member) {
+		util.LogPrintf("Community node %s is %s (incarnation %d)", member.Address, member.State, member.Incarnation)
+		s.metrics.ObserveMember(member)
+	})
+	s.memberRegions = make(map[string]string)
+}
+
+// runMembership runs the protocol periods of the failure detector until the server stops, and reports the
+// community nodes it finds dead as failed cluster peers of their region
+func (s *Server) runMembership() {
+	probes := time.NewTicker(MembershipProbeInterval)
+	defer probes.Stop()
+	var seeded time.Time
+
+	for {
+		select {
+		case <-s.ctx:
+			return
+		case <-probes.C:
+		}
+
+		if time.Since(seeded) > MembershipSeedInterval {
+			if _, err := s.seedMembers(); err != nil {
+				util.LogPrintf("Error in getting the community nodes from the discovery - %s", err)
+			}
+			seeded = time.Now()
+		}
+
+		ctx, cancel := monitorContext()
+		s.members.Probe(ctx)
+		s.reconcileFailedPeers(ctx)
+		cancel()
+	}
+}
+
+// seedMembers adds the community nodes known to the discovery to the members, and returns them
+func (s *Server) seedMembers() ([]string, error) {
+	_, nodes, peers, err := s.getAllPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	seeds := make([]membership.Update, 0, len(nodes))
+	for address, node := range nodes {
+		seeds = append(seeds, membership.Update{Address: address, ClusterIP: node.ClusterIP})
+	}
+	s.members.Join(seeds)
+	return peers, nil
+}
+
+// repairPeers returns the community nodes to give the units of a repair to: those known to the discovery
+// service which the failure detector believes alive
+func (s *Server) repairPeers() ([]string, error) {
+	peers, err := s.seedMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	alive := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		if state, ok := s.members.State(peer); ok && state == membership.Alive {
+			alive = append(alive, peer)
+		}
+	}
+	return alive, nil
+}
+
+// reconcileFailedPeers adds the cluster peers of the dead community nodes to the potential failed regions,
+// and removes them once their node is alive again. It runs on the goroutine of the failure detector
+func (s *Server) reconcileFailedPeers(ctx context.Context) {
+	for _, member := range s.members.Members() {
+		region, recorded := s.memberRegions[member.Address]
+
+		switch {
+		case member.State == membership.Dead && !recorded && member.ClusterIP != "":
+			client := s.currentClient()
+			if client == nil {
+				continue
+			}
+			region, err := client.IPFSClusterConnector.GetPeerRegionTag(ctx, member.ClusterIP)
+			if err != nil || region == "" {
+				util.LogPrintf("Unable to get the region of the cluster peer %s of dead node %s - %v", member.ClusterIP, member.Address, err)
+				continue
+			}
+
+			peer := member.ClusterIP
+			s.do(func() {
+				for _, failed := range s.state.potentialFailedRegions[region] {
+					if failed == peer {
+						return
+					}
+				}
+				s.state.potentialFailedRegions[region] = append(s.state.potentialFailedRegions[region], peer)
+			})
+			s.memberRegions[member.Address] = region
+
+		case member.State == membership.Alive && recorded:
+			peer := member.ClusterIP
+			s.do(func() {
+				peers := s.state.potentialFailedRegions[region][:0]
+				for _, failed := range s.state.potentialFailedRegions[region] {
+					if failed != peer {
+						peers = append(peers, failed)
+					}
+				}
+				if len(peers) == 0 {
+					delete(s.state.potentialFailedRegions, region)
+				} else {
+					s.state.potentialFailedRegions[region] = peers
+				}
+			})
+			delete(s.memberRegions, member.Address)
+		}
+	}
+}
+
+// swimPing
+// Answers a probe of the failure detector of another community node
+func swimPing(s *Server, c *gin.Context) {
+	var msg membership.Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(400, gin.H{"message": "Missing parameters"})
+		return
+	}
+	if !s.signedBy(c, msg.Sender.Address) {
+		c.JSON(403, gin.H{"message": "Sender does not match the signer of the request"})
+		return
+	}
+
+	c.JSON(200, s.members.HandlePing(&msg))
+}
+
+// swimPingReq
+// Probes a community node for the failure detector of another community node, answering 504 if it does not
+// acknowledge the probe
+func swimPingReq(s *Server, c *gin.Context) {
+	var msg membership.Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(400, gin.H{"message": "Missing parameters"})
+		return
+	}
+	if !s.signedBy(c, msg.Sender.Address) {
+		c.JSON(403, gin.H{"message": "Sender does not match the signer of the request"})
+		return
+	}
+
+	ack, err := s.members.HandlePingReq(c.Request.Context(), &msg)
+	if err != nil {
+		c.JSON(504, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(200, ack)
+}
+
+// listMembers
+// Lists the community nodes known to the failure detector with their state
+func listMembers(s *Server, c *gin.Context) {
+	c.JSON(200, gin.H{"members": s.members.Members()})
+}
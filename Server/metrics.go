@@ -0,0 +1,184 @@
+package Server
+
+import (
+	"time"
+
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	"ipfs-alpha-entanglement-code/membership"
+	"ipfs-alpha-entanglement-code/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getters whose blocks are counted by the metrics
+const (
+	DownloadGetter    = "download"
+	CoordinatorGetter = "coordinator" // retrieval of the failed leaves of a collaborative repair
+	UnitRepairGetter  = "unit_repair"
+)
+
+// UnitRepairKind labels the metrics of the unit repairs run by the node for other peers
+const UnitRepairKind = "unit"
+
+// ServerMetrics are the metrics of the community node, exposed by the metrics endpoint
+type ServerMetrics struct {
+	Registry *metrics.Registry
+
+	blocks          *metrics.Counter
+	repairs         *metrics.Counter
+	repairDurations *metrics.Histogram
+	inspections     *metrics.Counter
+	fileHealth      *metrics.Gauge
+	fileBlockProb   *metrics.Gauge
+	filesMissing    *metrics.Gauge
+	healthThreshold *metrics.Gauge
+	peerUp          *metrics.Gauge
+	peerLastSeen    *metrics.Gauge
+	peerRequests    *metrics.Counter
+	failedPeers     *metrics.Gauge
+	workersQueued   *metrics.Gauge
+	workersBusy     *metrics.Gauge
+	workersRejected *metrics.Counter
+}
+
+func NewServerMetrics() *ServerMetrics {
+	registry := metrics.NewRegistry()
+	return &ServerMetrics{
+		Registry: registry,
+		blocks: registry.NewCounter("community_getter_blocks_total",
+			"Blocks requested by the getters of the node, by getter, kind of block and result", "getter", "kind", "result"),
+		repairs: registry.NewCounter("community_repairs_total",
+			"Repairs finished by the node, by kind and status", "kind", "status"),
+		repairDurations: registry.NewHistogram("community_repair_duration_seconds",
+			"Duration of the repairs finished by the node, by kind and status", metrics.DefaultDurationBuckets, "kind", "status"),
+		inspections: registry.NewCounter("community_inspections_total",
+			"Blocks inspected by the monitoring of the node, by kind of block and result", "kind", "result"),
+		fileHealth: registry.NewGauge("community_file_health",
+			"Estimated health of the monitored files, the share of sampled data blocks recoverable", "file"),
+		fileBlockProb: registry.NewGauge("community_file_block_probability",
+			"Estimated probability of a block of the monitored files to be available", "file"),
+		filesMissing: registry.NewGauge("community_file_missing_blocks",
+			"Blocks known to be missing from the monitored files, by kind of block", "file", "kind"),
+		healthThreshold: registry.NewGauge("community_health_repair_threshold",
+			"Health under which the node repairs a monitored file"),
+		peerUp: registry.NewGauge("community_peer_up",
+			"Whether a community peer is up, as told by the last request of the node to it or by the failure detector", "peer"),
+		peerLastSeen: registry.NewGauge("community_peer_last_seen_timestamp_seconds",
+			"Last time a community peer accepted or reported a repair or was found alive, in seconds since the epoch", "peer"),
+		peerRequests: registry.NewCounter("community_peer_requests_total",
+			"Outcomes of the units of repairs given to community peers, by peer and result", "peer", "result"),
+		failedPeers: registry.NewGauge("community_cluster_peer_failed",
+			"Cluster peers suspected to have failed, as they host missing parity blocks", "region", "peer"),
+		workersQueued: registry.NewGauge("community_worker_queued_tasks",
+			"Operations waiting for a worker, by pool", "pool"),
+		workersBusy: registry.NewGauge("community_worker_busy",
+			"Workers running an operation, by pool", "pool"),
+		workersRejected: registry.NewCounter("community_worker_rejected_total",
+			"Operations rejected as the queue of their pool was full, by pool", "pool"),
+	}
+}
+
+// ObserveGetter counts the blocks requested by a getter
+func (m *ServerMetrics) ObserveGetter(getter string, snapshot ipfsconnector.GetterMetrics) {
+	m.blocks.Add(float64(snapshot.DataBlocksFetched), getter, "data", "fetched")
+	m.blocks.Add(float64(snapshot.DataBlocksCached), getter, "data", "cached")
+	m.blocks.Add(float64(snapshot.DataBlocksUnavailable), getter, "data", "unavailable")
+	m.blocks.Add(float64(snapshot.DataBlocksError), getter, "data", "error")
+	m.blocks.Add(float64(snapshot.ParityBlocksFetched), getter, "parity", "fetched")
+	m.blocks.Add(float64(snapshot.ParityBlocksCached), getter, "parity", "cached")
+	m.blocks.Add(float64(snapshot.ParityBlocksUnavailable), getter, "parity", "unavailable")
+	m.blocks.Add(float64(snapshot.ParityBlocksError), getter, "parity", "error")
+}
+
+// ObserveRepair records the outcome and duration of a finished repair
+func (m *ServerMetrics) ObserveRepair(kind string, status RepairStatus, duration time.Duration) {
+	m.repairs.Inc(kind, status.String())
+	m.repairDurations.Observe(duration.Seconds(), kind, status.String())
+}
+
+// ObserveInspection counts an inspected block, whose result is available, missing or unreachable
+func (m *ServerMetrics) ObserveInspection(isData bool, result string) {
+	kind := "parity"
+	if isData {
+		kind = "data"
+	}
+	m.inspections.Inc(kind, result)
+}
+
+// ObservePeer records the outcome of a unit of repair given to a community peer, which is accepted, rejected,
+// expired or reported
+func (m *ServerMetrics) ObservePeer(peer string, result string, now time.Time) {
+	m.peerRequests.Inc(peer, result)
+	switch result {
+	case "accepted", "reported":
+		m.peerUp.Set(1, peer)
+		m.peerLastSeen.Set(float64(now.UnixNano())/1e9, peer)
+	default:
+		m.peerUp.Set(0, peer)
+	}
+}
+
+// ObserveMember records a change of state of a community peer seen by the failure detector. A suspected peer
+// missed a probe, so it is down until it refutes the suspicion
+func (m *ServerMetrics) ObserveMember(member membership.Member) {
+	if member.State == membership.Alive {
+		m.peerUp.Set(1, member.Address)
+		m.peerLastSeen.Set(float64(member.Since.UnixNano())/1e9, member.Address)
+	} else {
+		m.peerUp.Set(0, member.Address)
+	}
+}
+
+// ObserveRejected counts an operation rejected by a full worker pool
+func (m *ServerMetrics) ObserveRejected(pool string) {
+	m.workersRejected.Inc(pool)
+}
+
+// observeGetter counts the blocks requested by a getter, if any
+func (s *Server) observeGetter(getter string, ipfsGetter *ipfsconnector.IPFSGetter) {
+	if ipfsGetter != nil {
+		s.metrics.ObserveGetter(getter, ipfsGetter.Metrics())
+	}
+}
+
+// refreshStateMetrics sets the gauges following the state of the monitored files
+func (s *Server) refreshStateMetrics() {
+	m := s.metrics
+	m.healthThreshold.Set(float64(s.repairThreshold))
+	for _, pool := range s.pools.All() {
+		m.workersQueued.Set(float64(pool.Queued()), pool.Name())
+		m.workersBusy.Set(float64(pool.Busy()), pool.Name())
+	}
+
+	s.do(func() { s.refreshFileMetrics() })
+}
+
+// refreshFileMetrics sets the gauges following the monitored files and the failed peers. It runs on the daemon
+func (s *Server) refreshFileMetrics() {
+	m := s.metrics
+	m.fileHealth.Reset()
+	m.fileBlockProb.Reset()
+	m.filesMissing.Reset()
+	for fileCID, stats := range s.state.files {
+		m.fileHealth.Set(float64(stats.Health), fileCID)
+		m.fileBlockProb.Set(float64(stats.SharedBlockProb()), fileCID)
+		m.filesMissing.Set(float64(len(stats.DataBlocksMissing)), fileCID, "data")
+		m.filesMissing.Set(float64(len(stats.ParityBlocksMissing)), fileCID, "parity")
+	}
+
+	m.failedPeers.Reset()
+	for region, peers := range s.state.potentialFailedRegions {
+		for _, peer := range peers {
+			m.failedPeers.Set(1, region, peer)
+		}
+	}
+}
+
+// serveMetrics
+// Exposes the metrics of the node in the Prometheus text format
+func serveMetrics(s *Server, c *gin.Context) {
+	s.refreshStateMetrics()
+	c.Header("Content-Type", metrics.ContentType)
+	c.Status(200)
+	s.metrics.Registry.WriteTo(c.Writer)
+}
@@ -0,0 +1,134 @@
+package Server
+
+import (
+	_ "embed"
+	"time"
+)
+
+// OpenAPISpec is the OpenAPI description of the endpoints of the community node
+//
+//go:embed openapi.json
+var OpenAPISpec []byte
+
+// FileSummary is a monitored file, as listed by the listMonitor endpoint
+type FileSummary struct {
+	FileCID                string  `json:"fileCID"`
+	MetadataCID            string  `json:"metadataCID"`
+	StrandRootCID          string  `json:"strandRootCID"`
+	StrandNumber           int     `json:"strandNumber"`
+	NumDataBlocksMissing   int     `json:"numDataBlocksMissing"`
+	NumParityBlocksMissing int     `json:"numParityBlocksMissing"`
+	EstimatedBlockProb     float32 `json:"estimatedBlockProb"`
+	SharedBlockProb        float32 `json:"sharedBlockProb"`
+	Health                 float32 `json:"health"`
+}
+
+// FileStatus is the state of a monitored file, as returned by the checkFileStatus endpoint
+type FileStatus struct {
+	FileSummary
+	DataBlocksMissing   map[uint]WatchedBlock `json:"dataBlocksMissing"`
+	ParityBlocksMissing map[uint]WatchedBlock `json:"parityBlocksMissing"`
+}
+
+// MissingBlockStats sums up the times at which the node detected missing blocks
+type MissingBlockStats struct {
+	Count                  int       `json:"count"`
+	Since                  time.Time `json:"since"` // start of the monitoring
+	LastDetected           time.Time `json:"lastDetected"`
+	AverageIntervalSeconds float64   `json:"averageIntervalSeconds"`
+	MinIntervalSeconds     float64   `json:"minIntervalSeconds"`
+	MaxIntervalSeconds     float64   `json:"maxIntervalSeconds"`
+}
+
+// ClusterStatus is the state of the cluster seen by the node, as returned by the checkClusterStatus endpoint
+type ClusterStatus struct {
+	ClusterIP              string              `json:"clusterIP"`
+	ClusterPort            int                 `json:"clusterPort"`
+	PotentialFailedRegions map[string][]string `json:"potentialFailedRegions"` // region -> failed cluster peers
+	MissingBlocks          MissingBlockStats   `json:"missingBlocks"`
+}
+
+// HealthStatus is the health of a file, as returned by the recomputeHealth endpoint
+type HealthStatus struct {
+	FileCID string  `json:"fileCID"`
+	Health  float32 `json:"health"`
+}
+
+// Summary returns the summary of the stats of a monitored file
+func (fs *FileStats) Summary() FileSummary {
+	return FileSummary{
+		FileCID:                fs.fileCID,
+		MetadataCID:            fs.MetadataCID,
+		StrandRootCID:          fs.StrandRootCID,
+		StrandNumber:           fs.strandNumber,
+		NumDataBlocksMissing:   len(fs.DataBlocksMissing),
+		NumParityBlocksMissing: len(fs.ParityBlocksMissing),
+		EstimatedBlockProb:     fs.EstimatedBlockProb,
+		SharedBlockProb:        fs.SharedBlockProb(),
+		Health:                 fs.Health,
+	}
+}
+
+// Status returns a copy of the stats of a monitored file, left untouched by the daemon
+func (fs *FileStats) Status() FileStatus {
+	return FileStatus{
+		FileSummary:         fs.Summary(),
+		DataBlocksMissing:   copyWatchedBlocks(fs.DataBlocksMissing),
+		ParityBlocksMissing: copyWatchedBlocks(fs.ParityBlocksMissing),
+	}
+}
+
+func copyWatchedBlocks(blocks map[uint]*WatchedBlock) map[uint]WatchedBlock {
+	copied := make(map[uint]WatchedBlock, len(blocks))
+	for index, block := range blocks {
+		if block != nil {
+			copied[index] = *block
+		}
+	}
+	return copied
+}
+
+// MissingBlockIntervals sums up the times at which missing blocks were detected, given as UnixNano
+// timestamps starting with the start of the monitoring
+func MissingBlockIntervals(timestamps []int64) MissingBlockStats {
+	var stats MissingBlockStats
+	if len(timestamps) == 0 {
+		return stats
+	}
+	stats.Since = time.Unix(0, timestamps[0])
+	stats.Count = len(timestamps) - 1
+	if stats.Count == 0 {
+		return stats
+	}
+	stats.LastDetected = time.Unix(0, timestamps[stats.Count])
+
+	var sum, min, max time.Duration
+	for i := 0; i < stats.Count; i++ {
+		interval := time.Duration(timestamps[i+1] - timestamps[i])
+		sum += interval
+		if i == 0 || interval < min {
+			min = interval
+		}
+		if interval > max {
+			max = interval
+		}
+	}
+	stats.AverageIntervalSeconds = (sum / time.Duration(stats.Count)).Seconds()
+	stats.MinIntervalSeconds = min.Seconds()
+	stats.MaxIntervalSeconds = max.Seconds()
+	return stats
+}
+
+// clusterStatus returns the state of the cluster seen by the node. It runs on the daemon
+func (s *Server) clusterStatus() ClusterStatus {
+	regions := make(map[string][]string, len(s.state.potentialFailedRegions))
+	for region, peers := range s.state.potentialFailedRegions {
+		regions[region] = append([]string(nil), peers...)
+	}
+	return ClusterStatus{
+		ClusterIP:              s.clusterIP,
+		ClusterPort:            s.clusterPort,
+		PotentialFailedRegions: regions,
+		MissingBlocks:          MissingBlockIntervals(s.state.unavailableBlocksTimestamps),
+	}
+}
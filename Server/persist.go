@@ -0,0 +1,269 @@
+package Server
+
+import (
+	"encoding/json"
+	"time"
+
+	"ipfs-alpha-entanglement-code/util"
+)
+
+// buckets of the store of the daemon
+const (
+	filesBucket  = "files"  // monitored files, by file CID
+	collabBucket = "collab" // collaborative repairs, by file CID
+	strandBucket = "strand" // strand repairs, by file CID
+)
+
+// storedFileStats is the persisted form of FileStats, including the fields hidden from the views
+type storedFileStats struct {
+	FileCID                  string                 `json:"fileCID"`
+	MetadataCID              string                 `json:"metadataCID"`
+	StrandRootCID            string                 `json:"strandRootCID"`
+	StrandNumber             int                    `json:"strandNumber"`
+	DataBlocksMissing        map[uint]*WatchedBlock `json:"dataBlocksMissing"`
+	ParityBlocksMissing      map[uint]*WatchedBlock `json:"parityBlocksMissing"`
+	ValidParityBlocksHistory map[uint]*WatchedBlock `json:"validParityBlocksHistory"`
+	EstimatedBlockProb       float32                `json:"estimatedBlockProb"`
+	Health                   float32                `json:"health"`
+	View                     *View                  `json:"view"`
+}
+
+func (fs *FileStats) stored() *storedFileStats {
+	return &storedFileStats{
+		FileCID:                  fs.fileCID,
+		MetadataCID:              fs.MetadataCID,
+		StrandRootCID:            fs.StrandRootCID,
+		StrandNumber:             fs.strandNumber,
+		DataBlocksMissing:        fs.DataBlocksMissing,
+		ParityBlocksMissing:      fs.ParityBlocksMissing,
+		ValidParityBlocksHistory: fs.validParityBlocksHistory,
+		EstimatedBlockProb:       fs.EstimatedBlockProb,
+		Health:                   fs.Health,
+		View:                     fs.view,
+	}
+}
+
+func (stored *storedFileStats) fileStats() *FileStats {
+	fs := &FileStats{
+		fileCID:                  stored.FileCID,
+		MetadataCID:              stored.MetadataCID,
+		StrandRootCID:            stored.StrandRootCID,
+		strandNumber:             stored.StrandNumber,
+		DataBlocksMissing:        stored.DataBlocksMissing,
+		ParityBlocksMissing:      stored.ParityBlocksMissing,
+		validParityBlocksHistory: stored.ValidParityBlocksHistory,
+		EstimatedBlockProb:       stored.EstimatedBlockProb,
+		Health:                   stored.Health,
+	}
+	if fs.DataBlocksMissing == nil {
+		fs.DataBlocksMissing = make(map[uint]*WatchedBlock)
+	}
+	if fs.ParityBlocksMissing == nil {
+		fs.ParityBlocksMissing = make(map[uint]*WatchedBlock)
+	}
+	if fs.validParityBlocksHistory == nil {
+		fs.validParityBlocksHistory = make(map[uint]*WatchedBlock)
+	}
+
+	// merging the stored view into an empty one restores its clock. Stats stored without view start one from
+	// their missing blocks
+	fs.view = NewView()
+	if stored.View != nil {
+		fs.mergeView(stored.View)
+	} else {
+		for blockNumber, block := range fs.DataBlocksMissing {
+			fs.view.Observe("", true, blockNumber, block)
+		}
+		for blockNumber, block := range fs.ParityBlocksMissing {
+			fs.view.Observe("", false, blockNumber, block)
+		}
+	}
+	return fs
+}
+
+// saveFile persists the stats of a monitored file, or forgets them if the file is not monitored anymore.
+// It runs on the daemon, as do the other functions saving the state, which only hand a snapshot to the store
+func (s *Server) saveFile(fileCID string) {
+	if s.store == nil {
+		return
+	}
+
+	var err error
+	if stats, in := s.state.files[fileCID]; in {
+		err = s.store.Put(filesBucket, fileCID, stats.stored())
+	} else {
+		err = s.store.Delete(filesBucket, fileCID)
+	}
+	if err != nil {
+		util.LogPrintf("Error in saving the stats of file %s - %s", fileCID, err)
+	}
+}
+
+// saveCollabRepair publishes and persists the collaborative repair of a file
+func (s *Server) saveCollabRepair(fileCID string) {
+	data, ok := s.collabData[fileCID]
+	if !ok {
+		return
+	}
+	if s.repairs.Publish(CollabRepairView(data)) {
+		s.metrics.ObserveRepair(CollabRepairKind, data.Status, data.EndTime.Sub(data.StartTime))
+	}
+
+	if s.store != nil {
+		if err := s.store.Put(collabBucket, fileCID, data); err != nil {
+			util.LogPrintf("Error in saving the collaborative repair of file %s - %s", fileCID, err)
+		}
+	}
+}
+
+// saveStrandRepair publishes and persists the strand repair of a file
+func (s *Server) saveStrandRepair(fileCID string) {
+	data, ok := s.strandData[fileCID]
+	if !ok {
+		return
+	}
+	if s.repairs.Publish(StrandRepairView(data)) {
+		s.metrics.ObserveRepair(StrandRepairKind, data.Status, data.EndTime.Sub(data.StartTime))
+	}
+
+	if s.store != nil {
+		if err := s.store.Put(strandBucket, fileCID, data); err != nil {
+			util.LogPrintf("Error in saving the strand repair of file %s - %s", fileCID, err)
+		}
+	}
+}
+
+// loadState restores the monitored files and the repair records from the store
+func (s *Server) loadState() {
+	for fileCID, value := range s.store.Load(filesBucket) {
+		var stored storedFileStats
+		if err := json.Unmarshal(value, &stored); err != nil {
+			util.LogPrintf("Skipping the stored stats of file %s - %s", fileCID, err)
+			continue
+		}
+		s.state.files[fileCID] = stored.fileStats()
+	}
+
+	for fileCID, value := range s.store.Load(collabBucket) {
+		var data CollaborativeRepairData
+		if err := json.Unmarshal(value, &data); err != nil {
+			util.LogPrintf("Skipping the stored collaborative repair of file %s - %s", fileCID, err)
+			continue
+		}
+		if data.Peers == nil {
+			data.Peers = make(map[string]*CollabPeerInfo)
+		}
+		if data.JobID == "" {
+			data.JobID = NewRepairJobID()
+		}
+		s.collabData[fileCID] = &data
+		s.repairs.Publish(CollabRepairView(&data))
+	}
+
+	for fileCID, value := range s.store.Load(strandBucket) {
+		var data StrandRepairData
+		if err := json.Unmarshal(value, &data); err != nil {
+			util.LogPrintf("Skipping the stored strand repair of file %s - %s", fileCID, err)
+			continue
+		}
+		if data.JobID == "" {
+			data.JobID = NewRepairJobID()
+		}
+		s.strandData[fileCID] = &data
+		s.repairs.Publish(StrandRepairView(&data))
+	}
+
+	util.LogPrintf("Restored %d monitored files, %d collaborative repairs and %d strand repairs",
+		len(s.state.files), len(s.collabData), len(s.strandData))
+}
+
+// recoverRepairs settles the repairs left pending by the previous run of the daemon.
+// A collaborative repair already split into units resumes, as its peers report to this node when they are done
+// and the units missing their deadline are given to other peers. A collaborative repair interrupted before that
+// fails, as does a strand repair waiting for it. It runs on a collaborative repair worker
+func (s *Server) recoverRepairs() {
+	var failed []*CollaborativeRepairData
+	var resumed []*CollaborativeRepairOperation
+	s.do(func() {
+		for fileCID, data := range s.collabData {
+			if data.Status != PENDING {
+				continue
+			}
+			if len(data.Units) > 0 {
+				util.LogPrintf("Resuming collaborative repair of file %s with %d units", fileCID, len(data.Units))
+				strand, ok := s.strandData[fileCID]
+				resumed = append(resumed, &CollaborativeRepairOperation{
+					FileCID:   fileCID,
+					MetaCID:   data.MetaCID,
+					Depth:     data.Depth,
+					Origin:    data.Origin,
+					NumPeers:  RepairNumPeers,
+					forStrand: data.Origin == s.address && ok && strand.Status == PENDING,
+				})
+				continue
+			}
+
+			util.LogPrintf("Failing collaborative repair of file %s interrupted by a restart", fileCID)
+			data.Status = FAILURE
+			data.EndTime = time.Now()
+			s.saveCollabRepair(fileCID)
+			failed = append(failed, data)
+		}
+
+		for fileCID, data := range s.strandData {
+			if data.Status != PENDING {
+				continue
+			}
+			if collab, ok := s.collabData[fileCID]; ok && collab.Status == PENDING {
+				util.LogPrintf("Resuming strand repair of file %s after its collaborative repair", fileCID)
+				continue
+			}
+
+			util.LogPrintf("Failing strand repair of file %s interrupted by a restart", fileCID)
+			data.Status = FAILURE
+			data.EndTime = time.Now()
+			s.saveStrandRepair(fileCID)
+		}
+	})
+
+	for _, data := range failed {
+		s.ReportMetrics(data.FileCID)
+		// the strand repair of this node waiting for the repair already failed above
+		if data.Origin != s.address {
+			s.reportCollabResult(data, false)
+		}
+	}
+
+	if len(resumed) > 0 {
+		s.recoordinateRepairs(resumed)
+	}
+}
+
+// recoordinateRepairs elects the node again to coordinate the repairs it resumed, and cancels those another
+// monitor of the file coordinates now
+func (s *Server) recoordinateRepairs(resumed []*CollaborativeRepairOperation) {
+	ctx, cancel := repairContext()
+	defer cancel()
+	client, err := s.RefreshClient(ctx)
+
+	for _, op := range resumed {
+		var task *RepairTask
+		if !op.forStrand {
+			task = &RepairTask{Collab: op}
+		}
+		if err == nil && s.coordinate(ctx, client, collabResource(op.FileCID), op.MetaCID, task) {
+			continue
+		}
+
+		util.LogPrintf("Cancelling resumed collaborative repair of file %s, not elected to coordinate it", op.FileCID)
+		var id string
+		s.do(func() {
+			if data, ok := s.collabData[op.FileCID]; ok && data.Status == PENDING {
+				id = data.JobID
+			}
+		})
+		if id != "" {
+			s.CancelRepair(id)
+		}
+	}
+}
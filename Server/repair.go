@@ -1,19 +1,29 @@
 package Server
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"ipfs-alpha-entanglement-code/auth"
 	"ipfs-alpha-entanglement-code/client"
 	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
 	"ipfs-alpha-entanglement-code/util"
 	"math/rand"
 	"net/http"
+	"sort"
 	"time"
 )
 
 func PostJSON(url string, body []byte) (status int, err error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	return PostSignedJSON(url, body, nil)
+}
+
+// PostSignedJSON sends a request signed by the signer, left unsigned if the signer is nil
+func PostSignedJSON(url string, body []byte, signer *auth.Signer) (status int, err error) {
+	req, err := signer.NewRequest("POST", url, body)
+	if err != nil {
+		return 0, err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
@@ -29,223 +39,481 @@ func PostJSON(url string, body []byte) (status int, err error) {
 	return resp.StatusCode, nil
 }
 
-func (s *Server) RefreshClient() {
+// RefreshClient connects a new client to the cluster and IPFS, and returns the client to use. The previous client
+// is kept if it fails, so an error is only returned when there is no client to use
+func (s *Server) RefreshClient(ctx context.Context) (*client.Client, error) {
 
-	client, err := client.NewClient(s.clusterIP, s.clusterPort, s.ipfsIP, s.ipfsPort)
+	newClient, err := client.NewClient(ctx, s.clusterIP, s.clusterPort, s.ipfsIP, s.ipfsPort)
 
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
 	if err != nil {
 		util.LogPrintf("Error in creating client - %s", err)
+		if s.client == nil {
+			return nil, err
+		}
+		return s.client, nil
 	}
 
-	s.client = client
+	s.client = newClient
+	return newClient, nil
 }
 
-func (s *Server) UpdateCoordinatorMetrics(getter *ipfsconnector.IPFSGetter, fileCID string) {
+// currentClient returns the last client connected to the cluster and IPFS, nil if there is none
+func (s *Server) currentClient() *client.Client {
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+	return s.client
+}
+
+// UpdateCoordinatorMetrics records the blocks requested by the getter of the coordinator of the repair.
+// It runs on the daemon
+func (s *Server) UpdateCoordinatorMetrics(getter *ipfsconnector.IPFSGetter, job *CollaborativeRepairData) {
 
 	if getter == nil {
 		return
 	}
 
-	s.collabData[fileCID].ParityAvailable = getter.ParityAvailable
-	s.collabData[fileCID].DataBlocksFetched = getter.DataBlocksFetched
-	s.collabData[fileCID].DataBlocksCached = getter.DataBlocksCached
-	s.collabData[fileCID].DataBlocksUnavailable = getter.DataBlocksUnavailable
-	s.collabData[fileCID].DataBlocksError = getter.DataBlocksError
-	s.collabData[fileCID].ParityBlocksFetched = getter.ParityBlocksFetched
-	s.collabData[fileCID].ParityBlocksCached = getter.ParityBlocksCached
-	s.collabData[fileCID].ParityBlocksUnavailable = getter.ParityBlocksUnavailable
-	s.collabData[fileCID].ParityBlocksError = getter.ParityBlocksError
+	snapshot := getter.Metrics()
+	s.metrics.ObserveGetter(CoordinatorGetter, snapshot)
+	job.ParityAvailable = snapshot.ParityAvailable
+	job.DataBlocksFetched = snapshot.DataBlocksFetched
+	job.DataBlocksCached = snapshot.DataBlocksCached
+	job.DataBlocksUnavailable = snapshot.DataBlocksUnavailable
+	job.DataBlocksError = snapshot.DataBlocksError
+	job.ParityBlocksFetched = snapshot.ParityBlocksFetched
+	job.ParityBlocksCached = snapshot.ParityBlocksCached
+	job.ParityBlocksUnavailable = snapshot.ParityBlocksUnavailable
+	job.ParityBlocksError = snapshot.ParityBlocksError
+	job.DataBlocksVerified = snapshot.DataBlocksVerified
+	job.DataBlocksCorrupted = snapshot.DataBlocksCorrupted
+	job.DataBlocksUnverified = snapshot.DataBlocksUnverified
+	job.Verification = snapshot.Verification
 
 }
 
-// function that takes in a CollaborativeRepairOperationRequest and starts the repair process
+// function that takes in a CollaborativeRepairOperationRequest and starts the repair process.
+// It runs on a collaborative repair worker
 func (s *Server) StartCollabRepair(op *CollaborativeRepairOperation) {
-	s.RefreshClient()
-	s.client.IPFSConnector.SetTimeout(100 * time.Millisecond)
-	defer s.client.IPFSConnector.SetTimeout(0)
+	ctx, cancel := repairContext()
+	defer cancel()
+	client, err := s.RefreshClient(ctx)
+	if err != nil {
+		util.LogPrintf("Error in starting collaborative repair for file %s - %s", op.FileCID, err)
+		return
+	}
+
+	// a single monitor of the file coordinates its repair. The collaborative repair of a strand repair is taken
+	// over with the strand repair
+	var task *RepairTask
+	if !op.forStrand {
+		task = &RepairTask{Collab: op}
+	}
+	if !s.coordinate(ctx, client, collabResource(op.FileCID), op.MetaCID, task) {
+		return
+	}
 
 	util.LogPrintf("Starting collaborative repair for file %s", op.FileCID)
 
-	// check if a repair is already in progress for this file in collabData
-	if _, ok := s.collabData[op.FileCID]; ok && s.collabData[op.FileCID].Status == PENDING {
+	var job *CollaborativeRepairData
+	s.do(func() {
+		// check if a repair is already in progress for this file in collabData
+		if data, ok := s.collabData[op.FileCID]; ok && data.Status == PENDING {
+			return
+		}
+
+		util.LogPrintf("No repair in progress for file %s, starting new repair", op.FileCID)
+
+		// create a new entry in collabData
+		job = &CollaborativeRepairData{
+			JobID:                   NewRepairJobID(),
+			FileCID:                 op.FileCID,
+			MetaCID:                 op.MetaCID,
+			Status:                  PENDING,
+			StartTime:               time.Now(),
+			Depth:                   op.Depth,
+			Origin:                  op.Origin,
+			Peers:                   make(map[string]*CollabPeerInfo),
+			ParityAvailable:         make([]bool, 0),
+			DataBlocksFetched:       0,
+			DataBlocksCached:        0,
+			DataBlocksUnavailable:   0,
+			DataBlocksError:         0,
+			ParityBlocksFetched:     0,
+			ParityBlocksCached:      0,
+			ParityBlocksUnavailable: 0,
+			ParityBlocksError:       0,
+		}
+		s.collabData[op.FileCID] = job
+
+		util.LogPrintf("Created new entry in collabData for file %s", op.FileCID)
+		s.saveCollabRepair(op.FileCID)
+	})
+	if job == nil {
 		return
 	}
+	defer s.repairs.SetCancel(job.JobID, cancel)()
 
-	util.LogPrintf("No repair in progress for file %s, starting new repair", op.FileCID)
+	// first repair the intermediate nodes of the tree
+	leaves, getter, err := client.RetrieveFailedLeaves(ctx, op.FileCID, op.MetaCID, op.Depth, op.missing)
+	if err != nil {
+		util.LogPrintf("Error in retrieving failed leaves for file %s - %s", op.FileCID, err)
+	} else {
+		util.LogPrintf("Retrieved %d failed leaves for file %s", len(leaves), op.FileCID)
+	}
 
-	// create a new entry in collabData
-	s.collabData[op.FileCID] = &CollaborativeRepairData{
-		FileCID:                 op.FileCID,
-		MetaCID:                 op.MetaCID,
-		Status:                  PENDING,
-		StartTime:               time.Now(),
-		Depth:                   op.Depth,
-		Origin:                  op.Origin,
-		Peers:                   make(map[string]*CollabPeerInfo),
-		ParityAvailable:         make([]bool, 0),
-		DataBlocksFetched:       0,
-		DataBlocksCached:        0,
-		DataBlocksUnavailable:   0,
-		DataBlocksError:         0,
-		ParityBlocksFetched:     0,
-		ParityBlocksCached:      0,
-		ParityBlocksUnavailable: 0,
-		ParityBlocksError:       0,
+	// if there are failed leaves, we need to get all peers available in the cluster
+	var peers []string
+	if err == nil && len(leaves) > 0 {
+		peers, err = s.repairPeers()
+		if err != nil {
+			util.LogPrintf("Error in getting all peers for file %s - %s", op.FileCID, err)
+		} else {
+			util.LogPrintf("Retrieved %d peers for file %s", len(peers), op.FileCID)
+		}
 	}
 
-	util.LogPrintf("Created new entry in collabData for file %s", op.FileCID)
+	var units []*RepairUnit
+	finished, success := false, false
+	s.do(func() {
+		s.UpdateCoordinatorMetrics(getter, job)
+		// the repair is left alone if it was cancelled meanwhile
+		if job.Status != PENDING {
+			return
+		}
+		defer s.saveCollabRepair(op.FileCID)
 
-	// first repair the intermediate nodes of the tree
-	leaves, getter, err := s.client.RetrieveFailedLeaves(op.FileCID, op.MetaCID, op.Depth)
+		if err != nil {
+			job.Status = FAILURE
+			job.EndTime = time.Now()
+			finished = true
+			return
+		}
 
-	s.UpdateCoordinatorMetrics(getter, op.FileCID)
+		// if there are no failed leaves, then the repair is done
+		if len(leaves) == 0 {
+			util.LogPrintf("No failed leaves for file %s", op.FileCID)
+			job.Status = SUCCESS
+			job.EndTime = time.Now()
+			finished, success = true, true
+			return
+		}
 
-	if err != nil {
-		util.LogPrintf("Error in retrieving failed leaves for file %s - %s", op.FileCID, err)
-		s.collabData[op.FileCID].Status = FAILURE
-		s.collabData[op.FileCID].EndTime = time.Now()
-		s.ReportMetrics(op.FileCID)
-		return
-	}
+		// find max number of peers to use for repair
+		numPeers := op.NumPeers
+		if len(peers) < numPeers {
+			numPeers = len(peers)
+		}
+		if len(leaves) < numPeers {
+			numPeers = len(leaves)
+		}
 
-	util.LogPrintf("Retrieved %d failed leaves for file %s", len(leaves), op.FileCID)
+		util.LogPrintf("Using %d peers for file %s", numPeers, op.FileCID)
+		if numPeers < 1 {
+			util.LogPrintf("No peer to repair file %s", op.FileCID)
+			job.Status = FAILURE
+			job.EndTime = time.Now()
+			finished = true
+			return
+		}
 
-	// if there are no failed leaves, then the repair is done
-	if len(leaves) == 0 {
-		util.LogPrintf("No failed leaves for file %s", op.FileCID)
-		s.collabData[op.FileCID].Status = SUCCESS
-		s.collabData[op.FileCID].EndTime = time.Now()
-		s.ReportMetrics(op.FileCID)
-		return
-	}
+		// shuffle the peerIPs list
+		for i := range peers {
+			j := rand.Intn(i + 1)
+			peers[i], peers[j] = peers[j], peers[i]
+		}
 
-	// if there are failed leaves, we need to get all peers available in the cluster
-	_, _, peers, err := s.getAllPeers()
+		// split the leaves into units, one for each peer, to hand them to the peers
+		job.SplitUnits(leaves, numPeers)
+		units = job.sortedUnits()
+		for _, unit := range units {
+			unit.dispatching = true
+		}
+	})
 
-	if err != nil {
-		util.LogPrintf("Error in getting all peers for file %s - %s", op.FileCID, err)
-		s.collabData[op.FileCID].Status = FAILURE
-		s.collabData[op.FileCID].EndTime = time.Now()
-		s.ReportMetrics(op.FileCID)
+	if finished {
+		s.collabRepairDone(job, success)
 		return
 	}
 
-	util.LogPrintf("Retrieved %d peers for file %s", len(peers), op.FileCID)
-
-	// find max number of peers to use for repair
-	numPeers := op.NumPeers
-	if len(peers) < numPeers {
-		numPeers = len(peers)
-	}
-	if len(leaves) < numPeers {
-		numPeers = len(leaves)
+	// a unit that no peer accepts, or whose peer does not report in time, is given to another peer later
+	if len(units) > 0 {
+		s.dispatchUnits(job, peers, units)
+		s.settleCollabRepair(job)
 	}
+}
 
-	util.LogPrintf("Using %d peers for file %s", numPeers, op.FileCID)
-
-	// shuffle the peerIPs list
-	for i := range peers {
-		j := rand.Intn(i + 1)
-		peers[i], peers[j] = peers[j], peers[i]
+// sortedUnits returns the units of the repair by ID, so that they are handed to the peers in order
+func (job *CollaborativeRepairData) sortedUnits() []*RepairUnit {
+	units := make([]*RepairUnit, 0, len(job.Units))
+	for _, unit := range job.Units {
+		units = append(units, unit)
 	}
+	sort.Slice(units, func(i, j int) bool { return units[i].ID < units[j].ID })
+	return units
+}
 
-	// for this shuffled list, iterate over peers
-	// send a request to each of IP/triggerUnitRepair
-	// the request should follow the UnitRepairOperationRequest struct
-	// each peer should take i*len(leaves)/numPeers to (i+1)*len(leaves)/numPeers leaves
-	// if the peer sends back status 200, then move on to the next peer
-	// for each peer that sends back status 200, add it to the list of peers that have successfully started
-	// if the peer sends back status 400, then retry the request twice before moving on to the next peer
-
-	// prepare the requests in advance
-	leavesPerPeer := len(leaves) / numPeers
-	requests := make([]*UnitRepairOperationRequest, numPeers)
-	jsonRequests := make([][]byte, numPeers)
-	for i := 0; i < numPeers; i++ {
-		requests[i] = &UnitRepairOperationRequest{
-			FileCID:       op.FileCID,
-			MetaCID:       op.MetaCID,
-			Depth:         op.Depth,
+// dispatchUnits offers each unit to the peers in turn until one accepts it, starting with a different peer
+// for each unit. A unit accepted by no peer waits before being offered again. The units are marked as being
+// dispatched by the caller, so that no other worker dispatches them meanwhile. It runs on a collaborative
+// repair worker
+func (s *Server) dispatchUnits(job *CollaborativeRepairData, peers []string, units []*RepairUnit) {
+	for i, unit := range units {
+		accepted := false
+		request, err := json.Marshal(&UnitRepairOperationRequest{
+			JobID:         job.JobID,
+			UnitID:        unit.ID,
+			FileCID:       job.FileCID,
+			MetaCID:       job.MetaCID,
+			Depth:         job.Depth,
 			Origin:        s.address,
-			FailedIndices: leaves[i*leavesPerPeer : (i+1)*leavesPerPeer],
+			FailedIndices: unit.FailedIndices,
+		})
+		if err != nil {
+			util.LogPrintf("Error in marshalling request for unit %s - %s", unit.ID, err)
 		}
-		if i == numPeers-1 {
-			requests[i].FailedIndices = leaves[i*leavesPerPeer:]
+
+		var candidates []string
+		s.do(func() {
+			if err != nil {
+				unit.Status = FAILURE
+			} else if job.Status == PENDING && unit.Status == PENDING {
+				candidates = unit.CandidatePeers(peers, i)
+			}
+		})
+
+		for _, peer := range candidates {
+			// the unit is given to the peer before it answers, so that its report is accepted even if it comes first
+			offered := false
+			s.do(func() {
+				if job.Status == PENDING && unit.Status == PENDING {
+					job.Assign(unit, peer, time.Now())
+					offered = true
+				}
+			})
+			if !offered {
+				break
+			}
+
+			status, err := s.postJSON("http://"+peer+"/triggerUnitRepair", request)
+			if err != nil || status != 200 {
+				util.LogPrintf("Peer %s did not accept unit %s of file %s", peer, unit.ID, job.FileCID)
+				s.metrics.ObservePeer(peer, "rejected", time.Now())
+				s.do(func() { job.Withdraw(unit, peer) })
+				continue
+			}
+
+			s.metrics.ObservePeer(peer, "accepted", time.Now())
+			s.do(func() { job.recordPeer(unit, peer, time.Now()) })
+
+			util.LogPrintf("Successfully sent unit %s to peer %s for file %s with %d leaves", unit.ID, peer, job.FileCID, len(unit.FailedIndices))
+			accepted = true
+			break
 		}
-		jsonRequests[i], err = json.Marshal(requests[i])
-		if err != nil {
-			util.LogPrintf("Error in marshalling request for peer %d - %s", i, err)
-			s.collabData[op.FileCID].Status = FAILURE
-			s.collabData[op.FileCID].EndTime = time.Now()
-			s.ReportMetrics(op.FileCID)
-			return
+
+		s.do(func() {
+			unit.dispatching = false
+			if !accepted && job.Status == PENDING && unit.Status == PENDING {
+				job.DispatchFailed(unit, time.Now())
+				util.LogPrintf("No peer accepted unit %s of file %s after %d attempts", unit.ID, job.FileCID, unit.Attempts)
+			}
+		})
+	}
+}
+
+// recordPeer records the peer which accepted a unit of the repair, unless it already reported it.
+// It runs on the daemon
+func (job *CollaborativeRepairData) recordPeer(unit *RepairUnit, peer string, now time.Time) {
+	if _, ok := job.Peers[peer]; !ok {
+		job.Peers[peer] = &CollabPeerInfo{
+			Name:            peer,
+			StartTime:       now,
+			AllocatedBlocks: make(map[int]bool),
+			ParityAvailable: make([]bool, 0),
 		}
 	}
+	if unit.Status != PENDING {
+		return
+	}
+
+	job.Peers[peer].Status = PENDING
+	for _, leaf := range unit.FailedIndices {
+		job.Peers[peer].AllocatedBlocks[leaf] = false
+	}
+}
+
+// CheckRepairJobs gives the units whose peer missed its deadline to other peers, once their backoff elapsed.
+// It runs on a collaborative repair worker
+func (s *Server) CheckRepairJobs() {
+	defer s.checkingRepairs.Store(false)
+
+	type check struct {
+		job   *CollaborativeRepairData
+		ready []*RepairUnit
+	}
+	var checks []check
+	retry := false
+	s.do(func() {
+		for fileCID, job := range s.collabData {
+			if job.Status != PENDING || len(job.Units) == 0 {
+				continue
+			}
 
-	sentRequests := 0
-	i := 0
-	for sentRequests < numPeers {
-		// send the request to the peer
-		status, err := PostJSON("http://"+peers[i]+"/triggerUnitRepair", jsonRequests[i])
-
-		if err == nil && status == 200 {
-			// add the peer to the list of peers that have successfully started
-			// check if peer already exists in peers
-			if _, ok := s.collabData[op.FileCID].Peers[peers[i]]; !ok {
-				s.collabData[op.FileCID].Peers[peers[i]] = &CollabPeerInfo{
-					Name:                    peers[i],
-					StartTime:               time.Now(),
-					Status:                  PENDING,
-					AllocatedBlocks:         make(map[int]bool),
-					ParityAvailable:         make([]bool, 0),
-					DataBlocksFetched:       0,
-					DataBlocksCached:        0,
-					DataBlocksUnavailable:   0,
-					DataBlocksError:         0,
-					ParityBlocksFetched:     0,
-					ParityBlocksCached:      0,
-					ParityBlocksUnavailable: 0,
-					ParityBlocksError:       0,
+			expired, ready := job.Expire(time.Now())
+			for _, peer := range expired {
+				util.LogPrintf("Peer %s missed the deadline of its unit for file %s", peer, fileCID)
+				s.metrics.ObservePeer(peer, "expired", time.Now())
+				if info, ok := job.Peers[peer]; ok {
+					info.Status = FAILURE
+					info.EndTime = time.Now()
 				}
 			}
+			for _, unit := range ready {
+				unit.dispatching = true
+			}
 
-			util.LogPrintf("Successfully sent request to peer %s for file %s with %d leaves", peers[i], op.FileCID, len(requests[i].FailedIndices))
-			// add the allocated blocks to the peer
-			for _, leaf := range requests[i].FailedIndices {
-				s.collabData[op.FileCID].Peers[peers[i]].AllocatedBlocks[leaf] = false
+			if len(expired) > 0 || len(ready) > 0 {
+				s.saveCollabRepair(fileCID)
+				checks = append(checks, check{job, ready})
+				retry = retry || len(ready) > 0
 			}
+		}
+	})
+
+	var peers []string
+	if retry {
+		var err error
+		peers, err = s.repairPeers()
+		if err != nil || len(peers) == 0 {
+			util.LogPrintf("Error in getting all peers to retry the repairs - %v", err)
+			peers = nil
+		}
+	}
 
-			sentRequests++
+	for _, check := range checks {
+		if len(check.ready) > 0 && peers != nil {
+			s.dispatchUnits(check.job, peers, check.ready)
+		} else {
+			s.do(func() {
+				for _, unit := range check.ready {
+					unit.dispatching = false
+					if check.job.Status == PENDING && unit.Status == PENDING {
+						check.job.DispatchFailed(unit, time.Now())
+					}
+				}
+			})
 		}
+		s.settleCollabRepair(check.job)
+	}
+}
+
+// finishCollabRepair completes the repair once all its units are settled, and tells whether it did with the
+// result of the repair. It runs on the daemon
+func (s *Server) finishCollabRepair(job *CollaborativeRepairData) (finished bool, success bool) {
+	done, success := job.Done()
+	if !done || job.Status != PENDING {
+		return false, false
+	}
+
+	// update time and status of collabData
+	job.EndTime = time.Now()
+	if success {
+		job.Status = SUCCESS
+	} else {
+		job.Status = FAILURE
+	}
+
+	util.LogPrintf("All peers finished unit repair for file %s with total time of %s", job.FileCID, job.EndTime.Sub(job.StartTime).String())
+	return true, success
+}
 
-		// Move in circular fashion as long as we haven't found numPeers peers
-		i++
-		if i == len(peers) {
-			i = 0
+// settleCollabRepair completes the repair once all its units are settled, and reports it
+func (s *Server) settleCollabRepair(job *CollaborativeRepairData) {
+	finished, success := false, false
+	s.do(func() {
+		if job.Status != PENDING {
+			return
 		}
+		finished, success = s.finishCollabRepair(job)
+		s.saveCollabRepair(job.FileCID)
+	})
+	if finished {
+		s.collabRepairDone(job, success)
 	}
+}
 
-	// if we reach here, then we have successfully sent requests to all peers
-	// We will wait for each of them to send back an async response to update the status of the repair
-	// once all peers have sent back a response, we will check if all leaves have been repaired
+// collabRepairDone reports a collaborative repair which just finished to the discovery and to its origin
+func (s *Server) collabRepairDone(job *CollaborativeRepairData, success bool) {
+	s.releaseCoordination(collabResource(job.FileCID))
+	s.ReportMetrics(job.FileCID)
+	s.reportCollabResult(job, success)
 }
 
-// function that takes in a UnitRepairOperation and starts the repair process
+// reportCollabResult sends the result of the repair to its origin, which continues its strand repair if any
+func (s *Server) reportCollabResult(job *CollaborativeRepairData, success bool) {
+	if job.Origin == s.address {
+		done := &CollaborativeRepairDone{FileCID: job.FileCID, MetaCID: job.MetaCID, Origin: s.address, RepairStatus: success}
+		if s.submit(s.pools.Strand, func() { s.ContinueStrandRepair(done) }) != nil {
+			// the strand repair waiting for the result cannot continue
+			s.do(func() { s.failStrandRepair(job.FileCID) })
+		}
+		return
+	}
+
+	// check if there's origin for this file
+	if job.Origin == "" {
+		util.LogPrintf("No origin for collaborative repair of file %s, so no need to report back", job.FileCID)
+		return
+	}
+
+	// send back the result to the origin
+	response := &CollaborativeRepairOperationResponse{
+		FileCID:      job.FileCID,
+		MetaCID:      job.MetaCID,
+		Origin:       s.address,
+		RepairStatus: success,
+	}
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		util.LogPrintf("Error in marshalling response for file %s - %s", job.FileCID, err)
+		return
+	}
+
+	// send the response back to the origin
+	s.postJSON("http://"+job.Origin+"/reportCollabRepair", jsonResponse)
+}
+
+// function that takes in a UnitRepairOperation and starts the repair process.
+// It runs on a unit repair worker
 func (s *Server) StartUnitRepair(op *UnitRepairOperation) {
-	s.RefreshClient()
-	s.client.IPFSConnector.SetTimeout(100 * time.Millisecond)
-	defer s.client.IPFSConnector.SetTimeout(0)
+	ctx, cancel := repairContext()
+	defer cancel()
+	client, err := s.RefreshClient(ctx)
+	if err != nil {
+		util.LogPrintf("Error in starting unit repair for file %s - %s", op.FileCID, err)
+		return
+	}
 
 	// get the failedIndices from the request
 	// trigger client.RepairFailedLeaves
 	// return the result from each of the failedIndices
 
 	util.LogPrintf("Starting unit repair for file %s, with depth %d and %d failed leaves", op.FileCID, op.Depth, len(op.FailedIndices))
-	res, getter, err := s.client.RepairFailedLeaves(op.FileCID, op.MetaCID, op.Depth, op.FailedIndices)
+	startTime := time.Now()
+	res, getter, err := client.RepairFailedLeaves(ctx, op.FileCID, op.MetaCID, op.Depth, op.FailedIndices)
 
+	status := SUCCESS
 	if err != nil {
 		util.LogPrintf("Error in repairing failed leaves for file %s - %s", op.FileCID, err)
+		status = FAILURE
 	}
+	for _, repaired := range res {
+		if !repaired {
+			status = FAILURE
+		}
+	}
+	s.metrics.ObserveRepair(UnitRepairKind, status, time.Since(startTime))
 
 	util.LogPrintf("Finished unit repair for file %s", op.FileCID)
 	for i, r := range res {
@@ -254,6 +522,8 @@ func (s *Server) StartUnitRepair(op *UnitRepairOperation) {
 
 	// send back the result to the origin
 	response := &UnitRepairOperationResponse{
+		JobID:        op.JobID,
+		UnitID:       op.UnitID,
 		FileCID:      op.FileCID,
 		MetaCID:      op.MetaCID,
 		Origin:       s.address,
@@ -261,15 +531,21 @@ func (s *Server) StartUnitRepair(op *UnitRepairOperation) {
 	}
 
 	if getter != nil {
-		response.ParityAvailable = getter.ParityAvailable
-		response.DataBlocksFetched = getter.DataBlocksFetched
-		response.DataBlocksCached = getter.DataBlocksCached
-		response.DataBlocksUnavailable = getter.DataBlocksUnavailable
-		response.DataBlocksError = getter.DataBlocksError
-		response.ParityBlocksFetched = getter.ParityBlocksFetched
-		response.ParityBlocksCached = getter.ParityBlocksCached
-		response.ParityBlocksUnavailable = getter.ParityBlocksUnavailable
-		response.ParityBlocksError = getter.ParityBlocksError
+		snapshot := getter.Metrics()
+		s.metrics.ObserveGetter(UnitRepairGetter, snapshot)
+		response.ParityAvailable = snapshot.ParityAvailable
+		response.DataBlocksFetched = snapshot.DataBlocksFetched
+		response.DataBlocksCached = snapshot.DataBlocksCached
+		response.DataBlocksUnavailable = snapshot.DataBlocksUnavailable
+		response.DataBlocksError = snapshot.DataBlocksError
+		response.ParityBlocksFetched = snapshot.ParityBlocksFetched
+		response.ParityBlocksCached = snapshot.ParityBlocksCached
+		response.ParityBlocksUnavailable = snapshot.ParityBlocksUnavailable
+		response.ParityBlocksError = snapshot.ParityBlocksError
+		response.DataBlocksVerified = snapshot.DataBlocksVerified
+		response.DataBlocksCorrupted = snapshot.DataBlocksCorrupted
+		response.DataBlocksUnverified = snapshot.DataBlocksUnverified
+		response.Verification = snapshot.Verification
 	}
 
 	util.LogPrintf("Sending back response for file %s to %s", op.FileCID, op.Origin)
@@ -281,23 +557,29 @@ func (s *Server) StartUnitRepair(op *UnitRepairOperation) {
 	}
 
 	// send the response back to the origin
-	PostJSON("http://"+op.Origin+"/reportUnitRepair", jsonResponse)
+	s.postJSON("http://"+op.Origin+"/reportUnitRepair", jsonResponse)
 }
 
 func (s *Server) ReportMetrics(fileCID string) {
-	data := s.collabData[fileCID]
-	if data == nil {
-		return
-	}
-
-	jsonResponse, err := json.Marshal(data)
+	var jsonResponse []byte
+	var err error
+	s.do(func() {
+		if data := s.collabData[fileCID]; data != nil {
+			jsonResponse, err = json.Marshal(data)
+		}
+	})
 	if err != nil {
 		util.LogPrintf("Error in marshalling metrics response for file %s - %s", fileCID, err)
 		return
 	}
+	if jsonResponse == nil {
+		return
+	}
 
-	// send the response back to the disovery/metrics
-	PostJSON("http://"+s.discoveryAddress+"/reportMetrics", jsonResponse)
+	// send the response back to the disovery/metrics, if the node uses the discovery service
+	if len(s.discoveryAddress) > 0 {
+		PostJSON("http://"+s.discoveryAddress+"/reportMetrics", jsonResponse)
+	}
 }
 
 func (s *Server) ReportDownloadMetrics(getter *ipfsconnector.IPFSGetter, startTime *time.Time, endTime *time.Time, status RepairStatus) {
@@ -306,19 +588,24 @@ func (s *Server) ReportDownloadMetrics(getter *ipfsconnector.IPFSGetter, startTi
 		return
 	}
 
+	snapshot := getter.Metrics()
 	metrics := &DownloadMetrics{
 		StartTime:               startTime,
 		EndTime:                 endTime,
 		Status:                  status,
-		ParityAvailable:         getter.ParityAvailable,
-		DataBlocksFetched:       getter.DataBlocksFetched,
-		DataBlocksCached:        getter.DataBlocksCached,
-		DataBlocksUnavailable:   getter.DataBlocksUnavailable,
-		DataBlocksError:         getter.DataBlocksError,
-		ParityBlocksFetched:     getter.ParityBlocksFetched,
-		ParityBlocksCached:      getter.ParityBlocksCached,
-		ParityBlocksUnavailable: getter.ParityBlocksUnavailable,
-		ParityBlocksError:       getter.ParityBlocksError,
+		ParityAvailable:         snapshot.ParityAvailable,
+		DataBlocksFetched:       snapshot.DataBlocksFetched,
+		DataBlocksCached:        snapshot.DataBlocksCached,
+		DataBlocksUnavailable:   snapshot.DataBlocksUnavailable,
+		DataBlocksError:         snapshot.DataBlocksError,
+		ParityBlocksFetched:     snapshot.ParityBlocksFetched,
+		ParityBlocksCached:      snapshot.ParityBlocksCached,
+		ParityBlocksUnavailable: snapshot.ParityBlocksUnavailable,
+		ParityBlocksError:       snapshot.ParityBlocksError,
+		DataBlocksVerified:      snapshot.DataBlocksVerified,
+		DataBlocksCorrupted:     snapshot.DataBlocksCorrupted,
+		DataBlocksUnverified:    snapshot.DataBlocksUnverified,
+		Verification:            snapshot.Verification,
 	}
 
 	jsonResponse, err := json.Marshal(metrics)
@@ -327,8 +614,10 @@ func (s *Server) ReportDownloadMetrics(getter *ipfsconnector.IPFSGetter, startTi
 		return
 	}
 
-	// send the response back to the disovery/reportDownloadMetrics
-	PostJSON("http://"+s.discoveryAddress+"/reportDownloadMetrics", jsonResponse)
+	// send the response back to the disovery/reportDownloadMetrics, if the node uses the discovery service
+	if len(s.discoveryAddress) > 0 {
+		PostJSON("http://"+s.discoveryAddress+"/reportDownloadMetrics", jsonResponse)
+	}
 }
 
 // function that takes in *UnitRepairDone, updates its corresponding entry in collabData
@@ -336,132 +625,133 @@ func (s *Server) ReportDownloadMetrics(getter *ipfsconnector.IPFSGetter, startTi
 
 func (s *Server) ReportUnitRepair(op *UnitRepairDone) {
 
-	util.LogPrintf("Reporting unit repair for file %s", op.FileCID)
+	util.LogPrintf("Reporting unit repair %s for file %s", op.UnitID, op.FileCID)
+
+	var job *CollaborativeRepairData
+	finished, success := false, false
+	s.do(func() {
+		if job = s.recordUnitRepair(op); job != nil {
+			finished, success = s.finishCollabRepair(job)
+			s.saveCollabRepair(op.FileCID)
+		}
+	})
+	if finished {
+		s.collabRepairDone(job, success)
+	}
+}
 
+// recordUnitRepair updates the repair with the report of a unit, and returns the repair if the report is
+// accepted. It runs on the daemon
+func (s *Server) recordUnitRepair(op *UnitRepairDone) *CollaborativeRepairData {
 	// check if entry exists in collabData
-	if _, ok := s.collabData[op.FileCID]; !ok {
+	job, ok := s.collabData[op.FileCID]
+	if !ok {
 		util.LogPrintf("Error in reporting unit repair for file %s - entry does not exist in collabData", op.FileCID)
-		return
+		return nil
 	}
 
-	util.LogPrintf("Entry exists in collabData for file %s", op.FileCID)
-
-	// check if peer exists in collabData
-	if _, ok := s.collabData[op.FileCID].Peers[op.Origin]; !ok {
-		util.LogPrintf("Error in reporting unit repair for file %s - peer %s does not exist in collabData", op.FileCID, op.Origin)
-		// print all peers in collabData
-		util.LogPrintf("Peers in available:")
-		for peer := range s.collabData[op.FileCID].Peers {
-			util.LogPrintf("Peer %s", peer)
-		}
-		return
+	// a report of a previous repair of the file or a repeated report is ignored
+	if op.JobID != job.JobID {
+		util.LogPrintf("Ignoring report of unit %s for file %s - repair %s is not the current one", op.UnitID, op.FileCID, op.JobID)
+		return nil
 	}
+	if !job.Report(op.UnitID, op.Origin, op.RepairStatus) {
+		util.LogPrintf("Ignoring report of unit %s for file %s from peer %s - unit already settled or not given to the peer", op.UnitID, op.FileCID, op.Origin)
+		return nil
+	}
+	s.metrics.ObservePeer(op.Origin, "reported", time.Now())
 
 	// update the entry in collabData
-	s.collabData[op.FileCID].Peers[op.Origin].EndTime = time.Now()
-
-	util.LogPrintf("Peer %s finished unit repair for file %s with total time of %s", op.Origin, op.FileCID, s.collabData[op.FileCID].Peers[op.Origin].EndTime.Sub(s.collabData[op.FileCID].Peers[op.Origin].StartTime).String())
-
-	if s.collabData[op.FileCID].Peers[op.Origin].ParityAvailable != nil {
-		s.collabData[op.FileCID].Peers[op.Origin].ParityAvailable = op.ParityAvailable
-	}
-	s.collabData[op.FileCID].Peers[op.Origin].DataBlocksFetched = op.DataBlocksFetched
-	s.collabData[op.FileCID].Peers[op.Origin].DataBlocksCached = op.DataBlocksCached
-	s.collabData[op.FileCID].Peers[op.Origin].DataBlocksUnavailable = op.DataBlocksUnavailable
-	s.collabData[op.FileCID].Peers[op.Origin].DataBlocksError = op.DataBlocksError
-	s.collabData[op.FileCID].Peers[op.Origin].ParityBlocksFetched = op.ParityBlocksFetched
-	s.collabData[op.FileCID].Peers[op.Origin].ParityBlocksCached = op.ParityBlocksCached
-	s.collabData[op.FileCID].Peers[op.Origin].ParityBlocksUnavailable = op.ParityBlocksUnavailable
+	peer, ok := job.Peers[op.Origin]
+	if !ok {
+		peer = &CollabPeerInfo{Name: op.Origin, AllocatedBlocks: make(map[int]bool)}
+		job.Peers[op.Origin] = peer
+	}
+	peer.EndTime = time.Now()
+
+	util.LogPrintf("Peer %s finished unit repair for file %s with total time of %s", op.Origin, op.FileCID, peer.EndTime.Sub(peer.StartTime).String())
+
+	if peer.ParityAvailable != nil {
+		peer.ParityAvailable = op.ParityAvailable
+	}
+	peer.DataBlocksFetched = op.DataBlocksFetched
+	peer.DataBlocksCached = op.DataBlocksCached
+	peer.DataBlocksUnavailable = op.DataBlocksUnavailable
+	peer.DataBlocksError = op.DataBlocksError
+	peer.ParityBlocksFetched = op.ParityBlocksFetched
+	peer.ParityBlocksCached = op.ParityBlocksCached
+	peer.ParityBlocksUnavailable = op.ParityBlocksUnavailable
+	peer.DataBlocksVerified = op.DataBlocksVerified
+	peer.DataBlocksCorrupted = op.DataBlocksCorrupted
+	peer.DataBlocksUnverified = op.DataBlocksUnverified
+	peer.Verification = op.Verification
 
 	repaired := 0
-	success := true
 	// check if all leaves have been repaired
 	for leaf, status := range op.RepairStatus {
-		success = success && status
 		if status {
-			s.collabData[op.FileCID].Peers[op.Origin].AllocatedBlocks[leaf] = true
+			peer.AllocatedBlocks[leaf] = true
 			repaired++
 		}
 	}
 
 	util.LogPrintf("Peer %s repaired %d/%d leaves for file %s", op.Origin, repaired, len(op.RepairStatus), op.FileCID)
 
-	if success {
-		s.collabData[op.FileCID].Peers[op.Origin].Status = SUCCESS
+	if job.Units[op.UnitID].Status == SUCCESS {
+		peer.Status = SUCCESS
 	} else {
-		s.collabData[op.FileCID].Peers[op.Origin].Status = FAILURE
-	}
-
-	// check if all peers have finished
-	allPeersDone := true
-	allPeersSucceeded := true
-	for _, peer := range s.collabData[op.FileCID].Peers {
-		allPeersDone = allPeersDone && (peer.Status != PENDING)
-		allPeersSucceeded = allPeersSucceeded && (peer.Status == SUCCESS)
-	}
-
-	if allPeersDone {
-		// update time and status of collabData
-		s.collabData[op.FileCID].EndTime = time.Now()
-		if allPeersSucceeded {
-			s.collabData[op.FileCID].Status = SUCCESS
-		} else {
-			s.collabData[op.FileCID].Status = FAILURE
-		}
-
-		util.LogPrintf("All peers finished unit repair for file %s with total time of %s", op.FileCID, s.collabData[op.FileCID].EndTime.Sub(s.collabData[op.FileCID].StartTime).String())
-		s.ReportMetrics(op.FileCID)
-		// check if there's origin for this file
-
-		if s.collabData[op.FileCID].Origin == "" {
-			util.LogPrintf("No origin for collaborative repair of file %s, so no need to report back", op.FileCID)
-			return
-		}
-
-		// send back the result to the origin
-		response := &CollaborativeRepairOperationResponse{
-			FileCID:      op.FileCID,
-			MetaCID:      op.MetaCID,
-			Origin:       s.address,
-			RepairStatus: success,
-		}
-
-		jsonResponse, err := json.Marshal(response)
-		if err != nil {
-			util.LogPrintf("Error in marshalling response for file %s - %s", op.FileCID, err)
-			return
-		}
-
-		// send the response back to the origin
-		PostJSON("http://"+s.collabData[op.FileCID].Origin+"/reportCollabRepair", jsonResponse)
-
+		peer.Status = FAILURE
 	}
 
+	return job
 }
 
-// function that takes in a StrandRepairOperation and starts the repair process
+// function that takes in a StrandRepairOperation and starts the repair process.
+// It runs on a strand repair worker
 func (s *Server) StartStrandRepair(op *StrandRepairOperation) {
-	s.RefreshClient()
-	s.client.IPFSConnector.SetTimeout(100 * time.Millisecond)
-	defer s.client.IPFSConnector.SetTimeout(0)
+	ctx, cancel := repairContext()
+	defer cancel()
+	client, err := s.RefreshClient(ctx)
+	if err != nil {
+		util.LogPrintf("Error in starting strand repair for file %s - %s", op.FileCID, err)
+		return
+	}
 	// get the failedIndices from the request
 	// trigger client.RepairFailedLeaves
 	// return the result from each of the failedIndices
 
-	// Check if same file is being repaired
-	// We'll assume that only one strand can be repaired at a time
-	if _, ok := s.strandData[op.FileCID]; ok && s.strandData[op.FileCID].Status == PENDING {
+	// a single monitor of the file coordinates the repair of the strand
+	resource := strandResource(op.FileCID, op.Strand)
+	if !s.coordinate(ctx, client, resource, op.MetaCID, &RepairTask{Strand: op}) {
 		return
 	}
 
-	// create a new entry in strandData
-	s.strandData[op.FileCID] = &StrandRepairData{
-		FileCID:   op.FileCID,
-		MetaCID:   op.MetaCID,
-		Strand:    op.Strand,
-		Status:    PENDING,
-		Depth:     op.Depth,
-		StartTime: time.Now(),
+	started := false
+	s.do(func() {
+		// Check if same file is being repaired
+		// We'll assume that only one strand can be repaired at a time
+		if data, ok := s.strandData[op.FileCID]; ok && data.Status == PENDING {
+			if data.Strand != op.Strand {
+				s.releaseCoordination(resource)
+			}
+			return
+		}
+
+		// create a new entry in strandData
+		s.strandData[op.FileCID] = &StrandRepairData{
+			JobID:     NewRepairJobID(),
+			FileCID:   op.FileCID,
+			MetaCID:   op.MetaCID,
+			Strand:    op.Strand,
+			Status:    PENDING,
+			Depth:     op.Depth,
+			StartTime: time.Now(),
+		}
+		s.saveStrandRepair(op.FileCID)
+		started = true
+	})
+	if !started {
+		return
 	}
 
 	// first create a new collab repair operation
@@ -471,50 +761,137 @@ func (s *Server) StartStrandRepair(op *StrandRepairOperation) {
 		Depth:    op.Depth,
 		Origin:   s.address,
 		NumPeers: 3, // should be variable but not as important here
+
+		forStrand: true,
 	}
 
 	// We need to make sure that file is data is actually available to be able to repair this strand
-	s.collabOps <- newOp
+	if s.submit(s.pools.Collab, func() { s.StartCollabRepair(newOp) }) != nil {
+		s.do(func() { s.failStrandRepair(op.FileCID) })
+	}
+}
+
+// failStrandRepair fails the pending strand repair of a file, if any. It runs on the daemon
+func (s *Server) failStrandRepair(fileCID string) {
+	data, ok := s.strandData[fileCID]
+	if !ok || data.Status != PENDING {
+		return
+	}
+
+	util.LogPrintf("Failing strand repair of file %s", fileCID)
+	data.Status = FAILURE
+	data.EndTime = time.Now()
+	s.saveStrandRepair(fileCID)
+	s.releaseCoordination(strandResource(fileCID, data.Strand))
 }
 
-// function that takes in *CollabOperationDone, updates its corresponding entry in strandData
+// function that takes in *CollabOperationDone, updates its corresponding entry in strandData.
+// It runs on a strand repair worker
 func (s *Server) ContinueStrandRepair(op *CollaborativeRepairDone) {
+	ctx, cancel := repairContext()
+	defer cancel()
+
+	var job *StrandRepairData
+	pending := false
+	s.do(func() {
+		job = s.strandData[op.FileCID]
+		if job == nil || job.Status != PENDING {
+			return
+		}
+		pending = true
+
+		// if the collab repair failed then we can need to fail the strand repair
+		if !op.RepairStatus {
+			job.Status = FAILURE
+			job.EndTime = time.Now()
+			s.saveStrandRepair(op.FileCID)
+			s.releaseCoordination(strandResource(op.FileCID, job.Strand))
+		}
+	})
 
 	// if we're not trying to repair any strands we could just ignore
-	if _, ok := s.strandData[op.FileCID]; !ok {
-		s.resetMonitorFile(op.FileCID, true)
+	if job == nil {
+		s.resetMonitorFile(ctx, op.FileCID, true)
 		return
 	}
 
 	// if the strand we're repairing somehow already finished then we can just ignore
-	if s.strandData[op.FileCID].Status != PENDING {
-		s.resetMonitorFile(op.FileCID, false)
+	if !pending {
+		s.resetMonitorFile(ctx, op.FileCID, false)
 		return
 	}
-
-	// if the collab repair failed then we can need to fail the strand repair
 	if !op.RepairStatus {
-		s.strandData[op.FileCID].Status = FAILURE
-		s.strandData[op.FileCID].EndTime = time.Now()
 		return
 	}
+	defer s.repairs.SetCancel(job.JobID, cancel)()
 
 	// if the collab repair succeeded then we can continue with the strand repair
 	// we just need to trigger client.RepairStrand
-	err := s.client.RepairStrand(op.FileCID, op.MetaCID, s.strandData[op.FileCID].Strand)
+	client, err := s.RefreshClient(ctx)
+	if err == nil {
+		err = client.RepairStrand(ctx, op.FileCID, op.MetaCID, job.Strand)
+	}
 
+	status := SUCCESS
 	if err != nil {
 		util.LogPrintf("Error in repairing strand for file %s - %s", op.FileCID, err)
-		s.strandData[op.FileCID].Status = FAILURE
-		s.strandData[op.FileCID].EndTime = time.Now()
-		s.resetMonitorFile(op.FileCID, true)
+		status = FAILURE
+	}
+	s.do(func() {
+		// the repair is left alone if it was cancelled meanwhile
+		if job.Status == PENDING {
+			job.Status = status
+			job.EndTime = time.Now()
+			s.saveStrandRepair(op.FileCID)
+		}
+	})
+	s.releaseCoordination(strandResource(op.FileCID, job.Strand))
 
-		return
+	// if we reach here with no error, then the strand repair succeeded
+	s.resetMonitorFile(ctx, op.FileCID, err != nil)
+}
+
+// CancelRepair stops the pending repair with the given ID. The peers working on the units of a cancelled
+// collaborative repair are not stopped, their reports are ignored
+func (s *Server) CancelRepair(id string) {
+	var cancelled *CollaborativeRepairData
+	s.do(func() { cancelled = s.cancelRepair(id) })
+	if cancelled != nil {
+		s.collabRepairDone(cancelled, false)
+	}
+}
+
+// cancelRepair settles the pending repair with the given ID as cancelled, and returns it if it is a
+// collaborative repair. It runs on the daemon
+func (s *Server) cancelRepair(id string) *CollaborativeRepairData {
+	for fileCID, job := range s.collabData {
+		if job.JobID != id || job.Status != PENDING {
+			continue
+		}
+
+		util.LogPrintf("Cancelling collaborative repair %s of file %s", id, fileCID)
+		job.Status = CANCELLED
+		job.EndTime = time.Now()
+		for _, unit := range job.Units {
+			if unit.Status == PENDING {
+				unit.Status = CANCELLED
+			}
+		}
+		s.saveCollabRepair(fileCID)
+		return job
 	}
 
-	// if we reach here, then the strand repair succeeded
-	s.strandData[op.FileCID].Status = SUCCESS
-	s.strandData[op.FileCID].EndTime = time.Now()
+	for fileCID, job := range s.strandData {
+		if job.JobID != id || job.Status != PENDING {
+			continue
+		}
 
-	s.resetMonitorFile(op.FileCID, false)
+		util.LogPrintf("Cancelling strand repair %s of file %s", id, fileCID)
+		job.Status = CANCELLED
+		job.EndTime = time.Now()
+		s.saveStrandRepair(fileCID)
+		s.releaseCoordination(strandResource(fileCID, job.Strand))
+		return nil
+	}
+	return nil
 }
@@ -0,0 +1,303 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const MaxRepairHistory = 256 // number of finished repairs kept by the registry
+
+const (
+	CollabRepairKind = "collaborative"
+	StrandRepairKind = "strand"
+)
+
+// LeafStatus is the progress of the repair of a failed leaf of a collaborative repair
+type LeafStatus struct {
+	Unit   string       `json:"unit"`
+	Peer   string       `json:"peer"` // last peer given the leaf
+	Status RepairStatus `json:"status"`
+}
+
+// RepairView is a snapshot of a repair, as returned by the repairs endpoints
+type RepairView struct {
+	ID        string       `json:"id"`
+	Kind      string       `json:"kind"`
+	FileCID   string       `json:"fileCID"`
+	MetaCID   string       `json:"metaCID"`
+	Status    RepairStatus `json:"status"`
+	State     string       `json:"state"` // name of the status
+	StartTime time.Time    `json:"startTime"`
+	EndTime   time.Time    `json:"endTime"`
+	Duration  string       `json:"duration"`
+	Strand    int          `json:"strand,omitempty"`
+
+	Peers  map[string]*CollabPeerInfo `json:"peers,omitempty"`
+	Units  map[string]*RepairUnit     `json:"units,omitempty"`
+	Leaves map[int]LeafStatus         `json:"leaves,omitempty"`
+}
+
+// Finished tells whether the repair reached its final status
+func (view *RepairView) Finished() bool {
+	return view.Status != PENDING
+}
+
+// summary returns the view without the breakdown by peer, unit and leaf
+func (view *RepairView) summary() *RepairView {
+	summary := *view
+	summary.Peers, summary.Units, summary.Leaves = nil, nil, nil
+	return &summary
+}
+
+func newRepairView(id string, kind string, fileCID string, metaCID string, status RepairStatus, start time.Time, end time.Time) *RepairView {
+	view := &RepairView{
+		ID:        id,
+		Kind:      kind,
+		FileCID:   fileCID,
+		MetaCID:   metaCID,
+		Status:    status,
+		State:     status.String(),
+		StartTime: start,
+		EndTime:   end,
+	}
+	if end.IsZero() {
+		view.Duration = time.Since(start).String()
+	} else {
+		view.Duration = end.Sub(start).String()
+	}
+	return view
+}
+
+// CollabRepairView returns a snapshot of a collaborative repair, with the status of each of its failed leaves
+func CollabRepairView(job *CollaborativeRepairData) *RepairView {
+	view := newRepairView(job.JobID, CollabRepairKind, job.FileCID, job.MetaCID, job.Status, job.StartTime, job.EndTime)
+
+	// the peers and units are copied, as the daemon keeps updating them
+	type breakdown struct {
+		Peers map[string]*CollabPeerInfo
+		Units map[string]*RepairUnit
+	}
+	var copied breakdown
+	encoded, err := json.Marshal(breakdown{job.Peers, job.Units})
+	if err == nil {
+		err = json.Unmarshal(encoded, &copied)
+	}
+	if err != nil {
+		return view
+	}
+	view.Peers, view.Units = copied.Peers, copied.Units
+
+	view.Leaves = make(map[int]LeafStatus)
+	for _, unit := range view.Units {
+		for _, leaf := range unit.FailedIndices {
+			status := LeafStatus{Unit: unit.ID, Peer: unit.Peer, Status: unit.Status}
+			if len(unit.Assignees) > 0 && status.Peer == "" {
+				status.Peer = unit.Assignees[len(unit.Assignees)-1]
+			}
+			if peer, ok := view.Peers[status.Peer]; ok && peer.AllocatedBlocks[leaf] {
+				status.Status = SUCCESS
+			} else if status.Status == SUCCESS {
+				// the peer reported the unit without this leaf
+				status.Status = FAILURE
+			}
+			view.Leaves[leaf] = status
+		}
+	}
+	return view
+}
+
+// StrandRepairView returns a snapshot of a strand repair
+func StrandRepairView(job *StrandRepairData) *RepairView {
+	view := newRepairView(job.JobID, StrandRepairKind, job.FileCID, job.MetaCID, job.Status, job.StartTime, job.EndTime)
+	view.Strand = job.Strand
+	return view
+}
+
+// RepairRegistry keeps the snapshots of the repairs of the node, for the repairs endpoints.
+// It is safe for concurrent use
+type RepairRegistry struct {
+	lock        sync.Mutex
+	views       map[string]*RepairView
+	finished    []string // IDs of the finished repairs, oldest first
+	subscribers map[string]map[chan *RepairView]struct{}
+	cancels     map[string]context.CancelFunc
+}
+
+func NewRepairRegistry() *RepairRegistry {
+	return &RepairRegistry{
+		views:       make(map[string]*RepairView),
+		subscribers: make(map[string]map[chan *RepairView]struct{}),
+		cancels:     make(map[string]context.CancelFunc),
+	}
+}
+
+// Publish records the snapshot of a repair and sends it to the subscribers of the repair. It tells whether the
+// snapshot is the first one of the repair once finished
+func (r *RepairRegistry) Publish(view *RepairView) bool {
+	if view.ID == "" {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	previous, known := r.views[view.ID]
+	r.views[view.ID] = view
+	finished := view.Finished() && (!known || !previous.Finished())
+	if finished {
+		r.finished = append(r.finished, view.ID)
+		for len(r.finished) > MaxRepairHistory {
+			delete(r.views, r.finished[0])
+			r.finished = r.finished[1:]
+		}
+	}
+
+	// subscribers only need the latest snapshot, so an unread one is replaced
+	for subscriber := range r.subscribers[view.ID] {
+		select {
+		case <-subscriber:
+		default:
+		}
+		subscriber <- view
+	}
+	return finished
+}
+
+// Get returns the snapshot of a repair
+func (r *RepairRegistry) Get(id string) (*RepairView, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	view, ok := r.views[id]
+	return view, ok
+}
+
+// List returns the summaries of the repairs, latest first
+func (r *RepairRegistry) List() []*RepairView {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	views := make([]*RepairView, 0, len(r.views))
+	for _, view := range r.views {
+		views = append(views, view.summary())
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].StartTime.After(views[j].StartTime) })
+	return views
+}
+
+// Subscribe returns a channel receiving the snapshots of a repair, starting with the current one,
+// and the function to call once done with it
+func (r *RepairRegistry) Subscribe(id string) (<-chan *RepairView, func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	subscriber := make(chan *RepairView, 1)
+	if view, ok := r.views[id]; ok {
+		subscriber <- view
+	}
+	if r.subscribers[id] == nil {
+		r.subscribers[id] = make(map[chan *RepairView]struct{})
+	}
+	r.subscribers[id][subscriber] = struct{}{}
+
+	return subscriber, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		delete(r.subscribers[id], subscriber)
+		if len(r.subscribers[id]) == 0 {
+			delete(r.subscribers, id)
+		}
+	}
+}
+
+// SetCancel registers the function cancelling the operation running for a repair, until the returned function
+// is called
+func (r *RepairRegistry) SetCancel(id string, cancel context.CancelFunc) func() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.cancels[id] = cancel
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		delete(r.cancels, id)
+	}
+}
+
+// Cancel cancels the operation running for a repair, if any
+func (r *RepairRegistry) Cancel(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if cancel, ok := r.cancels[id]; ok {
+		cancel()
+	}
+}
+
+// listRepairs
+// Lists the repairs known to the node, latest first
+func listRepairs(s *Server, c *gin.Context) {
+	c.JSON(200, gin.H{"repairs": s.repairs.List()})
+}
+
+// getRepair
+// Path parameters: id (repair ID)
+func getRepair(s *Server, c *gin.Context) {
+	view, ok := s.repairs.Get(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"message": "Unknown repair"})
+		return
+	}
+	c.JSON(200, view)
+}
+
+// cancelRepair
+// Path parameters: id (repair ID)
+func cancelRepair(s *Server, c *gin.Context) {
+	id := c.Param("id")
+	view, ok := s.repairs.Get(id)
+	if !ok {
+		c.JSON(404, gin.H{"message": "Unknown repair"})
+		return
+	}
+	if view.Finished() {
+		c.JSON(409, gin.H{"message": "Repair already " + view.State})
+		return
+	}
+
+	// stop the operation running for the repair, then settle it
+	s.repairs.Cancel(id)
+	s.CancelRepair(id)
+
+	c.JSON(202, gin.H{"message": "Cancel op."})
+}
+
+// streamRepair
+// Path parameters: id (repair ID)
+// Streams the snapshots of the repair as server-sent events until it is finished
+func streamRepair(s *Server, c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := s.repairs.Get(id); !ok {
+		c.JSON(404, gin.H{"message": "Unknown repair"})
+		return
+	}
+
+	updates, unsubscribe := s.repairs.Subscribe(id)
+	defer unsubscribe()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case view := <-updates:
+			c.SSEvent("repair", view)
+			return !view.Finished()
+		}
+	})
+}
@@ -1,11 +1,15 @@
 package Server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"ipfs-alpha-entanglement-code/client"
+	"ipfs-alpha-entanglement-code/entangler"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
 	"ipfs-alpha-entanglement-code/util"
 	"log"
+	"sort"
 	"strconv"
 	"time"
 
@@ -20,106 +24,115 @@ func (s *Server) setUpServer() {
 	s.ginEngine = gin.Default()
 
 	// monitoring endpoints
-	s.ginEngine.POST("/forwardMonitoring", func(c *gin.Context) { forwardMonitoring(s, c) })
-	s.ginEngine.POST("/startMonitorFile", func(c *gin.Context) { startMonitorFile(s, c) })
-	s.ginEngine.POST("/stopMonitorFile", func(c *gin.Context) { stopMonitorFile(s, c) })
-	s.ginEngine.POST("/resetMonitorFile", func(c *gin.Context) { resetMonitorFile(s, c) })
-	s.ginEngine.GET("/listMonitor", func(c *gin.Context) { listMonitor(s, c) })
-	s.ginEngine.GET("/checkFileStatus", func(c *gin.Context) { checkFileStatus(s, c) })
-	s.ginEngine.GET("/checkClusterStatus", func(c *gin.Context) { checkClusterStatus(s, c) })
-	s.ginEngine.POST("/updateView", func(c *gin.Context) { prepareUpdateView(s, c) })
-	s.ginEngine.GET("/recomputeHealth", func(c *gin.Context) { recomputeHealth(s, c) })
+	s.ginEngine.POST("/forwardMonitoring", s.authorize(OperatorAccess), func(c *gin.Context) { forwardMonitoring(s, c) })
+	s.ginEngine.POST("/startMonitorFile", s.authorize(PeerAccess), func(c *gin.Context) { startMonitorFile(s, c) })
+	s.ginEngine.POST("/stopMonitorFile", s.authorize(OperatorAccess), func(c *gin.Context) { stopMonitorFile(s, c) })
+	s.ginEngine.POST("/resetMonitorFile", s.authorize(SignedAccess), func(c *gin.Context) { resetMonitorFile(s, c) })
+	s.ginEngine.GET("/listMonitor", s.authorize(PublicAccess), func(c *gin.Context) { listMonitor(s, c) })
+	s.ginEngine.GET("/checkFileStatus", s.authorize(PublicAccess), func(c *gin.Context) { checkFileStatus(s, c) })
+	s.ginEngine.GET("/checkClusterStatus", s.authorize(PublicAccess), func(c *gin.Context) { checkClusterStatus(s, c) })
+	s.ginEngine.POST("/updateView", s.authorize(PeerAccess), func(c *gin.Context) { prepareUpdateView(s, c) })
+	s.ginEngine.GET("/recomputeHealth", s.authorize(OperatorAccess), func(c *gin.Context) { recomputeHealth(s, c) })
 
 	// repair endpoints
-	s.ginEngine.GET("/downloadFile", func(c *gin.Context) { downloadFile(s, c) })
-	s.ginEngine.POST("/triggerCollabRepair", func(c *gin.Context) { triggerCollabRepair(s, c) })
-	s.ginEngine.POST("/triggerUnitRepair", func(c *gin.Context) { triggerUnitRepair(s, c) })
-	s.ginEngine.POST("/triggerStrandRepair", func(c *gin.Context) { triggerStrandRepair(s, c) })
-	s.ginEngine.POST("/reportUnitRepair", func(c *gin.Context) { reportUnitRepair(s, c) })
-	s.ginEngine.POST("/reportCollabRepair", func(c *gin.Context) { reportCollabRepair(s, c) })
+	s.ginEngine.GET("/downloadFile", s.authorize(OperatorAccess), func(c *gin.Context) { downloadFile(s, c) })
+	s.ginEngine.POST("/triggerCollabRepair", s.authorize(OperatorAccess), func(c *gin.Context) { triggerCollabRepair(s, c) })
+	s.ginEngine.POST("/triggerUnitRepair", s.authorize(PeerAccess), func(c *gin.Context) { triggerUnitRepair(s, c) })
+	s.ginEngine.POST("/triggerStrandRepair", s.authorize(OperatorAccess), func(c *gin.Context) { triggerStrandRepair(s, c) })
+	s.ginEngine.POST("/reportUnitRepair", s.authorize(PeerAccess), func(c *gin.Context) { reportUnitRepair(s, c) })
+	s.ginEngine.POST("/reportCollabRepair", s.authorize(PeerAccess), func(c *gin.Context) { reportCollabRepair(s, c) })
+	s.ginEngine.GET("/repairs", s.authorize(PublicAccess), func(c *gin.Context) { listRepairs(s, c) })
+	s.ginEngine.GET("/repairs/:id", s.authorize(PublicAccess), func(c *gin.Context) { getRepair(s, c) })
+	s.ginEngine.DELETE("/repairs/:id", s.authorize(OperatorAccess), func(c *gin.Context) { cancelRepair(s, c) })
+	s.ginEngine.GET("/repairs/:id/events", s.authorize(PublicAccess), func(c *gin.Context) { streamRepair(s, c) })
+
+	// membership endpoints
+	s.ginEngine.POST("/swim/ping", s.authorize(PeerAccess), func(c *gin.Context) { swimPing(s, c) })
+	s.ginEngine.POST("/swim/ping-req", s.authorize(PeerAccess), func(c *gin.Context) { swimPingReq(s, c) })
+	s.ginEngine.GET("/members", s.authorize(PublicAccess), func(c *gin.Context) { listMembers(s, c) })
+
+	// coordination endpoints
+	s.ginEngine.POST("/lease/request", s.authorize(PeerAccess), func(c *gin.Context) { requestLease(s, c) })
+	s.ginEngine.POST("/lease/release", s.authorize(PeerAccess), func(c *gin.Context) { releaseLease(s, c) })
+	s.ginEngine.GET("/leases", s.authorize(PublicAccess), func(c *gin.Context) { listLeases(s, c) })
 
 	s.ginEngine.GET("/health-check", func(c *gin.Context) { c.Status(200) })
+	s.ginEngine.GET("/metrics", func(c *gin.Context) { serveMetrics(s, c) })
+	s.ginEngine.GET("/openapi.json", func(c *gin.Context) { c.Data(200, "application/json", OpenAPISpec) })
 
 	// init state
 	s.ctx = make(chan struct{})
-	s.operations = make(chan Operation)
+	s.stateOps = make(chan stateOp, StateQueueSize)
+	s.pools = NewPools()
 	s.state = State{files: make(map[string]*FileStats),
+		inspecting:                  make(map[string]struct{}),
+		viewAcks:                    make(map[string]map[string]uint64),
 		potentialFailedRegions:      make(map[string][]string),
 		unavailableBlocksTimestamps: make([]int64, 0)}
 	s.state.unavailableBlocksTimestamps = append(s.state.unavailableBlocksTimestamps, time.Now().UnixNano())
-	serverClient, err := client.NewClient(s.clusterIP, s.clusterPort, s.ipfsIP, s.ipfsPort)
+	ctx, cancel := monitorContext()
+	defer cancel()
+	serverClient, err := client.NewClient(ctx, s.clusterIP, s.clusterPort, s.ipfsIP, s.ipfsPort)
 	if err != nil {
 		log.Println("Error creating Server client: ", err)
 	}
 	s.client = serverClient
 	s.repairThreshold = HealthRepairThreshold
-	// s.ipConverter = &docker.DockerClusterToCommunityConverter{}
-	s.collabOps = make(chan *CollaborativeRepairOperation)
-	s.collabDone = make(chan *CollaborativeRepairDone)
-	s.unitOps = make(chan *UnitRepairOperation)
-	s.unitDone = make(chan *UnitRepairDone)
-	s.strandOps = make(chan *StrandRepairOperation)
 	s.collabData = make(map[string]*CollaborativeRepairData)
 	s.strandData = make(map[string]*StrandRepairData)
+	s.repairs = NewRepairRegistry()
+	s.metrics = NewServerMetrics()
 }
 
+// AnnounceSelf makes the node known to the other community nodes through its discovery backend
 func (s *Server) AnnounceSelf() error {
-	// announce self to discovery server
-	// send an http post request to discovery server
-	/*
-			takes the following as parameters:
-
-			communityIP
-		    clusterIP
-		    clusterPort
-		    ipfsIP
-		    ipfsPort
-
-	*/
-
-	baseURL := fmt.Sprintf("http://%s/announce", s.discoveryAddress)
-
-	body := &CommunityNodeAnnouncement{
+	ctx, cancel := monitorContext()
+	defer cancel()
+	return s.discovery.Announce(ctx, CommunityNodeAnnouncement{
 		CommunityIP: s.address,
 		ClusterIP:   s.clusterIP,
 		ClusterPort: s.clusterPort,
 		IpfsIP:      s.ipfsIP,
 		IpfsPort:    s.ipfsPort,
-	}
-
-	jsonResponse, err := json.Marshal(body)
-	if err != nil {
-		util.LogPrintf("Error in marshalling body for community node announcement %s - %s", s.address, err)
-	}
-
-	// send the response back to the origin
-	status, err := PostJSON(baseURL, jsonResponse)
-
-	if err != nil {
-		return fmt.Errorf("error announcing oneself: %v", err)
-	}
-
-	if status != 200 {
-		return fmt.Errorf("error announcing oneself, status not 200 but: %d", status)
-	}
-
-	return nil
+	})
 }
 
 // RunServer
 // @Description: Run the server (blocking)
 // @param port: The port to listen on
-func (s *Server) RunServer(port int, communityIP string, clusterIP string, clusterPort int, IpfsIP string, IpfsPort int, discovery string) int {
+// @param discovery: The address of the discovery service, used as discovery backend unless SetDiscovery was called
+// @param stateDir: The directory where the state is persisted, kept in memory only if empty
+func (s *Server) RunServer(port int, communityIP string, clusterIP string, clusterPort int, IpfsIP string, IpfsPort int, discovery string, stateDir string) int {
 	s.clusterIP = clusterIP
 	s.clusterPort = clusterPort
 	s.ipfsIP = IpfsIP
 	s.ipfsPort = IpfsPort
 	s.discoveryAddress = discovery
+	if s.discovery == nil {
+		s.discovery = &HTTPDiscovery{Address: discovery}
+	}
 
 	s.setUpServer()
 
+	if len(stateDir) > 0 {
+		store, err := OpenStore(stateDir)
+		if err != nil {
+			util.LogPrintf("Error opening the state store: %v", err)
+			return 1
+		}
+		defer store.Close()
+		s.store = store
+		s.loadState()
+	}
+
 	s.address = fmt.Sprintf("%s:%d", communityIP, port)
 	util.LogPrintf("Server listening on %s", s.address)
+	if err := s.enableAuth(); err != nil {
+		util.LogPrintf("Error setting up the authentication: %v", err)
+		return 1
+	}
+	s.enableMembership()
+	s.enableLeases()
 
 	// announce self to discovery server
 	err := s.AnnounceSelf()
@@ -130,6 +143,9 @@ func (s *Server) RunServer(port int, communityIP string, clusterIP string, clust
 
 	// Starting daemon
 	go Daemon(s)
+	go s.runMembership()
+	go s.runLeases()
+	defer s.pools.Close()
 	defer close(s.ctx)
 
 	err = s.ginEngine.Run(fmt.Sprintf(":%d", port)) // blocking
@@ -155,15 +171,19 @@ func forwardMonitoring(s *Server, c *gin.Context) {
 		StrandRootCIDs: monitoringRequest.StrandRootCIDs,
 	}
 
-	s.RefreshClient()
-	s.client.SetTimeout(2 * time.Second)
-	defer s.client.SetTimeout(0)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), MonitorTimeout)
+	defer cancel()
+	client, err := s.RefreshClient(ctx)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"message": err.Error()})
+		return
+	}
 
 	time.Sleep(5 * time.Second) // give time to allocation to succeed
 
 	// for strandRoot in strandCIDs: -> peers = c.IPFSClusterConnector.GetPinAllocations(strandRoot)
 	for _, strandRoot := range monitoringRequest.StrandRootCIDs {
-		peers, err := s.client.IPFSClusterConnector.GetPinAllocations(strandRoot)
+		peers, err := client.IPFSClusterConnector.GetPinAllocations(ctx, strandRoot)
 
 		if err != nil {
 			log.Printf("Couldn't start tracking for root CID: %s\n", strandRoot)
@@ -205,7 +225,7 @@ func forwardMonitoring(s *Server, c *gin.Context) {
 				continue
 			}
 
-			status, err := PostJSON("http://"+communityPeerAddress+fmt.Sprintf("/startMonitorFile"), body)
+			status, err := s.postJSON("http://"+communityPeerAddress+"/startMonitorFile", body)
 			if err != nil {
 				log.Println("Status: ", status, "Error: ", err)
 			} else {
@@ -225,12 +245,9 @@ func startMonitorFile(s *Server, c *gin.Context) {
 		return
 	}
 
-	param, err := json.Marshal(request)
-	if err != nil {
-		c.JSON(400, gin.H{"message": "Malformated parameters"})
+	if !s.submitRequest(c, s.pools.Inspection, func() { s.startMonitoring(request) }) {
 		return
 	}
-	s.operations <- Operation{START_MONITOR_FILE, param}
 
 	c.JSON(200, gin.H{"message": "Start op."})
 }
@@ -245,13 +262,7 @@ func stopMonitorFile(s *Server, c *gin.Context) {
 		return
 	}
 
-	param, err := json.Marshal(request)
-	if err != nil {
-		c.JSON(400, gin.H{"message": "Malformated parameters"})
-		return
-	}
-
-	s.operations <- Operation{STOP_MONITOR_FILE, param}
+	s.do(func() { s.stopMonitoring(request.FileCID) })
 
 	c.JSON(200, gin.H{"message": "Stop op."})
 }
@@ -264,20 +275,14 @@ func resetMonitorFile(s *Server, c *gin.Context) {
 		return
 	}
 
-	param, err := json.Marshal(request)
-	if err != nil {
-		c.JSON(400, gin.H{"message": "Malformated parameters"})
-		return
-	}
-
-	s.operations <- Operation{RESET_MONITOR_FILE, param}
+	s.do(func() { s.resetMonitoring(request) })
 
 	c.JSON(200, gin.H{"message": "Reset op."})
 }
 
 // resetMonitorFile
 // reset stats for file (fileCID) after repair
-func (s *Server) resetMonitorFile(fileCID string, isData bool) {
+func (s *Server) resetMonitorFile(ctx context.Context, fileCID string, isData bool) {
 	request := ResetMonitoringRequest{
 		FileCID: fileCID,
 		IsData:  isData,
@@ -290,7 +295,18 @@ func (s *Server) resetMonitorFile(fileCID string, isData bool) {
 	}
 
 	// send reset op. to all monitor nodes for this file
-	metaData, err := s.client.GetMetaData(s.state.files[fileCID].MetadataCID)
+	var metadataCID string
+	s.do(func() {
+		if stats, in := s.state.files[fileCID]; in {
+			metadataCID = stats.MetadataCID
+		}
+	})
+	client := s.currentClient()
+	if metadataCID == "" || client == nil {
+		log.Println("Could not reset the monitoring of file: ", fileCID)
+		return
+	}
+	metaData, err := client.GetMetaData(ctx, metadataCID)
 
 	if err != nil {
 		println("Could not fetch the metadata: ", err.Error())
@@ -298,7 +314,7 @@ func (s *Server) resetMonitorFile(fileCID string, isData bool) {
 	}
 
 	for _, root := range metaData.TreeCIDs {
-		peers, err := s.client.IPFSClusterConnector.GetPinAllocations(root)
+		peers, err := client.IPFSClusterConnector.GetPinAllocations(ctx, root)
 
 		if err != nil {
 			log.Printf("Couldn't start tracking for root CID: %s\n", root)
@@ -317,7 +333,7 @@ func (s *Server) resetMonitorFile(fileCID string, isData bool) {
 				continue
 			}
 
-			status, err := PostJSON("http://"+communityPeerAddress+fmt.Sprintf("/resetMonitorFile"), param)
+			status, err := s.postJSON("http://"+communityPeerAddress+"/resetMonitorFile", param)
 			if err != nil {
 				log.Println("Status: ", status, "Error: ", err)
 			}
@@ -326,24 +342,18 @@ func (s *Server) resetMonitorFile(fileCID string, isData bool) {
 
 }
 
+// listMonitor
+// Lists the monitored files
 func listMonitor(s *Server, c *gin.Context) {
-	s.stateMux.Lock()
-	defer s.stateMux.Unlock()
-
-	// gather CIDs of files being monitored
-	cids := ""
-
-	if len(s.state.files) == 0 {
-		c.JSON(200, gin.H{"message": "No monitored CIDs"})
-		return
-	}
-
-	for file, stats := range s.state.files {
-		cids += " - CID=" + file + "-[BlockProb = " +
-			strconv.FormatFloat(float64(stats.EstimatedBlockProb*100), 'f', -1, 64) + "%]\n"
-	}
+	files := make([]FileSummary, 0)
+	s.do(func() {
+		for _, stats := range s.state.files {
+			files = append(files, stats.Summary())
+		}
+	})
 
-	c.JSON(200, gin.H{"Result": "Listing monitored CIDs: " + cids[:len(cids)-1]})
+	sort.Slice(files, func(i, j int) bool { return files[i].FileCID < files[j].FileCID })
+	c.JSON(200, gin.H{"files": files})
 }
 
 // checkFileStatus
@@ -355,78 +365,76 @@ func checkFileStatus(s *Server, c *gin.Context) {
 		return
 	}
 
-	stats, in := s.state.files[fileCID]
+	var status FileStatus
+	var in bool
+	s.do(func() {
+		var stats *FileStats
+		if stats, in = s.state.files[fileCID]; in {
+			status = stats.Status()
+		}
+	})
 
 	if !in {
-		c.JSON(400, gin.H{"message": "File not monitored or invalid CID"})
+		c.JSON(404, gin.H{"message": "File not monitored or invalid CID"})
 		return
 	}
-
-	// Pack stats in string
-	ret := "=====================================\n"
-	ret += " * FileCID: " + stats.fileCID + "\n"
-	ret += " * MetadataCID: " + stats.MetadataCID + "\n"
-	ret += " * StrandRootCID: " + stats.StrandRootCID + "\n"
-	ret += " * StrandNumber: " + strconv.Itoa(stats.strandNumber) + "\n"
-	ret += " * Nb of data blocks missing: " + fmt.Sprint(len(stats.DataBlocksMissing)) + "\n"
-	ret += " * Nb of parity blocks missing: " + fmt.Sprint(len(stats.ParityBlocksMissing)) + "\n"
-	ret += " * EstimatedBlockProb: " + strconv.FormatFloat(float64(stats.EstimatedBlockProb*100), 'f', -1, 64) + "%\n"
-	ret += " * Health: " + strconv.FormatFloat(float64(stats.Health*100), 'f', -1, 64) + "%\n"
-	ret += "=====================================\n"
-
-	c.JSON(200, gin.H{"Result": ret})
+	c.JSON(200, status)
 }
 
 // checkClusterStatus
 func checkClusterStatus(s *Server, c *gin.Context) {
-	// Pack state in string
-	ret := "=====================================\n"
-	ret += " * ClusterIP: " + s.clusterIP + "\n"
-	ret += " * ClusterPort: " + strconv.Itoa(s.clusterPort) + "\n"
-	ret += " * PotentialFailedRegions: " + fmt.Sprint(s.state.potentialFailedRegions) + "\n"
-
-	cntMissing := len(s.state.unavailableBlocksTimestamps) - 1
-
-	ret += " * Number detected missing blocks: " + fmt.Sprint(cntMissing) + "\n"
-
-	if cntMissing > 0 {
-		sumIntervals := 0
-		for i := 0; i < cntMissing; i++ {
-			sumIntervals += int(s.state.unavailableBlocksTimestamps[i+1] - s.state.unavailableBlocksTimestamps[i])
-		}
-		avgIntervalsNano := float64(sumIntervals) / float64(cntMissing)
-		avgIntervals := time.Duration(avgIntervalsNano)
+	var status ClusterStatus
+	s.do(func() { status = s.clusterStatus() })
 
-		ret += " * Average time between detected missing blocks: " + fmt.Sprint(avgIntervals) + " \n"
-	}
-	ret += "=====================================\n"
-	c.JSON(200, gin.H{"Result": ret})
+	c.JSON(200, status)
 }
 
 // Query parameters in context: fileCID (CID-string)
 func prepareUpdateView(s *Server, c *gin.Context) {
 	fileCID := c.Query("fileCID")
+	if fileCID == "" {
+		c.JSON(400, gin.H{"message": "Invalid CID parameter"})
+		return
+	}
 
-	var updateViewArgs FileStats
+	var update ViewUpdate
 	// parse args
-	if err := c.ShouldBindJSON(&updateViewArgs); err != nil {
+	if err := c.ShouldBindJSON(&update); err != nil || update.View == nil {
 		c.JSON(400, gin.H{"message": "Missing parameters"})
 		return
 	}
 
-	updateViewArgs = FileStats{
-		StrandRootCID:       updateViewArgs.StrandRootCID,
-		DataBlocksMissing:   updateViewArgs.DataBlocksMissing,
-		ParityBlocksMissing: updateViewArgs.ParityBlocksMissing,
-		EstimatedBlockProb:  updateViewArgs.EstimatedBlockProb,
-		Health:              updateViewArgs.Health,
+	// the view must come from a peer storing the strand, as known by the node if it monitors the file
+	strandRootCID := update.StrandRootCID
+	s.do(func() {
+		if stats, in := s.state.files[fileCID]; in {
+			strandRootCID = stats.StrandRootCID
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), MonitorRequestTimeout)
+	defer cancel()
+	if err := s.checkViewSource(ctx, c, strandRootCID); err != nil {
+		util.LogPrintf("Rejecting view of file %s from %s - %s", fileCID, c.GetString(signerKey), err)
+		c.JSON(403, gin.H{"message": "Sender not allocated the strand of the file"})
+		return
 	}
 
-	s.UpdateView(fileCID, &updateViewArgs)
-	c.JSON(503, gin.H{"message": "file view updated"})
+	merged, err := s.UpdateView(fileCID, &update)
+	if err != nil {
+		c.Header("Retry-After", RetryAfterSeconds)
+		c.JSON(429, gin.H{"message": "Too many operations queued to start monitoring the file, retry later"})
+		return
+	}
+	if !merged {
+		c.JSON(202, gin.H{"message": "monitoring of the file started, view not merged"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "file view updated"})
 }
 
-// Query parameters in context: rootFileCID (CID-string), metadataCID (CID-string), path (string), uploadRecoverData (bool)
+// Query parameters in context: rootFileCID (CID-string), metadataCID (CID-string), path (string), uploadRecoverData (bool),
+// recovery (sequential, parallel or hybrid)
 func downloadFile(s *Server, c *gin.Context) {
 	startTime := time.Now()
 	rootFileCID := c.Query("rootFileCID")
@@ -437,23 +445,32 @@ func downloadFile(s *Server, c *gin.Context) {
 	if err != nil {
 		depth = 1
 	}
+	recoveryMode, err := entangler.ParseRecoveryMode(c.Query("recovery"))
+	if err != nil {
+		c.Data(400, "application/octet-stream", []byte(err.Error()))
+		return
+	}
 
-	s.RefreshClient()
+	ctx := ipfsconnector.WithBlockTimeout(c.Request.Context(), RepairRequestTimeout)
+	serverClient, err := s.RefreshClient(ctx)
+	if err != nil {
+		c.Data(errorStatus(err), "application/octet-stream", []byte(err.Error()))
+		return
+	}
 
 	options := client.DownloadOption{
 		UploadRecoverData: uploadRecoverData == "true",
 		MetaCID:           metadataCID,
+		RecoveryMode:      recoveryMode,
 	}
 
-	s.client.SetTimeout(100 * time.Millisecond)
-	defer s.client.SetTimeout(0)
 	status := PENDING
-	data, getter, err := s.client.Download(rootFileCID, path, options, uint(depth))
+	data, getter, err := serverClient.Download(ctx, rootFileCID, path, options, uint(depth))
 	endTime := time.Now()
 
 	if err != nil {
 		c.Header("Content-Disposition", "attachment; filename="+path)
-		c.Data(400, "application/octet-stream", []byte(err.Error()))
+		c.Data(errorStatus(err), "application/octet-stream", []byte(err.Error()))
 		status = FAILURE
 	} else {
 		c.Header("Content-Disposition", "attachment; filename="+path)
@@ -461,6 +478,8 @@ func downloadFile(s *Server, c *gin.Context) {
 		status = SUCCESS
 	}
 
+	s.observeGetter(DownloadGetter, getter)
+
 	// Only report metrics if depth > 1 (actually doing some kind of repair)
 	if depth > 1 {
 		s.ReportDownloadMetrics(getter, &startTime, &endTime, status)
@@ -482,7 +501,9 @@ func triggerCollabRepair(s *Server, c *gin.Context) {
 		NumPeers: opRequest.NumPeers,
 	}
 
-	s.collabOps <- newOp
+	if !s.submitRequest(c, s.pools.Collab, func() { s.StartCollabRepair(newOp) }) {
+		return
+	}
 
 	c.JSON(200, gin.H{"message": "Collab repair triggered"})
 }
@@ -493,8 +514,14 @@ func triggerUnitRepair(s *Server, c *gin.Context) {
 		c.JSON(400, gin.H{"message": "Missing parameters"})
 		return
 	}
+	if !s.signedBy(c, opRequest.Origin) {
+		c.JSON(403, gin.H{"message": "Origin does not match the signer of the request"})
+		return
+	}
 
 	newOp := &UnitRepairOperation{
+		JobID:         opRequest.JobID,
+		UnitID:        opRequest.UnitID,
 		FileCID:       opRequest.FileCID,
 		MetaCID:       opRequest.MetaCID,
 		FailedIndices: opRequest.FailedIndices,
@@ -502,7 +529,9 @@ func triggerUnitRepair(s *Server, c *gin.Context) {
 		Origin:        opRequest.Origin,
 	}
 
-	s.unitOps <- newOp
+	if !s.submitRequest(c, s.pools.Unit, func() { s.StartUnitRepair(newOp) }) {
+		return
+	}
 
 	c.JSON(200, gin.H{"message": "Unit repair triggered"})
 
@@ -522,7 +551,9 @@ func triggerStrandRepair(s *Server, c *gin.Context) {
 		Depth:   opRequest.Depth,
 	}
 
-	s.strandOps <- newOp
+	if !s.submitRequest(c, s.pools.Strand, func() { s.StartStrandRepair(newOp) }) {
+		return
+	}
 
 	c.JSON(200, gin.H{"message": "Strand repair triggered"})
 }
@@ -533,8 +564,14 @@ func reportUnitRepair(s *Server, c *gin.Context) {
 		c.JSON(400, gin.H{"message": "Missing parameters"})
 		return
 	}
+	if !s.signedBy(c, opResponse.Origin) {
+		c.JSON(403, gin.H{"message": "Origin does not match the signer of the request"})
+		return
+	}
 
 	newOp := &UnitRepairDone{
+		JobID:                   opResponse.JobID,
+		UnitID:                  opResponse.UnitID,
 		FileCID:                 opResponse.FileCID,
 		MetaCID:                 opResponse.MetaCID,
 		Origin:                  opResponse.Origin,
@@ -548,9 +585,14 @@ func reportUnitRepair(s *Server, c *gin.Context) {
 		ParityBlocksCached:      opResponse.ParityBlocksCached,
 		ParityBlocksUnavailable: opResponse.ParityBlocksUnavailable,
 		ParityBlocksError:       opResponse.ParityBlocksError,
+		DataBlocksVerified:      opResponse.DataBlocksVerified,
+		DataBlocksCorrupted:     opResponse.DataBlocksCorrupted,
+		DataBlocksUnverified:    opResponse.DataBlocksUnverified,
+		Verification:            opResponse.Verification,
 	}
 
-	s.unitDone <- newOp
+	// reports are not queued, as a peer does not send them again
+	s.ReportUnitRepair(newOp)
 }
 
 func reportCollabRepair(s *Server, c *gin.Context) {
@@ -559,6 +601,10 @@ func reportCollabRepair(s *Server, c *gin.Context) {
 		c.JSON(400, gin.H{"message": "Missing parameters"})
 		return
 	}
+	if !s.signedBy(c, opResponse.Origin) {
+		c.JSON(403, gin.H{"message": "Origin does not match the signer of the request"})
+		return
+	}
 
 	newOp := &CollaborativeRepairDone{
 		FileCID:      opResponse.FileCID,
@@ -567,39 +613,45 @@ func reportCollabRepair(s *Server, c *gin.Context) {
 		RepairStatus: opResponse.RepairStatus,
 	}
 
-	s.collabDone <- newOp
+	s.submitRequest(c, s.pools.Strand, func() { s.ContinueStrandRepair(newOp) })
 }
 
 // recomputeHealth
 // Query parameters in context: fileCID (CID-string)
 func recomputeHealth(s *Server, c *gin.Context) {
-	s.stateMux.Lock()
-	defer s.stateMux.Unlock()
-
 	fileCID := c.Query("fileCID")
 	if fileCID == "" {
 		c.JSON(400, gin.H{"message": "Invalid CID parameter"})
 		return
 	}
-	stats, in := s.state.files[fileCID]
-	if !in {
-		c.JSON(400, gin.H{"message": "File not monitored or invalid CID"})
+	var base *FileStats
+	s.do(func() { base = s.state.files[fileCID] })
+	if base == nil {
+		c.JSON(404, gin.H{"message": "File not monitored or invalid CID"})
 		return
 	}
 
-	s.RefreshClient()
-	s.client.SetTimeout(1 * time.Second)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), MonitorTimeout)
+	defer cancel()
+	ctx = ipfsconnector.WithBlockTimeout(ctx, time.Second)
+	serverClient, err := s.RefreshClient(ctx)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"message": err.Error()})
+		return
+	}
 
-	_, _, lattice, _, _, err := s.client.PrepareRepair(fileCID, stats.MetadataCID, 2)
+	_, _, lattice, _, _, err := serverClient.PrepareRepair(ctx, fileCID, base.MetadataCID, 2)
 
 	if err != nil {
 		println("Could not generate lattice: ", err.Error())
+		c.JSON(errorStatus(err), gin.H{"message": "Could not generate lattice: " + err.Error()})
 		return
 	}
 
-	health := s.ComputeHealth(stats, lattice)
-
-	// Pack stats in string
-	ret := "Health=" + strconv.FormatFloat(float64(health), 'f', -1, 64) + "\n"
-	c.JSON(200, gin.H{"Result": ret})
+	var in *inspection
+	s.do(func() { in = s.newInspection(serverClient) })
+	stats := base.clone()
+	health := s.ComputeHealth(ctx, stats, lattice, in)
+	s.do(func() { s.commitInspection(fileCID, base, stats, in) })
+	c.JSON(200, HealthStatus{FileCID: fileCID, Health: health})
 }
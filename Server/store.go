@@ -0,0 +1,298 @@
+package Server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"ipfs-alpha-entanglement-code/util"
+)
+
+const StoreFileName = "state.log"
+const StoreCompactionRecords = 1024 // minimum number of records in the log before it is compacted
+
+type storeOp string
+
+const (
+	storePut    storeOp = "put"
+	storeDelete storeOp = "delete"
+)
+
+// storeRecord is a line of the log
+type storeRecord struct {
+	Op     storeOp         `json:"op"`
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// Store is a key-value store kept in an append-only log on the local disk. The writes are handed to a goroutine
+// appending them to the log in batches synced once, where a key written again before its batch keeps its last
+// value only, so that the callers never wait for the disk. The log is rewritten with the live records only once it
+// holds mostly overwritten ones
+type Store struct {
+	path    string
+	lock    sync.Mutex
+	file    *os.File                              // only used by the writer once the store is open
+	records int                                   // number of records in the log, only used by the writer
+	live    map[string]map[string]json.RawMessage // bucket -> key -> value, including the pending records
+	keys    int                                   // number of keys in live
+
+	pending []storeRecord  // records not written yet, in order
+	queued  map[string]int // index in pending of the record of a bucket and key
+	wake    chan struct{}  // signals the writer that records are pending
+	closed  bool
+	done    chan struct{} // closed once the writer wrote the last records
+}
+
+// OpenStore opens the store kept in the directory, creating it if needed, and replays its log
+func OpenStore(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the state directory: %w", err)
+	}
+
+	st := &Store{
+		path:   filepath.Join(dir, StoreFileName),
+		live:   make(map[string]map[string]json.RawMessage),
+		queued: make(map[string]int),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	err = st.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	// start from a compacted log, which also drops a record torn by a crash
+	err = st.compact()
+	if err != nil {
+		return nil, err
+	}
+	go st.run()
+	return st, nil
+}
+
+// replay loads the records of the log. Only the last line may be torn, by a crash in the middle of a write
+func (st *Store) replay() error {
+	content, err := os.ReadFile(st.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read the state log: %w", err)
+	}
+
+	lines := bytes.Split(content, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var record storeRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return fmt.Errorf("corrupted state log at line %d: %w", i+1, err)
+		}
+		st.apply(record)
+		st.records++
+	}
+	return nil
+}
+
+// apply updates the live records with the record. The store lock must be held once the store is open
+func (st *Store) apply(record storeRecord) {
+	values := st.live[record.Bucket]
+	_, exists := values[record.Key]
+	switch record.Op {
+	case storePut:
+		if values == nil {
+			values = make(map[string]json.RawMessage)
+			st.live[record.Bucket] = values
+		}
+		values[record.Key] = record.Value
+		if !exists {
+			st.keys++
+		}
+	case storeDelete:
+		if exists {
+			delete(values, record.Key)
+			st.keys--
+		}
+	}
+}
+
+// compact rewrites the log with the live records and reopens it for appending
+func (st *Store) compact() error {
+	if st.file != nil {
+		st.file.Close()
+		st.file = nil
+	}
+
+	var content bytes.Buffer
+	records := 0
+	st.lock.Lock()
+	for bucket, values := range st.live {
+		for key, value := range values {
+			line, err := json.Marshal(storeRecord{Op: storePut, Bucket: bucket, Key: key, Value: value})
+			if err != nil {
+				st.lock.Unlock()
+				return fmt.Errorf("could not compact the state log: %w", err)
+			}
+			content.Write(append(line, '\n'))
+			records++
+		}
+	}
+	st.lock.Unlock()
+
+	tmpPath := st.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("could not compact the state log: %w", err)
+	}
+	_, err = tmp.Write(content.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, st.path)
+	}
+	if err != nil {
+		return fmt.Errorf("could not compact the state log: %w", err)
+	}
+
+	st.file, err = os.OpenFile(st.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open the state log: %w", err)
+	}
+	st.records = records
+	return nil
+}
+
+// run is the writer of the store, writing the pending records until the store is closed
+func (st *Store) run() {
+	defer close(st.done)
+	for range st.wake {
+		st.flush()
+	}
+	st.flush()
+}
+
+// flush appends the pending records to the log and syncs it, then compacts the log if it holds mostly
+// overwritten records
+func (st *Store) flush() {
+	st.lock.Lock()
+	batch := st.pending
+	st.pending = nil
+	st.queued = make(map[string]int)
+	keys := st.keys
+	st.lock.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	var content bytes.Buffer
+	for _, record := range batch {
+		line, err := json.Marshal(record)
+		if err != nil {
+			util.LogPrintf("Could not encode the state record of %s/%s - %s", record.Bucket, record.Key, err)
+			continue
+		}
+		content.Write(append(line, '\n'))
+	}
+	err := fmt.Errorf("state log not open")
+	if st.file != nil {
+		_, err = st.file.Write(content.Bytes())
+		if err == nil {
+			err = st.file.Sync()
+		}
+	}
+	st.records += len(batch)
+
+	if err != nil {
+		// the live records include the batch: rewriting the log saves it, and drops a partly written record
+		util.LogPrintf("Could not write the state log - %s", err)
+	} else if st.records <= StoreCompactionRecords || st.records <= 2*keys {
+		return
+	}
+	if err := st.compact(); err != nil {
+		util.LogPrintf("Could not compact the state log - %s", err)
+	}
+}
+
+// write queues the record for the writer, replacing the pending record of the same key
+func (st *Store) write(record storeRecord) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.closed {
+		return fmt.Errorf("state store is closed")
+	}
+	st.apply(record)
+
+	id := record.Bucket + "/" + record.Key
+	if i, ok := st.queued[id]; ok {
+		st.pending[i] = record
+	} else {
+		st.queued[id] = len(st.pending)
+		st.pending = append(st.pending, record)
+	}
+
+	select {
+	case st.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Put stores the value, encoded in JSON when called, under the key of the bucket
+func (st *Store) Put(bucket string, key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("could not encode the state of %s/%s: %w", bucket, key, err)
+	}
+	return st.write(storeRecord{Op: storePut, Bucket: bucket, Key: key, Value: encoded})
+}
+
+// Delete removes the key from the bucket
+func (st *Store) Delete(bucket string, key string) error {
+	return st.write(storeRecord{Op: storeDelete, Bucket: bucket, Key: key})
+}
+
+// Load returns the values of the bucket, by key
+func (st *Store) Load(bucket string) map[string]json.RawMessage {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	values := make(map[string]json.RawMessage, len(st.live[bucket]))
+	for key, value := range st.live[bucket] {
+		values[key] = value
+	}
+	return values
+}
+
+// Close writes the pending records and closes the log
+func (st *Store) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.lock.Unlock()
+
+	close(st.wake)
+	<-st.done
+	if st.file == nil {
+		return nil
+	}
+	err := st.file.Close()
+	st.file = nil
+	return err
+}
@@ -2,20 +2,27 @@ package Server
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"ipfs-alpha-entanglement-code/auth"
 	"ipfs-alpha-entanglement-code/client"
+	"ipfs-alpha-entanglement-code/entangler"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	"ipfs-alpha-entanglement-code/lease"
+	"ipfs-alpha-entanglement-code/membership"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type IPConverter interface {
-	ClusterToCommunityIP(clusterIP string) (communityIP string, err error)
-}
-
+// State is the state of the daemon, only accessed through Server.do
 type State struct {
-	files                       map[string]*FileStats
-	potentialFailedRegions      map[string][]string // map [region] -> [failed cluster peer names]
+	files                       map[string]*FileStats // replaced rather than updated, so that workers can read them
+	inspecting                  map[string]struct{}   // files whose inspection is queued or running
+	potentialFailedRegions      map[string][]string   // map [region] -> [failed cluster peer names]
 	running                     bool
-	unavailableBlocksTimestamps []int64 // use UnixNano
+	unavailableBlocksTimestamps []int64                      // use UnixNano
+	viewAcks                    map[string]map[string]uint64 // map [file CID] -> [monitor address] -> changes of the view it has
+	viewShareRounds             int                          // rounds of view sharing, every ViewFullSyncRounds-th sends whole views
 }
 
 type FileStats struct {
@@ -26,8 +33,9 @@ type FileStats struct {
 	DataBlocksMissing        map[uint]*WatchedBlock `json:"dataBlocksMissing,omitempty"`
 	ParityBlocksMissing      map[uint]*WatchedBlock `json:"parityBlocksMissing,omitempty"`
 	validParityBlocksHistory map[uint]*WatchedBlock // If too much mem used -> use a fifo/ring or make a gc
-	EstimatedBlockProb       float32                `json:"estimatedBlockProb,omitempty"`
+	EstimatedBlockProb       float32                `json:"estimatedBlockProb,omitempty"` // estimate of this node only
 	Health                   float32                `json:"health,omitempty"`
+	view                     *View                  // observations shared with the other monitors of the file
 }
 
 type WatchedBlock struct {
@@ -53,6 +61,14 @@ type StartMonitoringRequest struct {
 	StrandRootCID string `json:"strandRootCID"`
 }
 
+// ViewUpdate is the view of a file shared by one of its monitors: the changes since the last update the
+// receiver acknowledged, or the whole view
+type ViewUpdate struct {
+	MetadataCID   string `json:"metadataCID"`
+	StrandRootCID string `json:"strandRootCID"`
+	View          *View  `json:"view"`
+}
+
 type StopMonitoringRequest struct {
 	FileCID string `json:"fileCID"`
 }
@@ -68,6 +84,9 @@ type CollaborativeRepairOperation struct {
 	Depth    uint   // depth of repair in lattice
 	Origin   string // refers to original requester to send back the result
 	NumPeers int    // number of peers to use for repair
+
+	forStrand bool                 // part of a strand repair of the node, taken over with the strand repair if the node fails
+	missing   []entangler.BlockRef // blocks the node found missing, to plan the repair of the tree
 }
 
 type CollaborativeRepairDone struct {
@@ -94,6 +113,8 @@ type CollaborativeRepairOperationResponse struct {
 }
 
 type UnitRepairOperationRequest struct {
+	JobID         string `json:"jobID"`
+	UnitID        string `json:"unitID"`
 	FileCID       string `json:"fileCID"`
 	MetaCID       string `json:"metaCID"`
 	FailedIndices []int  `json:"failedIndices"`
@@ -103,6 +124,8 @@ type UnitRepairOperationRequest struct {
 
 // This response is async, it is sent back to the origin of the request when the repair is done
 type UnitRepairOperationResponse struct {
+	JobID                   string       `json:"jobID"`
+	UnitID                  string       `json:"unitID"`
 	FileCID                 string       `json:"fileCID"`
 	MetaCID                 string       `json:"metaCID"`
 	RepairStatus            map[int]bool `json:"repairStatus"`
@@ -116,9 +139,16 @@ type UnitRepairOperationResponse struct {
 	ParityBlocksCached      int          `json:"parityBlocksCached"`
 	ParityBlocksUnavailable int          `json:"parityBlocksUnavailable"`
 	ParityBlocksError       int          `json:"parityBlocksError"`
+
+	DataBlocksVerified   int                                      `json:"dataBlocksVerified"`
+	DataBlocksCorrupted  int                                      `json:"dataBlocksCorrupted"`
+	DataBlocksUnverified int                                      `json:"dataBlocksUnverified"`
+	Verification         map[int]ipfsconnector.VerificationStatus `json:"verification"`
 }
 
 type UnitRepairOperation struct {
+	JobID         string
+	UnitID        string
 	FileCID       string
 	MetaCID       string
 	FailedIndices []int
@@ -127,6 +157,8 @@ type UnitRepairOperation struct {
 }
 
 type UnitRepairDone struct {
+	JobID                   string
+	UnitID                  string
 	FileCID                 string
 	MetaCID                 string
 	Origin                  string
@@ -140,6 +172,11 @@ type UnitRepairDone struct {
 	ParityBlocksCached      int
 	ParityBlocksUnavailable int
 	ParityBlocksError       int
+
+	DataBlocksVerified   int
+	DataBlocksCorrupted  int
+	DataBlocksUnverified int
+	Verification         map[int]ipfsconnector.VerificationStatus
 }
 
 type StrandRepairOperation struct {
@@ -162,8 +199,24 @@ const (
 	PENDING RepairStatus = iota
 	SUCCESS
 	FAILURE
+	CANCELLED
 )
 
+func (status RepairStatus) String() string {
+	switch status {
+	case PENDING:
+		return "pending"
+	case SUCCESS:
+		return "success"
+	case FAILURE:
+		return "failure"
+	case CANCELLED:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
 type DownloadMetrics struct {
 	StartTime               *time.Time   `json:"startTime"`
 	EndTime                 *time.Time   `json:"endTime"`
@@ -177,6 +230,11 @@ type DownloadMetrics struct {
 	ParityBlocksCached      int          `json:"parityBlocksCached"`
 	ParityBlocksUnavailable int          `json:"parityBlocksUnavailable"`
 	ParityBlocksError       int          `json:"parityBlocksError"`
+
+	DataBlocksVerified   int                                      `json:"dataBlocksVerified"`
+	DataBlocksCorrupted  int                                      `json:"dataBlocksCorrupted"`
+	DataBlocksUnverified int                                      `json:"dataBlocksUnverified"`
+	Verification         map[int]ipfsconnector.VerificationStatus `json:"verification"`
 }
 
 type CollabPeerInfo struct {
@@ -194,9 +252,15 @@ type CollabPeerInfo struct {
 	ParityBlocksCached      int          `json:"parityBlocksCached"`
 	ParityBlocksUnavailable int          `json:"parityBlocksUnavailable"`
 	ParityBlocksError       int          `json:"parityBlocksError"`
+
+	DataBlocksVerified   int                                      `json:"dataBlocksVerified"`
+	DataBlocksCorrupted  int                                      `json:"dataBlocksCorrupted"`
+	DataBlocksUnverified int                                      `json:"dataBlocksUnverified"`
+	Verification         map[int]ipfsconnector.VerificationStatus `json:"verification"`
 }
 
 type CollaborativeRepairData struct {
+	JobID     string                     `json:"jobID"`
 	FileCID   string                     `json:"fileCID"`
 	MetaCID   string                     `json:"metaCID"`
 	Depth     uint                       `json:"depth"`
@@ -205,6 +269,7 @@ type CollaborativeRepairData struct {
 	EndTime   time.Time                  `json:"endTime"`
 	Peers     map[string]*CollabPeerInfo `json:"peers"` // from peer name to all associated information
 	Origin    string                     `json:"origin"`
+	Units     map[string]*RepairUnit     `json:"units"` // from unit ID to the leaves handed to a peer
 
 	// metrics used by the coordinating node
 	ParityAvailable         []bool `json:"parityAvailable"`
@@ -216,9 +281,15 @@ type CollaborativeRepairData struct {
 	ParityBlocksCached      int    `json:"parityBlocksCached"`
 	ParityBlocksUnavailable int    `json:"parityBlocksUnavailable"`
 	ParityBlocksError       int    `json:"parityBlocksError"`
+
+	DataBlocksVerified   int                                      `json:"dataBlocksVerified"`
+	DataBlocksCorrupted  int                                      `json:"dataBlocksCorrupted"`
+	DataBlocksUnverified int                                      `json:"dataBlocksUnverified"`
+	Verification         map[int]ipfsconnector.VerificationStatus `json:"verification"`
 }
 
 type StrandRepairData struct {
+	JobID     string
 	FileCID   string
 	MetaCID   string
 	Strand    int
@@ -245,39 +316,34 @@ type CommunityNodeAnnouncement struct {
 
 type CommunitiesMap map[string]CommunityNode
 
-type OperationType int
-
-const (
-	START_MONITOR_FILE OperationType = iota
-	STOP_MONITOR_FILE
-	RESET_MONITOR_FILE
-)
-
-type Operation struct {
-	operationType OperationType
-	parameter     []byte
-}
-
 type Server struct {
 	ginEngine       *gin.Engine
 	state           State
-	stateMux        sync.Mutex
-	operations      chan Operation
+	stateOps        chan stateOp // operations on the state, run by the daemon
+	pools           *Pools       // workers running the operations of the daemon
+	checkingRepairs atomic.Bool  // whether a check of the repair jobs is queued or running
 	ctx             chan struct{}
-	client          *client.Client
+	client          *client.Client // only accessed through RefreshClient and currentClient
+	clientMux       sync.Mutex
 	repairThreshold float32
-
-	// data for collaborative repair
-	// ipConverter IPConverter
-	collabOps  chan *CollaborativeRepairOperation
-	collabDone chan *CollaborativeRepairDone
-	unitOps    chan *UnitRepairOperation
-	unitDone   chan *UnitRepairDone
-	strandOps  chan *StrandRepairOperation
-
-	// data for stateful repair
+	store           *Store                   // persisted state, nil if the state is kept in memory only
+	metrics         *ServerMetrics           // exposed by the metrics endpoint
+	secret          []byte                   // shared by the community nodes, the endpoints accept any request if empty
+	identity        crypto.PrivKey           // key of the cluster peer of the node, signing its requests with the secret
+	signer          *auth.Signer             // signs the requests of the node, nil without secret
+	verifier        *auth.Verifier           // checks the requests to the endpoints, nil without secret
+	signers         map[string]signerAddress // addresses of the nodes of the signing peers, by peer ID
+	signersMux      sync.Mutex
+	members         *membership.Detector
+	memberRegions   map[string]string // regions of the dead community nodes added to the failed regions, by address
+	leases          *lease.Table      // leases of the coordination of the repairs granted by the node
+	elector         *lease.Elector    // acquires the leases of the repairs coordinated by the node
+	discovery       Discovery         // finds the other community nodes, the discovery service by default
+
+	// data for stateful repair, part of the state of the daemon
 	collabData map[string]*CollaborativeRepairData // map from [file CID] to repair data
 	strandData map[string]*StrandRepairData        // map from [file CID + Strand] to repair data
+	repairs    *RepairRegistry                     // snapshots of the repairs, for the repairs endpoints
 
 	//personal information
 	address          string //includes full address for community node include port
@@ -285,5 +351,5 @@ type Server struct {
 	clusterPort      int    //includes only the port of the cluster node
 	ipfsIP           string //includes only the IP/hostname of the IPFS node
 	ipfsPort         int    //includes only the port of the IPFS node
-	discoveryAddress string //includes the full address of the discovery server
+	discoveryAddress string //includes the full address of the discovery server, empty if there is none
 }
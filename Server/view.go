@@ -0,0 +1,275 @@
+package Server
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// BlockObservation is the last state of a block of a file seen by one of its monitors
+type BlockObservation struct {
+	Missing  bool         `json:"missing"`
+	Block    WatchedBlock `json:"block"`    // the missing block, or the available one found by the observer
+	Time     int64        `json:"time"`     // hybrid logical clock of the observer, in UnixNano
+	Observer string       `json:"observer"` // address of the community node which made the observation
+	seq      uint64       // change of the view which recorded the observation, for the deltas
+}
+
+// ProbEstimate is the last estimated presence probability of the blocks of a file of one of its monitors
+type ProbEstimate struct {
+	Prob float32 `json:"prob"`
+	Time int64   `json:"time"`
+	seq  uint64
+}
+
+// View is the view of a monitored file shared by its monitors, a state-based replicated data type: a
+// last-writer-wins register per block and per estimate of a monitor. Merging views gives the same result
+// whatever their order, and an observation only replaces the observations made before it, so a stale view
+// cannot bring back a block found again or repaired since. Observations are never changed once recorded,
+// they are replaced, so a view is copied before being updated like the stats holding it
+type View struct {
+	Blocks    map[string]*BlockObservation `json:"blocks"`    // by block key, see blockKey
+	Estimates map[string]*ProbEstimate     `json:"estimates"` // by observer
+	clock     int64                        // latest time seen, so that new observations are after all of them
+	seq       uint64                       // number of changes of the view
+}
+
+func NewView() *View {
+	return &View{Blocks: make(map[string]*BlockObservation), Estimates: make(map[string]*ProbEstimate)}
+}
+
+// blockKey returns the key of a block in a view, d<index> for a data block and p<index> for a parity block
+func blockKey(isData bool, blockNumber uint) string {
+	if isData {
+		return "d" + strconv.FormatUint(uint64(blockNumber), 10)
+	}
+	return "p" + strconv.FormatUint(uint64(blockNumber), 10)
+}
+
+func parseBlockKey(key string) (isData bool, blockNumber uint, ok bool) {
+	if len(key) < 2 || (key[0] != 'd' && key[0] != 'p') {
+		return false, 0, false
+	}
+	n, err := strconv.ParseUint(key[1:], 10, 0)
+	if err != nil {
+		return false, 0, false
+	}
+	return key[0] == 'd', uint(n), true
+}
+
+// after tells whether an observation replaces another. Observations are ordered by time, then by observer,
+// and the few left equal are ordered by content so that the order is total
+func (o *BlockObservation) after(other *BlockObservation) bool {
+	if o.Time != other.Time {
+		return o.Time > other.Time
+	}
+	if o.Observer != other.Observer {
+		return o.Observer > other.Observer
+	}
+	if o.Missing != other.Missing {
+		return !o.Missing // a block found wins over a block missing
+	}
+	if o.Block.Probability != other.Block.Probability {
+		return o.Block.Probability < other.Block.Probability
+	}
+	return o.Block.CID > other.Block.CID
+}
+
+func (e *ProbEstimate) after(other *ProbEstimate) bool {
+	if e.Time != other.Time {
+		return e.Time > other.Time
+	}
+	return e.Prob < other.Prob
+}
+
+// clone returns a copy of the view which can be updated, sharing the observations
+func (v *View) clone() *View {
+	cloned := &View{
+		Blocks:    make(map[string]*BlockObservation, len(v.Blocks)),
+		Estimates: make(map[string]*ProbEstimate, len(v.Estimates)),
+		clock:     v.clock,
+		seq:       v.seq,
+	}
+	for key, observation := range v.Blocks {
+		cloned.Blocks[key] = observation
+	}
+	for observer, estimate := range v.Estimates {
+		cloned.Estimates[observer] = estimate
+	}
+	return cloned
+}
+
+// tick returns the time of a new observation: the current time, unless the view saw a later one
+func (v *View) tick() int64 {
+	now := time.Now().UnixNano()
+	if now <= v.clock {
+		now = v.clock + 1
+	}
+	v.clock = now
+	return now
+}
+
+// Observe records a block found missing, or available if block is nil
+func (v *View) Observe(observer string, isData bool, blockNumber uint, block *WatchedBlock) {
+	observation := &BlockObservation{Time: v.tick(), Observer: observer}
+	if block != nil {
+		observation.Missing = true
+		observation.Block = *block
+	}
+	v.seq++
+	observation.seq = v.seq
+	v.Blocks[blockKey(isData, blockNumber)] = observation
+}
+
+// Estimate records the estimated block probability of an observer
+func (v *View) Estimate(observer string, prob float32) {
+	v.seq++
+	v.Estimates[observer] = &ProbEstimate{Prob: prob, Time: v.tick(), seq: v.seq}
+}
+
+// Merge merges another view into the view, and tells whether the view changed
+func (v *View) Merge(other *View) bool {
+	if other == nil {
+		return false
+	}
+	changed := false
+
+	for key, observation := range other.Blocks {
+		if _, _, ok := parseBlockKey(key); !ok || observation == nil {
+			continue
+		}
+		if observation.Time > v.clock {
+			v.clock = observation.Time
+		}
+		if current, in := v.Blocks[key]; in && !observation.after(current) {
+			continue
+		}
+		merged := *observation
+		v.seq++
+		merged.seq = v.seq
+		v.Blocks[key] = &merged
+		changed = true
+	}
+
+	for observer, estimate := range other.Estimates {
+		if estimate == nil {
+			continue
+		}
+		if estimate.Time > v.clock {
+			v.clock = estimate.Time
+		}
+		if current, in := v.Estimates[observer]; in && !estimate.after(current) {
+			continue
+		}
+		merged := *estimate
+		v.seq++
+		merged.seq = v.seq
+		v.Estimates[observer] = &merged
+		changed = true
+	}
+
+	return changed
+}
+
+// Seq returns the number of changes of the view, to ask for the changes after them with Delta
+func (v *View) Seq() uint64 {
+	return v.seq
+}
+
+// Delta returns the observations recorded by the view after its first since changes
+func (v *View) Delta(since uint64) *View {
+	delta := NewView()
+	for key, observation := range v.Blocks {
+		if observation.seq > since {
+			delta.Blocks[key] = observation
+		}
+	}
+	for observer, estimate := range v.Estimates {
+		if estimate.seq > since {
+			delta.Estimates[observer] = estimate
+		}
+	}
+	return delta
+}
+
+// Empty tells whether the view holds no observation
+func (v *View) Empty() bool {
+	return len(v.Blocks) == 0 && len(v.Estimates) == 0
+}
+
+// MissingBlocks returns the blocks of a kind whose last observation found them missing
+func (v *View) MissingBlocks(isData bool) map[uint]*WatchedBlock {
+	blocks := make(map[uint]*WatchedBlock)
+	for key, observation := range v.Blocks {
+		data, blockNumber, ok := parseBlockKey(key)
+		if !ok || data != isData || !observation.Missing {
+			continue
+		}
+		block := observation.Block
+		blocks[blockNumber] = &block
+	}
+	return blocks
+}
+
+// EstimatedBlockProb returns the mean of the estimates of the monitors, false if there is none. The estimates
+// are summed in the order of their observers, so that the mean does not depend on the order of the merges
+func (v *View) EstimatedBlockProb() (float32, bool) {
+	if len(v.Estimates) == 0 {
+		return 0, false
+	}
+	observers := make([]string, 0, len(v.Estimates))
+	for observer := range v.Estimates {
+		observers = append(observers, observer)
+	}
+	sort.Strings(observers)
+
+	var sum float32
+	for _, observer := range observers {
+		sum += v.Estimates[observer].Prob
+	}
+	return sum / float32(len(observers)), true
+}
+
+// observeMissing records a block found missing in the stats and their view
+func (fs *FileStats) observeMissing(observer string, isData bool, blockNumber uint, block *WatchedBlock) {
+	if isData {
+		fs.DataBlocksMissing[blockNumber] = block
+	} else {
+		fs.ParityBlocksMissing[blockNumber] = block
+	}
+	fs.view.Observe(observer, isData, blockNumber, block)
+}
+
+// observeAvailable records a block found available in the stats and their view
+func (fs *FileStats) observeAvailable(observer string, isData bool, blockNumber uint) {
+	if isData {
+		delete(fs.DataBlocksMissing, blockNumber)
+	} else {
+		delete(fs.ParityBlocksMissing, blockNumber)
+	}
+	fs.view.Observe(observer, isData, blockNumber, nil)
+}
+
+// shareEstimate records the estimated block probability of the node in the view
+func (fs *FileStats) shareEstimate(observer string) {
+	fs.view.Estimate(observer, fs.EstimatedBlockProb)
+}
+
+// SharedBlockProb returns the mean of the estimates of the monitors of the file, or the estimate of the node
+// if none was shared yet. The estimate of the node is kept apart, so that the mean never feeds it
+func (fs *FileStats) SharedBlockProb() float32 {
+	if prob, ok := fs.view.EstimatedBlockProb(); ok {
+		return prob
+	}
+	return fs.EstimatedBlockProb
+}
+
+// mergeView merges a view into the stats, which must be a copy, and tells whether they changed
+func (fs *FileStats) mergeView(view *View) bool {
+	if !fs.view.Merge(view) {
+		return false
+	}
+	fs.DataBlocksMissing = fs.view.MissingBlocks(true)
+	fs.ParityBlocksMissing = fs.view.MissingBlocks(false)
+	return true
+}
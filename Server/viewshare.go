@@ -1,47 +1,116 @@
 package Server
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"log"
+	"net/url"
 )
 
+// ShareViews shares the view of each monitored file, each on its own view sharing worker. Every monitor of a
+// file is sent the changes of the view it has not acknowledged yet, and every ViewFullSyncRounds-th round the
+// whole view, in case it lost some. It runs on a view sharing worker
+func (s *Server) ShareViews() {
+	s.do(func() {
+		s.state.viewShareRounds++
+		full := s.state.viewShareRounds%ViewFullSyncRounds == 0
+
+		for file, stats := range s.state.files {
+			// the stats of a file are replaced rather than updated by the daemon, so the worker can read them
+			file, stats := file, stats
+			acks := make(map[string]uint64, len(s.state.viewAcks[file]))
+			if !full {
+				for monitor, seq := range s.state.viewAcks[file] {
+					acks[monitor] = seq
+				}
+			}
+			if s.submit(s.pools.ViewShare, func() { s.shareView(file, stats, acks) }) != nil {
+				return
+			}
+		}
+	})
+}
+
+func (s *Server) shareView(fileCID string, fs *FileStats, acks map[string]uint64) {
+	println("Sharing view for file: ", fileCID, "with strandRoot: ", fs.StrandRootCID, "\n")
+	ctx, cancel := monitorContext()
+	defer cancel()
+
+	// Check allocation list for fs.strandRootCID
+	//   send a view of the stats to each CommunityNode corresponding to a peer in the allocation list
+	acked := s.ShareView(ctx, fileCID, fs, acks)
+
+	s.do(func() {
+		if _, in := s.state.files[fileCID]; !in || len(acked) == 0 {
+			return
+		}
+		if s.state.viewAcks[fileCID] == nil {
+			s.state.viewAcks[fileCID] = make(map[string]uint64)
+		}
+		for monitor, seq := range acked {
+			if seq > s.state.viewAcks[fileCID][monitor] {
+				s.state.viewAcks[fileCID][monitor] = seq
+			}
+		}
+	})
+}
+
 // ShareView
-// @Description: broadcast view (stats) for a file to other monitors
-func (s *Server) ShareView(fileCID string, fs *FileStats) {
+// @Description: send the changes of the view (stats) of a file to the other monitors, the whole view to those
+// missing from acks, and return the changes of the view each monitor now has
+func (s *Server) ShareView(ctx context.Context, fileCID string, fs *FileStats, acks map[string]uint64) map[string]uint64 {
 	// Check allocation list for fs.strandRootCID
 	//   send a view of the stats to each CommunityNode corresponding to a peer in the allocation list
+	client := s.currentClient()
+	if client == nil {
+		log.Println("Failed to share view for file: ", fileCID, ": no cluster client")
+		return nil
+	}
 
-	peers, err := s.client.IPFSClusterConnector.GetPinAllocations(fs.StrandRootCID)
+	peers, err := client.IPFSClusterConnector.GetPinAllocations(ctx, fs.StrandRootCID)
 	if err != nil {
 		log.Println("Failed to share view for file: ", fileCID)
-		return
+		return nil
 	}
 	// for peer in peers: -> send peer's Community Node [startTracking FileCID - strandRoot]
 	log.Println("Test: len allocation peers = ", len(peers))
 
-	body, err := json.Marshal(fs)
-	if err != nil {
-		log.Println("Failed to marshal view for file: ", fileCID)
-		return
-	}
-
 	stillInPeers := false
+	acked := make(map[string]uint64)
+	seq := fs.view.Seq()
 
 	for _, peer := range peers {
+		if peer == s.clusterIP {
+			stillInPeers = true
+			continue
+		}
+
 		communityPeerAddress, err := s.getCommunityAddress(peer)
 		if err != nil {
 			log.Printf("Skiping peer: %s for file: %s\n", peer, fileCID)
 			continue
 		}
 
-		status, err := PostJSON(communityPeerAddress+fmt.Sprintf("/updateView"), body)
+		view := fs.view
+		if since, known := acks[communityPeerAddress]; known {
+			if since >= seq {
+				continue
+			}
+			view = fs.view.Delta(since)
+		}
+
+		body, err := json.Marshal(ViewUpdate{MetadataCID: fs.MetadataCID, StrandRootCID: fs.StrandRootCID, View: view})
 		if err != nil {
-			log.Println("Status: ", status)
+			log.Println("Failed to marshal view for file: ", fileCID)
+			return acked
 		}
 
-		if peer == s.clusterIP {
-			stillInPeers = true
+		status, err := s.postJSON("http://"+communityPeerAddress+"/updateView?fileCID="+url.QueryEscape(fileCID), body)
+		if err != nil {
+			log.Println("Status: ", status)
+		} else if status == 200 {
+			// other answers, like the monitoring of the file just starting, mean the view was not merged
+			acked[communityPeerAddress] = seq
 		}
 	}
 
@@ -51,49 +120,47 @@ func (s *Server) ShareView(fileCID string, fs *FileStats) {
 		body, err := json.Marshal(request)
 		if err != nil {
 			log.Println("Failed to marshal stop monitoring request for file: ", fileCID)
-			return
+			return acked
 		}
 
-		status, err := PostJSON(s.address+fmt.Sprintf("/stopMonitorFile"), body)
+		status, err := s.postJSON("http://"+s.address+"/stopMonitorFile", body)
 		if err != nil {
 			log.Println("Status: ", status)
 		}
 	}
 
+	return acked
 }
 
 // UpdateView
-// @Description: Incorporates the view of another peer to own view for a file
-func (s *Server) UpdateView(fileCID string, fs *FileStats) {
-	s.stateMux.Lock()
-	defer s.stateMux.Unlock()
-
-	_, in := s.state.files[fileCID]
-
-	// merge view
-	if in {
-		for i, dbm := range fs.DataBlocksMissing {
-			s.state.files[fileCID].DataBlocksMissing[i] = dbm
+// @Description: Merges the view of another monitor into own view for a file. It returns whether the view was
+// merged, false if the file is not monitored and its monitoring was started instead, and ErrQueueFull if it
+// could not be started
+func (s *Server) UpdateView(fileCID string, update *ViewUpdate) (bool, error) {
+	var merged bool
+	var err error
+	s.do(func() {
+		current, in := s.state.files[fileCID]
+
+		// merge view
+		if in {
+			// the stats are replaced, as the inspections and the view sharing read them on workers
+			stats := current.clone()
+			if stats.mergeView(update.View) {
+				s.state.files[fileCID] = stats
+				s.saveFile(fileCID)
+			}
+			merged = true
+
+		} else {
+			// Start with these values
+			request := StartMonitoringRequest{
+				FileCID:       fileCID,
+				MetadataCID:   update.MetadataCID,
+				StrandRootCID: update.StrandRootCID,
+			}
+			err = s.submit(s.pools.Inspection, func() { s.startMonitoring(request) })
 		}
-		for i, pbm := range fs.ParityBlocksMissing {
-			s.state.files[fileCID].ParityBlocksMissing[i] = pbm
-		}
-
-		s.state.files[fileCID].EstimatedBlockProb = (s.state.files[fileCID].EstimatedBlockProb + fs.EstimatedBlockProb) / 2
-
-	} else {
-		// Start with these values
-		request := StartMonitoringRequest{
-			FileCID:       fileCID,
-			MetadataCID:   fs.MetadataCID,
-			StrandRootCID: fs.StrandRootCID,
-		}
-		body, err := json.Marshal(request)
-		if err != nil {
-			log.Println("Failed to marshal start monitoring request for file: ", fileCID)
-			return
-		}
-
-		s.operations <- Operation{START_MONITOR_FILE, body}
-	}
+	})
+	return merged, err
 }
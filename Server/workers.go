@@ -0,0 +1,160 @@
+package Server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"ipfs-alpha-entanglement-code/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+// workers and queued tasks of each pool of the daemon
+const (
+	CollabRepairWorkers = 2
+	UnitRepairWorkers   = 4
+	StrandRepairWorkers = 2
+	InspectionWorkers   = 4
+	ViewSharingWorkers  = 2
+	WorkerQueueSize     = 64
+)
+
+const StateQueueSize = 256 // state operations waiting for the daemon
+
+const RetryAfterSeconds = "5" // wait suggested to the clients of an endpoint whose queue is full
+
+var ErrQueueFull = errors.New("too many operations queued")
+
+// WorkerPool runs the tasks of one kind of operation on a fixed number of workers. Tasks wait in a bounded
+// queue, and are rejected once it is full rather than blocking the sender
+type WorkerPool struct {
+	name  string
+	tasks chan func()
+	busy  atomic.Int64
+	wg    sync.WaitGroup
+}
+
+// NewWorkerPool starts the workers of a pool
+func NewWorkerPool(name string, workers int, queueSize int) *WorkerPool {
+	p := &WorkerPool{name: name, tasks: make(chan func(), queueSize)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		p.busy.Add(1)
+		task()
+		p.busy.Add(-1)
+	}
+}
+
+// Submit queues a task without waiting, and returns ErrQueueFull if the queue is full
+func (p *WorkerPool) Submit(task func()) error {
+	select {
+	case p.tasks <- task:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Name returns the kind of operation run by the pool
+func (p *WorkerPool) Name() string {
+	return p.name
+}
+
+// Queued returns the number of tasks waiting for a worker
+func (p *WorkerPool) Queued() int {
+	return len(p.tasks)
+}
+
+// Busy returns the number of workers running a task
+func (p *WorkerPool) Busy() int {
+	return int(p.busy.Load())
+}
+
+// Close stops the pool once the queued tasks are done
+func (p *WorkerPool) Close() {
+	close(p.tasks)
+	p.wg.Wait()
+}
+
+// Pools are the worker pools of the daemon, one per kind of operation
+type Pools struct {
+	Collab     *WorkerPool // collaborative repairs coordinated by the node, and the checks of their units
+	Unit       *WorkerPool // units of repairs given to the node by other peers
+	Strand     *WorkerPool // strand repairs
+	Inspection *WorkerPool // inspections of the monitored files, and the start of their monitoring
+	ViewShare  *WorkerPool // views of the monitored files shared with the other monitors
+}
+
+func NewPools() *Pools {
+	return &Pools{
+		Collab:     NewWorkerPool("collab", CollabRepairWorkers, WorkerQueueSize),
+		Unit:       NewWorkerPool("unit", UnitRepairWorkers, WorkerQueueSize),
+		Strand:     NewWorkerPool("strand", StrandRepairWorkers, WorkerQueueSize),
+		Inspection: NewWorkerPool("inspection", InspectionWorkers, WorkerQueueSize),
+		ViewShare:  NewWorkerPool("viewshare", ViewSharingWorkers, WorkerQueueSize),
+	}
+}
+
+// All returns the pools in a fixed order
+func (pools *Pools) All() []*WorkerPool {
+	return []*WorkerPool{pools.Collab, pools.Unit, pools.Strand, pools.Inspection, pools.ViewShare}
+}
+
+// Close stops the pools once their queued tasks are done
+func (pools *Pools) Close() {
+	for _, pool := range pools.All() {
+		pool.Close()
+	}
+}
+
+// submit queues a task on a pool, counting the tasks rejected as the pool is full
+func (s *Server) submit(pool *WorkerPool, task func()) error {
+	err := pool.Submit(task)
+	if err != nil {
+		s.metrics.ObserveRejected(pool.Name())
+		util.LogPrintf("Rejecting %s operation - %s", pool.Name(), err)
+	}
+	return err
+}
+
+// submitRequest queues the task of a request on a pool, answering 429 if the pool is full
+func (s *Server) submitRequest(c *gin.Context, pool *WorkerPool, task func()) bool {
+	if err := s.submit(pool, task); err != nil {
+		c.Header("Retry-After", RetryAfterSeconds)
+		c.JSON(429, gin.H{"message": "Too many " + pool.Name() + " operations queued, retry later"})
+		return false
+	}
+	return true
+}
+
+// stateOp is a function run by the daemon on its state
+type stateOp struct {
+	fn   func()
+	done chan struct{}
+}
+
+// do runs a function on the state of the daemon and waits for it. The state (the monitored files, the failed
+// regions and the repairs) is only accessed by the daemon, which runs these functions one at a time, so they
+// must not block: no request to the cluster, IPFS or another node, and no call to do. Queuing a task on a pool
+// is fine as it never waits. Once the server is stopped, the function is not run
+func (s *Server) do(fn func()) {
+	op := stateOp{fn: fn, done: make(chan struct{})}
+	select {
+	case s.stateOps <- op:
+	case <-s.ctx:
+		return
+	}
+	select {
+	case <-op.done:
+	case <-s.ctx:
+	}
+}
@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/xerrors"
+)
+
+// headers of the signed requests
+const (
+	NodeHeader          = "X-Community-Node" // cluster peer ID of the community node signing the request, empty for clients
+	TimestampHeader     = "X-Community-Timestamp"
+	NonceHeader         = "X-Community-Nonce"
+	SignatureHeader     = "X-Community-Signature"      // signature with the shared secret
+	NodeSignatureHeader = "X-Community-Node-Signature" // signature with the key of the node, empty for clients
+	NodeKeyHeader       = "X-Community-Node-Key"       // public key of the node, only sent if its peer ID does not embed it
+)
+
+const MaxClockSkew = 5 * time.Minute // largest difference between the time of a request and of its check
+const MinSecretSize = 16             // size in bytes of the shortest secret accepted
+
+var (
+	ErrUnsigned     = errors.New("request not signed")
+	ErrBadSignature = errors.New("invalid request signature")
+	ErrExpired      = errors.New("request signed too long ago or in the future")
+	ErrReplayed     = errors.New("request already received")
+)
+
+// ParseSecret decodes the secret shared by the community nodes, given in hexadecimal like the secret of the cluster
+func ParseSecret(secret string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.TrimSpace(secret))
+	if err != nil {
+		return nil, xerrors.Errorf("secret is not hexadecimal: %w", err)
+	}
+	if len(decoded) < MinSecretSize {
+		return nil, xerrors.Errorf("secret of %d bytes is too short, at least %d expected", len(decoded), MinSecretSize)
+	}
+	return decoded, nil
+}
+
+// LoadIdentity reads the private key of a cluster peer from its identity file, identity.json in the
+// configuration folder of ipfs-cluster-service
+func LoadIdentity(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read the identity: %w", err)
+	}
+
+	var identity struct {
+		ID         string `json:"id"`
+		PrivateKey string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, xerrors.Errorf("invalid identity file %s: %w", path, err)
+	}
+	encoded, err := base64.StdEncoding.DecodeString(identity.PrivateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid private key in %s: %w", path, err)
+	}
+	key, err := crypto.UnmarshalPrivateKey(encoded)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid private key in %s: %w", path, err)
+	}
+
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid private key in %s: %w", path, err)
+	}
+	if identity.ID != "" && identity.ID != id.String() {
+		return nil, xerrors.Errorf("private key in %s is not the one of peer %s", path, identity.ID)
+	}
+	return key, nil
+}
+
+// payload returns the signed content of a request
+func payload(method string, uri string, timestamp string, nonce string, node string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{method, uri, timestamp, nonce, node, hex.EncodeToString(bodyHash[:])}, "\n"))
+}
+
+// signature returns the signature of a request payload with the secret
+func signature(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signer signs the requests sent by a community node with the shared secret and the key of its cluster peer,
+// or by a client with the shared secret only
+type Signer struct {
+	secret []byte
+	key    crypto.PrivKey // nil for a client
+	node   string         // peer ID of the key, empty for a client
+	pubKey string         // public key sent with the requests if the peer ID does not embed it
+}
+
+// NewSigner returns the signer of a client
+func NewSigner(secret []byte) *Signer {
+	return &Signer{secret: secret}
+}
+
+// NewNodeSigner returns the signer of a community node, identified by the key of its cluster peer
+func NewNodeSigner(secret []byte, key crypto.PrivKey) (*Signer, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot derive the peer ID of the key: %w", err)
+	}
+	signer := &Signer{secret: secret, key: key, node: id.String()}
+
+	if _, err := id.ExtractPublicKey(); err != nil {
+		encoded, err := crypto.MarshalPublicKey(key.GetPublic())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot encode the public key: %w", err)
+		}
+		signer.pubKey = hex.EncodeToString(encoded)
+	}
+	return signer, nil
+}
+
+// Node returns the peer ID identifying the signer, empty for a client
+func (s *Signer) Node() string {
+	return s.node
+}
+
+// Sign adds the signature headers to a request with the body. A nil signer leaves the request unsigned
+func (s *Signer) Sign(req *http.Request, body []byte) {
+	if s == nil {
+		return
+	}
+
+	random := make([]byte, 12)
+	rand.Read(random)
+	nonce := hex.EncodeToString(random)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	signed := payload(req.Method, req.URL.RequestURI(), timestamp, nonce, s.node, body)
+	req.Header.Set(NodeHeader, s.node)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, signature(s.secret, signed))
+	if s.key == nil {
+		return
+	}
+
+	nodeSig, err := s.key.Sign(signed)
+	if err != nil {
+		// the request is rejected for the missing signature
+		return
+	}
+	req.Header.Set(NodeSignatureHeader, hex.EncodeToString(nodeSig))
+	if s.pubKey != "" {
+		req.Header.Set(NodeKeyHeader, s.pubKey)
+	}
+}
+
+// NewRequest returns a signed request with the body
+func (s *Signer) NewRequest(method string, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.Sign(req, body)
+	return req, nil
+}
+
+// Verifier checks the signatures of the requests received by a community node, rejecting the requests
+// received twice. The node signing a request must also sign it with the key of its peer ID, so that
+// holding the secret is not enough to act as another node. It is safe for concurrent use
+type Verifier struct {
+	secret []byte
+
+	lock sync.Mutex
+	seen map[string]time.Time // nonces of the requests received, until they expire
+}
+
+func NewVerifier(secret []byte) *Verifier {
+	return &Verifier{secret: secret, seen: make(map[string]time.Time)}
+}
+
+// Verify checks the signatures of a request with the body, and returns the peer ID of the node which
+// signed it, empty for a client
+func (v *Verifier) Verify(req *http.Request, body []byte, now time.Time) (string, error) {
+	timestamp, nonce, sig := req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader), req.Header.Get(SignatureHeader)
+	if timestamp == "" || nonce == "" || sig == "" {
+		return "", ErrUnsigned
+	}
+	node := req.Header.Get(NodeHeader)
+
+	signed := payload(req.Method, req.URL.RequestURI(), timestamp, nonce, node, body)
+	if !hmac.Equal([]byte(sig), []byte(signature(v.secret, signed))) {
+		return "", ErrBadSignature
+	}
+	if node != "" && !verifyNode(req, node, signed) {
+		return "", ErrBadSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrBadSignature
+	}
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-MaxClockSkew)) || signedAt.After(now.Add(MaxClockSkew)) {
+		return "", ErrExpired
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for seenNonce, expiry := range v.seen {
+		if now.After(expiry) {
+			delete(v.seen, seenNonce)
+		}
+	}
+	if _, ok := v.seen[nonce]; ok {
+		return "", ErrReplayed
+	}
+	// a nonce is kept as long as its request could pass the check of the time
+	v.seen[nonce] = signedAt.Add(MaxClockSkew)
+
+	return node, nil
+}
+
+// verifyNode checks that the request was signed with the key of the peer ID of the node
+func verifyNode(req *http.Request, node string, signed []byte) bool {
+	nodeSig, err := hex.DecodeString(req.Header.Get(NodeSignatureHeader))
+	if err != nil || len(nodeSig) == 0 {
+		return false
+	}
+	id, err := peer.Decode(node)
+	if err != nil {
+		return false
+	}
+
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		// the peer ID is a hash of the key, which is sent along
+		encoded, err := hex.DecodeString(req.Header.Get(NodeKeyHeader))
+		if err != nil {
+			return false
+		}
+		pubKey, err = crypto.UnmarshalPublicKey(encoded)
+		if err != nil || !id.MatchesPublicKey(pubKey) {
+			return false
+		}
+	}
+
+	ok, err := pubKey.Verify(signed, nodeSig)
+	return err == nil && ok
+}
@@ -1,7 +1,7 @@
 package client
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"ipfs-alpha-entanglement-code/entangler"
 	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
@@ -16,15 +16,21 @@ type DownloadOption struct {
 	MetaCID           string
 	UploadRecoverData bool
 	DataFilter        []int
+	RecoveryMode      entangler.RecoveryMode
 }
 
 // directDownload interacts directly with IPFS. It fails when any data is missing
-func (c *Client) directCountDownload(rootCID string) (int, error) {
+func (c *Client) directCountDownload(ctx context.Context, rootCID string) (int, error) {
 	count := 0
 
 	var walker func(string)
 	walker = func(nodeCID string) {
-		raw_node, err := c.GetRawObject(nodeCID)
+		if ipfsconnector.IsRawCID(nodeCID) {
+			// raw leaf
+			count += 1
+			return
+		}
+		raw_node, err := c.GetRawObject(ctx, nodeCID)
 		if err != nil {
 			return
 		}
@@ -41,11 +47,11 @@ func (c *Client) directCountDownload(rootCID string) (int, error) {
 	return count, nil
 }
 
-func (c *Client) DownloadCount(rootCID string, metaCID string, depth uint) (*ipfsconnector.IPFSGetter, int, error) {
+func (c *Client) DownloadCount(ctx context.Context, rootCID string, metaCID string, depth uint) (*ipfsconnector.IPFSGetter, int, error) {
 
 	/* direct downloading if no metafile provided or depth is provided as 1 */
 	if len(metaCID) == 0 || depth <= 1 {
-		cnt, err := c.directCountDownload(rootCID)
+		cnt, err := c.directCountDownload(ctx, rootCID)
 		return nil, cnt, err
 	}
 
@@ -55,12 +61,12 @@ func (c *Client) DownloadCount(rootCID string, metaCID string, depth uint) (*ipf
 		DataFilter:        []int{},
 	}
 
-	_, getter, cnt, err := c.metaDownload(rootCID, option, depth, false)
+	_, getter, cnt, err := c.metaDownload(ctx, rootCID, option, depth, false)
 	return getter, cnt, err
 }
 
 // Download download the original file, repair it if metadata is provided
-func (c *Client) Download(rootCID string, path string, option DownloadOption, depth uint) ([]byte, *ipfsconnector.IPFSGetter, error) {
+func (c *Client) Download(ctx context.Context, rootCID string, path string, option DownloadOption, depth uint) ([]byte, *ipfsconnector.IPFSGetter, error) {
 	// err = c.InitIPFSConnector()
 	// if err != nil {
 	// 	return "", err
@@ -68,19 +74,19 @@ func (c *Client) Download(rootCID string, path string, option DownloadOption, de
 
 	/* direct downloading if no metafile provided or depth is provided as 1 */
 	if len(option.MetaCID) == 0 || depth <= 1 {
-		return c.directDownload(rootCID)
+		return c.directDownload(ctx, rootCID)
 	}
 
-	data, getter, _, err := c.metaDownload(rootCID, option, depth, true)
+	data, getter, _, err := c.metaDownload(ctx, rootCID, option, depth, true)
 	return data, getter, err
 }
 
 // directDownload interacts directly with IPFS. It fails when any data is missing
-func (c *Client) directDownload(rootCID string) ([]byte, *ipfsconnector.IPFSGetter, error) {
+func (c *Client) directDownload(ctx context.Context, rootCID string) ([]byte, *ipfsconnector.IPFSGetter, error) {
 	// try to down original file using given rootCID (i.e. no metafile)
-	data, err := c.GetFileToMem(rootCID)
+	data, err := c.GetFileToMem(ctx, rootCID)
 	if err != nil {
-		return nil, nil, xerrors.Errorf("fail to download original file: %s", err)
+		return nil, nil, xerrors.Errorf("fail to download original file: %w", err)
 	}
 	util.LogPrintf("Finish downloading file (no recovery)")
 
@@ -88,36 +94,54 @@ func (c *Client) directDownload(rootCID string) ([]byte, *ipfsconnector.IPFSGett
 }
 
 // downloadAndRecover interacts with IPFS through lattice, It launches recovery if any data is missing
-func (c *Client) downloadAndRecover(lattice *entangler.Lattice, metaData *Metadata,
+func (c *Client) downloadAndRecover(ctx context.Context, lattice *entangler.Lattice, metaData *Metadata,
 	option DownloadOption, tree *ipfsconnector.EmptyTreeNode, failOnError bool) (data []byte, repaired bool, count int, err error) {
 
+	return recoverTree(ctx, lattice, metaData, tree, failOnError, func(chunk []byte, cid string, isLeaf bool) error {
+		return c.dataReupload(ctx, chunk, cid, metaData.AddOptions(), isLeaf, option.UploadRecoverData)
+	})
+}
+
+// recoverTree walks the file tree through the lattice and returns the file data. Every repaired chunk
+// is passed to reupload with its CID
+func recoverTree(ctx context.Context, lattice *entangler.Lattice, metaData *Metadata, tree *ipfsconnector.EmptyTreeNode, failOnError bool,
+	reupload func(chunk []byte, cid string, isLeaf bool) error) (data []byte, repaired bool, count int, err error) {
+
 	count = 0
 	data = []byte{}
 	repaired = false
 	var walker func(*ipfsconnector.EmptyTreeNode) error
 	walker = func(node *ipfsconnector.EmptyTreeNode) (err error) {
 		util.LogPrintf("Downloading chunk with lattice index %d and preorder index %d", node.LatticeIdx, node.PreOrderIdx)
-		chunk, hasRepaired, err := lattice.GetChunk(node.LatticeIdx + 1)
+		chunk, hasRepaired, err := lattice.GetChunk(ctx, node.LatticeIdx+1)
 		if err != nil {
-			return xerrors.Errorf("fail to recover chunk with CID: %s - %s", node.CID, err)
+			return xerrors.Errorf("fail to recover chunk with CID %s: %w", node.CID, err)
 		}
 
 		count += 1
 		// upload missing chunk back to the network if allowed
 		if hasRepaired {
-			// Problem: does trimming zero always works?
-			chunk = bytes.Trim(chunk, "\x00")
-			err = c.dataReupload(chunk, node.CID, option.UploadRecoverData)
+			chunk, err = exactChunk(chunk, node.CID, metaData)
+			if err != nil {
+				return err
+			}
+			err = reupload(chunk, node.CID, len(node.Children) == 0)
 			if err != nil {
 				return err
 			}
 		}
 		repaired = repaired || hasRepaired
 
+		if len(node.Children) == 0 && metaData.RawLeaves {
+			// raw leaves hold the file data without unixfs envelope
+			data = append(data, chunk...)
+			return nil
+		}
+
 		// unmarshal and iterate
-		dagNode, err := c.GetDagNodeFromRawBytes(chunk)
+		dagNode, err := ipfsconnector.DecodeDagNode(chunk)
 		if err != nil {
-			return xerrors.Errorf("fail to parse raw data: %s", err)
+			return xerrors.Errorf("fail to parse raw data: %w", err)
 		}
 		links := dagNode.Links()
 
@@ -134,9 +158,9 @@ func (c *Client) downloadAndRecover(lattice *entangler.Lattice, metaData *Metada
 		}
 
 		if len(links) == 0 {
-			fileChunkData, err := c.GetFileDataFromDagNode(dagNode)
+			fileChunkData, err := ipfsconnector.FileDataFromDagNode(dagNode)
 			if err != nil {
-				return xerrors.Errorf("fail to parse file data: %s", err)
+				return xerrors.Errorf("fail to parse file data: %w", err)
 			}
 			data = append(data, fileChunkData...)
 		}
@@ -147,18 +171,18 @@ func (c *Client) downloadAndRecover(lattice *entangler.Lattice, metaData *Metada
 }
 
 // metaDownload download metadata for recovery usage
-func (c *Client) metaDownload(rootCID string, option DownloadOption, depth uint, failOnError bool) ([]byte, *ipfsconnector.IPFSGetter, int, error) {
+func (c *Client) metaDownload(ctx context.Context, rootCID string, option DownloadOption, depth uint, failOnError bool) ([]byte, *ipfsconnector.IPFSGetter, int, error) {
 	/* download metafile */
-	metaData, err := c.GetMetaData(option.MetaCID)
+	metaData, err := c.GetMetaData(ctx, option.MetaCID)
 	if err != nil {
-		return nil, nil, 0, xerrors.Errorf("fail to download metaData: %s", err)
+		return nil, nil, 0, xerrors.Errorf("fail to download metaData: %w", err)
 	}
 
 	// Construct empty tree
 	merkleTree, child_parent_index_map, index_node_map, err := ipfsconnector.ConstructTree(metaData.Leaves, metaData.MaxChildren, metaData.Depth, metaData.NumBlocks, metaData.S, metaData.P)
 
 	if err != nil {
-		return nil, nil, 0, xerrors.Errorf("fail to construct tree: %s", err)
+		return nil, nil, 0, xerrors.Errorf("fail to construct tree: %w", err)
 	}
 
 	merkleTree.CID = metaData.OriginalFileCID
@@ -167,9 +191,7 @@ func (c *Client) metaDownload(rootCID string, option DownloadOption, depth uint,
 	parityTrees := make([]*ipfsconnector.ParityTreeNode, len(metaData.TreeCIDs))
 	parityIndexMap := make([]map[int]*ipfsconnector.ParityTreeNode, len(metaData.TreeCIDs))
 
-	// Calculate parity tree number of leaves based on the following:
-	//TODO: Make these numbers global and initialize them once!
-	L_parity := (metaData.NumBlocks*262158 + 262143) / 262144
+	L_parity := metaData.ParityLeafNum()
 	K_parity := metaData.MaxParityChildren
 
 	for i, treeCID := range metaData.TreeCIDs {
@@ -181,6 +203,7 @@ func (c *Client) metaDownload(rootCID string, option DownloadOption, depth uint,
 	/* create lattice */
 	// create getter
 	getter := ipfsconnector.CreateIPFSGetter(c.IPFSConnector, metaData.DataCIDIndexMap, metaData.ParityCIDs, metaData.OriginalFileCID, metaData.TreeCIDs, metaData.NumBlocks, merkleTree, child_parent_index_map, index_node_map, parityTrees, parityIndexMap)
+	getter.ParityBlockSize, getter.ParityLeafSize = metaData.ParityBlockSize, metaData.ParityLeafSize
 	if len(option.DataFilter) > 0 {
 		getter.DataFilter = make(map[int]struct{}, len(option.DataFilter))
 		for _, index := range option.DataFilter {
@@ -189,14 +212,17 @@ func (c *Client) metaDownload(rootCID string, option DownloadOption, depth uint,
 	}
 
 	// create lattice
-	lattice := entangler.NewLattice(metaData.Alpha, metaData.S, metaData.P, metaData.NumBlocks, getter, depth)
-	lattice.Init()
+	lattice, err := metaData.newLattice(getter, depth)
+	if err != nil {
+		return nil, getter, 0, xerrors.Errorf("fail to create lattice: %w", err)
+	}
+	lattice.SetRecoveryMode(option.RecoveryMode, 0)
 
 	/* download & recover file from IPFS */
-	data, repaired, count, errDownload := c.downloadAndRecover(lattice, metaData, option, merkleTree, failOnError)
+	data, repaired, count, errDownload := c.downloadAndRecover(ctx, lattice, metaData, option, merkleTree, failOnError)
 	if errDownload != nil {
 		err = errDownload
-		return nil, getter, count, xerrors.Errorf("fail to download and recover file: %s", err)
+		return nil, getter, count, xerrors.Errorf("fail to download and recover file: %w", err)
 	}
 
 	if repaired {
@@ -209,15 +235,35 @@ func (c *Client) metaDownload(rootCID string, option DownloadOption, depth uint,
 	return data, getter, count, nil
 }
 
-// dataReupload re-uploads the recovered data back to IPFS
-func (c *Client) dataReupload(chunk []byte, cid string, allow bool) error {
+// exactChunk returns the repaired chunk without padding, verified against its CID when known.
+// The lattice already truncates the chunks of the files whose block sizes are in the metadata.
+// For older files, the padding is found by hashing, which needs the CID
+func exactChunk(chunk []byte, cid string, metaData *Metadata) ([]byte, error) {
+	exact := len(metaData.DataBlockSizes) > 0
+	if len(cid) == 0 {
+		if !exact {
+			return nil, xerrors.Errorf("unknown size and CID of the repaired chunk")
+		}
+		return chunk, nil
+	}
+
+	chunk, err := ipfsconnector.VerifyRecovered(chunk, cid, exact)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid repaired chunk: %w", err)
+	}
+	return chunk, nil
+}
+
+// dataReupload re-uploads the recovered data back to IPFS. The block is put with the options
+// the file was added with, so that it gets its original CID
+func (c *Client) dataReupload(ctx context.Context, chunk []byte, cid string, opts ipfsconnector.AddOptions, isLeaf bool, allow bool) error {
 	if !allow {
 		return nil
 	}
 
-	uploadCID, err := c.AddRawData(chunk)
+	uploadCID, err := c.PutBlock(ctx, chunk, opts, isLeaf)
 	if err != nil {
-		return xerrors.Errorf("fail to upload the repaired chunk to IPFS: %s", err)
+		return xerrors.Errorf("fail to upload the repaired chunk to IPFS: %w", err)
 	}
 	if uploadCID != cid {
 		return xerrors.Errorf("incorrect CID of the repaired chunk. Expected: %s, Got: %s", cid, uploadCID)
@@ -225,15 +271,15 @@ func (c *Client) dataReupload(chunk []byte, cid string, allow bool) error {
 	return nil
 }
 
-// dataReupload re-uploads the recovered data back to IPFS
-func (c *Client) dataReuploadNoCheck(chunk []byte, allow bool) error {
+// dataReuploadNoCheck re-uploads the recovered data back to IPFS without checking its CID
+func (c *Client) dataReuploadNoCheck(ctx context.Context, chunk []byte, opts ipfsconnector.AddOptions, isLeaf bool, allow bool) error {
 	if !allow {
 		return nil
 	}
 
-	_, err := c.AddRawData(chunk)
+	_, err := c.PutBlock(ctx, chunk, opts, isLeaf)
 	if err != nil {
-		return xerrors.Errorf("fail to upload the repaired chunk to IPFS: %s", err)
+		return xerrors.Errorf("fail to upload the repaired chunk to IPFS: %w", err)
 	}
 
 	return nil
@@ -272,6 +318,11 @@ type DownloadMetrics struct {
 	ParityBlocksCached      int          `json:"parityBlocksCached"`
 	ParityBlocksUnavailable int          `json:"parityBlocksUnavailable"`
 	ParityBlocksError       int          `json:"parityBlocksError"`
+
+	DataBlocksVerified   int                                      `json:"dataBlocksVerified"`
+	DataBlocksCorrupted  int                                      `json:"dataBlocksCorrupted"`
+	DataBlocksUnverified int                                      `json:"dataBlocksUnverified"`
+	Verification         map[int]ipfsconnector.VerificationStatus `json:"verification"`
 }
 
 func WriteMetrics(path string, getter *ipfsconnector.IPFSGetter, startTime *time.Time, endTime *time.Time, status RepairStatus) (out string, err error) {
@@ -285,19 +336,24 @@ func WriteMetrics(path string, getter *ipfsconnector.IPFSGetter, startTime *time
 		return "", xerrors.Errorf("getter is nil")
 	}
 
+	snapshot := getter.Metrics()
 	metrics := DownloadMetrics{
 		StartTime:               startTime,
 		EndTime:                 endTime,
 		Status:                  status,
-		ParityAvailable:         getter.ParityAvailable,
-		DataBlocksFetched:       getter.DataBlocksFetched,
-		DataBlocksCached:        getter.DataBlocksCached,
-		DataBlocksUnavailable:   getter.DataBlocksUnavailable,
-		DataBlocksError:         getter.DataBlocksError,
-		ParityBlocksFetched:     getter.ParityBlocksFetched,
-		ParityBlocksCached:      getter.ParityBlocksCached,
-		ParityBlocksUnavailable: getter.ParityBlocksUnavailable,
-		ParityBlocksError:       getter.ParityBlocksError,
+		ParityAvailable:         snapshot.ParityAvailable,
+		DataBlocksFetched:       snapshot.DataBlocksFetched,
+		DataBlocksCached:        snapshot.DataBlocksCached,
+		DataBlocksUnavailable:   snapshot.DataBlocksUnavailable,
+		DataBlocksError:         snapshot.DataBlocksError,
+		ParityBlocksFetched:     snapshot.ParityBlocksFetched,
+		ParityBlocksCached:      snapshot.ParityBlocksCached,
+		ParityBlocksUnavailable: snapshot.ParityBlocksUnavailable,
+		ParityBlocksError:       snapshot.ParityBlocksError,
+		DataBlocksVerified:      snapshot.DataBlocksVerified,
+		DataBlocksCorrupted:     snapshot.DataBlocksCorrupted,
+		DataBlocksUnverified:    snapshot.DataBlocksUnverified,
+		Verification:            snapshot.Verification,
 	}
 
 	jsonBody, err := json.Marshal(metrics)
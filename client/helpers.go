@@ -1,46 +1,30 @@
 package client
 
 import (
-	"encoding/json"
+	"context"
+	"io"
+	"ipfs-alpha-entanglement-code/auth"
 	ipfscluster "ipfs-alpha-entanglement-code/ipfs-cluster"
 	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	"sync"
 
 	"golang.org/x/xerrors"
 )
 
-type Metadata struct {
-	Alpha int
-	S     int
-	P     int
-
-	OriginalFileCID string
-	TreeCIDs        []string
-	NumBlocks       int // N
-	MaxChildren     int // K
-	Leaves          int // L
-	Depth           int // D
-
-	MaxParityChildren int // K Parity
-
-	RootCID string
-
-	DataCIDIndexMap map[string]int
-	ParityCIDs      [][]string
-}
-
 type Client struct {
 	*ipfsconnector.IPFSConnector
 	IPFSClusterConnector *ipfscluster.Connector
+	CommunitySigner      *auth.Signer // signs the requests to the community node, nil to send them unsigned
 }
 
 // create client
-func NewClient(clusterHost string, clusterPort int, ipfsHost string, ipfsPort int) (client *Client, err error) {
+func NewClient(ctx context.Context, clusterHost string, clusterPort int, ipfsHost string, ipfsPort int) (client *Client, err error) {
 	client = &Client{}
 	err = client.InitIPFSConnector(ipfsPort, ipfsHost)
 	if err != nil {
 		return nil, err
 	}
-	err = client.InitIPFSClusterConnector(clusterPort, clusterHost)
+	err = client.InitIPFSClusterConnector(ctx, clusterPort, clusterHost)
 	if err != nil {
 		return nil, err
 	}
@@ -52,7 +36,7 @@ func NewClient(clusterHost string, clusterPort int, ipfsHost string, ipfsPort in
 func (c *Client) InitIPFSConnector(port int, host string) error {
 	conn, err := ipfsconnector.CreateIPFSConnector(port, host)
 	if err != nil {
-		return xerrors.Errorf("fail to connect to IPFS: %s", err)
+		return xerrors.Errorf("fail to connect to IPFS: %w", err)
 	}
 	c.IPFSConnector = conn
 
@@ -60,10 +44,10 @@ func (c *Client) InitIPFSConnector(port int, host string) error {
 }
 
 // init ipfs cluster connector for future usage
-func (c *Client) InitIPFSClusterConnector(port int, host string) error {
-	conn, err := ipfscluster.CreateIPFSClusterConnector(port, host)
+func (c *Client) InitIPFSClusterConnector(ctx context.Context, port int, host string) error {
+	conn, err := ipfscluster.CreateIPFSClusterConnector(ctx, port, host)
 	if err != nil {
-		return xerrors.Errorf("fail to connect to IPFS Cluster: %s", err)
+		return xerrors.Errorf("fail to connect to IPFS Cluster: %w", err)
 	}
 	c.IPFSClusterConnector = conn
 
@@ -72,47 +56,69 @@ func (c *Client) InitIPFSClusterConnector(port int, host string) error {
 
 // AddAndPinAsFile adds a file to IPFS network and pin the file in cluster with a replication factor
 // replicate = 0 means use default config in the cluster
-func (c *Client) AddAndPinAsFile(data []byte, replicate int) (cid string, err error) {
+func (c *Client) AddAndPinAsFile(ctx context.Context, data []byte, replicate int) (cid string, err error) {
 	// upload file to IPFS network
-	cid, err = c.AddFileFromMem(data)
+	cid, err = c.AddFileFromMem(ctx, data)
 	if err != nil {
 		return "", err
 	}
 
 	// pin file in cluster
-	err = c.IPFSClusterConnector.AddPin(cid, replicate)
+	err = c.IPFSClusterConnector.AddPin(ctx, cid, replicate)
 	return cid, err
 }
 
+// addStrands uploads the strand readers to IPFS network concurrently and returns the CID of each strand.
+// Nil readers are skipped and leave an empty CID
+func (c *Client) addStrands(ctx context.Context, readers []io.ReadCloser) ([]string, error) {
+	return addStrandsWith(readers, func(k int, reader io.Reader) (string, error) {
+		return c.AddFileFromReader(ctx, reader)
+	})
+}
+
+// addStrandsWith adds the strand readers concurrently with add, as the entangler generates the strands together.
+// Nil readers are skipped and leave an empty CID
+func addStrandsWith(readers []io.ReadCloser, add func(k int, reader io.Reader) (string, error)) ([]string, error) {
+	parityCIDs := make([]string, len(readers))
+	errs := make([]error, len(readers))
+
+	var waitGroupAdd sync.WaitGroup
+	for k, reader := range readers {
+		if reader == nil {
+			continue
+		}
+		waitGroupAdd.Add(1)
+		go func(k int, reader io.ReadCloser) {
+			defer waitGroupAdd.Done()
+			defer reader.Close()
+			parityCIDs[k], errs[k] = add(k, reader)
+		}(k, reader)
+	}
+	waitGroupAdd.Wait()
+
+	for k, err := range errs {
+		if err != nil {
+			return nil, xerrors.Errorf("could not upload parity %d: %w", k, err)
+		}
+	}
+
+	return parityCIDs, nil
+}
+
 // AddAndPinAsRaw adds raw data to IPFS network and pin it in cluster with a replication factor
 // replicate = 0 means use default config in the cluster
-func (c *Client) AddAndPinAsRaw(data []byte, replicate int) (cid string, err error) {
+func (c *Client) AddAndPinAsRaw(ctx context.Context, data []byte, replicate int) (cid string, err error) {
 	// upload raw bytes to IPFS network
-	cid, err = c.AddRawData(data)
+	cid, err = c.AddRawData(ctx, data)
 	if err != nil {
 		return "", err
 	}
 
 	// pin data in cluster
-	err = c.IPFSClusterConnector.AddPin(cid, replicate)
+	err = c.IPFSClusterConnector.AddPin(ctx, cid, replicate)
 	return cid, err
 }
 
-// GetMetaData downloads metafile from IPFS network and returns a metafile object
-func (c *Client) GetMetaData(cid string) (metadata *Metadata, err error) {
-	data, err := c.GetFileToMem(cid)
-	if err != nil {
-		return nil, err
-	}
-	var myMetadata Metadata
-	err = json.Unmarshal(data, &myMetadata)
-	if err != nil {
-		return nil, err
-	}
-
-	return &myMetadata, nil
-}
-
 type ForwardMonitoringRequest struct {
 	FileCID        string   `json:"fileCID"`
 	MetadataCID    string   `json:"metadataCID"`
@@ -0,0 +1,249 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"ipfs-alpha-entanglement-code/entangler"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	localstore "ipfs-alpha-entanglement-code/local-store"
+	"ipfs-alpha-entanglement-code/util"
+
+	"golang.org/x/xerrors"
+)
+
+// UploadLocal adds the file at path to the local store, generates its entanglement and stores the strands
+// next to it. It returns the CIDs of the file and of its metadata, which is stored as a file too
+func UploadLocal(ctx context.Context, store *localstore.Store, path string, alpha int, s int, p int) (rootCID string, metaCID string, err error) {
+	rootCID, err = store.AddFile(path)
+	if err != nil {
+		return "", "", xerrors.Errorf("could not add file to the local store: %w", err)
+	}
+	util.LogPrintf("Finish adding file to the local store with CID %s. File path: %s", rootCID, path)
+	if alpha < 1 {
+		// expect no entanglement
+		return rootCID, "", nil
+	}
+
+	/* flatten the merkle tree */
+
+	root, maxChildren, maxDepth, err := store.GetMerkleTree(rootCID)
+	if err != nil {
+		return rootCID, "", xerrors.Errorf("could not read merkle tree: %w", err)
+	}
+	nodes := root.GetFlattenedTree(s, p, true)
+	leaves := 0
+	maxBlockSize := 0
+	blockSizes := make([]int, len(nodes))
+	for idx, node := range nodes {
+		data, err := node.Data(ctx)
+		if err != nil {
+			return rootCID, "", err
+		}
+		if len(node.Children) == 0 {
+			leaves++
+		}
+		if len(data) > maxBlockSize {
+			maxBlockSize = len(data)
+		}
+		blockSizes[idx] = len(data)
+	}
+
+	/* generate and store entanglement */
+
+	tangler, err := entangler.NewEntangler(alpha, s, p, []bool{})
+	if err != nil {
+		return rootCID, "", err
+	}
+	tangler.ParitySize = maxBlockSize
+	readers := tangler.EntangleToReaders(len(nodes), func(index int) ([]byte, error) {
+		return nodes[index-1].Data(ctx)
+	})
+	fanOuts := make([]int, alpha)
+	treeCIDs, err := addStrandsWith(readers, func(k int, reader io.Reader) (string, error) {
+		strandCID, fanOut, err := store.AddStrand(reader, maxBlockSize)
+		fanOuts[k] = fanOut
+		return strandCID, err
+	})
+	if err != nil {
+		return rootCID, "", err
+	}
+	maxParityChildren := 0
+	for _, fanOut := range fanOuts {
+		if fanOut > maxParityChildren {
+			maxParityChildren = fanOut
+		}
+	}
+
+	/* store metadata */
+
+	metaData, err := newMetadata(alpha, s, p, store.GetAddOptions())
+	if err != nil {
+		return rootCID, "", err
+	}
+	metaData.ParityBlockSize = maxBlockSize
+	metaData.NumBlocks = len(nodes)
+	metaData.OriginalFileCID = rootCID
+	metaData.TreeCIDs = treeCIDs
+	metaData.MaxChildren = maxChildren
+	metaData.Leaves = leaves
+	metaData.Depth = maxDepth
+	metaData.MaxParityChildren = maxParityChildren
+	metaData.DataBlockSizes = blockSizes
+	if err = metaData.Validate(); err != nil {
+		return rootCID, "", xerrors.Errorf("inconsistent metadata: %w", err)
+	}
+	rawMetadata, err := json.Marshal(metaData)
+	if err != nil {
+		return rootCID, "", xerrors.Errorf("could not marshal metadata: %w", err)
+	}
+	metaCID, err = store.AddFileFromMem(rawMetadata)
+	if err != nil {
+		return rootCID, "", xerrors.Errorf("could not store metadata: %w", err)
+	}
+	util.LogPrintf("File CID: %s. MetaFile CID: %s", rootCID, metaCID)
+
+	return rootCID, metaCID, nil
+}
+
+// DownloadLocal reads the file from the local store and repairs it if metadata is provided.
+// Repaired blocks are written back to the store if the option allows it
+func DownloadLocal(ctx context.Context, store *localstore.Store, rootCID string, option DownloadOption, depth uint) ([]byte, *localstore.Getter, error) {
+	/* direct reading if no metafile provided or depth is provided as 1 */
+	if len(option.MetaCID) == 0 || depth <= 1 {
+		data, err := store.GetFileToMem(rootCID)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("fail to read original file: %w", err)
+		}
+		return data, nil, nil
+	}
+
+	metaData, err := getLocalMetadata(store, option.MetaCID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if metaData.OriginalFileCID != rootCID {
+		return nil, nil, xerrors.Errorf("metadata describes file %s, not %s", metaData.OriginalFileCID, rootCID)
+	}
+
+	getter, lattice, tree, err := localLattice(store, metaData, depth, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, index := range option.DataFilter {
+		getter.DataFilter[index] = struct{}{}
+	}
+	lattice.SetRecoveryMode(option.RecoveryMode, 0)
+
+	reupload := func(chunk []byte, cid string, isLeaf bool) error {
+		if !option.UploadRecoverData {
+			return nil
+		}
+		return localReupload(store, chunk, cid, metaData.AddOptions(), isLeaf)
+	}
+	data, repaired, _, err := recoverTree(ctx, lattice, metaData, tree, true, reupload)
+	if err != nil {
+		return nil, getter, xerrors.Errorf("fail to read and recover file: %w", err)
+	}
+
+	if repaired {
+		util.LogPrintf("Finish reading file (recovered)")
+	} else {
+		util.LogPrintf("Finish reading file (no recovery)")
+	}
+	return data, getter, nil
+}
+
+// RepairStrandLocal regenerates a strand of the file in the local store from the data and the other strands.
+// The missing data blocks are repaired on the way
+func RepairStrandLocal(ctx context.Context, store *localstore.Store, metaCID string, strand int) error {
+	metaData, err := getLocalMetadata(store, metaCID)
+	if err != nil {
+		return err
+	}
+	if strand < 0 || strand >= metaData.Alpha {
+		return xerrors.Errorf("invalid strand number")
+	}
+
+	_, lattice, tree, err := localLattice(store, metaData, 2, strand)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = recoverTree(ctx, lattice, metaData, tree, true, func(chunk []byte, cid string, isLeaf bool) error {
+		return localReupload(store, chunk, cid, metaData.AddOptions(), isLeaf)
+	})
+	if err != nil {
+		return err
+	}
+
+	// only generate the strand we're repairing
+	strands := make([]bool, metaData.Alpha)
+	strands[strand] = true
+	tangler, err := entangler.NewEntangler(metaData.Alpha, metaData.S, metaData.P, strands)
+	if err != nil {
+		return err
+	}
+	tangler.ParitySize = metaData.ParityBlockSize
+	readers := tangler.EntangleToReaders(metaData.NumBlocks, func(index int) ([]byte, error) {
+		data, _, err := lattice.GetChunk(ctx, index)
+		return data, err
+	})
+
+	treeCIDs, err := addStrandsWith(readers, func(k int, reader io.Reader) (string, error) {
+		strandCID, _, err := store.AddStrand(reader, metaData.ParityBlockSize)
+		return strandCID, err
+	})
+	if err != nil {
+		return err
+	}
+	if treeCIDs[strand] != metaData.TreeCIDs[strand] {
+		return xerrors.Errorf("parity CID mismatch")
+	}
+
+	return nil
+}
+
+// getLocalMetadata reads the metadata file from the local store
+func getLocalMetadata(store *localstore.Store, metaCID string) (*Metadata, error) {
+	data, err := store.GetFileToMem(metaCID)
+	if err != nil {
+		return nil, xerrors.Errorf("fail to read metaData: %w", err)
+	}
+	return ParseMetadata(data)
+}
+
+// localLattice creates the lattice of the file over the local store. The excluded strand, if any, is not read
+func localLattice(store *localstore.Store, metaData *Metadata, depth uint,
+	excluded int) (*localstore.Getter, *entangler.Lattice, *ipfsconnector.EmptyTreeNode, error) {
+
+	merkleTree, parentMap, nodeMap, err := ipfsconnector.ConstructTree(metaData.Leaves, metaData.MaxChildren,
+		metaData.Depth, metaData.NumBlocks, metaData.S, metaData.P)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("fail to construct tree: %w", err)
+	}
+	merkleTree.CID = metaData.OriginalFileCID
+
+	treeCIDs := append([]string{}, metaData.TreeCIDs...)
+	if excluded >= 0 {
+		treeCIDs[excluded] = ""
+	}
+	getter := localstore.CreateGetter(store, treeCIDs, parentMap, nodeMap)
+
+	lattice, err := metaData.newLattice(getter, depth)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("fail to create lattice: %w", err)
+	}
+	return getter, lattice, merkleTree, nil
+}
+
+// localReupload writes the repaired chunk back to the local store and checks that it gets its original CID
+func localReupload(store *localstore.Store, chunk []byte, cid string, opts ipfsconnector.AddOptions, isLeaf bool) error {
+	storedCID, err := store.PutBlock(chunk, opts, isLeaf)
+	if err != nil {
+		return xerrors.Errorf("fail to store the repaired chunk: %w", err)
+	}
+	if storedCID != cid {
+		return xerrors.Errorf("incorrect CID of the repaired chunk. Expected: %s, Got: %s", cid, storedCID)
+	}
+	return nil
+}
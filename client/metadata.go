@@ -0,0 +1,281 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"ipfs-alpha-entanglement-code/entangler"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	"ipfs-alpha-entanglement-code/util"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// MetadataVersion is the version of the metadata schema written by this tool.
+// Version 0 is the unversioned schema. Older versions are migrated when read
+const MetadataVersion = 2
+
+type Metadata struct {
+	Version     int
+	ToolVersion string    // version of the tool that uploaded the file
+	CreatedAt   time.Time // upload time
+
+	Alpha   int
+	S       int
+	P       int
+	Strands []StrandLayout // one per strand, in strand order
+
+	OriginalFileCID string
+	TreeCIDs        []string
+	NumBlocks       int // N
+	MaxChildren     int // K
+	Leaves          int // L
+	Depth           int // D
+
+	// options the original file was added with (since version 2)
+	CidVersion int
+	Hash       string
+	RawLeaves  bool
+	Chunker    string
+
+	ChunkSize         int // maximum size of the data chunks of the original file
+	ParityBlockSize   int // size of a parity block in the strand file
+	ParityLeafSize    int // size of a leaf of the strand file
+	MaxParityChildren int // K Parity: fan-out of the strand trees
+
+	ParityAllocations map[string][]string // parity tree node CID -> peer IDs chosen at upload
+	DataBlockSizes    []int               // size of each data block in lattice order. Empty for older files
+
+	RootCID string
+
+	DataCIDIndexMap map[string]int
+	ParityCIDs      [][]string
+}
+
+// StrandLayout describes the geometry of a strand in the lattice
+type StrandLayout struct {
+	Class string // horizontal, right or left
+	Pitch int
+}
+
+// NewStrandLayouts returns the layout of the alpha strands generated by the entangler
+func NewStrandLayouts(alpha int) []StrandLayout {
+	layouts := make([]StrandLayout, alpha)
+	for k := range layouts {
+		strand := entangler.StrandClass(k)
+		switch {
+		case strand.IsHorizontal():
+			layouts[k].Class = "horizontal"
+		case strand.IsRightHanded():
+			layouts[k].Class = "right"
+		default:
+			layouts[k].Class = "left"
+		}
+		layouts[k].Pitch = strand.Pitch()
+	}
+	return layouts
+}
+
+// ParseMetadata unmarshals the metadata, migrates it to the current schema and validates it
+func ParseMetadata(data []byte) (*Metadata, error) {
+	var metadata Metadata
+	err := json.Unmarshal(data, &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.Version > MetadataVersion {
+		return nil, xerrors.Errorf("unsupported metadata version %d. Expect at most %d", metadata.Version, MetadataVersion)
+	}
+	switch metadata.Version {
+	case 0:
+		metadata.migrateFromUnversioned()
+		fallthrough
+	case 1:
+		metadata.migrateFromV1()
+	}
+	metadata.Version = MetadataVersion
+
+	err = metadata.Validate()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid metadata: %w", err)
+	}
+
+	return &metadata, nil
+}
+
+// migrateFromUnversioned fills the fields missing in the unversioned schema
+// with the values that were hard-coded when it was in use
+func (m *Metadata) migrateFromUnversioned() {
+	m.ChunkSize = ipfsconnector.DefaultChunkSize
+	m.ParityBlockSize = ipfsconnector.DefaultParityBlockSize
+	m.ParityLeafSize = ipfsconnector.DefaultParityLeafSize
+	if m.Alpha > 0 {
+		m.Strands = NewStrandLayouts(m.Alpha)
+	}
+}
+
+// migrateFromV1 sets the add options, which were the IPFS defaults before version 2
+func (m *Metadata) migrateFromV1() {
+	defaults := ipfsconnector.DefaultAddOptions()
+	m.CidVersion = defaults.CidVersion
+	m.Hash = defaults.Hash
+	m.RawLeaves = defaults.RawLeaves
+	m.Chunker = defaults.Chunker
+}
+
+// Validate checks that the metadata is consistent, so that the trees and lattice can be built from it
+func (m *Metadata) Validate() error {
+	if m.Version != MetadataVersion {
+		return xerrors.Errorf("unexpected version %d", m.Version)
+	}
+	if len(m.OriginalFileCID) == 0 {
+		return xerrors.Errorf("missing original file CID")
+	}
+
+	// entanglement parameters
+	if m.Alpha < 1 {
+		return xerrors.Errorf("alpha %d should be positive", m.Alpha)
+	}
+	if m.Alpha > 1 && (m.S < 1 || m.S > m.P) {
+		return xerrors.Errorf("s = %d and p = %d do not satisfy 0 < s <= p", m.S, m.P)
+	}
+	if len(m.TreeCIDs) != m.Alpha {
+		return xerrors.Errorf("%d strand trees for alpha = %d", len(m.TreeCIDs), m.Alpha)
+	}
+	expectedStrands := NewStrandLayouts(m.Alpha)
+	if len(m.Strands) != m.Alpha {
+		return xerrors.Errorf("%d strand layouts for alpha = %d", len(m.Strands), m.Alpha)
+	}
+	for k, strand := range m.Strands {
+		if strand != expectedStrands[k] {
+			return xerrors.Errorf("unsupported layout %+v for strand %d", strand, k)
+		}
+	}
+
+	// add options and block sizes
+	if err := m.AddOptions().Validate(); err != nil {
+		return err
+	}
+	maxChunkSize, _ := m.AddOptions().MaxChunkSize()
+	if m.ChunkSize != maxChunkSize || m.ParityBlockSize < 1 || m.ParityLeafSize < 1 {
+		return xerrors.Errorf("invalid block sizes. Chunk: %d, parity block: %d, parity leaf: %d",
+			m.ChunkSize, m.ParityBlockSize, m.ParityLeafSize)
+	}
+
+	// original file tree
+	if m.NumBlocks < 1 || m.Leaves < 1 || m.Leaves > m.NumBlocks {
+		return xerrors.Errorf("invalid tree size. Nodes: %d, leaves: %d", m.NumBlocks, m.Leaves)
+	}
+	nodes, depth, err := treeShape(m.Leaves, m.MaxChildren)
+	if err != nil {
+		return xerrors.Errorf("invalid tree: %w", err)
+	}
+	if nodes != m.NumBlocks || depth != m.Depth {
+		return xerrors.Errorf("tree of %d leaves and fan-out %d has %d nodes and depth %d, metadata says %d and %d",
+			m.Leaves, m.MaxChildren, nodes, depth, m.NumBlocks, m.Depth)
+	}
+
+	if len(m.DataBlockSizes) > 0 {
+		if len(m.DataBlockSizes) != m.NumBlocks {
+			return xerrors.Errorf("%d data block sizes for %d blocks", len(m.DataBlockSizes), m.NumBlocks)
+		}
+		for i, size := range m.DataBlockSizes {
+			if size < 1 || size > m.ParityBlockSize {
+				return xerrors.Errorf("invalid size %d of data block %d", size, i+1)
+			}
+		}
+	}
+
+	// strand trees
+	if _, _, err := treeShape(m.ParityLeafNum(), m.MaxParityChildren); err != nil {
+		return xerrors.Errorf("invalid strand tree: %w", err)
+	}
+
+	return nil
+}
+
+// AddOptions returns the options the original file was added with
+func (m *Metadata) AddOptions() ipfsconnector.AddOptions {
+	return ipfsconnector.AddOptions{
+		CidVersion: m.CidVersion,
+		Hash:       m.Hash,
+		RawLeaves:  m.RawLeaves,
+		Chunker:    m.Chunker,
+	}
+}
+
+// ParityLeafNum returns the number of leaves of each strand tree
+func (m *Metadata) ParityLeafNum() int {
+	return (m.NumBlocks*m.ParityBlockSize + m.ParityLeafSize - 1) / m.ParityLeafSize
+}
+
+// newLattice creates and initializes the lattice of the file. Recovered data blocks get their exact size if known
+func (m *Metadata) newLattice(getter entangler.BlockGetter, depth uint) (*entangler.Lattice, error) {
+	lattice, err := entangler.NewLattice(m.Alpha, m.S, m.P, m.NumBlocks, getter, depth)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid metadata: %w", err)
+	}
+	lattice.Init()
+	if len(m.DataBlockSizes) > 0 {
+		err := lattice.SetDataSizes(m.DataBlockSizes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lattice, nil
+}
+
+// treeShape returns the number of nodes and the depth of the tree built by ipfsconnector.ConstructTree
+func treeShape(leaves int, maxChildren int) (nodes int, depth int, err error) {
+	if leaves > 1 && maxChildren < 2 {
+		return 0, 0, xerrors.Errorf("%d leaves need a fan-out of at least 2, got %d", leaves, maxChildren)
+	}
+
+	level, nodes, depth := leaves, leaves, 1
+	for level > 1 {
+		level = (level + maxChildren - 1) / maxChildren
+		nodes += level
+		depth++
+	}
+	return nodes, depth, nil
+}
+
+// newMetadata returns the metadata of a file uploaded now with the current schema.
+// The parity block size is the default one and should be set to the size of the largest block
+func newMetadata(alpha int, s int, p int, opts ipfsconnector.AddOptions) (Metadata, error) {
+	chunkSize, err := opts.MaxChunkSize()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return Metadata{
+		Version:     MetadataVersion,
+		ToolVersion: util.Version,
+		CreatedAt:   time.Now().UTC(),
+
+		Alpha:   alpha,
+		S:       s,
+		P:       p,
+		Strands: NewStrandLayouts(alpha),
+
+		CidVersion: opts.CidVersion,
+		Hash:       opts.Hash,
+		RawLeaves:  opts.RawLeaves,
+		Chunker:    opts.Chunker,
+
+		ChunkSize:       chunkSize,
+		ParityBlockSize: ipfsconnector.DefaultParityBlockSize,
+		ParityLeafSize:  ipfsconnector.DefaultParityLeafSize,
+	}, nil
+}
+
+// GetMetaData downloads metafile from IPFS network and returns a metafile object
+func (c *Client) GetMetaData(ctx context.Context, cid string) (metadata *Metadata, err error) {
+	data, err := c.GetFileToMem(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMetadata(data)
+}
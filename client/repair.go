@@ -1,20 +1,19 @@
 package client
 
 import (
-	"bytes"
+	"context"
 	"ipfs-alpha-entanglement-code/entangler"
 	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
 	"ipfs-alpha-entanglement-code/util"
-	"sync"
 
 	"golang.org/x/xerrors"
 )
 
 // Given RootCID of a file and the MetadataCID, regenerate Strand X by downloading data and parity blocks
-func (c *Client) RepairStrand(rootCID string, metadataCID string, strand int) (err error) {
-	metaData, err := c.GetMetaData(metadataCID)
+func (c *Client) RepairStrand(ctx context.Context, rootCID string, metadataCID string, strand int) (err error) {
+	metaData, err := c.GetMetaData(ctx, metadataCID)
 	if err != nil {
-		return xerrors.Errorf("fail to download metaData: %s", err)
+		return xerrors.Errorf("fail to download metaData: %w", err)
 	}
 
 	if (strand < 0) || (strand >= metaData.Alpha) {
@@ -25,7 +24,7 @@ func (c *Client) RepairStrand(rootCID string, metadataCID string, strand int) (e
 	merkleTree, child_parent_index_map, index_node_map, err := ipfsconnector.ConstructTree(metaData.Leaves, metaData.MaxChildren, metaData.Depth, metaData.NumBlocks, metaData.S, metaData.P)
 
 	if err != nil {
-		return xerrors.Errorf("fail to construct tree: %s", err)
+		return xerrors.Errorf("fail to construct tree: %w", err)
 	}
 
 	merkleTree.CID = metaData.OriginalFileCID
@@ -34,9 +33,7 @@ func (c *Client) RepairStrand(rootCID string, metadataCID string, strand int) (e
 	parityTrees := make([]*ipfsconnector.ParityTreeNode, len(metaData.TreeCIDs))
 	parityIndexMap := make([]map[int]*ipfsconnector.ParityTreeNode, len(metaData.TreeCIDs))
 
-	// Calculate parity tree number of leaves based on the following:
-	//TODO: Make these numbers global and initialize them once!
-	L_parity := (metaData.NumBlocks*262158 + 262143) / 262144
+	L_parity := metaData.ParityLeafNum()
 	K_parity := metaData.MaxParityChildren
 
 	for i, treeCID := range metaData.TreeCIDs {
@@ -53,12 +50,15 @@ func (c *Client) RepairStrand(rootCID string, metadataCID string, strand int) (e
 	/* create lattice */
 	// create getter
 	getter := ipfsconnector.CreateIPFSGetter(c.IPFSConnector, metaData.DataCIDIndexMap, metaData.ParityCIDs, metaData.OriginalFileCID, metaData.TreeCIDs, metaData.NumBlocks, merkleTree, child_parent_index_map, index_node_map, parityTrees, parityIndexMap)
+	getter.ParityBlockSize, getter.ParityLeafSize = metaData.ParityBlockSize, metaData.ParityLeafSize
 
 	// We'll set the depth to a larger number since this will be an async process and we can afford to get deeper without affecting
 	//  the perceived latency for users
 	// create lattice
-	lattice := entangler.NewLattice(metaData.Alpha, metaData.S, metaData.P, metaData.NumBlocks, getter, 2)
-	lattice.Init()
+	lattice, err := metaData.newLattice(getter, 2)
+	if err != nil {
+		return xerrors.Errorf("fail to create lattice: %w", err)
+	}
 
 	option := DownloadOption{
 		MetaCID:           metadataCID,
@@ -67,71 +67,37 @@ func (c *Client) RepairStrand(rootCID string, metadataCID string, strand int) (e
 	}
 
 	/* download & recover file from IPFS */
-	_, _, _, errDownload := c.downloadAndRecover(lattice, metaData, option, merkleTree, true)
+	_, _, _, errDownload := c.downloadAndRecover(ctx, lattice, metaData, option, merkleTree, true)
 	if errDownload != nil {
 		return errDownload
 	}
 
 	// Regenerate the strand we're repairing
 
-	// start the entangler to read from pipline
+	// only generate the strand we're repairing
 	strands := make([]bool, metaData.Alpha)
 	for i := 0; i < metaData.Alpha; i++ {
 		strands[i] = (i == strand)
 	}
 
-	blockNum := metaData.NumBlocks
-	dataChan := make(chan []byte, blockNum)
-	parityChan := make(chan entangler.EntangledBlock, blockNum)
-	tangler := entangler.NewEntangler(metaData.Alpha, metaData.S, metaData.P, strands)
-
-	// start the entangler to read from pipline
-	go func() {
-		err := tangler.Entangle(dataChan, parityChan)
-		if err != nil {
-			panic(xerrors.Errorf("could not generate entanglement: %s", err))
-		}
-	}()
-
-	// send data to entangler
-	go func() {
-		for i := 1; i <= blockNum; i++ {
-			data, _, err := lattice.GetChunk(i)
-			if err != nil {
-				return
-			}
-			dataChan <- data
-		}
-		close(dataChan)
-	}()
-
-	parityBlocks := make([][]byte, blockNum)
-
-	// receive entangled blocks from entangler
-	var waitGroupAdd sync.WaitGroup
-	for block := range parityChan {
-		waitGroupAdd.Add(1)
-		go func(block entangler.EntangledBlock) {
-			defer waitGroupAdd.Done()
-			parityBlocks[block.LeftBlockIndex-1] = block.Data
-		}(block)
-	}
-	waitGroupAdd.Wait()
-
-	// Merge entangled blocks into a single byte array
-	var mergedParity []byte
-	for _, block := range parityBlocks {
-		util.LogPrintf("Parity block size: %d", len(block))
-		mergedParity = append(mergedParity, block...)
+	tangler, err := entangler.NewEntangler(metaData.Alpha, metaData.S, metaData.P, strands)
+	if err != nil {
+		return err
 	}
+	tangler.ParitySize = metaData.ParityBlockSize
+	readers := tangler.EntangleToReaders(metaData.NumBlocks, func(index int) ([]byte, error) {
+		data, _, err := lattice.GetChunk(ctx, index)
+		return data, err
+	})
 
 	// Re-upload the whole parity strand
 	// We assume that IPFS Cluster would still have the same pinnings
 	// and would just redistribute the data
-	parityCID, err := c.AddFileFromMem(mergedParity)
+	parityCIDs, err := c.addStrands(ctx, readers)
 	if err != nil {
-		return xerrors.Errorf("could not upload parity %d: %s", strand, err)
+		return err
 	}
+	parityCID := parityCIDs[strand]
 
 	if parityCID != metaData.TreeCIDs[strand] {
 		return xerrors.Errorf("parity CID mismatch")
@@ -142,18 +108,18 @@ func (c *Client) RepairStrand(rootCID string, metadataCID string, strand int) (e
 
 // Function that prepares all data structures needed before downloading or repairing a file
 
-func (c *Client) PrepareRepair(rootCID string, metadataCID string, depth uint) (*Metadata, *ipfsconnector.IPFSGetter, *entangler.Lattice, *ipfsconnector.EmptyTreeNode, *map[int]*ipfsconnector.EmptyTreeNode, error) {
+func (c *Client) PrepareRepair(ctx context.Context, rootCID string, metadataCID string, depth uint) (*Metadata, *ipfsconnector.IPFSGetter, *entangler.Lattice, *ipfsconnector.EmptyTreeNode, *map[int]*ipfsconnector.EmptyTreeNode, error) {
 
-	metaData, err := c.GetMetaData(metadataCID)
+	metaData, err := c.GetMetaData(ctx, metadataCID)
 	if err != nil {
-		return nil, nil, nil, nil, nil, xerrors.Errorf("fail to download metaData: %s", err)
+		return nil, nil, nil, nil, nil, xerrors.Errorf("fail to download metaData: %w", err)
 	}
 
 	// Construct empty tree
 	merkleTree, child_parent_index_map, index_node_map, err := ipfsconnector.ConstructTree(metaData.Leaves, metaData.MaxChildren, metaData.Depth, metaData.NumBlocks, metaData.S, metaData.P)
 
 	if err != nil {
-		return nil, nil, nil, nil, nil, xerrors.Errorf("fail to construct tree: %s", err)
+		return nil, nil, nil, nil, nil, xerrors.Errorf("fail to construct tree: %w", err)
 	}
 
 	merkleTree.CID = metaData.OriginalFileCID
@@ -162,9 +128,7 @@ func (c *Client) PrepareRepair(rootCID string, metadataCID string, depth uint) (
 	parityTrees := make([]*ipfsconnector.ParityTreeNode, len(metaData.TreeCIDs))
 	parityIndexMap := make([]map[int]*ipfsconnector.ParityTreeNode, len(metaData.TreeCIDs))
 
-	// Calculate parity tree number of leaves based on the following:
-	//TODO: Make these numbers global and initialize them once!
-	L_parity := (metaData.NumBlocks*262158 + 262143) / 262144
+	L_parity := metaData.ParityLeafNum()
 	K_parity := metaData.MaxParityChildren
 
 	for i, treeCID := range metaData.TreeCIDs {
@@ -176,10 +140,13 @@ func (c *Client) PrepareRepair(rootCID string, metadataCID string, depth uint) (
 	/* create lattice */
 	// create getter
 	getter := ipfsconnector.CreateIPFSGetter(c.IPFSConnector, metaData.DataCIDIndexMap, metaData.ParityCIDs, metaData.OriginalFileCID, metaData.TreeCIDs, metaData.NumBlocks, merkleTree, child_parent_index_map, index_node_map, parityTrees, parityIndexMap)
+	getter.ParityBlockSize, getter.ParityLeafSize = metaData.ParityBlockSize, metaData.ParityLeafSize
 
 	// create lattice
-	lattice := entangler.NewLattice(metaData.Alpha, metaData.S, metaData.P, metaData.NumBlocks, getter, depth)
-	lattice.Init()
+	lattice, err := metaData.newLattice(getter, depth)
+	if err != nil {
+		return nil, nil, nil, nil, nil, xerrors.Errorf("fail to create lattice: %w", err)
+	}
 
 	return metaData, getter, lattice, merkleTree, &index_node_map, nil
 
@@ -187,19 +154,28 @@ func (c *Client) PrepareRepair(rootCID string, metadataCID string, depth uint) (
 
 // Function that repairs all intermediate nodes of a tree
 // then for all leaf nodes that aren't available, just reports adds its CID to a list
-// Arguments: FileCID, MetaCID, Depth
+// Arguments: FileCID, MetaCID, Depth, blocks known to be missing (may be nil)
 // returns: List of lattice indices for leaf nodes that need to be repaired
+// An intermediate node known to be missing is recovered with a repair plan avoiding the missing blocks
 
-func (c *Client) RetrieveFailedLeaves(rootCID string, metadataCID string, depth uint) ([]int, *ipfsconnector.IPFSGetter, error) {
+func (c *Client) RetrieveFailedLeaves(ctx context.Context, rootCID string, metadataCID string, depth uint,
+	missing []entangler.BlockRef) ([]int, *ipfsconnector.IPFSGetter, error) {
 
 	util.LogPrintf("Retrieving failed leaves for root %s, metadata %s, depth %d", rootCID, metadataCID, depth)
-	_, getter, lattice, root, _, err := c.PrepareRepair(rootCID, metadataCID, depth)
+	metaData, getter, lattice, root, _, err := c.PrepareRepair(ctx, rootCID, metadataCID, depth)
 	leafIndices := make([]int, 0)
 
 	if err != nil {
 		return nil, getter, err
 	}
 
+	missingData := make(map[int]struct{})
+	for _, ref := range missing {
+		if !ref.IsParity {
+			missingData[ref.Index] = struct{}{}
+		}
+	}
+
 	// starting from root, traverse the tree and repair all intermediate nodes
 	var walker func(*ipfsconnector.EmptyTreeNode) error
 	walker = func(node *ipfsconnector.EmptyTreeNode) (err error) {
@@ -208,7 +184,7 @@ func (c *Client) RetrieveFailedLeaves(rootCID string, metadataCID string, depth
 		// if node is a leaf, check if it's available
 		// if not, add it to the list of leaves to be repaired
 		if len(node.Children) == 0 {
-			_, _, err := lattice.GetChunkDepth(node.LatticeIdx+1, 1)
+			_, _, err := lattice.GetChunkDepth(ctx, node.LatticeIdx+1, 1)
 			if err != nil {
 				leafIndices = append(leafIndices, node.LatticeIdx)
 			}
@@ -217,17 +193,28 @@ func (c *Client) RetrieveFailedLeaves(rootCID string, metadataCID string, depth
 			return nil
 		}
 
-		// if node is not a leaf, repair it with previously specified depth
-		chunk, hasRepaired, err := lattice.GetChunk(node.LatticeIdx + 1)
+		// if node is not a leaf, repair it with the cheapest plan if it is known to be missing,
+		// otherwise or if there is no plan with previously specified depth
+		if _, ok := missingData[node.LatticeIdx+1]; ok {
+			target := []entangler.BlockRef{{Index: node.LatticeIdx + 1}}
+			if plan, err := lattice.RecoverWithPlan(ctx, target, missing); err != nil {
+				util.LogPrintf("Fail to repair node %d with a plan: %s", node.LatticeIdx+1, err)
+			} else {
+				util.LogPrintf("Repaired node %d with a plan downloading %d blocks", node.LatticeIdx+1, plan.Cost())
+			}
+		}
+		chunk, hasRepaired, err := lattice.GetChunk(ctx, node.LatticeIdx+1)
 		if err != nil {
-			return xerrors.Errorf("fail to recover chunk with CID: %s", err)
+			return xerrors.Errorf("fail to recover chunk with CID: %w", err)
 		}
 
 		// upload missing chunk back to the network if allowed
 		if hasRepaired {
-			// Problem: does trimming zero always works?
-			chunk = bytes.Trim(chunk, "\x00")
-			err = c.dataReupload(chunk, node.CID, true)
+			chunk, err = exactChunk(chunk, node.CID, metaData)
+			if err != nil {
+				return err
+			}
+			err = c.dataReupload(ctx, chunk, node.CID, metaData.AddOptions(), false, true)
 			if err != nil {
 				return err
 			}
@@ -236,7 +223,7 @@ func (c *Client) RetrieveFailedLeaves(rootCID string, metadataCID string, depth
 		// unmarshal and iterate
 		dagNode, err := c.GetDagNodeFromRawBytes(chunk)
 		if err != nil {
-			return xerrors.Errorf("fail to parse raw data: %s", err)
+			return xerrors.Errorf("fail to parse raw data: %w", err)
 		}
 		links := dagNode.Links()
 
@@ -289,9 +276,9 @@ func (c *Client) RetrieveFailedLeaves(rootCID string, metadataCID string, depth
 // Arguments: FileCID, MetaCID, Depth, List of indices
 // returns: a map of each index to a bool whether it was either repaired(either already available or repaired) or not
 
-func (c *Client) RepairFailedLeaves(rootCID string, metadataCID string, depth uint, leafIndices []int) (map[int]bool, *ipfsconnector.IPFSGetter, error) {
+func (c *Client) RepairFailedLeaves(ctx context.Context, rootCID string, metadataCID string, depth uint, leafIndices []int) (map[int]bool, *ipfsconnector.IPFSGetter, error) {
 
-	_, getter, lattice, _, _, err := c.PrepareRepair(rootCID, metadataCID, depth)
+	metaData, getter, lattice, _, _, err := c.PrepareRepair(ctx, rootCID, metadataCID, depth)
 	result := make(map[int]bool)
 	for _, index := range leafIndices {
 		result[index] = false
@@ -303,12 +290,13 @@ func (c *Client) RepairFailedLeaves(rootCID string, metadataCID string, depth ui
 
 	// for each index, try to get from the lattice and report whether it was retrieved successfully or not
 	for _, index := range leafIndices {
-		chunk, hasRepaired, err := lattice.GetChunk(index + 1)
+		chunk, hasRepaired, err := lattice.GetChunk(ctx, index+1)
 		result[index] = (err == nil)
 		if hasRepaired {
-			// Problem: does trimming zero always works?
-			chunk = bytes.Trim(chunk, "\x00")
-			e := c.dataReuploadNoCheck(chunk, true)
+			chunk, e := exactChunk(chunk, getter.GetCIDForDataBlock(index), metaData)
+			if e == nil {
+				e = c.dataReuploadNoCheck(ctx, chunk, metaData.AddOptions(), true, true)
+			}
 			result[index] = result[index] && (e == nil)
 		}
 
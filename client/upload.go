@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"ipfs-alpha-entanglement-code/entangler"
 	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
@@ -13,17 +14,21 @@ import (
 	"golang.org/x/xerrors"
 )
 
-func (c *Client) DirectUploadWithReplication(path string, replicationFactor int) error {
-	rootCID, err := c.AddFile(path)
-	util.CheckError(err, "could not add File to IPFS")
+func (c *Client) DirectUploadWithReplication(ctx context.Context, path string, replicationFactor int) error {
+	rootCID, err := c.AddFile(ctx, path)
+	if err != nil {
+		return xerrors.Errorf("could not add File to IPFS: %w", err)
+	}
 	util.LogPrintf("Finish adding file to IPFS with CID %s. File path: %s", rootCID, path)
-	err = c.IPFSClusterConnector.AddPin(rootCID, replicationFactor)
-	util.CheckError(err, "could not pin file to IPFS cluster")
+	err = c.IPFSClusterConnector.AddPin(ctx, rootCID, replicationFactor)
+	if err != nil {
+		return xerrors.Errorf("could not pin file to IPFS cluster: %w", err)
+	}
 	return nil
 }
 
 // Upload uploads the original file, generates and uploads the entanglement of that file
-func (c *Client) Upload(path string, alpha int, s int, p int, replicationFactor int, communityNodeAddress string) (rootCID string,
+func (c *Client) Upload(ctx context.Context, path string, alpha int, s int, p int, replicationFactor int, communityNodeAddress string) (rootCID string,
 	metaCID string, pinResult func() error, err error) {
 
 	/* add original file to ipfs */
@@ -36,8 +41,16 @@ func (c *Client) Upload(path string, alpha int, s int, p int, replicationFactor
 		util.LogPrintf("Peer %s: %s", id, peer)
 	}
 
-	rootCID, err = c.AddFile(path)
-	util.CheckError(err, "could not add File to IPFS")
+	if alpha >= 1 {
+		// check the parameters before anything is added
+		if _, err = entangler.NewEntangler(alpha, s, p, []bool{}); err != nil {
+			return "", "", nil, err
+		}
+	}
+	rootCID, err = c.AddFile(ctx, path)
+	if err != nil {
+		return "", "", nil, xerrors.Errorf("could not add File to IPFS: %w", err)
+	}
 	util.LogPrintf("Finish adding file to IPFS with CID %s. File path: %s", rootCID, path)
 	if alpha < 1 {
 		// expect no entanglement
@@ -46,25 +59,30 @@ func (c *Client) Upload(path string, alpha int, s int, p int, replicationFactor
 
 	/* get merkle tree from IPFS and flatten the tree */
 
-	root, maxChildren, maxDepth, err := c.GetMerkleTree(rootCID, &entangler.Lattice{})
+	root, maxChildren, maxDepth, err := c.GetMerkleTree(ctx, rootCID, &entangler.Lattice{})
 	if err != nil {
-		return rootCID, "", nil, xerrors.Errorf("could not read merkle tree: %s", err)
+		return rootCID, "", nil, xerrors.Errorf("could not read merkle tree: %w", err)
 	}
 	nodes := root.GetFlattenedTree(s, p, true)
 	blockNum := len(nodes)
 	leaves := 0
+	maxBlockSize := 0
+	blockSizes := make([]int, blockNum)
 	util.LogPrintf(util.Green("Number of nodes in the merkle tree is %d. Node sequence:"), blockNum)
 	for idx, node := range nodes {
 		util.LogPrintf(util.Green(" %d"), node.PreOrderIdx)
-		data, err := node.Data()
+		data, err := node.Data(ctx)
+		if err != nil {
+			return rootCID, "", nil, xerrors.Errorf("could not read block %s: %w", node.CID, err)
+		}
 
 		if len(node.Children) == 0 {
 			leaves++
 		}
-
-		if err != nil {
-			log.Fatal(err)
+		if len(data) > maxBlockSize {
+			maxBlockSize = len(data)
 		}
+		blockSizes[idx] = len(data)
 		util.LogPrintf("Data size: %d", len(data))
 		util.LogPrintf("Child number: %d", len(node.Children))
 		util.LogPrintf("Node lattice Index: %d, preorder index: %d", idx, node.PreOrderIdx)
@@ -74,43 +92,51 @@ func (c *Client) Upload(path string, alpha int, s int, p int, replicationFactor
 
 	/* generate entanglement */
 
-	parityBlocks, err := c.generateEntanglementAndUpload(alpha, s, p, nodes)
+	// every parity takes the size of the largest block, so that it can be located in its strand
+	treeCids, err := c.generateEntanglementAndUpload(ctx, alpha, s, p, nodes, maxBlockSize)
 	if err != nil {
 		return rootCID, "", nil, err
 	}
 
 	/* pin files in cluster */
-	treeCids, maxParityChildren, err := c.pinAlphaEntanglements(alpha, parityBlocks, replicationFactor)
+	dataPeers, err := c.dataPeers(ctx, rootCID)
+	if err != nil {
+		return rootCID, "", nil, err
+	}
+	maxParityChildren, parityAllocations, err := c.pinAlphaEntanglements(ctx, treeCids, replicationFactor, dataPeers)
 	if err != nil {
 		return rootCID, "", nil, err
 	}
 
 	/* Store Metatdata */
-	metaData := Metadata{
-		Alpha: alpha,
-		S:     s,
-		P:     p,
-		//new fields
-		NumBlocks:       len(nodes), // N
-		OriginalFileCID: rootCID,
-		TreeCIDs:        treeCids,
-		MaxChildren:     maxChildren, // K
-		Leaves:          leaves,      // L
-		Depth:           maxDepth,    // D
-
-		MaxParityChildren: maxParityChildren,
+	metaData, err := newMetadata(alpha, s, p, c.GetAddOptions())
+	if err != nil {
+		return rootCID, "", nil, err
+	}
+	metaData.ParityBlockSize = maxBlockSize
+	metaData.NumBlocks = len(nodes) // N
+	metaData.OriginalFileCID = rootCID
+	metaData.TreeCIDs = treeCids
+	metaData.MaxChildren = maxChildren // K
+	metaData.Leaves = leaves           // L
+	metaData.Depth = maxDepth          // D
+	metaData.MaxParityChildren = maxParityChildren
+	metaData.ParityAllocations = parityAllocations
+	metaData.DataBlockSizes = blockSizes
+	if err = metaData.Validate(); err != nil {
+		return rootCID, "", nil, xerrors.Errorf("inconsistent metadata: %w", err)
 	}
 	rawMetadata, err := json.Marshal(metaData)
 	if err != nil {
-		return rootCID, "", nil, xerrors.Errorf("could not marshal metadata: %s", err)
+		return rootCID, "", nil, xerrors.Errorf("could not marshal metadata: %w", err)
 	}
-	metaCID, err = c.AddFileFromMem(rawMetadata)
+	metaCID, err = c.AddFileFromMem(ctx, rawMetadata)
 	if err != nil {
-		return rootCID, "", nil, xerrors.Errorf("could not upload metadata: %s", err)
+		return rootCID, "", nil, xerrors.Errorf("could not upload metadata: %w", err)
 	}
 	util.LogPrintf("File CID: %s. MetaFile CID: %s", rootCID, metaCID)
 
-	pinResult = c.pinMetadata(metaCID)
+	pinResult = c.pinMetadata(ctx, metaCID)
 
 	// Notify IPFS-Community Node that ROOT CIDs must be tracked (if requested)
 	if communityNodeAddress != "" {
@@ -128,11 +154,12 @@ func (c *Client) Upload(path string, alpha int, s int, p int, replicationFactor
 		}
 
 		// Send the POST request
-		req, err := http.NewRequest("POST", "http://"+communityNodeAddress+"/forwardMonitoring", bytes.NewBuffer(requestPayload))
+		req, err := http.NewRequestWithContext(ctx, "POST", "http://"+communityNodeAddress+"/forwardMonitoring", bytes.NewBuffer(requestPayload))
 		if err != nil {
 			log.Println("(error creating http request) Couldn't start tracking for : ", rootCID)
 			return rootCID, metaCID, pinResult, nil
 		}
+		c.CommunitySigner.Sign(req, requestPayload)
 		req.Header.Set("Content-Type", "application/json")
 		client := &http.Client{}
 		resp, err := client.Do(req)
@@ -149,140 +176,85 @@ func (c *Client) Upload(path string, alpha int, s int, p int, replicationFactor
 	return rootCID, metaCID, pinResult, nil
 }
 
-// generateLattice takes a slice of flattened tree as well as alpha, s, p to perform alpha entanglement
-func (c *Client) generateEntanglementAndUpload(alpha int, s int, p int,
-	nodes []*ipfsconnector.TreeNode) ([][][]byte, error) {
+// generateEntanglementAndUpload takes a slice of flattened tree as well as alpha, s, p to perform alpha entanglement.
+// Every strand is streamed to IPFS while it is generated, so that only the cached parities stay in memory.
+// The parities are padded to paritySize in the strands
+func (c *Client) generateEntanglementAndUpload(ctx context.Context, alpha int, s int, p int,
+	nodes []*ipfsconnector.TreeNode, paritySize int) ([]string, error) {
 
-	blockNum := len(nodes)
-	dataChan := make(chan []byte, blockNum)
-	parityChan := make(chan entangler.EntangledBlock, alpha*blockNum)
-
-	// start the entangler to read from pipline
-	tangler := entangler.NewEntangler(alpha, s, p, []bool{})
-	go func() {
-		err := tangler.Entangle(dataChan, parityChan)
-		if err != nil {
-			panic(xerrors.Errorf("could not generate entanglement: %s", err))
-		}
-	}()
-
-	// send data to entangler
-	go func() {
-		for _, node := range nodes {
-			nodeData, err := node.Data()
-			if err != nil {
-				return
-			}
-			dataChan <- nodeData
-		}
-		close(dataChan)
-	}()
-
-	/* store parity blocks one by one */
-
-	// parityCIDs := make([][]string, alpha)
-	// for k := 0; k < alpha; k++ {
-	// 	parityCIDs[k] = make([]string, blockNum)
-	// }
+	tangler, err := entangler.NewEntangler(alpha, s, p, []bool{})
+	if err != nil {
+		return nil, err
+	}
+	tangler.ParitySize = paritySize
+	readers := tangler.EntangleToReaders(len(nodes), func(index int) ([]byte, error) {
+		return nodes[index-1].Data(ctx)
+	})
 
-	parityBlocks := make([][][]byte, alpha)
-	for k := 0; k < alpha; k++ {
-		parityBlocks[k] = make([][]byte, blockNum)
+	parityCIDs, err := c.addStrands(ctx, readers)
+	if err != nil {
+		return nil, err
+	}
+	for k, parityCID := range parityCIDs {
+		util.LogPrintf("Finish uploading entanglement %d with root cid %s", k, parityCID)
 	}
 
-	var waitGroupAdd sync.WaitGroup
-	for block := range parityChan {
-		waitGroupAdd.Add(1)
+	return parityCIDs, nil
+}
 
-		go func(block entangler.EntangledBlock) {
-			defer waitGroupAdd.Done()
-			parityBlocks[block.Strand][block.LeftBlockIndex-1] = block.Data
+// dataPeers returns the cluster peers holding the data blocks of a file just added through the IPFS daemon
+// of the client: the peer running that daemon, and the peers the file is pinned on if it already was.
+// The data blocks are not pinned on their own, so all of them are held by these peers
+func (c *Client) dataPeers(ctx context.Context, rootCID string) ([]string, error) {
+	ipfsID, err := c.PeerID(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("could not get the peer ID of the IPFS daemon: %w", err)
+	}
 
-			// // upload file to IPFS network
-			// blockCID, err := c.AddFileFromMem(block.Data)
-			// if err == nil {
-			// 	parityCIDs[block.Strand][block.LeftBlockIndex-1] = blockCID
-			// }
-		}(block)
+	var peers []string
+	if peer := c.IPFSClusterConnector.GetPeerOfIPFS(ipfsID); peer != "" {
+		peers = append(peers, peer)
+	} else {
+		util.LogPrintf("IPFS daemon %s does not run a cluster peer", ipfsID)
 	}
-	waitGroupAdd.Wait()
-
-	// // check if all parity blocks are added successfully
-	// for k := 0; k < alpha; k++ {
-	// 	util.LogPrintf("Displaying parities for strand %d", k)
-	// 	for i, parity := range parityCIDs[k] {
-	// 		util.LogPrintf("Parity %d: %s", i, parity)
-	// 		if len(parity) == 0 {
-	// 			return nil, nil, xerrors.Errorf("could not upload parity %d on strand %d\n", i, k)
-	// 		}
-	// 	}
-	// 	util.LogPrintf("Finish uploading entanglement %d", k)
-	// }
-
-	// c.pinAlphaEntanglements(alpha, parityBlocks)
-
-	return parityBlocks, nil
+	peers = append(peers, c.IPFSClusterConnector.GetPinAllocationIDs(ctx, rootCID)...)
+	return peers, nil
 }
 
-func (c *Client) pinAlphaEntanglements(alpha int, parityBlocks [][][]byte, replicationFactor int) ([]string, int, error) {
-	// for each strand, merge all bytes into one byte array
-	// then upload the whole file to IPFS
-	// retreieve the merkle tree of each file
-	// for each tree, recursively pin the root node and all its children
-	// finally return each of the strand's root node's CID
-
-	// TODO: Try to find if there's another way for this!
-	// we will define each block so that it would be exactly 2 * 256 KB (which is the maximum for each block in IPFS)
-	// targetSize := 2 * 262144
+// pinAlphaEntanglements pins the merkle tree of every uploaded strand, placing the parities away from the
+// peers holding the data. It returns the maximum number of children of a parity tree node and the peers
+// allocated to each pinned parity tree node
+func (c *Client) pinAlphaEntanglements(ctx context.Context, parityCIDs []string, replicationFactor int,
+	dataPeers []string) (int, map[string][]string, error) {
 
 	currentMaxChildren := 0
-	parityCIDs := make([]string, alpha)
-	for k := 0; k < alpha; k++ {
-		// merge all bytes into one byte array
-		var mergedParity []byte
-		util.LogPrintf("Merging entanglement %d", k)
-		for _, block := range parityBlocks[k] {
-			util.LogPrintf("Parity block size: %d", len(block))
-			// padding := make([]byte, targetSize-len(block))
-			mergedParity = append(mergedParity, block...)
-			// mergedParity = append(mergedParity, padding...)
-		}
-
-		// print mergedParity size
-		util.LogPrintf("Merged parity size: %d", len(mergedParity))
-		// upload file to IPFS network
-		blockCID, err := c.AddFileFromMem(mergedParity)
-		if err != nil {
-			return nil, 0, xerrors.Errorf("could not upload parity %d: %s", k, err)
-		}
-
-		util.LogPrintf("Finish uploading entanglement %d with root cid %s", k, blockCID)
-
+	allocations := make(map[string][]string)
+	for k, parityCID := range parityCIDs {
 		// pin the whole file block by block
-		tmpMaxChildren, err := c.pinEntanglementTree(blockCID, replicationFactor)
+		tmpMaxChildren, err := c.pinEntanglementTree(ctx, parityCID, replicationFactor, dataPeers, allocations)
 		if err != nil {
-			return nil, 0, xerrors.Errorf("could not pin parity %d: %s", k, err)
+			return 0, nil, xerrors.Errorf("could not pin parity %d: %w", k, err)
 		}
 
 		if tmpMaxChildren > currentMaxChildren {
 			currentMaxChildren = tmpMaxChildren
 		}
-		util.LogPrintf("Finish uploading entanglement %d with root cid %s", k, blockCID)
-		parityCIDs[k] = blockCID
+		util.LogPrintf("Finish pinning entanglement %d with root cid %s", k, parityCID)
 	}
 
-	return parityCIDs, currentMaxChildren, nil
+	return currentMaxChildren, allocations, nil
 }
 
-func (c *Client) pinEntanglementTree(entaglementCID string, replicationFactor int) (int, error) {
+// pinEntanglementTree pins the merkle tree of a strand. The placement of each leaf, which holds the parities,
+// avoids the given peers holding the data blocks and the chosen allocations are recorded in allocations
+func (c *Client) pinEntanglementTree(ctx context.Context, entaglementCID string, replicationFactor int,
+	dataPeers []string, allocations map[string][]string) (int, error) {
 	// get the merkle tree from IPFS
 	currentMaxChildren := 0
-	tree, _, _, err := c.GetMerkleTree(entaglementCID, nil)
+	tree, _, _, err := c.GetMerkleTree(ctx, entaglementCID, nil)
 	if err != nil {
-		return 0, xerrors.Errorf("could not get merkle tree: %s", err)
+		return 0, xerrors.Errorf("could not get merkle tree: %w", err)
 	}
-	// Strand 0 , parity 0
-	//Qma3dPFfrYjS8yGbyMZCrrRNDq6oFKhykmqEnuSnAvhp85
 
 	// recursively pin the root node and all its children
 	var walker func(*ipfsconnector.TreeNode)
@@ -295,14 +267,15 @@ func (c *Client) pinEntanglementTree(entaglementCID string, replicationFactor in
 		// if leaf then just pin once, otherwise pin replicationFactor times
 		var err error
 		if len(parent.Children) == 0 {
-			err = c.IPFSClusterConnector.AddPinDirect(parent.CID, 1)
+			err = c.IPFSClusterConnector.AddPinDirectWithNeighbours(ctx, parent.CID, 1, dataPeers)
 		} else {
-			err = c.IPFSClusterConnector.AddPinDirect(parent.CID, replicationFactor)
+			err = c.IPFSClusterConnector.AddPinDirect(ctx, parent.CID, replicationFactor)
 		}
 		if err != nil {
 			log.Printf("could not pin node %s: %s", parent.CID, err)
 			return
 		}
+		allocations[parent.CID] = c.IPFSClusterConnector.GetPinAllocationIDs(ctx, parent.CID)
 		if len(parent.Children) > currentMaxChildren {
 			currentMaxChildren = len(parent.Children)
 		}
@@ -320,16 +293,16 @@ func (c *Client) pinEntanglementTree(entaglementCID string, replicationFactor in
 
 // pinMetadataAndParities pins the metadata and parities in IPFS cluster in the non-blocking way
 // User could use the returned function to wait and check if there is any error
-func (c *Client) pinMetadata(metaCID string) func() error {
+func (c *Client) pinMetadata(ctx context.Context, metaCID string) func() error {
 	var waitGroupPin sync.WaitGroup
 	waitGroupPin.Add(1)
 	var PinErr error
 	go func() {
 		defer waitGroupPin.Done()
 
-		err := c.IPFSClusterConnector.AddPin(metaCID, 0)
+		err := c.IPFSClusterConnector.AddPin(ctx, metaCID, 0)
 		if err != nil {
-			PinErr = xerrors.Errorf("could not pin metadata: %s", err)
+			PinErr = xerrors.Errorf("could not pin metadata: %w", err)
 			return
 		}
 	}()
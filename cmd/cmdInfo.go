@@ -1,10 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"ipfs-alpha-entanglement-code/Server"
+	"ipfs-alpha-entanglement-code/auth"
 	"ipfs-alpha-entanglement-code/client"
+	"ipfs-alpha-entanglement-code/entangler"
+	ipfscluster "ipfs-alpha-entanglement-code/ipfs-cluster"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	localstore "ipfs-alpha-entanglement-code/local-store"
 	"ipfs-alpha-entanglement-code/performance"
 	"ipfs-alpha-entanglement-code/util"
 	"log"
@@ -12,11 +18,15 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// SecretEnv is the environment variable holding the secret of the community nodes by default, the one of the cluster
+const SecretEnv = "CLUSTER_SECRET"
+
 type Command struct {
 	*cobra.Command
 	*client.Client
@@ -27,7 +37,7 @@ type Command struct {
 func NewCommand() (command *Command, err error) {
 	command = &Command{}
 	command.initCmd()
-	cl, _ := client.NewClient("", 0, "", 0)
+	cl, _ := client.NewClient(context.Background(), "", 0, "", 0)
 	// if err != nil {
 	// 	return nil, err
 	// }
@@ -48,6 +58,7 @@ func (c *Command) initCmd() {
 	c.AddPerformanceCmd()
 	c.AddDaemonCmd()
 	c.AddDownloadCountCmd()
+	c.AddRepairCmd()
 }
 
 func (c *Command) AddDaemonCmd() {
@@ -58,6 +69,10 @@ func (c *Command) AddDaemonCmd() {
 	var IpfsIP string
 	var IpfsPort int
 	var discovery string
+	var discoveryConfig Server.DiscoveryConfig
+	var stateDir string
+	var secret string
+	var identity string
 
 	daemonCmd := &cobra.Command{
 		Use:   "daemon",
@@ -68,7 +83,35 @@ func (c *Command) AddDaemonCmd() {
 			util.EnableLogPrint()
 			util.EnableInfoPrint()
 
-			c.RunServer(port, communityIP, clusterIP, clusterPort, IpfsIP, IpfsPort, discovery)
+			if len(secret) > 0 {
+				key, err := auth.ParseSecret(secret)
+				if err != nil {
+					log.Println("Error:", err)
+					os.Exit(1)
+				}
+				peerKey, err := auth.LoadIdentity(identity)
+				if err != nil {
+					log.Println("Error:", err)
+					os.Exit(1)
+				}
+				c.SetSecret(key, peerKey)
+			}
+
+			// the discovery service is only used for the metrics of the repairs with another backend
+			if discoveryConfig.Backend != Server.HTTPDiscoveryBackend && !cmd.Flags().Changed("discovery") {
+				discovery = ""
+			}
+			discoveryConfig.Address = discovery
+			discoveryConfig.ClusterIP = clusterIP
+			discoveryConfig.ClusterPort = clusterPort
+			backend, err := Server.NewDiscovery(discoveryConfig)
+			if err != nil {
+				log.Println("Error:", err)
+				os.Exit(1)
+			}
+			c.SetDiscovery(backend)
+
+			os.Exit(c.RunServer(port, communityIP, clusterIP, clusterPort, IpfsIP, IpfsPort, discovery, stateDir))
 		},
 	}
 	daemonCmd.Flags().IntVarP(&port, "port", "p", 7070, "Set the port for corresponding community node")
@@ -78,6 +121,13 @@ func (c *Command) AddDaemonCmd() {
 	daemonCmd.Flags().StringVarP(&IpfsIP, "ipfs-ip", "j", "localhost", "Sets the IP address of the IPFS node")
 	daemonCmd.Flags().IntVarP(&IpfsPort, "ipfs-port", "b", 5001, "Sets the port of the IPFS node")
 	daemonCmd.Flags().StringVarP(&discovery, "discovery", "d", "localhost:3000", "Sets the discovery server address with port")
+	daemonCmd.Flags().StringVar(&discoveryConfig.Backend, "discovery-backend", Server.HTTPDiscoveryBackend, "Sets how the community nodes are found: http (discovery server), static, dns or cluster")
+	daemonCmd.Flags().StringVar(&discoveryConfig.PeersFile, "peers-file", "", "Sets the JSON file listing the community nodes, for the static discovery")
+	daemonCmd.Flags().StringVar(&discoveryConfig.Service, "discovery-srv", "", "Sets the name of the SRV records of the community nodes, e.g. _community._tcp.example.org, for the dns discovery")
+	daemonCmd.Flags().StringVar(&discoveryConfig.Tag, "discovery-tag", Server.DefaultCommunityTag, "Sets the cluster peer tag holding the address of its community node, for the cluster discovery")
+	daemonCmd.Flags().StringVarP(&stateDir, "state-dir", "s", "community-state", "Sets the directory where the state of the community node is persisted, kept in memory only if empty")
+	daemonCmd.Flags().StringVar(&secret, "secret", os.Getenv(SecretEnv), "Sets the hexadecimal secret shared by the community nodes to sign their requests, any request is accepted if empty")
+	daemonCmd.Flags().StringVar(&identity, "identity", defaultIdentityPath(), "Sets the identity file of the cluster peer, whose key signs the requests of the node along with the secret")
 	c.AddCommand(daemonCmd)
 }
 
@@ -86,6 +136,10 @@ func (c *Command) AddUploadCmd() {
 	var alpha, s, p, replication int
 	var cNAddress string
 	var directReplication int
+	var placement string
+	var localDir string
+	var secret string
+	addOptions := ipfsconnector.DefaultAddOptions()
 	uploadCmd := &cobra.Command{
 		Use:   "upload [path]",
 		Short: "Upload a file to IPFS",
@@ -94,7 +148,26 @@ func (c *Command) AddUploadCmd() {
 		Run: func(cmd *cobra.Command, args []string) {
 			// util.EnableLogPrint()
 
-			cl, err := client.NewClient("", 0, "", 0)
+			if len(localDir) > 0 {
+				store, err := openLocalStore(localDir, addOptions)
+				if err != nil {
+					log.Println("Error:", err)
+					os.Exit(1)
+				}
+				cid, metaCID, err := client.UploadLocal(context.Background(), store, args[0], alpha, s, p)
+				if err != nil {
+					log.Println("Error:", err)
+					os.Exit(1)
+				}
+				log.Println("Finish adding file to the local store. File CID: ", cid)
+				if len(metaCID) > 0 {
+					log.Println("Finish adding metaData to the local store. MetaFile CID: ", metaCID)
+				}
+				return
+			}
+
+			ctx := context.Background()
+			cl, err := client.NewClient(ctx, "", 0, "", 0)
 
 			if err != nil {
 				log.Println("Error:", err)
@@ -102,9 +175,27 @@ func (c *Command) AddUploadCmd() {
 			}
 
 			c.Client = cl
+			c.CommunitySigner, err = newClientSigner(secret)
+			if err != nil {
+				log.Println("Error:", err)
+				os.Exit(1)
+			}
+
+			policy, err := ipfscluster.NewPlacementPolicy(placement)
+			if err != nil {
+				log.Println("Error:", err)
+				os.Exit(1)
+			}
+			c.IPFSClusterConnector.SetPlacementPolicy(policy)
+
+			err = c.IPFSConnector.SetAddOptions(addOptions)
+			if err != nil {
+				log.Println("Error:", err)
+				os.Exit(1)
+			}
 
 			if directReplication > 0 {
-				err := c.DirectUploadWithReplication(args[0], directReplication)
+				err := c.DirectUploadWithReplication(ctx, args[0], directReplication)
 
 				if err != nil {
 					log.Println("Error:", err)
@@ -115,7 +206,7 @@ func (c *Command) AddUploadCmd() {
 				return
 			}
 
-			cid, metaCID, pinResult, err := c.Upload(args[0], alpha, s, p, replication, cNAddress)
+			cid, metaCID, pinResult, err := c.Upload(ctx, args[0], alpha, s, p, replication, cNAddress)
 			if len(cid) > 0 {
 				log.Println("Finish adding file to IPFS. File CID: ", cid)
 			}
@@ -142,6 +233,13 @@ func (c *Command) AddUploadCmd() {
 	uploadCmd.Flags().IntVarP(&replication, "replication", "r", 5, "Set replication factor for intermediate nodes of EMTs")
 	uploadCmd.Flags().StringVarP(&cNAddress, "address", "d", "", "Pass the Community node address:port for monitoring")
 	uploadCmd.Flags().IntVarP(&directReplication, "direct-replication", "t", 0, "Set replication factor for direct replication (without entanglement)")
+	uploadCmd.Flags().StringVarP(&placement, "placement", "l", "round-robin", "Set the parity placement policy: round-robin, region or neighbour")
+	uploadCmd.Flags().IntVar(&addOptions.CidVersion, "cid-version", addOptions.CidVersion, "Set the CID version of the file blocks: 0 or 1")
+	uploadCmd.Flags().StringVar(&addOptions.Hash, "hash", addOptions.Hash, "Set the hash function of the file blocks")
+	uploadCmd.Flags().BoolVar(&addOptions.RawLeaves, "raw-leaves", addOptions.RawLeaves, "Store the file leaves as raw blocks")
+	uploadCmd.Flags().StringVar(&addOptions.Chunker, "chunker", addOptions.Chunker, "Set the chunker: size-N, rabin, rabin-avg, rabin-min-avg-max or buzhash")
+	uploadCmd.Flags().StringVar(&localDir, "local", "", "Store the file and its entanglement in a local directory instead of IPFS")
+	uploadCmd.Flags().StringVar(&secret, "secret", os.Getenv(SecretEnv), "Set the hexadecimal secret of the community nodes to sign the monitoring request")
 
 	c.AddCommand(uploadCmd)
 }
@@ -157,7 +255,8 @@ type ErrorResponse struct {
 	Error   string `json:"error"`
 }
 
-func (c *Command) downloadFile(communityAddress, rootFileCID, metadataCID, path string, uploadRecoverData bool, depth int) (string, error) {
+func (c *Command) downloadFile(communityAddress, rootFileCID, metadataCID, path string, uploadRecoverData bool, depth int,
+	recovery string, signer *auth.Signer) (string, error) {
 	baseURL := fmt.Sprintf("http://%s/downloadFile", communityAddress)
 
 	// Build the query parameters
@@ -167,12 +266,17 @@ func (c *Command) downloadFile(communityAddress, rootFileCID, metadataCID, path
 	params.Add("path", path)
 	params.Add("uploadRecoverData", fmt.Sprintf("%v", uploadRecoverData))
 	params.Add("depth", fmt.Sprintf("%d", depth))
+	params.Add("recovery", recovery)
 
 	// Construct the final URL with query parameters
 	fullURL := fmt.Sprintf("%s?%s", baseURL, params.Encode())
 
 	// Send the GET request
-	resp, err := http.Get(fullURL)
+	req, err := signer.NewRequest("GET", fullURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("error making request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("error making request: %v", err)
 	}
@@ -208,6 +312,9 @@ func (c *Command) AddDownloadCmd() {
 	var path string
 	var communityAddress string
 	var depth int
+	var recovery string
+	var localDir string
+	var secret string
 	downloadCmd := &cobra.Command{
 		Use:   "download [cid] [path]",
 		Short: "Download a file from IPFS",
@@ -216,8 +323,24 @@ func (c *Command) AddDownloadCmd() {
 		Run: func(cmd *cobra.Command, args []string) {
 			util.EnableLogPrint()
 
+			if len(localDir) > 0 {
+				out, err := downloadLocal(localDir, args[0], path, opt, depth, recovery)
+				if err != nil {
+					log.Println("Error:", err)
+					os.Exit(1)
+				}
+				log.Printf("Download succeeds to '%s'.\n", out)
+				return
+			}
+
+			signer, err := newClientSigner(secret)
+			if err != nil {
+				log.Println("Error:", err)
+				os.Exit(1)
+			}
+
 			// send get request to 0.0.0.0:port/downloadFile
-			out, err := c.downloadFile(communityAddress, args[0], opt.MetaCID, path, opt.UploadRecoverData, depth)
+			out, err := c.downloadFile(communityAddress, args[0], opt.MetaCID, path, opt.UploadRecoverData, depth, recovery, signer)
 			if err != nil {
 				log.Println("Error:", err)
 				os.Exit(1)
@@ -237,10 +360,101 @@ func (c *Command) AddDownloadCmd() {
 		[]int{}, "Specify the missing data blocks for testing")
 
 	downloadCmd.Flags().IntVarP(&depth, "depth", "d", 1, "Set the depth for repairing the missing data (1 no repair)")
+	downloadCmd.Flags().StringVar(&recovery, "recovery", "sequential",
+		"Set the recovery mode: sequential, parallel or hybrid (parallel after depth)")
+	downloadCmd.Flags().StringVar(&localDir, "local", "", "Read the file from a local directory instead of the community node")
+	downloadCmd.Flags().StringVar(&secret, "secret", os.Getenv(SecretEnv), "Set the hexadecimal secret of the community nodes to sign the download request")
 
 	c.AddCommand(downloadCmd)
 }
 
+// newClientSigner returns the signer of the requests of a client to a community node, nil without secret
+func newClientSigner(secret string) (*auth.Signer, error) {
+	if len(secret) == 0 {
+		return nil, nil
+	}
+	key, err := auth.ParseSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewSigner(key), nil
+}
+
+// defaultIdentityPath returns the path of the identity file of ipfs-cluster-service in its default folder
+func defaultIdentityPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "identity.json"
+	}
+	return filepath.Join(home, ".ipfs-cluster", "identity.json")
+}
+
+// openLocalStore opens the local store in the directory
+func openLocalStore(dir string, opts ipfsconnector.AddOptions) (*localstore.Store, error) {
+	store, err := localstore.CreateStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = store.SetAddOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// downloadLocal reads and repairs the file from the local store and writes it to path
+func downloadLocal(dir string, rootCID string, path string, opt client.DownloadOption, depth int, recovery string) (string, error) {
+	store, err := openLocalStore(dir, ipfsconnector.DefaultAddOptions())
+	if err != nil {
+		return "", err
+	}
+	opt.RecoveryMode, err = entangler.ParseRecoveryMode(recovery)
+	if err != nil {
+		return "", err
+	}
+	if depth < 0 {
+		depth = 0
+	}
+
+	data, _, err := client.DownloadLocal(context.Background(), store, rootCID, opt, uint(depth))
+	if err != nil {
+		return "", err
+	}
+	return client.WriteFile(rootCID, path, data)
+}
+
+// AddRepairCmd enables the repair of a strand stored in a local directory
+func (c *Command) AddRepairCmd() {
+	var localDir string
+	var strand int
+	repairCmd := &cobra.Command{
+		Use:   "repair [metacid]",
+		Short: "Repair a strand of a file in a local directory",
+		Long:  "Regenerate a strand of a file stored in a local directory, and the missing data blocks on the way",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			util.EnableLogPrint()
+
+			store, err := openLocalStore(localDir, ipfsconnector.DefaultAddOptions())
+			if err != nil {
+				log.Println("Error:", err)
+				os.Exit(1)
+			}
+			err = client.RepairStrandLocal(context.Background(), store, args[0], strand)
+			if err != nil {
+				log.Println("Error:", err)
+				os.Exit(1)
+			}
+			log.Printf("Repair of strand %d succeeds.\n", strand)
+		},
+	}
+	repairCmd.Flags().StringVar(&localDir, "local", "", "Set the local directory storing the file")
+	repairCmd.Flags().IntVarP(&strand, "strand", "s", 0, "Set the strand to repair")
+	repairCmd.MarkFlagRequired("local")
+
+	c.AddCommand(repairCmd)
+}
+
 // AddDownloadCmd enables download functionality
 func (c *Command) AddDownloadCountCmd() {
 	var metaCID string
@@ -256,17 +470,18 @@ func (c *Command) AddDownloadCountCmd() {
 			// util.EnableLogPrint()
 			startTime := time.Now()
 			// For testing purposes only, using different ports for IPFS and IPFS Cluster
-			cl, err := client.NewClient("", 9095, "", 5002)
+			// every block IPFS cannot find quickly is skipped and recovered
+			ctx := ipfsconnector.WithBlockTimeout(context.Background(), 100*time.Millisecond)
+			cl, err := client.NewClient(ctx, "", 9095, "", 5002)
 
 			if err != nil {
 				log.Println("Error:", err)
 				os.Exit(1)
 			}
 
-			cl.IPFSConnector.SetTimeout(100 * time.Millisecond)
 			c.Client = cl
 
-			getter, cnt, err := c.DownloadCount(args[0], metaCID, depth)
+			getter, cnt, err := c.DownloadCount(ctx, args[0], metaCID, depth)
 			// send get request to 0.0.0.0:port/downloadFile
 
 			if metrics {
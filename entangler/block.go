@@ -30,6 +30,7 @@ type Block struct {
 	IsParity       bool
 	Index          int
 	Repaired       bool
+	Size           int // exact size of the data if known. Recovered data are truncated to it
 
 	// parity block parameters
 	Strand         int
@@ -101,7 +102,7 @@ func (b *Block) StartRepair(ctx context.Context, rid uint) bool {
 					// already visited by the request
 					return false
 				}
-				b.waitingGroup.Wait()
+				b.waitWithContext(ctx)
 			} else if b.Status == DataAvailable {
 				return false
 			} else {
@@ -113,6 +114,28 @@ func (b *Block) StartRepair(ctx context.Context, rid uint) bool {
 	}
 }
 
+// waitWithContext waits for the block to be released by another request, or for ctx to be done.
+// The block lock must be held
+func (b *Block) waitWithContext(ctx context.Context) {
+	if ctx.Done() == nil {
+		b.waitingGroup.Wait()
+		return
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.Lock()
+			b.waitingGroup.Broadcast()
+			b.Unlock()
+		case <-stop:
+		}
+	}()
+	b.waitingGroup.Wait()
+}
+
 // FinishRepair update the block status and wake the waiting thread
 func (b *Block) FinishRepair(success bool) {
 	b.Lock()
@@ -137,6 +160,9 @@ func (b *Block) SetData(data []byte, isRecover bool) {
 	defer b.Unlock()
 
 	if b.Status != DataAvailable {
+		if isRecover {
+			data = b.truncate(data)
+		}
 		b.Data = data
 		b.Status = DataAvailable
 		b.Repaired = isRecover
@@ -145,11 +171,10 @@ func (b *Block) SetData(data []byte, isRecover bool) {
 
 // Recover recovers the block by xoring two given chunk
 func (b *Block) Recover(v []byte, w []byte) (err error) {
-	if len(v) == 0 || len(w) == 0 {
-		err = xerrors.Errorf("invalid recover input!")
+	data, err := b.recoveredData(v, w)
+	if err != nil {
 		return err
 	}
-	data := xorChunkData(v, w)
 
 	b.Lock()
 	defer b.Unlock()
@@ -163,6 +188,33 @@ func (b *Block) Recover(v []byte, w []byte) (err error) {
 	return nil
 }
 
+// recoveredData returns the data of the block recovered from two given chunk, without setting it
+func (b *Block) recoveredData(v []byte, w []byte) ([]byte, error) {
+	if len(v) == 0 || len(w) == 0 {
+		return nil, xerrors.Errorf("invalid recover input!")
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	return b.truncate(xorChunkData(v, w)), nil
+}
+
+// hasSize tells whether the exact size of the data is known, so that recovered data are truncated to it
+func (b *Block) hasSize() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.Size > 0
+}
+
+// truncate removes the padding that recovered data get from the longer blocks they are xored with.
+// The block lock must be held, unless the size is not changed concurrently
+func (b *Block) truncate(data []byte) []byte {
+	if b.Size > 0 && len(data) > b.Size {
+		return data[:b.Size]
+	}
+	return data
+}
+
 // GetRecoverPairs returns a list of pair that can be used to do recovery
 func (b *Block) GetRecoverPairs() (pairs []*BlockPair) {
 	b.once.Do(func() {
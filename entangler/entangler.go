@@ -1,30 +1,45 @@
 package entangler
 
 import (
+	"errors"
 	"ipfs-alpha-entanglement-code/util"
 	"os"
 
 	"golang.org/x/xerrors"
 )
 
-// Position defines which position category the original block belongs
-type PositionClass int8
-
-const (
-	Top PositionClass = iota
-	Central
-	Bottom
-)
+// ErrInvalidParameters is returned when the entanglement parameters do not describe a valid lattice
+var ErrInvalidParameters = errors.New("invalid entanglement parameters")
 
 // Strand defines which strand the entangled block belongs
+// Strand 0 is horizontal. The following strands are helical and alternate between
+// right-handed and left-handed classes, each pair using a steeper pitch than the previous one
 type StrandClass int
 
 const (
 	Horizontal StrandClass = iota
 	Right
 	Left
+	Right2
+	Left2
 )
 
+// IsHorizontal returns true if the strand is the horizontal strand
+func (strand StrandClass) IsHorizontal() bool {
+	return strand == Horizontal
+}
+
+// IsRightHanded returns true if the strand is a right-handed helical strand
+func (strand StrandClass) IsRightHanded() bool {
+	return strand > Horizontal && strand%2 == 1
+}
+
+// Pitch returns the number of rows a helical strand moves down (right-handed) or up (left-handed)
+// between two consecutive columns. The horizontal strand has pitch 0
+func (strand StrandClass) Pitch() int {
+	return (int(strand) + 1) / 2
+}
+
 // EntangledBlock is the parity block output by alpha entanglement code
 type EntangledBlock struct {
 	LeftBlockIndex  int
@@ -42,34 +57,53 @@ func NewEntangledBlock(l int, r int, data []byte, strand int) (block *EntangledB
 
 // Entangler manages all the entanglement related behaviors
 type Entangler struct {
-	Alpha    int // now only support alpha = 3
+	Alpha    int // number of strands. 1 horizontal + (Alpha - 1) helical
 	S        int
 	P        int
 	ChunkNum int
 
+	// size of the parities in the readers of EntangleToReaders. Shorter parities are zero-padded
+	// so that a parity can be located in a strand. Not padded if 0
+	ParitySize int
+
 	ChainStartData       [][]byte
 	MaxChainNumPerStrand int
 
 	// cached data. reset for each entanglement
 	cachedParities     [][]*EntangledBlock
 	parityBlocksToWrap [][]*EntangledBlock
+	wrappedParities    [][]*EntangledBlock // precomputed wrapping parities. only set by EntangleOrdered
 
 	// Strands to generate
 	// For each index, specifies whether the strand should be generated
 	Strands []bool
 }
 
-// NewEntangler takes the entanglement paramters and the original data slice and creates an entangler
-func NewEntangler(alpha int, s int, p int, strands []bool) (entangler *Entangler) {
+// NewEntangler takes the entanglement paramters and the original data slice and creates an entangler.
+// It returns ErrInvalidParameters if the parameters do not describe a valid lattice
+func NewEntangler(alpha int, s int, p int, strands []bool) (entangler *Entangler, err error) {
 	// value check. See details in alpha-entanglement-code paper (https://ieeexplore.ieee.org/document/8416482)
 	if alpha < 1 {
-		util.ThrowError("invalid value. Expect alpha > 0")
+		return nil, xerrors.Errorf("expect alpha > 0: %w", ErrInvalidParameters)
 	}
 	if alpha == 1 && !(s == 1 && p == 0) {
-		util.ThrowError("invalid value. Expect s = 1 and p = 0")
+		return nil, xerrors.Errorf("expect s = 1 and p = 0: %w", ErrInvalidParameters)
 	}
 	if alpha > 1 && s > p {
-		util.ThrowError("invalid value. Expect p >= s")
+		return nil, xerrors.Errorf("expect p >= s: %w", ErrInvalidParameters)
+	}
+	if alpha > 3 {
+		// the steepest helical strands must not overlap the horizontal strand or each other
+		maxPitch := StrandClass(alpha - 1).Pitch()
+		if maxPitch >= s {
+			return nil, xerrors.Errorf("expect s > %d for alpha = %d: %w", maxPitch, alpha, ErrInvalidParameters)
+		}
+		if alpha%2 == 1 && 2*maxPitch == s {
+			return nil, xerrors.Errorf("expect s != %d for alpha = %d: %w", s, alpha, ErrInvalidParameters)
+		}
+	}
+	if len(strands) != 0 && len(strands) != alpha {
+		return nil, xerrors.Errorf("expect %d strands but %d given: %w", alpha, len(strands), ErrInvalidParameters)
 	}
 
 	entangler = &Entangler{Alpha: alpha, S: s, P: p}
@@ -87,7 +121,7 @@ func NewEntangler(alpha int, s int, p int, strands []bool) (entangler *Entangler
 		entangler.Strands = strands
 	}
 
-	return entangler
+	return entangler, nil
 }
 
 // WriteEntanglementToFile writes the entanglement into files
@@ -141,6 +175,7 @@ func (e *Entangler) WriteEntanglementToFile(chunkSize int, path []string, parity
 
 // Entangle generate the entangelement for the given arrray of blocks
 func (e *Entangler) Entangle(dataChan chan []byte, parityChan chan EntangledBlock) error {
+	e.wrappedParities = nil
 	e.prepareEntangle()
 
 	// generate the lattice
@@ -166,6 +201,49 @@ func (e *Entangler) Entangle(dataChan chan []byte, parityChan chan EntangledBloc
 	return nil
 }
 
+// EntangleOrdered generates the same entanglement as Entangle, but emits the parities of every strand
+// in the order of their left block index, so that a strand can be streamed without buffering it.
+// The wrapping parities are computed by a first pass over the data, therefore getData is called
+// twice for every block index from 1 to blockNum
+func (e *Entangler) EntangleOrdered(blockNum int, getData func(index int) ([]byte, error),
+	parityChan chan EntangledBlock) error {
+	defer close(parityChan)
+
+	// first pass: only compute the parities that wrap the lattice
+	util.LogPrintf("Start computing wrapping parities")
+	e.wrappedParities = nil
+	e.prepareEntangle()
+	for index := 1; index <= blockNum; index++ {
+		block, err := getData(index)
+		if err != nil {
+			return xerrors.Errorf("could not read block %d: %w", index, err)
+		}
+		e.entangleSingleBlock(index, block, nil)
+		if index <= e.MaxChainNumPerStrand {
+			e.ChainStartData[index-1] = block
+		}
+	}
+	e.ChunkNum = blockNum
+	e.wrapLattice(nil)
+	e.wrappedParities = e.parityBlocksToWrap
+	util.LogPrintf("Finish computing wrapping parities")
+
+	// second pass: generate the lattice and emit the wrapping parities in place
+	util.LogPrintf("Start generating lattice")
+	e.prepareEntangle()
+	for index := 1; index <= blockNum; index++ {
+		block, err := getData(index)
+		if err != nil {
+			return xerrors.Errorf("could not read block %d: %w", index, err)
+		}
+		e.entangleSingleBlock(index, block, parityChan)
+	}
+	e.wrappedParities = nil
+	util.LogPrintf("Finish generating lattice")
+
+	return nil
+}
+
 // prepareEntangle prepares the data structure that will be used for entanglement
 func (e *Entangler) prepareEntangle() {
 	e.parityBlocksToWrap = make([][]*EntangledBlock, e.Alpha)
@@ -201,7 +279,8 @@ func (e *Entangler) prepareEntangle() {
 
 // entangleSingleBlock reads the backward parity neighbors from cache
 // and produce the corresponding forward parity neighbors. It should be
-// called in the correct order to ensure the correctness of cached blocks
+// called in the correct order to ensure the correctness of cached blocks.
+// A nil parityChan only updates the cache
 func (e *Entangler) entangleSingleBlock(index int, data []byte, parityChan chan EntangledBlock) {
 	cachePos := e.getChainIndexes(index)
 	rIndexes := e.getForwardNeighborIndexes(index)
@@ -219,14 +298,19 @@ func (e *Entangler) entangleSingleBlock(index int, data []byte, parityChan chan
 		nextBlock := NewEntangledBlock(index, rIndexes[k], parityData, k)
 		e.cachedParities[k][cachePos[k]] = nextBlock
 		if e.getChainStartIndexes(index)[k] != index {
-			parityChan <- *nextBlock
+			if parityChan != nil {
+				parityChan <- *nextBlock
+			}
+		} else if e.wrappedParities != nil {
+			parityChan <- *e.wrappedParities[k][index-1]
 		} else {
 			e.parityBlocksToWrap[k][index-1] = nextBlock
 		}
 	}
 }
 
-// wrapLattice wraps the lattice by modify the first parities on each strand
+// wrapLattice wraps the lattice by modify the first parities on each strand.
+// A nil parityChan only computes the wrapping parities
 func (e *Entangler) wrapLattice(parityChan chan EntangledBlock) {
 	for k, cacheParity := range e.cachedParities {
 		if !e.Strands[k] {
@@ -244,22 +328,13 @@ func (e *Entangler) wrapLattice(parityChan chan EntangledBlock) {
 					xorChunkData(e.ChainStartData[index-1], parityNode.Data), k)
 				e.parityBlocksToWrap[k][index-1] = rNext
 			}
-			parityChan <- *e.parityBlocksToWrap[k][index-1]
+			if parityChan != nil {
+				parityChan <- *e.parityBlocksToWrap[k][index-1]
+			}
 		}
 	}
 }
 
-// getPositionCategory determines which category the node belongs. Top, Bottom or Central
-func (e *Entangler) getPositionCategory(index int) PositionClass {
-	nodePos := index % e.S
-	if nodePos == 1 || nodePos == 1-e.S {
-		return Top
-	} else if nodePos == 0 {
-		return Bottom
-	}
-	return Central
-}
-
 // getChainIndexes reads the cached backward parity neighbors of the current indexed node
 func (e *Entangler) getChainIndexes(index int) (indexes []int) {
 	h := (index - 1) % e.S
@@ -268,10 +343,17 @@ func (e *Entangler) getChainIndexes(index int) (indexes []int) {
 	x := indexInWindow % e.P
 	y := indexInWindow / e.P
 
-	rh := (y - x + e.P) % e.P
-	lh := (x + y) % e.S
-
-	indexes = []int{h, rh, lh}
+	indexes = make([]int, e.Alpha)
+	indexes[0] = h
+	for k := 1; k < e.Alpha; k++ {
+		strand := StrandClass(k)
+		pitch := strand.Pitch()
+		if strand.IsRightHanded() {
+			indexes[k] = ((pitch*y-x)%e.P + e.P) % e.P
+		} else {
+			indexes[k] = (pitch*y + x) % e.S
+		}
+	}
 
 	return indexes
 }
@@ -279,70 +361,46 @@ func (e *Entangler) getChainIndexes(index int) (indexes []int) {
 // getChainStartIndexes returns the position of the first node on the chain where the indexed node is on
 func (e *Entangler) getChainStartIndexes(index int) (indexes []int) {
 	indexes = e.getChainIndexes(index)
-	indexes[0]++
-	indexes[1] = (e.P-indexes[1])%e.P + 1
-	indexes[2]++
+	for k := range indexes {
+		if StrandClass(k).IsRightHanded() {
+			indexes[k] = (e.P-indexes[k])%e.P + 1
+		} else {
+			indexes[k]++
+		}
+	}
 
 	return indexes
 }
 
-// getBackwardNeighborIndexes returns the index of backward neighbors that can be entangled with current node
-// See details in alpha-entanglement-code paper (https://ieeexplore.ieee.org/document/8416482)
-// func (e *Entangler) getBackwardNeighborIndexes(index int) (indexes []int) {
-// 	if e.Alpha > 3 {
-// 		util.ThrowError("alpha should equal 3")
-// 	}
-
-// 	// d_i is tangled with p_{h,i}
-// 	pos := e.getPositionCategory(index)
-// 	var h, rh, lh int
-// 	switch pos {
-// 	case Top:
-// 		h = index - e.S
-// 		rh = index - e.S*e.P + (e.S*e.S - 1)
-// 		lh = index - (e.S - 1)
-// 	case Central:
-// 		h = index - e.S
-// 		rh = index - (e.S + 1)
-// 		lh = index - (e.S - 1)
-// 	case Bottom:
-// 		h = index - e.S
-// 		rh = index - (e.S + 1)
-// 		lh = index - e.S*e.P + (e.S-1)*(e.S-1)
-// 	}
-
-// 	indexes = []int{h, rh, lh}
-
-// 	return indexes
-// }
-
 // getForwardNeighborIndexes returns the index of forward neighbors that is the entangled output of current node
 // See details in alpha-entanglement-code paper (https://ieeexplore.ieee.org/document/8416482)
 func (e *Entangler) getForwardNeighborIndexes(index int) (indexes []int) {
-	if e.Alpha > 3 {
-		util.ThrowError("alpha should equal 3")
-	}
-
 	// d_i creates entangled block p_{i,j}
-	pos := e.getPositionCategory(index)
-	var h, rh, lh int
-	switch pos {
-	case Top:
-		h = index + e.S
-		rh = index + e.S + 1
-		lh = index + e.S*e.P - (e.S-1)*(e.S-1)
-	case Central:
-		h = index + e.S
-		rh = index + e.S + 1
-		lh = index + e.S - 1
-	case Bottom:
-		h = index + e.S
-		rh = index + e.S*e.P - (e.S*e.S - 1)
-		lh = index + e.S - 1
+	row := (index - 1) % e.S
+	indexes = make([]int, e.Alpha)
+	for k := 0; k < e.Alpha; k++ {
+		strand := StrandClass(k)
+		pitch := strand.Pitch()
+		switch {
+		case strand.IsHorizontal():
+			indexes[k] = index + e.S
+		case strand.IsRightHanded():
+			if row+pitch < e.S {
+				indexes[k] = index + e.S + pitch
+			} else {
+				// wrap from the bottom of the lattice to the top
+				indexes[k] = index + e.S*(e.P-e.S) + pitch
+			}
+		default:
+			if row-pitch >= 0 {
+				indexes[k] = index + e.S - pitch
+			} else {
+				// wrap from the top of the lattice to the bottom
+				indexes[k] = index + e.S*(e.P-e.S+2) - pitch
+			}
+		}
 	}
 
-	indexes = []int{h, rh, lh}
-
 	return indexes
 }
 
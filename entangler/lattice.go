@@ -9,12 +9,55 @@ import (
 )
 
 type BlockGetter interface {
-	GetData(index int) ([]byte, error)
-	GetDataCID(index int) string
-	GetParity(index int, strand int) ([]byte, error)
+	GetData(ctx context.Context, index int) ([]byte, error)
+	GetDataCID(ctx context.Context, index int) string
+	GetParity(ctx context.Context, index int, strand int) ([]byte, error)
 	GetParityCID(index int, strand int) string
 }
 
+// BlockVerifier is implemented by the getters that can check the content of recovered data blocks
+type BlockVerifier interface {
+	// VerifyData returns an error if data is not the content of the indexed (0-based) data block.
+	// exact tells whether data were truncated to the known size of the block, otherwise they may
+	// still hold zero padding
+	VerifyData(ctx context.Context, index int, data []byte, exact bool) error
+}
+
+// RecoveryMode selects the strategy used to recover missing blocks
+type RecoveryMode int
+
+const (
+	SequentialRecovery RecoveryMode = iota // depth-first, one pair at a time, limited by SwitchDepth
+	ParallelRecovery                       // all the recover pairs are explored concurrently
+	HybridRecovery                         // sequential up to SwitchDepth, then parallel
+)
+
+var recoveryModeNames = map[RecoveryMode]string{
+	SequentialRecovery: "sequential",
+	ParallelRecovery:   "parallel",
+	HybridRecovery:     "hybrid",
+}
+
+func (mode RecoveryMode) String() string {
+	return recoveryModeNames[mode]
+}
+
+// ParseRecoveryMode returns the recovery mode with the given name
+func ParseRecoveryMode(name string) (RecoveryMode, error) {
+	if name == "" {
+		return SequentialRecovery, nil
+	}
+	for mode, modeName := range recoveryModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return SequentialRecovery, xerrors.Errorf("unknown recovery mode %s", name)
+}
+
+// DefaultMaxParallelism bounds the number of goroutines spawned by the parallel recovery
+var DefaultMaxParallelism = 32
+
 type Lattice struct {
 	*sync.Mutex
 
@@ -28,22 +71,52 @@ type Lattice struct {
 	requestCounter uint
 
 	SwitchDepth uint
+	Mode        RecoveryMode
+	workers     chan struct{} // semaphore bounding the parallel recovery fan-out
 }
 
 // NewLattice creates a new lattice for block downloading and recovering
-func NewLattice(alpha int, s int, p int, blockNum int, blockGetter BlockGetter, switchDepth uint) (lattice *Lattice) {
-	var tangler = *NewEntangler(alpha, s, p, []bool{})
+func NewLattice(alpha int, s int, p int, blockNum int, blockGetter BlockGetter, switchDepth uint) (lattice *Lattice, err error) {
+	tangler, err := NewEntangler(alpha, s, p, []bool{})
+	if err != nil {
+		return nil, err
+	}
 	tangler.ChunkNum = blockNum
 	lattice = &Lattice{
 		Mutex:        &sync.Mutex{},
-		Entangler:    tangler,
+		Entangler:    *tangler,
 		DataBlocks:   make([]*Block, 0),
 		ParityBlocks: make([][]*Block, alpha),
 		Getter:       blockGetter,
 		SwitchDepth:  switchDepth,
+		Mode:         SequentialRecovery,
+		workers:      make(chan struct{}, DefaultMaxParallelism),
 	}
 
-	return lattice
+	return lattice, nil
+}
+
+// SetRecoveryMode sets the recovery strategy and the maximum number of goroutines
+// the parallel recovery may spawn. maxParallelism < 1 keeps the current bound
+func (l *Lattice) SetRecoveryMode(mode RecoveryMode, maxParallelism int) {
+	l.Mode = mode
+	if maxParallelism > 0 {
+		l.workers = make(chan struct{}, maxParallelism)
+	}
+}
+
+// SetDataSizes sets the exact size of the data blocks, so that recovered data are not padded.
+// sizes[i] is the size of the data block with index i+1. The lattice must be initialized
+func (l *Lattice) SetDataSizes(sizes []int) error {
+	if len(sizes) != len(l.DataBlocks) {
+		return xerrors.Errorf("%d sizes for %d data blocks", len(sizes), len(l.DataBlocks))
+	}
+	for i, block := range l.DataBlocks {
+		block.Lock()
+		block.Size = sizes[i]
+		block.Unlock()
+	}
+	return nil
 }
 
 // TODO add return neighbours function (neighbours are 1-based)
@@ -71,10 +144,10 @@ func (l *Lattice) GetRepairedParities() (repairedParities []*Block) {
 }
 
 // GetAllData returns all data in the data blocks as a byte array
-func (l *Lattice) GetAllData() (data [][]byte, err error) {
+func (l *Lattice) GetAllData(ctx context.Context) (data [][]byte, err error) {
 	for i := 0; i < l.ChunkNum; i++ {
 		var chunk []byte
-		chunk, _, err = l.GetChunk(i + 1)
+		chunk, _, err = l.GetChunk(ctx, i+1)
 		if err != nil {
 			return data, err
 		}
@@ -88,27 +161,28 @@ func (l *Lattice) UpdateParity(index int, strand int, data []byte) {
 	l.ParityBlocks[strand][index].SetData(data, true)
 }
 
-// GetChunk returns a data chunk in the indexed block with the given depth
-func (l *Lattice) GetChunkDepth(index int, depth uint) (data []byte, repaired bool, err error) {
+// GetChunk returns a data chunk in the indexed block with the given depth.
+// The recovery is always sequential so that the depth is respected
+func (l *Lattice) GetChunkDepth(ctx context.Context, index int, depth uint) (data []byte, repaired bool, err error) {
 	block := l.getBlock(index)
-	data, err = l.getDataFromBlock(block, depth)
+	data, err = l.getDataFromBlockWithMode(ctx, block, SequentialRecovery, depth)
 	repaired = block.IsRepaired()
 
 	return data, repaired, err
 }
 
-// GetChunk returns a data chunk in the indexed block
-func (l *Lattice) GetChunk(index int) (data []byte, repaired bool, err error) {
+// GetChunk returns a data chunk in the indexed block. The recovery stops once ctx is done
+func (l *Lattice) GetChunk(ctx context.Context, index int) (data []byte, repaired bool, err error) {
 	block := l.getBlock(index)
-	data, err = l.getDataFromBlock(block, l.SwitchDepth)
+	data, err = l.getDataFromBlock(ctx, block, l.SwitchDepth)
 	repaired = block.IsRepaired()
 
 	return data, repaired, err
 }
 
-func (l *Lattice) GetParity(index int, strand int) (data []byte, repaired bool, err error) {
+func (l *Lattice) GetParity(ctx context.Context, index int, strand int) (data []byte, repaired bool, err error) {
 	block := l.ParityBlocks[strand][index-1]
-	data, err = l.getDataFromBlock(block, l.SwitchDepth)
+	data, err = l.getDataFromBlock(ctx, block, l.SwitchDepth)
 	repaired = block.IsRepaired()
 
 	return data, repaired, err
@@ -120,31 +194,42 @@ func (l *Lattice) getBlock(index int) (block *Block) {
 	return block
 }
 
-// getDataFromBlock recovers a block with missing chunk using the lattice (hybrid, auto switch)
-func (l *Lattice) getDataFromBlock(block *Block, allowDepth uint) ([]byte, error) {
+// getDataFromBlock recovers a block with missing chunk using the recovery mode of the lattice
+func (l *Lattice) getDataFromBlock(ctx context.Context, block *Block, allowDepth uint) ([]byte, error) {
+	return l.getDataFromBlockWithMode(ctx, block, l.Mode, allowDepth)
+}
+
+// getDataFromBlockWithMode recovers a block with missing chunk using the given recovery mode
+func (l *Lattice) getDataFromBlockWithMode(ctx context.Context, block *Block, mode RecoveryMode,
+	allowDepth uint) ([]byte, error) {
 	rid := l.getRequestID()
-	if allowDepth > 0 {
-		data, err := l.getDataFromBlockSequential(block, rid, allowDepth)
-		if err == nil {
-			return data, nil
-		}
+	if mode != ParallelRecovery && allowDepth > 0 {
+		// the hybrid recovery switches to parallel within the sequential one once allowDepth is reached
+		return l.getDataFromBlockSequential(ctx, block, rid, allowDepth, mode == HybridRecovery)
+	}
+	if mode != SequentialRecovery && ctx.Err() == nil {
+		return l.getDataFromBlockParallel(ctx, block, rid)
 	}
 
+	reason := "sequential recovery failed"
+	if ctx.Err() != nil {
+		reason = ctx.Err().Error()
+	}
 	return nil, xerrors.Errorf("fail to recover block %d (parity: %t. strand: %d): %s.",
-		block.Index, block.IsParity, block.Strand, "sequential recovery failed")
-
-	// ctx, cancel := context.WithCancel(context.Background())
-	// defer cancel()
-
-	// return l.getDataFromBlockParallel(ctx, block, rid)
+		block.Index, block.IsParity, block.Strand, reason)
 }
 
-// getDataFromBlockSequential recovers a block with missing chunk using the lattice (single thread)
-func (l *Lattice) getDataFromBlockSequential(block *Block, rid uint, allowDepth uint) (data []byte, err error) {
-	l.sequentialRecoverHelper(block, rid, allowDepth)
+// getDataFromBlockSequential recovers a block with missing chunk using the lattice (single thread).
+// If hybrid, the blocks beyond allowDepth are repaired in parallel instead of giving up
+func (l *Lattice) getDataFromBlockSequential(ctx context.Context, block *Block, rid uint, allowDepth uint,
+	hybrid bool) (data []byte, err error) {
+	l.sequentialRecoverHelper(ctx, block, rid, allowDepth, hybrid)
 
 	data, err = block.GetData()
 	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		err = xerrors.Errorf("fail to recover block %d (parity: %t. strand: %d): %s.",
 			block.Index, block.IsParity, block.Strand, err)
 	}
@@ -154,11 +239,13 @@ func (l *Lattice) getDataFromBlockSequential(block *Block, rid uint, allowDepth
 
 // getDataFromBlockParallel recovers a block with missing chunk using the lattice (multiple threads)
 func (l *Lattice) getDataFromBlockParallel(ctx context.Context, block *Block, rid uint) (data []byte, err error) {
-	myChannel := make(chan bool, 1)
-	l.parallelRecoverHelper(ctx, block, rid, myChannel)
-	<-myChannel
+	l.parallelRecoverHelper(ctx, block, rid)
+
 	data, err = block.GetData()
 	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		err = xerrors.Errorf("fail to recover block %d (parity: %t. strand: %d): %s.",
 			block.Index, block.IsParity, block.Strand, err)
 	}
@@ -220,12 +307,12 @@ func (l *Lattice) initLinks() {
 }
 
 // downloadBlock downloads data/parity blocks using the Getter passed in
-func (l *Lattice) downloadBlock(block *Block) (err error) {
+func (l *Lattice) downloadBlock(ctx context.Context, block *Block) (err error) {
 	var data []byte
 	if block.IsParity {
-		data, err = l.Getter.GetParity(block.Index-1, block.Strand)
+		data, err = l.Getter.GetParity(ctx, block.Index-1, block.Strand)
 	} else {
-		data, err = l.Getter.GetData(block.Index - 1)
+		data, err = l.Getter.GetData(ctx, block.Index-1)
 	}
 	if err == nil {
 		block.SetData(data, false)
@@ -244,9 +331,12 @@ func (l *Lattice) getRequestID() uint {
 	return id
 }
 
-// sequentialRepair repairs a block using single thread
-func (l *Lattice) sequentialRepair(block *Block, rid uint, allowDepth uint) bool {
+// sequentialRepair repairs a block using single thread, or switches to parallel at the depth limit if hybrid
+func (l *Lattice) sequentialRepair(ctx context.Context, block *Block, rid uint, allowDepth uint, hybrid bool) bool {
 	if allowDepth == 0 {
+		if hybrid {
+			return l.parallelRepair(ctx, block, rid)
+		}
 		return false
 	}
 	pairs := block.GetRecoverPairs()
@@ -255,23 +345,25 @@ func (l *Lattice) sequentialRepair(block *Block, rid uint, allowDepth uint) bool
 	}
 
 	for _, mypair := range pairs {
+		if ctx.Err() != nil {
+			return false
+		}
 		util.LogPrintf(util.Yellow("{Sequential} Left - Index: %d, Parity: %t, Strand: %d\n"+
 			"Right - Index: %d, Parity: %t, Strand: %d\n\n"),
 			mypair.Left.Index, mypair.Left.IsParity, mypair.Left.Strand,
 			mypair.Right.Index, mypair.Right.IsParity, mypair.Right.Strand)
 
-		leftChunk, RepairErr := l.getDataFromBlockSequential(mypair.Left, rid, allowDepth)
+		leftChunk, RepairErr := l.getDataFromBlockSequential(ctx, mypair.Left, rid, allowDepth, hybrid)
 		if RepairErr != nil {
 			continue
 		}
 
-		rightChunk, RepairErr := l.getDataFromBlockSequential(mypair.Right, rid, allowDepth)
+		rightChunk, RepairErr := l.getDataFromBlockSequential(ctx, mypair.Right, rid, allowDepth, hybrid)
 		if RepairErr != nil {
 			continue
 		}
 
-		if block.Recover(leftChunk, rightChunk) == nil {
-
+		if l.recoverFromPair(ctx, block, mypair, leftChunk, rightChunk) {
 			return true
 		}
 	}
@@ -279,7 +371,7 @@ func (l *Lattice) sequentialRepair(block *Block, rid uint, allowDepth uint) bool
 }
 
 // sequentialRecoverHelper is a helper function to recursively do the sequential recovery
-func (l *Lattice) sequentialRecoverHelper(block *Block, rid uint, allowDepth uint) {
+func (l *Lattice) sequentialRecoverHelper(ctx context.Context, block *Block, rid uint, allowDepth uint, hybrid bool) {
 	var repairSuccess = false
 	var modifyState = true
 	defer func() {
@@ -289,7 +381,7 @@ func (l *Lattice) sequentialRecoverHelper(block *Block, rid uint, allowDepth uin
 	}()
 
 	// if already has data or already visited
-	if !block.StartRepair(context.Background(), rid) {
+	if !block.StartRepair(ctx, rid) {
 		modifyState = false
 		printVisitedStatus(false, Visited, block)
 		return
@@ -303,7 +395,7 @@ func (l *Lattice) sequentialRecoverHelper(block *Block, rid uint, allowDepth uin
 	}
 
 	// download data
-	downloadErr := l.downloadBlock(block)
+	downloadErr := l.downloadBlock(ctx, block)
 	if downloadErr == nil {
 		repairSuccess = true
 		printRecoverStatus(false, DownloadSuccess, block)
@@ -312,7 +404,7 @@ func (l *Lattice) sequentialRecoverHelper(block *Block, rid uint, allowDepth uin
 	printRecoverError(false, DownloadFail, block, downloadErr)
 
 	// repair data
-	success := l.sequentialRepair(block, rid, allowDepth-1)
+	success := l.sequentialRepair(ctx, block, rid, allowDepth-1, hybrid)
 	if success {
 		repairSuccess = true
 		printRecoverStatus(false, RepairSuccess, block)
@@ -321,6 +413,20 @@ func (l *Lattice) sequentialRecoverHelper(block *Block, rid uint, allowDepth uin
 	}
 }
 
+// spawn runs the task in a new goroutine if the fan-out bound allows it, otherwise in the caller.
+// Running in the caller instead of waiting for a free slot avoids deadlocks in the recursion
+func (l *Lattice) spawn(task func()) {
+	select {
+	case l.workers <- struct{}{}:
+		go func() {
+			defer func() { <-l.workers }()
+			task()
+		}()
+	default:
+		task()
+	}
+}
+
 // parallelRepair repairs a block using muti-threads
 func (l *Lattice) parallelRepair(ctx context.Context, block *Block, rid uint) bool {
 	pairs := block.GetRecoverPairs()
@@ -328,99 +434,120 @@ func (l *Lattice) parallelRepair(ctx context.Context, block *Block, rid uint) bo
 		return false
 	}
 
-	finish := make(chan bool)
-	counter := 0
+	// stop the remaining pairs as soon as one succeeds
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	finish := make(chan bool, len(pairs))
 	for _, mypair := range pairs {
-		util.InfoPrintf(util.Yellow("{Parallel} Left - Index: %d, Parity: %t, Strand: %d\n"+
+		util.LogPrintf(util.Yellow("{Parallel} Left - Index: %d, Parity: %t, Strand: %d\n"+
 			"Right - Index: %d, Parity: %t, Strand: %d\n\n"),
 			mypair.Left.Index, mypair.Left.IsParity, mypair.Left.Strand,
 			mypair.Right.Index, mypair.Right.IsParity, mypair.Right.Strand)
 
-		go func(pair *BlockPair) {
-			// tell the caller current func is finished
-			success := false
-			defer func() { finish <- success }()
+		pair := mypair
+		l.spawn(func() {
+			finish <- l.parallelRecoverPair(ctx, block, pair, rid)
+		})
+	}
 
-			resultChan := make(chan bool, 2)
-			go l.parallelRecoverHelper(ctx, pair.Left, rid, resultChan)
-			go l.parallelRecoverHelper(ctx, pair.Right, rid, resultChan)
+	// wait until one recover success, or all pairs finish
+	for range pairs {
+		if <-finish {
+			return true
+		}
+	}
+	printRecoverStatus(true, RepairFail, block)
+	return false
+}
 
-			<-resultChan
-			<-resultChan
-			leftChunk, err := pair.Left.GetData()
-			if err != nil {
-				return
-			}
+// parallelRecoverPair recovers both blocks of the pair concurrently and uses them to repair the block
+func (l *Lattice) parallelRecoverPair(ctx context.Context, block *Block, pair *BlockPair, rid uint) bool {
+	leftDone := make(chan struct{})
+	l.spawn(func() {
+		defer close(leftDone)
+		l.parallelRecoverHelper(ctx, pair.Left, rid)
+	})
+	l.parallelRecoverHelper(ctx, pair.Right, rid)
+	<-leftDone
 
-			// special case: wrap on itself
-			if pair.Left == pair.Right {
-				block.SetData(leftChunk, true)
-				success = true
-				return
-			}
+	leftChunk, err := pair.Left.GetData()
+	if err != nil {
+		return false
+	}
+	rightChunk, err := pair.Right.GetData()
+	if err != nil {
+		return false
+	}
 
-			rightChunk, err := pair.Right.GetData()
-			if err != nil {
-				return
-			}
+	return l.recoverFromPair(ctx, block, pair, leftChunk, rightChunk)
+}
 
-			if block.Recover(leftChunk, rightChunk) == nil {
-				success = true
-			}
-		}(mypair)
-	}
-	// wait until one recover success, or all routine finishes
-	for {
-		success := <-finish
-		if success {
-			return true
+// recoverFromPair recovers the block from the data of its pair. A recovered data block is verified
+// if the getter is a BlockVerifier, and rejected on mismatch so that the next pair can be tried
+func (l *Lattice) recoverFromPair(ctx context.Context, block *Block, pair *BlockPair, leftChunk []byte, rightChunk []byte) bool {
+	var data []byte
+	if pair.Left == pair.Right {
+		// special case: wrap on itself
+		data = block.truncate(leftChunk)
+	} else {
+		var err error
+		data, err = block.recoveredData(leftChunk, rightChunk)
+		if err != nil {
+			return false
 		}
-		counter++
-		if counter >= len(pairs) {
-			printRecoverStatus(true, RepairFail, block)
+	}
+
+	if verifier, ok := l.Getter.(BlockVerifier); ok && !block.IsParity {
+		err := verifier.VerifyData(ctx, block.Index-1, data, block.hasSize())
+		if err != nil {
+			util.LogPrintf(util.Red("Recovered data block %d is rejected: %s"), block.Index, err)
 			return false
 		}
 	}
+
+	block.SetData(data, true)
+	return true
 }
 
 // parallelRecoverHelper is a helper function to recursively do the parallel recovery
-func (l *Lattice) parallelRecoverHelper(ctx context.Context, block *Block, rid uint, channel chan bool) {
+func (l *Lattice) parallelRecoverHelper(ctx context.Context, block *Block, rid uint) {
 	var repairSuccess = false
 	var modifyState = true
 	defer func() {
 		if modifyState {
 			block.FinishRepair(repairSuccess)
 		}
-		channel <- true
 	}()
 
-	select {
-	case <-ctx.Done():
+	if ctx.Err() != nil {
+		modifyState = false
 		return
-	default:
-		// if already has data or already visited
-		if !block.StartRepair(ctx, rid) {
-			modifyState = false
-			return
-		}
+	}
 
-		// download data
-		err := l.downloadBlock(block)
-		if err == nil {
-			repairSuccess = true
-			printRecoverStatus(true, DownloadSuccess, block)
-			return
-		}
-		printRecoverError(true, DownloadFail, block, err)
-
-		// repair data
-		success := l.parallelRepair(ctx, block, rid)
-		if success {
-			repairSuccess = true
-			printRecoverStatus(false, RepairSuccess, block)
-		} else {
-			printRecoverStatus(false, RepairFail, block)
-		}
+	// if already has data or already visited
+	if !block.StartRepair(ctx, rid) {
+		modifyState = false
+		printVisitedStatus(true, Visited, block)
+		return
+	}
+
+	// download data
+	err := l.downloadBlock(ctx, block)
+	if err == nil {
+		repairSuccess = true
+		printRecoverStatus(true, DownloadSuccess, block)
+		return
+	}
+	printRecoverError(true, DownloadFail, block, err)
+
+	// repair data
+	success := l.parallelRepair(ctx, block, rid)
+	if success {
+		repairSuccess = true
+		printRecoverStatus(true, RepairSuccess, block)
+	} else {
+		printRecoverStatus(true, RepairFail, block)
 	}
 }
 
@@ -0,0 +1,273 @@
+package entangler
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+
+	"golang.org/x/xerrors"
+)
+
+// BlockRef identifies a data or parity block in the lattice
+type BlockRef struct {
+	Index    int // 1-based lattice index
+	IsParity bool
+	Strand   int // only meaningful for parity blocks
+}
+
+func (ref BlockRef) String() string {
+	if ref.IsParity {
+		return fmt.Sprintf("parity %d (strand %d)", ref.Index, ref.Strand)
+	}
+	return fmt.Sprintf("data %d", ref.Index)
+}
+
+// RepairStep recovers the target block by XORing the left and right blocks.
+// If left and right are the same block, the target is a copy of it
+type RepairStep struct {
+	Target BlockRef
+	Left   BlockRef
+	Right  BlockRef
+}
+
+// RepairPlan describes how to recover a set of blocks: the blocks to download,
+// then the XOR steps to apply in order
+type RepairPlan struct {
+	Targets       []BlockRef
+	Fetch         []BlockRef
+	Steps         []RepairStep
+	Unrecoverable []BlockRef // targets that cannot be recovered given the missing blocks
+}
+
+// Cost returns the number of blocks the plan downloads
+func (plan *RepairPlan) Cost() int {
+	return len(plan.Fetch)
+}
+
+// planNode is the planning state of a lattice block
+type planNode struct {
+	block     *Block
+	cost      int // number of downloads needed to get the block
+	fetch     bool
+	via       *BlockPair
+	finalized bool
+}
+
+// planUse records that a block takes part in a recover pair of the target
+type planUse struct {
+	target *Block
+	pair   *BlockPair
+}
+
+// PlanRepair computes a cheap plan per target, without downloading anything. The cost of a recovery is the sum
+// of the costs of its pair, so a block needed by several recoveries is counted for each of them and the plan
+// may download more blocks than needed, though never the same block twice. Blocks already holding data cost
+// nothing, missing blocks can only be recovered and any other block costs one download. If no target is given,
+// every missing data block is targeted.
+// The lattice must be initialized
+func (l *Lattice) PlanRepair(targets []BlockRef, missing []BlockRef) *RepairPlan {
+	missingBlocks := make(map[*Block]struct{}, len(missing))
+	for _, ref := range missing {
+		missingBlocks[l.getBlockByRef(ref)] = struct{}{}
+	}
+	if len(targets) == 0 {
+		for _, ref := range missing {
+			if !ref.IsParity {
+				targets = append(targets, ref)
+			}
+		}
+	}
+
+	// register every block and the recover pairs it takes part in
+	nodes := make(map[*Block]*planNode)
+	uses := make(map[*Block][]planUse)
+	queue := &planQueue{}
+	register := func(block *Block) {
+		node := &planNode{block: block, cost: math.MaxInt}
+		if block.IsAvailable() {
+			node.cost = 0
+		} else if _, ok := missingBlocks[block]; !ok {
+			node.cost = 1
+			node.fetch = true
+		}
+		nodes[block] = node
+		if node.cost != math.MaxInt {
+			heap.Push(queue, planEntry{node: node, cost: node.cost})
+		}
+
+		for _, pair := range block.GetRecoverPairs() {
+			uses[pair.Left] = append(uses[pair.Left], planUse{target: block, pair: pair})
+			if pair.Right != pair.Left {
+				uses[pair.Right] = append(uses[pair.Right], planUse{target: block, pair: pair})
+			}
+		}
+	}
+	for _, block := range l.DataBlocks {
+		register(block)
+	}
+	for _, strand := range l.ParityBlocks {
+		for _, block := range strand {
+			register(block)
+		}
+	}
+
+	// Knuth's generalization of Dijkstra: the cost of a recovery is the sum of the costs of its pair
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(planEntry).node
+		if node.finalized {
+			continue
+		}
+		node.finalized = true
+
+		for _, use := range uses[node.block] {
+			target := nodes[use.target]
+			left, right := nodes[use.pair.Left], nodes[use.pair.Right]
+			if target.finalized || !left.finalized || !right.finalized {
+				continue
+			}
+			cost := left.cost + right.cost
+			if left == right {
+				cost = left.cost
+			}
+			if cost < target.cost {
+				target.cost = cost
+				target.fetch = false
+				target.via = use.pair
+				heap.Push(queue, planEntry{node: target, cost: cost})
+			}
+		}
+	}
+
+	// walk back the chosen recoveries of every target
+	plan := &RepairPlan{Targets: targets}
+	visited := make(map[*Block]struct{})
+	var walker func(node *planNode)
+	walker = func(node *planNode) {
+		if _, ok := visited[node.block]; ok {
+			return
+		}
+		visited[node.block] = struct{}{}
+
+		switch {
+		case node.cost == 0:
+		case node.fetch:
+			plan.Fetch = append(plan.Fetch, blockToRef(node.block))
+		default:
+			walker(nodes[node.via.Left])
+			walker(nodes[node.via.Right])
+			plan.Steps = append(plan.Steps, RepairStep{
+				Target: blockToRef(node.block),
+				Left:   blockToRef(node.via.Left),
+				Right:  blockToRef(node.via.Right),
+			})
+		}
+	}
+	for _, ref := range targets {
+		node := nodes[l.getBlockByRef(ref)]
+		if node.cost == math.MaxInt {
+			plan.Unrecoverable = append(plan.Unrecoverable, ref)
+			continue
+		}
+		walker(node)
+	}
+
+	return plan
+}
+
+// ExecutePlan downloads the blocks of the plan and applies its steps. It returns the blocks that
+// could not be downloaded, so that the caller can mark them missing and plan again
+func (l *Lattice) ExecutePlan(ctx context.Context, plan *RepairPlan) (failed []BlockRef, err error) {
+	for _, ref := range plan.Fetch {
+		block := l.getBlockByRef(ref)
+		if block.IsAvailable() {
+			continue
+		}
+		if l.downloadBlock(ctx, block) != nil {
+			failed = append(failed, ref)
+		}
+	}
+	if len(failed) > 0 {
+		return failed, xerrors.Errorf("fail to download %d blocks of the plan", len(failed))
+	}
+
+	for _, step := range plan.Steps {
+		target := l.getBlockByRef(step.Target)
+		left, err := l.getBlockByRef(step.Left).GetData()
+		if err != nil {
+			return nil, xerrors.Errorf("fail to recover %s: %w", step.Target, err)
+		}
+		right, err := l.getBlockByRef(step.Right).GetData()
+		if err != nil {
+			return nil, xerrors.Errorf("fail to recover %s: %w", step.Target, err)
+		}
+
+		pair := &BlockPair{Left: l.getBlockByRef(step.Left), Right: l.getBlockByRef(step.Right)}
+		if !l.recoverFromPair(ctx, target, pair, left, right) {
+			return nil, xerrors.Errorf("fail to recover %s: invalid or unverified data", step.Target)
+		}
+	}
+
+	if len(plan.Unrecoverable) > 0 {
+		return nil, xerrors.Errorf("no repair plan for %v", plan.Unrecoverable)
+	}
+	return nil, nil
+}
+
+// RecoverWithPlan plans and executes the recovery of the targets. Blocks that fail to download
+// are added to the missing ones and the recovery is planned again, until it succeeds, no plan exists
+// or ctx is done. It returns the last executed plan
+func (l *Lattice) RecoverWithPlan(ctx context.Context, targets []BlockRef, missing []BlockRef) (*RepairPlan, error) {
+	missing = append([]BlockRef{}, missing...)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		plan := l.PlanRepair(targets, missing)
+		if len(plan.Unrecoverable) > 0 {
+			return plan, xerrors.Errorf("no repair plan for %v", plan.Unrecoverable)
+		}
+
+		failed, err := l.ExecutePlan(ctx, plan)
+		if len(failed) == 0 {
+			return plan, err
+		}
+		missing = append(missing, failed...)
+	}
+}
+
+// getBlockByRef returns the lattice block identified by the reference
+func (l *Lattice) getBlockByRef(ref BlockRef) *Block {
+	if ref.IsParity {
+		return l.ParityBlocks[ref.Strand][ref.Index-1]
+	}
+	return l.DataBlocks[ref.Index-1]
+}
+
+// blockToRef returns the reference of a lattice block
+func blockToRef(block *Block) BlockRef {
+	if block.IsParity {
+		return BlockRef{Index: block.Index, IsParity: true, Strand: block.Strand}
+	}
+	return BlockRef{Index: block.Index}
+}
+
+// planEntry is a planning node queued with the cost it had when queued
+type planEntry struct {
+	node *planNode
+	cost int
+}
+
+// planQueue is a min-heap of planning entries ordered by cost
+type planQueue []planEntry
+
+func (q planQueue) Len() int            { return len(q) }
+func (q planQueue) Less(i, j int) bool  { return q[i].cost < q[j].cost }
+func (q planQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *planQueue) Push(x interface{}) { *q = append(*q, x.(planEntry)) }
+func (q *planQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
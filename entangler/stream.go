@@ -0,0 +1,55 @@
+package entangler
+
+import (
+	"io"
+)
+
+// EntangleToReaders runs EntangleOrdered in the background and returns one reader per strand.
+// Each reader yields the concatenation of the parities of its strand, so that the strand can be
+// uploaded without holding it in memory. Parities are padded to ParitySize. Readers of strands that are not generated are nil.
+// Every reader must be consumed or closed, otherwise the entanglement is blocked.
+// If the entanglement fails, the readers return the error instead of EOF
+func (e *Entangler) EntangleToReaders(blockNum int, getData func(index int) ([]byte, error)) []io.ReadCloser {
+	readers := make([]io.ReadCloser, e.Alpha)
+	writers := make([]*io.PipeWriter, e.Alpha)
+	for k := 0; k < e.Alpha; k++ {
+		if !e.Strands[k] {
+			continue
+		}
+		readers[k], writers[k] = io.Pipe()
+	}
+
+	parityChan := make(chan EntangledBlock, e.Alpha)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- e.EntangleOrdered(blockNum, getData, parityChan)
+	}()
+
+	// dispatch the parities to the strand readers
+	go func() {
+		for block := range parityChan {
+			writer := writers[block.Strand]
+			if writer == nil {
+				continue
+			}
+			data := block.Data
+			if len(data) < e.ParitySize {
+				data = make([]byte, e.ParitySize)
+				copy(data, block.Data)
+			}
+			if _, err := writer.Write(data); err != nil {
+				// the reader has been closed. keep draining the other strands
+				writers[block.Strand] = nil
+			}
+		}
+
+		err := <-errChan
+		for _, writer := range writers {
+			if writer != nil {
+				writer.CloseWithError(err)
+			}
+		}
+	}()
+
+	return readers
+}
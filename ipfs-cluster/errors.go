@@ -0,0 +1,50 @@
+package ipfscluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrPeerUnreachable is returned when the cluster peer cannot be reached
+	ErrPeerUnreachable = errors.New("cluster peer unreachable")
+	// ErrMalformedResponse is returned when the cluster answers with a body that cannot be understood
+	ErrMalformedResponse = errors.New("malformed cluster response")
+	// ErrRequestRejected is returned when the cluster answers with an error status
+	ErrRequestRejected = errors.New("cluster request rejected")
+)
+
+// get sends a GET request to the cluster and returns the response if its status is a success.
+// The caller closes the body
+func get(ctx context.Context, url string) (*http.Response, error) {
+	return send(ctx, http.MethodGet, url)
+}
+
+// send sends a request without body to the cluster and returns the response if its status is a success.
+// The caller closes the body
+func send(ctx context.Context, method string, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the caller gave up, which says nothing about the peer
+			return nil, fmt.Errorf("%s: %w", url, ctx.Err())
+		}
+		return nil, fmt.Errorf("%s: %s: %w", url, err, ErrPeerUnreachable)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: status %s: %w", url, resp.Status, ErrRequestRejected)
+	}
+	return resp, nil
+}
+
+// malformed returns the error of a response from the url that cannot be understood
+func malformed(url string, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s: %w", url, fmt.Sprintf(format, args...), ErrMalformedResponse)
+}
@@ -1,25 +1,31 @@
 package ipfscluster
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 var DefaultPort = 9094
 
 type Connector struct {
-	url        string
-	selfID     string
-	peerIDs    []string
-	currentIdx int
-	peers      map[string]string
+	url     string
+	selfID  string
+	peerIDs []string
+	peers   map[string]string
+	ipfsIDs map[string]string // IPFS peer ID -> ID of the cluster peer running that IPFS daemon
+
+	policy          PlacementPolicy
+	allocationsLock sync.Mutex          // guards allocations
+	allocations     map[string][]string // CID -> peer IDs chosen by the placement policy
 }
 
 // CreateIPFSClusterConnector is the constructor of IPFSClusterConnector
-func CreateIPFSClusterConnector(port int, host string) (*Connector, error) {
+func CreateIPFSClusterConnector(ctx context.Context, port int, host string) (*Connector, error) {
 	if port == 0 {
 		port = DefaultPort
 	}
@@ -30,11 +36,14 @@ func CreateIPFSClusterConnector(port int, host string) (*Connector, error) {
 
 	conn := Connector{url: fmt.Sprintf("http://%s:%d", host, port)}
 	conn.peers = make(map[string]string)
-	_, err := conn.PeerInfo()
+	conn.ipfsIDs = make(map[string]string)
+	conn.policy = &RoundRobinPlacement{}
+	conn.allocations = make(map[string][]string)
+	_, err := conn.PeerInfo(ctx)
 	if err != nil {
 		return nil, err
 	}
-	_, err = conn.PeerLs()
+	_, err = conn.PeerLs(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -42,10 +51,11 @@ func CreateIPFSClusterConnector(port int, host string) (*Connector, error) {
 }
 
 // PeerInfo list the info about the cluster peers
-func (c *Connector) PeerInfo() (string, error) {
+func (c *Connector) PeerInfo(ctx context.Context) (string, error) {
 	/* Return the connected peer info
 	For the moment, only returns the name of the connected peer */
-	resp, err := http.Get(c.url + "/id")
+	infoURL := c.url + "/id"
+	resp, err := get(ctx, infoURL)
 	if err != nil {
 		return "", err
 	}
@@ -54,65 +64,111 @@ func (c *Connector) PeerInfo() (string, error) {
 	decoder := json.NewDecoder(resp.Body)
 	var info map[string]interface{}
 	if err = decoder.Decode(&info); err != nil {
-		panic(err)
+		return "", malformed(infoURL, "%s", err)
 	}
 
 	selfID, ok := info["id"].(string)
 	if !ok {
-		panic("ID field does not exist!")
+		return "", malformed(infoURL, "id field does not exist")
 	}
-	c.selfID = selfID
-
 	selfName, ok := info["peername"].(string)
 	if !ok {
-		panic("peername field does not exist!")
+		return "", malformed(infoURL, "peername field does not exist")
 	}
+	c.selfID = selfID
 	return selfName, nil
 }
 
 // PeerLs list the number of peers that are inside the cluster
-func (c *Connector) PeerLs() (int, error) {
+func (c *Connector) PeerLs(ctx context.Context) (int, error) {
 	/* List all peers inside the IPFS cluster
 	For the moment, only returns the number of peers */
-	resp, err := http.Get(c.url + "/peers")
+	peersURL := c.url + "/peers"
+	resp, err := get(ctx, peersURL)
 	if err != nil {
 		return 0, err
 	}
 	defer resp.Body.Close()
 
-	var peersInfo []map[string]interface{}
+	// the peers are only recorded once the whole response is understood
+	peers := make(map[string]string)
+	ipfsIDs := make(map[string]string)
+	var peerIDs []string
+	var peerNum int
 	decoder := json.NewDecoder(resp.Body)
 	for decoder.More() {
 		var info map[string]interface{}
 		if err = decoder.Decode(&info); err != nil {
-			panic(err)
+			return 0, malformed(peersURL, "%s", err)
+		}
+		peerID, ok := info["id"].(string)
+		if !ok {
+			return 0, malformed(peersURL, "id field does not exist")
+		}
+		peerName, ok := info["peername"].(string)
+		if !ok {
+			return 0, malformed(peersURL, "peername field does not exist")
 		}
-		peersInfo = append(peersInfo, info)
-		if info["id"].(string) != c.selfID {
-			c.peers[info["id"].(string)] = info["peername"].(string)
-			c.peerIDs = append(c.peerIDs, info["id"].(string))
+		peerNum++
+		if ipfs, ok := info["ipfs"].(map[string]interface{}); ok {
+			if ipfsID, ok := ipfs["id"].(string); ok && ipfsID != "" {
+				ipfsIDs[ipfsID] = peerID
+			}
+		}
+		if peerID != c.selfID {
+			peers[peerID] = peerName
+			peerIDs = append(peerIDs, peerID)
 		}
 	}
+	c.peers = peers
+	c.peerIDs = peerIDs
+	c.ipfsIDs = ipfsIDs
 
-	return len(peersInfo), nil
+	return peerNum, nil
 }
 
 func (c *Connector) GetAllPeers() map[string]string {
 	return c.peers
 }
 
-func (c *Connector) GetLatestPeers() map[string]string {
-	c.PeerLs()
-	return c.peers
+// GetLatestPeers asks the cluster for its peers again. The peers known so far are kept if it fails
+func (c *Connector) GetLatestPeers(ctx context.Context) (map[string]string, error) {
+	if _, err := c.PeerLs(ctx); err != nil {
+		return c.peers, err
+	}
+	return c.peers, nil
 }
 
 func (c *Connector) GetPeerIDs() []string {
 	return c.peerIDs
 }
 
-func (c *Connector) GetPeerName(peerID string) string {
+// GetPeerOfIPFS returns the ID of the cluster peer running the IPFS daemon with the given peer ID,
+// or an empty string if the daemon is not part of the cluster
+func (c *Connector) GetPeerOfIPFS(ipfsID string) string {
+	return c.ipfsIDs[ipfsID]
+}
+
+// SetPlacementPolicy sets the policy that chooses the peers of every new pin
+func (c *Connector) SetPlacementPolicy(policy PlacementPolicy) {
+	c.policy = policy
+}
+
+// GetRecordedAllocations returns the peer IDs chosen for every CID pinned through this connector
+func (c *Connector) GetRecordedAllocations() map[string][]string {
+	c.allocationsLock.Lock()
+	defer c.allocationsLock.Unlock()
+
+	allocations := make(map[string][]string, len(c.allocations))
+	for cid, peerIDs := range c.allocations {
+		allocations[cid] = peerIDs
+	}
+	return allocations
+}
+
+func (c *Connector) GetPeerName(ctx context.Context, peerID string) string {
 	if peerID == c.selfID {
-		name, err := c.PeerInfo() // can also save c.selfName while running PeerInfo()
+		name, err := c.PeerInfo(ctx) // can also save c.selfName while running PeerInfo()
 		if err != nil {
 			return ""
 		}
@@ -123,7 +179,7 @@ func (c *Connector) GetPeerName(peerID string) string {
 
 // PinStatus check the status of the specified cid, if the CID is not given, it will
 // show all CIDs that are inside the ipfs cluster
-func (c *Connector) PinStatus(cid string) (string, error) {
+func (c *Connector) PinStatus(ctx context.Context, cid string) (string, error) {
 	/* Check the pin status of all CIDs or a specific CID
 	For the moment, only checks the number of pin peers */
 	var statusURL string
@@ -134,44 +190,79 @@ func (c *Connector) PinStatus(cid string) (string, error) {
 		statusURL = c.url + "/pins/" + cid
 	}
 
-	resp, err := http.Get(statusURL)
+	resp, err := get(ctx, statusURL)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	var pinInfo []map[string]interface{}
+	var pinNum int
 	decoder := json.NewDecoder(resp.Body)
 	for decoder.More() {
 		var status map[string]interface{}
 		if err = decoder.Decode(&status); err != nil {
-			panic(err)
+			return "", malformed(statusURL, "%s", err)
+		}
+		pinCID, ok := status["cid"].(string)
+		if !ok {
+			return "", malformed(statusURL, "cid field does not exist")
+		}
+		peerStatus, err := decodePeerMap(statusURL, status)
+		if err != nil {
+			return "", err
 		}
-		pinInfo = append(pinInfo, status)
-	}
-
-	for _, status := range pinInfo {
-		var statusMap = status["peer_map"].(map[string]interface{})
 		var pinCount int
-		for key := range statusMap {
-			if statusMap[key].(map[string]interface{})["status"].(string) == "pinned" {
+		for _, peerPinStatus := range peerStatus {
+			if peerPinStatus == "pinned" {
 				pinCount++
 			}
 		}
-		pinStatus += fmt.Sprintf("%s pinned by %d peers.\n", status["cid"].(string), pinCount)
+		pinStatus += fmt.Sprintf("%s pinned by %d peers.\n", pinCID, pinCount)
+		pinNum++
 	}
-	pinStatus = fmt.Sprintf("\nTotal number of pins: %d\n", len(pinInfo)) + pinStatus
+	pinStatus = fmt.Sprintf("\nTotal number of pins: %d\n", pinNum) + pinStatus
 
-	return pinStatus, err
+	return pinStatus, nil
 }
 
 // Returns the peer names of the peers that are pinning the specified CID
-func (c *Connector) GetPinAllocations(cid string) ([]string, error) {
-	/* Check the pin status of all CIDs or a specific CID
-	For the moment, only checks the number of pin peers */
+func (c *Connector) GetPinAllocations(ctx context.Context, cid string) ([]string, error) {
+	peerIDs, err := c.fetchPinAllocations(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	var peerNames []string
+	for _, peerID := range peerIDs {
+		peerNames = append(peerNames, c.GetPeerName(ctx, peerID))
+	}
+
+	return peerNames, nil
+}
+
+// GetPinAllocationIDs returns the IDs of the peers that are pinning the specified CID.
+// The allocations recorded by this connector are used first, otherwise the cluster is asked.
+// It returns nil if the CID is not pinned on its own
+func (c *Connector) GetPinAllocationIDs(ctx context.Context, cid string) []string {
+	c.allocationsLock.Lock()
+	peerIDs, ok := c.allocations[cid]
+	c.allocationsLock.Unlock()
+	if ok {
+		return peerIDs
+	}
+
+	peerIDs, err := c.fetchPinAllocations(ctx, cid)
+	if err != nil {
+		return nil
+	}
+	return peerIDs
+}
+
+// fetchPinAllocations asks the cluster for the IDs of the peers allocated to the specified CID
+func (c *Connector) fetchPinAllocations(ctx context.Context, cid string) ([]string, error) {
 	statusURL := c.url + "/pins/" + cid
 
-	resp, err := http.Get(statusURL)
+	resp, err := get(ctx, statusURL)
 	if err != nil {
 		return nil, err
 	}
@@ -180,64 +271,68 @@ func (c *Connector) GetPinAllocations(cid string) ([]string, error) {
 	var pinInfo map[string]interface{}
 	decoder := json.NewDecoder(resp.Body)
 	if err = decoder.Decode(&pinInfo); err != nil {
-		panic(err)
+		return nil, malformed(statusURL, "%s", err)
 	}
 
 	allocations, ok := pinInfo["allocations"].([]interface{})
 	if !ok {
-		fmt.Println("Error: unable to find or assert allocations as an array")
-		return nil, err
+		return nil, malformed(statusURL, "allocations field is not an array")
 	}
 
-	var peerNames []string
+	var peerIDs []string
 	for _, allocation := range allocations {
-		if peerID, ok := allocation.(string); ok {
-			peerNames = append(peerNames, c.GetPeerName(peerID))
+		peerID, ok := allocation.(string)
+		if !ok {
+			return nil, malformed(statusURL, "allocation %v is not a peer ID", allocation)
 		}
+		peerIDs = append(peerIDs, peerID)
 	}
 
-	return peerNames, nil
-
+	return peerIDs, nil
 }
 
 // AddPin add the specified CID to the ipfs cluster, with the specified replication factor,
 // the default behavior is recursive, which means pinning all content that is beneath the CID
 // "mode" can be "direct" or "recursive"
-func (c *Connector) AddPin(cid string, replicationFactor int) error {
+func (c *Connector) AddPin(ctx context.Context, cid string, replicationFactor int) error {
 	/* Add a new CID to the cluster,  it uses the default replication
 	factor that is specified in the CLUSTER configuration file */
-	peerID := c.peerIDs[c.currentIdx]
-	c.currentIdx = (c.currentIdx + 1) % len(c.peerIDs)
-	postURL := fmt.Sprintf("%s/pins/ipfs/%s?mode=recursive&name=&replication-max="+
-		"%d&replication-min=%d&shard-size=0&user-allocations=%s",
-		c.url, cid, replicationFactor, replicationFactor, peerID)
-	resp, err := http.PostForm(postURL, nil)
+	return c.addPin(ctx, "recursive", PlacementRequest{CID: cid, ReplicationFactor: replicationFactor})
+}
+
+func (c *Connector) AddPinDirect(ctx context.Context, cid string, replicationFactor int) error {
+	return c.addPin(ctx, "direct", PlacementRequest{CID: cid, ReplicationFactor: replicationFactor})
+}
+
+// AddPinDirectWithNeighbours pins the specified CID directly and lets the placement policy
+// avoid the peers holding its neighbours
+func (c *Connector) AddPinDirectWithNeighbours(ctx context.Context, cid string, replicationFactor int, neighbourPeers []string) error {
+	return c.addPin(ctx, "direct", PlacementRequest{CID: cid, ReplicationFactor: replicationFactor, NeighbourPeers: neighbourPeers})
+}
+
+// addPin asks the placement policy for the peers of the pin, records them and submits the pin
+func (c *Connector) addPin(ctx context.Context, mode string, request PlacementRequest) error {
+	allocation, err := c.policy.Allocate(ctx, c, request)
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
-	return err
-}
-
-func (c *Connector) AddPinDirect(cid string, replicationFactor int) error {
-	/* Add a new CID to the cluster,  it uses the default replication
-	factor that is specified in the CLUSTER configuration file */
-	peerID := c.peerIDs[c.currentIdx]
-	c.currentIdx = (c.currentIdx + 1) % len(c.peerIDs)
-	postURL := fmt.Sprintf("%s/pins/ipfs/%s?mode=direct&name=&replication-max="+
+	postURL := fmt.Sprintf("%s/pins/ipfs/%s?mode=%s&name=&replication-max="+
 		"%d&replication-min=%d&shard-size=0&user-allocations=%s",
-		c.url, cid, replicationFactor, replicationFactor, peerID)
-	resp, err := http.PostForm(postURL, nil)
+		c.url, request.CID, mode, request.ReplicationFactor, request.ReplicationFactor, strings.Join(allocation, ","))
+	resp, err := send(ctx, http.MethodPost, postURL)
 	if err != nil {
 		return err
 	}
 	resp.Body.Close()
-	return err
+	c.allocationsLock.Lock()
+	c.allocations[request.CID] = allocation
+	c.allocationsLock.Unlock()
+	return nil
 }
 
 // PeerLoad checks the load balance of the cluster, namely how many blocks is stored on each
 // cluster peer
-func (c *Connector) PeerLoad() (string, error) {
+func (c *Connector) PeerLoad(ctx context.Context) (string, error) {
 	min := func(a, b int) int {
 		if a < b {
 			return a
@@ -253,7 +348,7 @@ func (c *Connector) PeerLoad() (string, error) {
 	}
 
 	statusURL := c.url + "/pins"
-	resp, err := http.Get(statusURL)
+	resp, err := get(ctx, statusURL)
 	if err != nil {
 		return "", err
 	}
@@ -265,16 +360,15 @@ func (c *Connector) PeerLoad() (string, error) {
 	for decoder.More() {
 		var status map[string]interface{}
 		if err = decoder.Decode(&status); err != nil {
-			panic(err)
+			return "", malformed(statusURL, "%s", err)
 		}
-		var statusMap = status["peer_map"].(map[string]interface{})
-		for key := range statusMap {
-			pinStatus, ok := statusMap[key].(map[string]interface{})["status"].(string)
-			if !ok {
-				panic("status field does not exist!")
-			}
+		peerStatus, err := decodePeerMap(statusURL, status)
+		if err != nil {
+			return "", err
+		}
+		for peerID, pinStatus := range peerStatus {
 			if pinStatus == "pinned" {
-				peerInfo[key]++
+				peerInfo[peerID]++
 				totBlocks++
 			}
 		}
@@ -297,29 +391,77 @@ func (c *Connector) PeerLoad() (string, error) {
 	return peerLoad, nil
 }
 
-func (c *Connector) GetPeerRegionTag(peer string) string {
-	statusURL := c.url + "/monitor/metrics/tag:region"
+// GetPeerRegions returns the region tag of every cluster peer that reports one, keyed by peer ID
+func (c *Connector) GetPeerRegions(ctx context.Context) (map[string]string, error) {
+	return c.GetPeerTags(ctx, "region")
+}
 
-	resp, err := http.Get(statusURL)
+// GetPeerTags returns the value of a tag of every cluster peer that reports it, keyed by peer ID. The tags
+// of a peer are set in the tags informer of its configuration
+func (c *Connector) GetPeerTags(ctx context.Context, tag string) (map[string]string, error) {
+	statusURL := c.url + "/monitor/metrics/tag:" + tag
+
+	resp, err := get(ctx, statusURL)
 	if err != nil {
-		fmt.Printf("Error: unable to get metric (tag:region) from cluster [err: %s]\n", err.Error())
-		return ""
+		return nil, fmt.Errorf("unable to get metric (tag:%s) from cluster: %w", tag, err)
 	}
 	defer resp.Body.Close()
 
 	var metrics []map[string]interface{}
 	decoder := json.NewDecoder(resp.Body)
-
 	if err = decoder.Decode(&metrics); err != nil {
-		fmt.Println("Error: unable to decode metrics")
-		panic(err)
+		return nil, malformed(statusURL, "unable to decode metrics: %s", err)
 	}
 
+	values := make(map[string]string)
 	for _, metric := range metrics {
-		if c.GetPeerName(metric["peer"].(string)) == peer {
-			return metric["value"].(string)
+		peerID, ok := metric["peer"].(string)
+		if !ok {
+			continue
+		}
+		value, ok := metric["value"].(string)
+		if !ok {
+			continue
 		}
+		values[peerID] = value
+	}
+
+	return values, nil
+}
+
+// GetPeerRegionTag returns the region tag of the peer with the given name, or "" if it reports none
+func (c *Connector) GetPeerRegionTag(ctx context.Context, peer string) (string, error) {
+	regions, err := c.GetPeerRegions(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	return ""
+	for peerID, region := range regions {
+		if c.GetPeerName(ctx, peerID) == peer {
+			return region, nil
+		}
+	}
+
+	return "", nil
+}
+
+// decodePeerMap returns the pin status on every peer found in the peer_map of a pin status
+func decodePeerMap(url string, status map[string]interface{}) (map[string]string, error) {
+	peerMap, ok := status["peer_map"].(map[string]interface{})
+	if !ok {
+		return nil, malformed(url, "peer_map field does not exist")
+	}
+	peerStatus := make(map[string]string)
+	for peerID, info := range peerMap {
+		peerInfo, ok := info.(map[string]interface{})
+		if !ok {
+			return nil, malformed(url, "peer_map entry of %s is not an object", peerID)
+		}
+		pinStatus, ok := peerInfo["status"].(string)
+		if !ok {
+			return nil, malformed(url, "status field of %s does not exist", peerID)
+		}
+		peerStatus[peerID] = pinStatus
+	}
+	return peerStatus, nil
 }
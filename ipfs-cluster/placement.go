@@ -0,0 +1,170 @@
+package ipfscluster
+
+import (
+	"context"
+	"fmt"
+)
+
+// PlacementRequest describes a block that is about to be pinned in the cluster
+type PlacementRequest struct {
+	CID               string
+	ReplicationFactor int
+	// IDs of the peers holding the blocks that should not share a peer with this block,
+	// e.g. the data blocks connected by a parity in the lattice
+	NeighbourPeers []string
+}
+
+// PlacementPolicy chooses the peers that should pin a block
+type PlacementPolicy interface {
+	Allocate(ctx context.Context, c *Connector, request PlacementRequest) ([]string, error)
+}
+
+// NewPlacementPolicy returns the placement policy with the given name.
+// Valid names are "round-robin", "region" and "neighbour"
+func NewPlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case "", "round-robin":
+		return &RoundRobinPlacement{}, nil
+	case "region":
+		return &RegionPlacement{}, nil
+	case "neighbour":
+		return &NeighbourPlacement{}, nil
+	default:
+		return nil, fmt.Errorf("unknown placement policy %s", name)
+	}
+}
+
+// RoundRobinPlacement allocates the blocks to the cluster peers in turn
+type RoundRobinPlacement struct {
+	currentIdx int
+}
+
+func (policy *RoundRobinPlacement) Allocate(ctx context.Context, c *Connector, request PlacementRequest) ([]string, error) {
+	peers := c.GetPeerIDs()
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peer available in cluster")
+	}
+
+	allocation := pickPeers(peers, allocationSize(request, len(peers)), policy.currentIdx)
+	policy.currentIdx = (policy.currentIdx + 1) % len(peers)
+
+	return allocation, nil
+}
+
+// NeighbourPlacement never co-locates a block with the peers holding its neighbours,
+// unless there is no other peer in the cluster. The remaining peers are used in turn
+type NeighbourPlacement struct {
+	RoundRobinPlacement
+}
+
+func (policy *NeighbourPlacement) Allocate(ctx context.Context, c *Connector, request PlacementRequest) ([]string, error) {
+	neighbourPeers := make(map[string]struct{})
+	for _, peer := range request.NeighbourPeers {
+		neighbourPeers[peer] = struct{}{}
+	}
+
+	var candidates []string
+	for _, peer := range c.GetPeerIDs() {
+		if _, ok := neighbourPeers[peer]; !ok {
+			candidates = append(candidates, peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return policy.RoundRobinPlacement.Allocate(ctx, c, request)
+	}
+
+	allocation := pickPeers(candidates, allocationSize(request, len(candidates)), policy.currentIdx)
+	policy.currentIdx = (policy.currentIdx + 1) % len(candidates)
+
+	return allocation, nil
+}
+
+// RegionPlacement spreads the replicas of a block over distinct regions and avoids the regions
+// of the peers holding its neighbours. It falls back to any other peer when regions run out
+type RegionPlacement struct {
+	RoundRobinPlacement
+	regions map[string]string // peer ID -> region tag, loaded once
+}
+
+func (policy *RegionPlacement) Allocate(ctx context.Context, c *Connector, request PlacementRequest) ([]string, error) {
+	peers := c.GetPeerIDs()
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peer available in cluster")
+	}
+	if policy.regions == nil {
+		regions, err := c.GetPeerRegions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		policy.regions = regions
+	}
+
+	usedPeers := make(map[string]struct{})
+	usedRegions := make(map[string]struct{})
+	for _, peer := range request.NeighbourPeers {
+		usedPeers[peer] = struct{}{}
+		if region := policy.regions[peer]; region != "" {
+			usedRegions[region] = struct{}{}
+		}
+	}
+
+	size := allocationSize(request, len(peers))
+	start := policy.currentIdx
+	policy.currentIdx = (policy.currentIdx + 1) % len(peers)
+
+	var allocation []string
+	allocate := func(peer string) {
+		allocation = append(allocation, peer)
+		usedPeers[peer] = struct{}{}
+		if region := policy.regions[peer]; region != "" {
+			usedRegions[region] = struct{}{}
+		}
+	}
+
+	// first take peers in new regions, then any unused peer
+	for _, peer := range pickPeers(peers, len(peers), start) {
+		if len(allocation) == size {
+			return allocation, nil
+		}
+		_, peerUsed := usedPeers[peer]
+		_, regionUsed := usedRegions[policy.regions[peer]]
+		if !peerUsed && !regionUsed && policy.regions[peer] != "" {
+			allocate(peer)
+		}
+	}
+	for _, peer := range pickPeers(peers, len(peers), start) {
+		if len(allocation) == size {
+			return allocation, nil
+		}
+		if _, ok := usedPeers[peer]; !ok {
+			allocate(peer)
+		}
+	}
+	if len(allocation) == 0 {
+		// every peer holds a neighbour
+		return policy.RoundRobinPlacement.Allocate(ctx, c, request)
+	}
+
+	return allocation, nil
+}
+
+// allocationSize returns how many peers should be allocated for the request
+func allocationSize(request PlacementRequest, peerNum int) int {
+	size := request.ReplicationFactor
+	if size < 1 {
+		size = 1
+	}
+	if size > peerNum {
+		size = peerNum
+	}
+	return size
+}
+
+// pickPeers returns num peers starting from the given position and wrapping around
+func pickPeers(peers []string, num int, start int) []string {
+	picked := make([]string, 0, num)
+	for i := 0; i < num && i < len(peers); i++ {
+		picked = append(picked, peers[(start+i)%len(peers)])
+	}
+	return picked
+}
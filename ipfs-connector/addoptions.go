@@ -0,0 +1,137 @@
+package ipfsconnector
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	sh "github.com/ipfs/go-ipfs-api"
+	"golang.org/x/xerrors"
+)
+
+// chunkSizeLimit is the largest chunk IPFS accepts to add
+const chunkSizeLimit = 1048576
+
+// supportedHashes are the multihash functions accepted by IPFS to add a file
+var supportedHashes = map[string]struct{}{
+	"sha2-256": {}, "sha2-512": {},
+	"sha3-224": {}, "sha3-256": {}, "sha3-384": {}, "sha3-512": {},
+	"keccak-224": {}, "keccak-256": {}, "keccak-384": {}, "keccak-512": {},
+	"blake2b-256": {}, "blake2b-512": {}, "blake2s-256": {}, "blake3": {},
+}
+
+// AddOptions decide how a file is chunked and hashed when added to IPFS, and so the CIDs of its blocks
+type AddOptions struct {
+	CidVersion int
+	Hash       string // multihash function, e.g. sha2-256
+	RawLeaves  bool   // store the leaves as raw blocks instead of unixfs nodes
+	Chunker    string // size-N, rabin[-avg] or rabin-min-avg-max, buzhash
+}
+
+// DefaultAddOptions returns the options used by IPFS when none is given
+func DefaultAddOptions() AddOptions {
+	return AddOptions{
+		CidVersion: 0,
+		Hash:       "sha2-256",
+		RawLeaves:  false,
+		Chunker:    "size-" + strconv.Itoa(DefaultChunkSize),
+	}
+}
+
+// Validate checks that IPFS can add a file with the options
+func (opts AddOptions) Validate() error {
+	if opts.CidVersion != 0 && opts.CidVersion != 1 {
+		return xerrors.Errorf("unsupported CID version %d", opts.CidVersion)
+	}
+	if _, ok := supportedHashes[opts.Hash]; !ok {
+		return xerrors.Errorf("unsupported hash function %s", opts.Hash)
+	}
+	if opts.CidVersion == 0 && opts.Hash != "sha2-256" {
+		return xerrors.Errorf("CID version 0 only supports sha2-256, got %s", opts.Hash)
+	}
+	_, err := opts.MaxChunkSize()
+	return err
+}
+
+// MaxChunkSize returns the size of the largest chunk the chunker can produce
+func (opts AddOptions) MaxChunkSize() (int, error) {
+	name, params, _ := strings.Cut(opts.Chunker, "-")
+	sizes, err := parseChunkerSizes(params)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid chunker %s: %w", opts.Chunker, err)
+	}
+
+	maxSize := 0
+	switch {
+	case name == "size" && len(sizes) == 1:
+		maxSize = sizes[0]
+	case name == "rabin" && len(sizes) == 0:
+		maxSize = DefaultChunkSize + DefaultChunkSize/2
+	case name == "rabin" && len(sizes) == 1:
+		maxSize = sizes[0] + sizes[0]/2
+	case name == "rabin" && len(sizes) == 3:
+		if sizes[0] > sizes[1] || sizes[1] > sizes[2] {
+			return 0, xerrors.Errorf("invalid chunker %s: expect min <= avg <= max", opts.Chunker)
+		}
+		maxSize = sizes[2]
+	case name == "buzhash" && len(sizes) == 0:
+		maxSize = 2 * DefaultChunkSize
+	default:
+		return 0, xerrors.Errorf("unsupported chunker %s", opts.Chunker)
+	}
+
+	if maxSize > chunkSizeLimit {
+		return 0, xerrors.Errorf("chunks of chunker %s exceed the limit of %d bytes", opts.Chunker, chunkSizeLimit)
+	}
+	return maxSize, nil
+}
+
+// parseChunkerSizes parses the dash separated sizes of a chunker
+func parseChunkerSizes(params string) ([]int, error) {
+	if params == "" {
+		return nil, nil
+	}
+	var sizes []int
+	for _, param := range strings.Split(params, "-") {
+		size, err := strconv.Atoi(param)
+		if err != nil || size < 1 {
+			return nil, xerrors.Errorf("invalid size %s", param)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// shellOptions returns the options of the add request
+func (opts AddOptions) shellOptions() []sh.AddOpts {
+	return []sh.AddOpts{
+		sh.CidVersion(opts.CidVersion),
+		sh.Hash(opts.Hash),
+		sh.RawLeaves(opts.RawLeaves),
+		func(rb *sh.RequestBuilder) error {
+			rb.Option("chunker", opts.Chunker)
+			return nil
+		},
+	}
+}
+
+// blockFormat returns the format to put a block of the file added with the options
+func (opts AddOptions) blockFormat(isLeaf bool) string {
+	switch {
+	case isLeaf && opts.RawLeaves:
+		return "raw"
+	case opts.CidVersion == 0:
+		return "v0"
+	default:
+		return "protobuf"
+	}
+}
+
+// IsRawCID returns whether the CID addresses a raw block, i.e. a leaf without unixfs envelope
+func IsRawCID(c string) bool {
+	decoded, err := cid.Decode(c)
+	if err != nil {
+		return false
+	}
+	return decoded.Type() == cid.Raw
+}
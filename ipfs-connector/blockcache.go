@@ -0,0 +1,194 @@
+package ipfsconnector
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultBlockCacheSize is the number of bytes of blocks kept by a block cache
+const DefaultBlockCacheSize = 64 << 20
+
+// CachedBlock is a block read from IPFS with the CIDs of its children
+type CachedBlock struct {
+	Data  []byte
+	Links []string
+}
+
+// size returns the number of bytes the block takes in the cache
+func (b CachedBlock) size() int {
+	size := len(b.Data)
+	for _, link := range b.Links {
+		size += len(link)
+	}
+	return size
+}
+
+type cacheEntry struct {
+	cid   string
+	block CachedBlock
+}
+
+// flight is a fetch of a block in progress, waited for by every caller asking for the same CID.
+// It is cancelled once none of them waits for it anymore
+type flight struct {
+	done    chan struct{}
+	block   CachedBlock
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// detachedContext keeps the values of a context but not its deadline and cancellation, so that a fetch
+// shared by several callers does not end with the first of them
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// BlockCache keeps the least recently used blocks up to a number of bytes, and fetches every missing block
+// once however many callers ask for it at the same time. It is safe for concurrent use and can be shared
+// by the getters of a client
+type BlockCache struct {
+	maxBytes int
+
+	lock    sync.Mutex
+	bytes   int
+	order   *list.List               // most recently used first
+	entries map[string]*list.Element // CID -> element of order
+	flights map[string]*flight       // CID -> fetch in progress
+}
+
+// NewBlockCache creates a cache holding up to maxBytes bytes of blocks
+func NewBlockCache(maxBytes int) *BlockCache {
+	return &BlockCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		flights:  make(map[string]*flight),
+	}
+}
+
+// Get returns the cached block of the CID
+func (c *BlockCache) Get(cid string) (CachedBlock, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.get(cid)
+}
+
+// Add caches the block of the CID, evicting the least recently used blocks if needed.
+// A block larger than the cache is not kept
+func (c *BlockCache) Add(cid string, block CachedBlock) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.add(cid, block)
+}
+
+// Len returns the number of cached blocks
+func (c *BlockCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
+
+// Bytes returns the number of bytes of the cached blocks
+func (c *BlockCache) Bytes() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.bytes
+}
+
+// Fetch returns the cached block of the CID, or fetches and caches it. Concurrent calls for the same CID
+// share a single fetch, which keeps the values of the context of the first caller and runs until it ends or
+// every caller gave up waiting. The returned flag tells whether the block was served without fetching it
+func (c *BlockCache) Fetch(ctx context.Context, cid string, fetch func(ctx context.Context) (CachedBlock, error)) (CachedBlock, bool, error) {
+	c.lock.Lock()
+	if block, ok := c.get(cid); ok {
+		c.lock.Unlock()
+		return block, true, nil
+	}
+	f, shared := c.flights[cid]
+	if !shared {
+		fetchCtx, cancel := context.WithCancel(detachedContext{ctx})
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		c.flights[cid] = f
+		go c.run(fetchCtx, cid, f, fetch)
+	}
+	f.waiters++
+	c.lock.Unlock()
+
+	select {
+	case <-f.done:
+		if f.err != nil {
+			return CachedBlock{}, false, f.err
+		}
+		return f.block, shared, nil
+	case <-ctx.Done():
+		c.lock.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// the next caller starts a new fetch rather than joining the cancelled one
+			f.cancel()
+			if c.flights[cid] == f {
+				delete(c.flights, cid)
+			}
+		}
+		c.lock.Unlock()
+		return CachedBlock{}, false, ctx.Err()
+	}
+}
+
+// run fetches the block of a flight and caches it
+func (c *BlockCache) run(ctx context.Context, cid string, f *flight, fetch func(ctx context.Context) (CachedBlock, error)) {
+	block, err := fetch(ctx)
+	f.cancel()
+
+	c.lock.Lock()
+	f.block, f.err = block, err
+	if c.flights[cid] == f {
+		delete(c.flights, cid)
+	}
+	if err == nil {
+		c.add(cid, block)
+	}
+	c.lock.Unlock()
+	close(f.done)
+}
+
+func (c *BlockCache) get(cid string) (CachedBlock, bool) {
+	element, ok := c.entries[cid]
+	if !ok {
+		return CachedBlock{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).block, true
+}
+
+func (c *BlockCache) add(cid string, block CachedBlock) {
+	if element, ok := c.entries[cid]; ok {
+		c.remove(element)
+	}
+	if block.size() > c.maxBytes {
+		return
+	}
+
+	c.entries[cid] = c.order.PushFront(&cacheEntry{cid: cid, block: block})
+	c.bytes += block.size()
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *BlockCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.cid)
+	c.bytes -= entry.block.size()
+}
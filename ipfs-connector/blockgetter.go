@@ -1,12 +1,29 @@
 package ipfsconnector
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
+
 	"ipfs-alpha-entanglement-code/entangler"
 	"ipfs-alpha-entanglement-code/util"
 
+	sh "github.com/ipfs/go-ipfs-api"
 	"golang.org/x/xerrors"
 )
 
+// VerificationStatus is the outcome of the verification of a recovered data block
+type VerificationStatus string
+
+const (
+	Verified   VerificationStatus = "verified"   // the recovered data hash to the block CID
+	Corrupted  VerificationStatus = "corrupted"  // the recovered data were rejected
+	Unverified VerificationStatus = "unverified" // the block CID is unknown, the data were accepted
+)
+
+// IPFSGetter fetches the blocks of an entangled file for the lattice. It is safe for concurrent use:
+// the CIDs discovered while walking the trees are guarded by a lock, the fetched blocks are kept in a
+// BlockCache shared with concurrent callers, and the counters are updated atomically
 type IPFSGetter struct {
 	entangler.BlockGetter
 	*IPFSConnector
@@ -25,6 +42,33 @@ type IPFSGetter struct {
 
 	ParityTrees     []*ParityTreeNode
 	ParityIndexMap  []map[int]*ParityTreeNode
+	ParityBlockSize int // size of a parity in the strand file
+	ParityLeafSize  int // size of a leaf of the strand file
+
+	Cache *BlockCache // blocks fetched by the getter, may be shared between getters
+
+	treeLock        sync.RWMutex // guards the CIDs of the tree nodes and parityAvailable
+	parityAvailable []bool
+
+	dataBlocksFetched     atomic.Int64
+	dataBlocksCached      atomic.Int64
+	dataBlocksUnavailable atomic.Int64
+	dataBlocksError       atomic.Int64
+
+	parityBlocksFetched     atomic.Int64
+	parityBlocksCached      atomic.Int64
+	parityBlocksUnavailable atomic.Int64
+	parityBlocksError       atomic.Int64
+
+	verificationLock     sync.Mutex // guards the verification counters and map
+	dataBlocksVerified   int
+	dataBlocksCorrupted  int
+	dataBlocksUnverified int
+	verification         map[int]VerificationStatus // last verification of the recovered data blocks, by index
+}
+
+// GetterMetrics is a snapshot of the counters of a getter
+type GetterMetrics struct {
 	ParityAvailable []bool
 
 	DataBlocksFetched     int
@@ -36,6 +80,11 @@ type IPFSGetter struct {
 	ParityBlocksCached      int
 	ParityBlocksUnavailable int
 	ParityBlocksError       int
+
+	DataBlocksVerified   int
+	DataBlocksCorrupted  int
+	DataBlocksUnverified int
+	Verification         map[int]VerificationStatus
 }
 
 // 1. save tree depth and max children for parity trees in the metadata
@@ -75,34 +124,131 @@ func CreateIPFSGetter(connector *IPFSConnector, CIDIndexMap map[string]int, pari
 
 		ParityTrees:     parityTrees,
 		ParityIndexMap:  parityIndexMap,
-		ParityAvailable: parityAvails,
-
-		DataBlocksFetched:       0,
-		DataBlocksCached:        0,
-		DataBlocksError:         0,
-		DataBlocksUnavailable:   0,
-		ParityBlocksFetched:     0,
-		ParityBlocksCached:      0,
-		ParityBlocksUnavailable: 0,
-		ParityBlocksError:       0,
+		ParityBlockSize: DefaultParityBlockSize,
+		ParityLeafSize:  DefaultParityLeafSize,
+
+		Cache: NewBlockCache(DefaultBlockCacheSize),
+
+		parityAvailable: parityAvails,
+		verification:    make(map[int]VerificationStatus),
+	}
+}
+
+// Metrics returns a snapshot of the counters of the getter
+func (getter *IPFSGetter) Metrics() GetterMetrics {
+	metrics := GetterMetrics{
+		ParityAvailable: getter.ParityAvailable(),
+
+		DataBlocksFetched:     int(getter.dataBlocksFetched.Load()),
+		DataBlocksCached:      int(getter.dataBlocksCached.Load()),
+		DataBlocksUnavailable: int(getter.dataBlocksUnavailable.Load()),
+		DataBlocksError:       int(getter.dataBlocksError.Load()),
+
+		ParityBlocksFetched:     int(getter.parityBlocksFetched.Load()),
+		ParityBlocksCached:      int(getter.parityBlocksCached.Load()),
+		ParityBlocksUnavailable: int(getter.parityBlocksUnavailable.Load()),
+		ParityBlocksError:       int(getter.parityBlocksError.Load()),
+	}
+
+	getter.verificationLock.Lock()
+	defer getter.verificationLock.Unlock()
+	metrics.DataBlocksVerified = getter.dataBlocksVerified
+	metrics.DataBlocksCorrupted = getter.dataBlocksCorrupted
+	metrics.DataBlocksUnverified = getter.dataBlocksUnverified
+	metrics.Verification = make(map[int]VerificationStatus, len(getter.verification))
+	for index, status := range getter.verification {
+		metrics.Verification[index] = status
+	}
+
+	return metrics
+}
+
+// ParityAvailable returns whether the tree of each strand can still be walked
+func (getter *IPFSGetter) ParityAvailable() []bool {
+	getter.treeLock.RLock()
+	defer getter.treeLock.RUnlock()
+
+	return append([]bool(nil), getter.parityAvailable...)
+}
+
+func (getter *IPFSGetter) isParityAvailable(strand int) bool {
+	getter.treeLock.RLock()
+	defer getter.treeLock.RUnlock()
+
+	return getter.parityAvailable[strand]
+}
+
+func (getter *IPFSGetter) dataNodeCID(node *EmptyTreeNode) string {
+	getter.treeLock.RLock()
+	defer getter.treeLock.RUnlock()
+
+	return node.CID
+}
+
+func (getter *IPFSGetter) parityNodeCID(node *ParityTreeNode) string {
+	getter.treeLock.RLock()
+	defer getter.treeLock.RUnlock()
+
+	return node.CID
+}
+
+// dataKey and parityKey tell apart in the cache a data block and a parity stored in a block with the same CID,
+// as the cache keeps the raw block of the former and only the file data of the latter
+func dataKey(cid string) string   { return "d/" + cid }
+func parityKey(cid string) string { return "p/" + cid }
+
+// fetchData downloads a data block with the CIDs of its children
+func (getter *IPFSGetter) fetchData(ctx context.Context, cid string) (block CachedBlock, err error) {
+	raw_node := &sh.IpfsObject{}
+	if !IsRawCID(cid) {
+		raw_node, err = getter.GetRawObject(ctx, cid)
+		if err != nil {
+			return
+		}
+	}
+	block.Data, err = getter.GetRawBlock(ctx, cid)
+	if err != nil {
+		return
+	}
+	for _, dag_child := range raw_node.Links {
+		block.Links = append(block.Links, dag_child.Hash)
+	}
+	return block, nil
+}
+
+// fetchParity downloads a node of a strand file with the CIDs of its children, keeping only its file data
+func (getter *IPFSGetter) fetchParity(ctx context.Context, cid string) (block CachedBlock, err error) {
+	rawNode, err := getter.GetRawObject(ctx, cid)
+	if err != nil {
+		return
+	}
+	rawBlock, err := getter.GetRawBlock(ctx, cid)
+	if err != nil {
+		return
+	}
+	dagNode, err := getter.GetDagNodeFromRawBytes(rawBlock)
+	if err != nil {
+		return
+	}
+	block.Data, err = getter.GetFileDataFromDagNode(dagNode)
+	if err != nil {
+		return
+	}
+	for _, dag_child := range rawNode.Links {
+		block.Links = append(block.Links, dag_child.Hash)
 	}
+	return block, nil
 }
 
 // Given an index, first check if this node exists already in the tree,
 // it it does, return the data from the node,
 // if it doesn't, find the parent of this index, and repeat the procedure,
 // we do this until we have an index that either doesn't have parent or whose parent is the same and still can't find its data
-func (getter *IPFSGetter) GetData(index int) ([]byte, error) {
-
-	//print getter Datafilter
-
-	for k := range getter.DataFilter {
-		util.LogPrintf("DataFilter: %d", k)
-	}
+func (getter *IPFSGetter) GetData(ctx context.Context, index int) ([]byte, error) {
 	/* get the data, mask to represent the data loss */
 	if getter.DataFilter != nil {
 		if _, ok := getter.DataFilter[index]; ok {
-			getter.DataBlocksUnavailable++
+			getter.dataBlocksUnavailable.Add(1)
 			err := xerrors.Errorf("no data exists")
 			return nil, err
 		}
@@ -113,65 +259,52 @@ func (getter *IPFSGetter) GetData(index int) ([]byte, error) {
 
 	if !ok {
 		util.LogPrintf("Could not find node for index %d", index)
-		getter.DataBlocksError++
+		getter.dataBlocksError.Add(1)
 		return nil, xerrors.Errorf("no node exists for such index")
 	}
 
-	// if node contains data just return the data
-	if target_node.Data != nil {
-		util.LogPrintf("Found data for index %d", index)
-		getter.DataBlocksCached++
-		return target_node.Data, nil
-	}
-
 	for {
-		// if node doesn't contain data, but the cid exists,
-		// then we use the cid to fetch the data from ipfs
-		if target_node.CID != "" {
-			util.LogPrintf("Found CID %s for index %d", target_node.CID, index)
-			util.LogPrintf("Attempting to download block using its cid")
-			raw_node, err := getter.shell.ObjectGet(target_node.CID)
+		// if the cid exists, then we use the cid to fetch the data from the cache or from ipfs
+		if cid := getter.dataNodeCID(target_node); cid != "" {
+			util.LogPrintf("Found CID %s for index %d", cid, index)
+			block, cached, err := getter.Cache.Fetch(ctx, dataKey(cid), func(ctx context.Context) (CachedBlock, error) {
+				return getter.fetchData(ctx, cid)
+			})
 			if err != nil {
-				getter.DataBlocksUnavailable++
-				return nil, err
-			}
-			data, err := getter.GetRawBlock(target_node.CID)
-			if err != nil {
-				getter.DataBlocksUnavailable++
+				getter.dataBlocksUnavailable.Add(1)
 				return nil, err
 			}
 
-			util.LogPrintf("Successfully downloaded block using its cid")
-			// populate the node with data and links if exists
-			if len(raw_node.Links) > 0 {
-				util.LogPrintf("Found %d links for index %d", len(raw_node.Links), index)
-
-				for i, dag_child := range raw_node.Links {
-					target_node.Children[i].CID = dag_child.Hash
+			// populate the node with links if exists
+			if len(block.Links) > 0 {
+				getter.treeLock.Lock()
+				for i, link := range block.Links {
+					target_node.Children[i].CID = link
 				}
-
-				util.LogPrintf("Successfully populated node with links")
+				getter.treeLock.Unlock()
 			}
 
-			getter.DataBlocksFetched++
-			target_node.Data = data
-			return data, nil
-
+			if cached {
+				getter.dataBlocksCached.Add(1)
+			} else {
+				getter.dataBlocksFetched.Add(1)
+			}
+			return block.Data, nil
 		}
 
-		// if node doesn't contain data and the cid doesn't exist,
+		// if the cid doesn't exist,
 		// then we need to find the parent of this node and repeat the procedure
 		util.LogPrintf("Could not find cid for index %d, finding its parent", index)
 		parent_index, ok := getter.ParentMap[index]
 		if !ok || parent_index == index {
-			getter.DataBlocksError++
+			getter.dataBlocksError.Add(1)
 			return nil, xerrors.Errorf("no data exists")
 		}
 
 		util.LogPrintf("Found parent for index %d, with index %d", index, parent_index)
-		_, err := getter.GetData(parent_index)
+		_, err := getter.GetData(ctx, parent_index)
 		if err != nil {
-			getter.DataBlocksUnavailable++
+			getter.dataBlocksUnavailable.Add(1)
 			return nil, err
 		}
 	}
@@ -179,10 +312,7 @@ func (getter *IPFSGetter) GetData(index int) ([]byte, error) {
 }
 
 // GetDataCID - mostly redoing of above func with only CID
-func (getter *IPFSGetter) GetDataCID(index int) string {
-	for k := range getter.DataFilter {
-		util.LogPrintf("DataFilter: %d", k)
-	}
+func (getter *IPFSGetter) GetDataCID(ctx context.Context, index int) string {
 	/* get the data, mask to represent the data loss */
 	if getter.DataFilter != nil {
 		if _, ok := getter.DataFilter[index]; ok {
@@ -190,6 +320,11 @@ func (getter *IPFSGetter) GetDataCID(index int) string {
 		}
 	}
 
+	return getter.resolveDataCID(ctx, index)
+}
+
+// resolveDataCID returns the CID of the indexed data block, downloading its ancestors if needed
+func (getter *IPFSGetter) resolveDataCID(ctx context.Context, index int) string {
 	util.LogPrintf("Getting CID for index %d", index)
 	target_node, ok := getter.NodeMap[index]
 
@@ -198,22 +333,13 @@ func (getter *IPFSGetter) GetDataCID(index int) string {
 		return ""
 	}
 
-	// if node contains CID just return the data
-	if target_node.CID != "" {
-		util.LogPrintf("Found CID for index %d", index)
-		return target_node.CID
-	}
-
 	for {
-		// if node doesn't contain data, but the cid exists,
-		// then we use the cid to fetch the data from ipfs
-		if target_node.CID != "" {
-			util.LogPrintf("Found CID %s for index %d", target_node.CID, index)
-			return target_node.CID
-
+		if cid := getter.dataNodeCID(target_node); cid != "" {
+			util.LogPrintf("Found CID %s for index %d", cid, index)
+			return cid
 		}
 
-		// if node doesn't contain data and the cid doesn't exist,
+		// if the cid doesn't exist,
 		// then we need to find the parent of this node and repeat the procedure
 		util.LogPrintf("Could not find CID for index %d, finding its parent", index)
 		parent_index, ok := getter.ParentMap[index]
@@ -222,13 +348,41 @@ func (getter *IPFSGetter) GetDataCID(index int) string {
 		}
 
 		util.LogPrintf("Found parent for index %d, with index %d", index, parent_index)
-		_, err := getter.GetData(parent_index)
+		_, err := getter.GetData(ctx, parent_index)
 		if err != nil {
 			return ""
 		}
 	}
 }
 
+// VerifyData checks that the recovered data hash to the CID of the indexed data block.
+// The data may still hold zero padding if the size of the block is unknown
+func (getter *IPFSGetter) VerifyData(ctx context.Context, index int, data []byte, exact bool) (err error) {
+	status := Unverified
+	if cid := getter.resolveDataCID(ctx, index); cid != "" {
+		_, err = VerifyRecovered(data, cid, exact)
+		if err != nil {
+			status = Corrupted
+		} else {
+			status = Verified
+		}
+	}
+
+	getter.verificationLock.Lock()
+	defer getter.verificationLock.Unlock()
+	getter.verification[index] = status
+	switch status {
+	case Verified:
+		getter.dataBlocksVerified++
+	case Corrupted:
+		getter.dataBlocksCorrupted++
+	default:
+		getter.dataBlocksUnverified++
+	}
+
+	return err
+}
+
 // func (getter *IPFSGetter) GetData(index int) ([]byte, error) {
 // 	/* Get the target CID of the block */
 // 	cid, ok := getter.DataIndexCIDMap.Get(index)
@@ -307,97 +461,83 @@ func calculateNewBlocks(originalBlockSize, newBlockSize, originalIndex int) [][3
 	return result
 }
 
-func (getter *IPFSGetter) GetParityHelper(currentNode *ParityTreeNode, strand int) ([]byte, error) {
+func (getter *IPFSGetter) GetParityHelper(ctx context.Context, currentNode *ParityTreeNode, strand int) ([]byte, error) {
 
 	if currentNode == nil {
-		getter.ParityBlocksError++
+		getter.parityBlocksError.Add(1)
 		return nil, xerrors.Errorf("parity doesn't exist")
 	}
 
-	// if data already exists just return it
-	if currentNode.Data != nil {
-		getter.ParityBlocksCached++
-		return currentNode.Data, nil
-	}
-
 	for {
-		// if data doesn't exist, but cid exists, then we use the cid to fetch the data from ipfs
-		if currentNode.CID != "" {
-			rawNode, err := getter.shell.ObjectGet(currentNode.CID)
-			if err != nil {
-				getter.ParityBlocksUnavailable++
-				return nil, err
-			}
-			rawBlock, err := getter.GetRawBlock(currentNode.CID)
-			if err != nil {
-				getter.ParityBlocksUnavailable++
-				return nil, err
-			}
-			dagNode, err := getter.GetDagNodeFromRawBytes(rawBlock)
+		// if cid exists, then we use the cid to fetch the data from the cache or from ipfs
+		if cid := getter.parityNodeCID(currentNode); cid != "" {
+			block, cached, err := getter.Cache.Fetch(ctx, parityKey(cid), func(ctx context.Context) (CachedBlock, error) {
+				return getter.fetchParity(ctx, cid)
+			})
 			if err != nil {
-				getter.ParityBlocksUnavailable++
+				getter.parityBlocksUnavailable.Add(1)
 				return nil, err
 			}
 
-			// populate the node with data and links if exists
-			if len(rawNode.Links) > 0 {
-				for i, dag_child := range rawNode.Links {
-					currentNode.Children[i].CID = dag_child.Hash
+			// populate the node with links if exists
+			if len(block.Links) > 0 {
+				getter.treeLock.Lock()
+				for i, link := range block.Links {
+					currentNode.Children[i].CID = link
 				}
+				getter.treeLock.Unlock()
 			}
 
-			currentData, err := getter.GetFileDataFromDagNode(dagNode)
-			if err != nil {
-				getter.ParityBlocksUnavailable++
-				return nil, err
+			if cached {
+				getter.parityBlocksCached.Add(1)
+			} else {
+				getter.parityBlocksFetched.Add(1)
 			}
-
-			getter.ParityBlocksFetched++
-			currentNode.Data = currentData
-			return currentData, nil
+			return block.Data, nil
 		}
 
-		// if data doesn't exist and cid doesn't exist, then we need to find the parent of this node and repeat the procedure
+		// if cid doesn't exist, then we need to find the parent of this node and repeat the procedure
 		if currentNode.Parent == nil {
-			getter.ParityBlocksError++
+			getter.parityBlocksError.Add(1)
 			return nil, xerrors.Errorf("parity doesn't have a parent")
 		}
 
-		_, err := getter.GetParityHelper(currentNode.Parent, strand)
+		_, err := getter.GetParityHelper(ctx, currentNode.Parent, strand)
 
 		if err != nil {
 			// we only set this to false if a non leaf node can't be found
 			// this internal node has no way of being repaired since its not entangled
 			// we'll have to make this whole strand unavailable and send a request to
 			// the daemon to regenerate and upload the whole strand again
-			getter.ParityBlocksUnavailable++
-			getter.ParityAvailable[strand] = false
+			getter.parityBlocksUnavailable.Add(1)
+			getter.treeLock.Lock()
+			getter.parityAvailable[strand] = false
+			getter.treeLock.Unlock()
 			return nil, err
 		}
 	}
 
 }
 
-func (getter *IPFSGetter) GetParity(index int, strand int) ([]byte, error) {
+func (getter *IPFSGetter) GetParity(ctx context.Context, index int, strand int) ([]byte, error) {
 	// find the node in ParityIndexMap
 	// get the path to the node
 
-	if !getter.ParityAvailable[strand] {
-		getter.ParityBlocksUnavailable++
+	if !getter.isParityAvailable(strand) {
+		getter.parityBlocksUnavailable.Add(1)
 		return nil, xerrors.Errorf("parity tree is missing")
 	}
 
 	final_data := make([]byte, 0)
-	// TODO: make these variables global and initialize them once!
-	blocks := calculateNewBlocks(262158, 262144, index)
+	blocks := calculateNewBlocks(getter.ParityBlockSize, getter.ParityLeafSize, index)
 
 	for _, block := range blocks {
 		targetNode, ok := getter.ParityIndexMap[strand][block[0]]
 		if !ok {
-			getter.ParityBlocksError++
+			getter.parityBlocksError.Add(1)
 			return nil, xerrors.Errorf("no parity exists")
 		}
-		currentData, err := getter.GetParityHelper(targetNode, strand)
+		currentData, err := getter.GetParityHelper(ctx, targetNode, strand)
 
 		if err != nil {
 			return nil, err
@@ -411,13 +551,12 @@ func (getter *IPFSGetter) GetParity(index int, strand int) ([]byte, error) {
 
 // GetParityCID - return the first CID where the parity block is stored
 func (getter *IPFSGetter) GetParityCID(index int, strand int) string {
-	if !getter.ParityAvailable[strand] {
+	if !getter.isParityAvailable(strand) {
 		util.LogPrintf("Parity tree is missing: strand=%d", strand)
 		return ""
 	}
 
-	// TODO: make these variables global and initialize them once!
-	blocks := calculateNewBlocks(262158, 262144, index)
+	blocks := calculateNewBlocks(getter.ParityBlockSize, getter.ParityLeafSize, index)
 
 	targetNode, ok := getter.ParityIndexMap[strand][blocks[0][0]]
 	if !ok {
@@ -425,14 +564,14 @@ func (getter *IPFSGetter) GetParityCID(index int, strand int) string {
 		return ""
 	}
 
-	return targetNode.CID
+	return getter.parityNodeCID(targetNode)
 }
 
 // Function is 0-indexed
 // function that translates lattice index of a block to its CID
 func (getter *IPFSGetter) GetCIDForDataBlock(index int) string {
 	if target_node, ok := getter.NodeMap[index]; ok {
-		return target_node.CID
+		return getter.dataNodeCID(target_node)
 	} else {
 		return ""
 	}
@@ -449,6 +588,6 @@ func (getter *IPFSGetter) GetCIDForParityBlock(index int, strand int) string {
 	if target_node, ok := getter.ParityIndexMap[strand][index]; !ok {
 		return ""
 	} else {
-		return target_node.CID
+		return getter.parityNodeCID(target_node)
 	}
 }
@@ -12,17 +12,29 @@ import (
 	"ipfs-alpha-entanglement-code/util"
 
 	sh "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
 	dag "github.com/ipfs/go-merkledag"
 	unixfs "github.com/ipfs/go-unixfs"
 )
 
 // IPFSConnector manages all the interaction with IPFS node
 type IPFSConnector struct {
-	shell *sh.Shell
+	shell      *sh.Shell
+	addOptions AddOptions
 }
 
 var DefaultPort = 5001
 
+const (
+	// DefaultChunkSize is the size of the data chunks produced by the default IPFS chunker
+	DefaultChunkSize = 262144
+	// DefaultParityBlockSize is the size a parity takes in a strand file: a full data leaf
+	// is a chunk wrapped in its unixfs envelope, and a parity is as large as the largest block of its chain
+	DefaultParityBlockSize = 262158
+	// DefaultParityLeafSize is the size of the leaves of a strand file added with the default chunker
+	DefaultParityLeafSize = 262144
+)
+
 // CreateIPFSConnector creates a running IPFS node and returns a connector to it
 func CreateIPFSConnector(port int, host string) (*IPFSConnector, error) {
 	if port == 0 {
@@ -33,101 +45,226 @@ func CreateIPFSConnector(port int, host string) (*IPFSConnector, error) {
 		host = "localhost"
 	}
 
-	connector := &IPFSConnector{sh.NewShell(fmt.Sprintf("%s:%d", host, port))}
+	connector := &IPFSConnector{
+		shell:      sh.NewShell(fmt.Sprintf("%s:%d", host, port)),
+		addOptions: DefaultAddOptions(),
+	}
 
 	return connector, nil
 }
 
-func (c *IPFSConnector) SetTimeout(duration time.Duration) {
-	c.shell.SetTimeout(duration)
+// blockTimeoutKey is the context key of the timeout of every single request to IPFS
+type blockTimeoutKey struct{}
+
+// WithBlockTimeout returns a context under which every single request to IPFS gives up after the timeout,
+// while the whole operation keeps the deadline of ctx. It is used to skip the blocks IPFS cannot find quickly
+func WithBlockTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, blockTimeoutKey{}, timeout)
+}
+
+// requestContext returns the context of a single request to IPFS
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout, ok := ctx.Value(blockTimeoutKey{}).(time.Duration); ok && timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// exec sends the request to IPFS and decodes the response into out
+func (c *IPFSConnector) exec(ctx context.Context, request *sh.RequestBuilder, out interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	return request.Exec(ctx, out)
+}
+
+// read sends the request to IPFS and reads the whole response
+func (c *IPFSConnector) read(ctx context.Context, request *sh.RequestBuilder) ([]byte, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	resp, err := request.Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return io.ReadAll(resp.Output)
+}
+
+// add adds the content of the reader as a file with the given options
+func (c *IPFSConnector) add(ctx context.Context, reader io.Reader, options ...sh.AddOpts) (string, error) {
+	entry := files.FileEntry("", files.NewReaderFile(reader))
+	body := files.NewMultiFileReader(files.NewSliceDirectory([]files.DirEntry{entry}), true)
+
+	request := c.shell.Request("add")
+	for _, option := range options {
+		if err := option(request); err != nil {
+			return "", err
+		}
+	}
+	var out struct {
+		Hash string
+	}
+	err := c.exec(ctx, request.Body(body), &out)
+	return out.Hash, err
+}
+
+// putBlock adds a single block with the given format and hash function
+func (c *IPFSConnector) putBlock(ctx context.Context, chunk []byte, format string, mhtype string) (string, error) {
+	entry := files.FileEntry("", files.NewBytesFile(chunk))
+	body := files.NewMultiFileReader(files.NewSliceDirectory([]files.DirEntry{entry}), true)
+
+	request := c.shell.Request("block/put").
+		Option("mhtype", mhtype).
+		Option("format", format).
+		Option("mhlen", -1).
+		Body(body)
+	var out struct {
+		Key string
+	}
+	err := c.exec(ctx, request, &out)
+	return out.Key, err
+}
+
+// PeerID returns the peer ID of the IPFS daemon
+func (c *IPFSConnector) PeerID(ctx context.Context) (string, error) {
+	var out struct {
+		ID string
+	}
+	if err := c.exec(ctx, c.shell.Request("id"), &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+// SetAddOptions sets the options used by AddFile
+func (c *IPFSConnector) SetAddOptions(opts AddOptions) error {
+	err := opts.Validate()
+	if err != nil {
+		return err
+	}
+	c.addOptions = opts
+	return nil
+}
+
+// GetAddOptions returns the options used by AddFile
+func (c *IPFSConnector) GetAddOptions() AddOptions {
+	return c.addOptions
 }
 
-// AddFile takes the file in the given path and writes it to IPFS network
-func (c *IPFSConnector) AddFile(path string) (cid string, err error) {
-	file, err := os.Open(path) // could catch error if file was not found
+// AddFile takes the file in the given path and writes it to IPFS network with the add options
+func (c *IPFSConnector) AddFile(ctx context.Context, path string) (cid string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
 	// get the file size
 	fileInfo, err := file.Stat()
-	util.InfoPrintf("Original File size: %d\n", fileInfo.Size())
 	if err != nil {
 		return
 	}
-	defer file.Close()
+	util.InfoPrintf("Original File size: %d\n", fileInfo.Size())
 
-	return c.shell.Add(file)
+	return c.add(ctx, file, c.addOptions.shellOptions()...)
 }
 
 // AddFileFromMem takes the bytes array and upload it to IPFS network as file
-func (c *IPFSConnector) AddFileFromMem(data []byte) (cid string, err error) {
-	return c.shell.Add(bytes.NewReader(data))
+func (c *IPFSConnector) AddFileFromMem(ctx context.Context, data []byte) (cid string, err error) {
+	return c.add(ctx, bytes.NewReader(data))
 }
 
-// AddDataFromMem takes the bytes array and upload it to IPFS network as raw leaves
-func (c *IPFSConnector) AddDataFromMem(data []byte) (cid string, err error) {
-	return c.shell.Add(bytes.NewReader(data), sh.RawLeaves(true))
+// AddFileFromReader reads the data until EOF and upload it to IPFS network as file
+func (c *IPFSConnector) AddFileFromReader(ctx context.Context, reader io.Reader) (cid string, err error) {
+	return c.add(ctx, reader)
 }
 
-// GetFile takes the file CID and reads it from IPFS network
-func (c *IPFSConnector) GetFile(cid string, outputPath string) error {
-	return c.shell.Get(cid, outputPath)
+// AddDataFromMem takes the bytes array and upload it to IPFS network as raw leaves
+func (c *IPFSConnector) AddDataFromMem(ctx context.Context, data []byte) (cid string, err error) {
+	return c.add(ctx, bytes.NewReader(data), sh.RawLeaves(true))
 }
 
-// GetFileToMem takes the file CID and reads it from IPFS network to memory
-func (c *IPFSConnector) GetFileToMem(cid string) ([]byte, error) {
-	data, err := c.shell.Cat(cid)
-	if err != nil {
-		return nil, err
-	}
-
-	body, err := io.ReadAll(data)
+// GetFile takes the file CID, reads it from IPFS network and writes it to the output path
+func (c *IPFSConnector) GetFile(ctx context.Context, cid string, outputPath string) error {
+	data, err := c.GetFileToMem(ctx, cid)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return os.WriteFile(outputPath, data, 0644)
+}
 
-	return body, nil
+// GetFileToMem takes the file CID and reads it from IPFS network to memory
+func (c *IPFSConnector) GetFileToMem(ctx context.Context, cid string) ([]byte, error) {
+	return c.read(ctx, c.shell.Request("cat", cid))
 }
 
 // AddRawData addes raw block data to IPFS network
-func (c *IPFSConnector) AddRawData(chunk []byte) (cid string, err error) {
-	return c.shell.BlockPut(chunk, "v0", "sha2-256", -1)
+func (c *IPFSConnector) AddRawData(ctx context.Context, chunk []byte) (cid string, err error) {
+	return c.putBlock(ctx, chunk, "v0", "sha2-256")
+}
+
+// PutBlock adds a block of a file added with the given options, so that it gets the same CID as when added
+func (c *IPFSConnector) PutBlock(ctx context.Context, chunk []byte, opts AddOptions, isLeaf bool) (cid string, err error) {
+	return c.putBlock(ctx, chunk, opts.blockFormat(isLeaf), opts.Hash)
 }
 
 // GetRawBlock gets raw block data from IPFS network
-func (c *IPFSConnector) GetRawBlock(cid string) (data []byte, err error) {
-	return c.shell.BlockGet(cid)
+func (c *IPFSConnector) GetRawBlock(ctx context.Context, cid string) (data []byte, err error) {
+	return c.read(ctx, c.shell.Request("block/get", cid))
 }
 
-func (c *IPFSConnector) GetRawObject(cid string) (*sh.IpfsObject, error) {
-	return c.shell.ObjectGet(cid)
+// GetRawObject gets the links and the data of a dag-pb block from IPFS network
+func (c *IPFSConnector) GetRawObject(ctx context.Context, cid string) (*sh.IpfsObject, error) {
+	var obj sh.IpfsObject
+	if err := c.exec(ctx, c.shell.Request("object/get", cid), &obj); err != nil {
+		return nil, err
+	}
+	return &obj, nil
 }
 
 // GetDagNodeFromRawBytes unmarshals raw bytes into IPFS dagnode
 func (c *IPFSConnector) GetDagNodeFromRawBytes(chunk []byte) (dagnode *dag.ProtoNode, err error) {
-	dagnode, err = dag.DecodeProtobuf(chunk)
-	return
+	return DecodeDagNode(chunk)
 }
 
 // GetFileDataFromDagNode extracts the real file data from IPFS dagnode
 func (c *IPFSConnector) GetFileDataFromDagNode(dagnode *dag.ProtoNode) (data []byte, err error) {
+	return FileDataFromDagNode(dagnode)
+}
+
+// DecodeDagNode unmarshals the raw bytes of a block into a dagnode
+func DecodeDagNode(chunk []byte) (*dag.ProtoNode, error) {
+	return dag.DecodeProtobuf(chunk)
+}
+
+// FileDataFromDagNode extracts the file data held by a unixfs dagnode
+func FileDataFromDagNode(dagnode *dag.ProtoNode) ([]byte, error) {
 	fsn, err := unixfs.FSNodeFromBytes(dagnode.Data())
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	data = fsn.Data()
-	return
+	return fsn.Data(), nil
 }
 
 // GetMerkleTree takes the Merkle tree root CID, constructs the tree and returns the root node
-func (c *IPFSConnector) GetMerkleTree(cid string, lattice *entangler.Lattice) (*TreeNode, int, int, error) {
+func (c *IPFSConnector) GetMerkleTree(ctx context.Context, cid string, lattice *entangler.Lattice) (*TreeNode, int, int, error) {
 	currIdx := 0
 	maxChildren := 0
 	var getMerkleNode func(string, int) (*TreeNode, int, error)
 
 	getMerkleNode = func(cid string, currentDepth int) (*TreeNode, int, error) {
-		// get the cid node from the IPFS
-		rootNodeFile, err := c.shell.ObjectGet(cid) //c.api.ResolveNode(c.ctx, cid)
-		if err != nil {
-			return nil, 0, err
+		// get the cid node from the IPFS. Raw leaves have no links
+		rootNodeFile := &sh.IpfsObject{}
+		if !IsRawCID(cid) {
+			var err error
+			rootNodeFile, err = c.GetRawObject(ctx, cid)
+			if err != nil {
+				return nil, 0, err
+			}
 		}
 
 		rootNode := CreateTreeNode([]byte{})
@@ -169,8 +306,10 @@ func (c *IPFSConnector) GetMerkleTree(cid string, lattice *entangler.Lattice) (*
 }
 
 // GetTotalBlocks returns the total number of blocks in the DAG pointed by the cid
-func (c *IPFSConnector) GetTotalBlocks(cid string) (int, error) {
-	filestate, err := c.shell.FilesStat(context.Background(), "/ipfs/"+cid)
+func (c *IPFSConnector) GetTotalBlocks(ctx context.Context, cid string) (int, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	filestate, err := c.shell.FilesStat(ctx, "/ipfs/"+cid)
 	if err != nil {
 		return 0, err
 	}
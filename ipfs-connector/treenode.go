@@ -1,6 +1,7 @@
 package ipfsconnector
 
 import (
+	"context"
 	"errors"
 	"fmt"
 )
@@ -50,10 +51,10 @@ func CreateTreeNode(data []byte) *TreeNode {
 }
 
 // LoadData loads the node raw data from IPFS network lazily
-func (n *TreeNode) Data() (data []byte, err error) {
+func (n *TreeNode) Data(ctx context.Context) (data []byte, err error) {
 	if len(n.data) == 0 && n.connector != nil && len(n.CID) > 0 {
 		var myData []byte
-		myData, err = n.connector.shell.BlockGet(n.CID)
+		myData, err = n.connector.GetRawBlock(ctx, n.CID)
 		if err != nil {
 			return
 		}
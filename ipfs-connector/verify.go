@@ -0,0 +1,49 @@
+package ipfsconnector
+
+import (
+	"bytes"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// VerifyBlock checks that the block data hash to the given CID
+func VerifyBlock(data []byte, expected string) error {
+	expectedCID, err := cid.Decode(expected)
+	if err != nil {
+		return xerrors.Errorf("invalid CID %s: %w", expected, err)
+	}
+
+	dataCID, err := expectedCID.Prefix().Sum(data)
+	if err != nil {
+		return xerrors.Errorf("fail to hash block: %w", err)
+	}
+	if !dataCID.Equals(expectedCID) {
+		return xerrors.Errorf("block hashes to %s, expected %s", dataCID, expectedCID)
+	}
+	return nil
+}
+
+// VerifyRecovered checks recovered data against the CID of their block and returns the block. Data truncated
+// to the known size of the block are hashed once, the others go through TrimToCID
+func VerifyRecovered(data []byte, expected string, exact bool) ([]byte, error) {
+	if !exact {
+		return TrimToCID(data, expected)
+	}
+	if err := VerifyBlock(data, expected); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// TrimToCID removes the zero padding of a recovered block whose size is unknown. The trailing zeros
+// are removed, then added back one by one until the block hashes to the given CID. It hashes the block
+// once per trailing zero, so it is only meant for files whose metadata lack the block sizes
+func TrimToCID(data []byte, expected string) ([]byte, error) {
+	for size := len(bytes.TrimRight(data, "\x00")); size <= len(data); size++ {
+		if VerifyBlock(data[:size], expected) == nil {
+			return data[:size], nil
+		}
+	}
+	return nil, xerrors.Errorf("no prefix of the recovered block hashes to %s", expected)
+}
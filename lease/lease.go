@@ -0,0 +1,349 @@
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"ipfs-alpha-entanglement-code/util"
+)
+
+const releaseAttempts = 4 // number of times a node is asked to release a lease before it is left to expire
+
+var ErrNoQuorum = errors.New("lease not granted by a majority of the nodes")
+var ErrHeld = errors.New("lease already held by the node")
+
+// Lease is the right of a node to coordinate an operation on a resource, granted by a majority of a group of
+// nodes until it expires. The term of the leases of a resource only grows, each election using a new one
+type Lease struct {
+	Resource string          `json:"resource"`
+	Holder   string          `json:"holder"`
+	Term     uint64          `json:"term"`
+	Duration time.Duration   `json:"duration"`
+	Task     json.RawMessage `json:"task,omitempty"` // operation to take over if the holder fails to renew the lease
+}
+
+// Grant is the answer of a node to a request for a lease or for its renewal
+type Grant struct {
+	Granted bool   `json:"granted"`
+	Holder  string `json:"holder,omitempty"` // holder of the lease on the node, if any
+	Term    uint64 `json:"term"`             // highest term of the resource known to the node
+}
+
+// Transport sends the requests of an elector to the other nodes of a group
+type Transport interface {
+	Request(ctx context.Context, address string, lease *Lease) (*Grant, error)
+	Release(ctx context.Context, address string, lease *Lease) error
+}
+
+// GrantedLease is a lease granted by the node
+type GrantedLease struct {
+	Lease
+	Expiry time.Time `json:"expiry"`
+}
+
+// Table holds the leases granted by the node to the nodes of its groups, itself included
+type Table struct {
+	mux    sync.Mutex
+	leases map[string]*GrantedLease // by resource
+	terms  map[string]uint64        // highest term known by resource, kept once the lease is released
+}
+
+func NewTable() *Table {
+	return &Table{leases: make(map[string]*GrantedLease), terms: make(map[string]uint64)}
+}
+
+// Grant grants a lease, or renews it, unless another node holds an unexpired lease of the resource or a lease
+// of a later term was granted
+func (t *Table) Grant(lease *Lease, now time.Time) *Grant {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	current := t.leases[lease.Resource]
+	if current != nil && current.Holder != lease.Holder && now.Before(current.Expiry) {
+		return &Grant{Holder: current.Holder, Term: t.terms[lease.Resource]}
+	}
+	if lease.Term < t.terms[lease.Resource] {
+		holder := ""
+		if current != nil {
+			holder = current.Holder
+		}
+		return &Grant{Holder: holder, Term: t.terms[lease.Resource]}
+	}
+
+	t.leases[lease.Resource] = &GrantedLease{Lease: *lease, Expiry: now.Add(lease.Duration)}
+	t.terms[lease.Resource] = lease.Term
+	return &Grant{Granted: true, Holder: lease.Holder, Term: lease.Term}
+}
+
+// Release forgets a lease, if it is still the one granted
+func (t *Table) Release(lease *Lease) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if current := t.leases[lease.Resource]; current != nil && current.Holder == lease.Holder && current.Term == lease.Term {
+		delete(t.leases, lease.Resource)
+	}
+}
+
+// Term returns the highest term of a resource known to the node
+func (t *Table) Term(resource string) uint64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.terms[resource]
+}
+
+// Observe records a term of a resource known to another node, so that the next election uses a later one
+func (t *Table) Observe(resource string, term uint64) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if term > t.terms[resource] {
+		t.terms[resource] = term
+	}
+}
+
+// Leases returns the leases granted by the node, by resource
+func (t *Table) Leases() []GrantedLease {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	leases := make([]GrantedLease, 0, len(t.leases))
+	for _, lease := range t.leases {
+		leases = append(leases, *lease)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Resource < leases[j].Resource })
+	return leases
+}
+
+// Expire removes and returns the leases expired for longer than grace without being released: their holder
+// failed, and their operation is left to take over
+func (t *Table) Expire(now time.Time, grace time.Duration) []GrantedLease {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	var expired []GrantedLease
+	for resource, lease := range t.leases {
+		if now.After(lease.Expiry.Add(grace)) {
+			expired = append(expired, *lease)
+			delete(t.leases, resource)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Resource < expired[j].Resource })
+	return expired
+}
+
+// heldLease is a lease held by the node, renewed until it is released or lost
+type heldLease struct {
+	lease  Lease
+	group  []string
+	expiry time.Time // as seen by the node, which started counting before the nodes granting it
+	onLost func()
+}
+
+// Elector acquires leases for the node from groups of nodes, and renews them
+type Elector struct {
+	self      string
+	table     *Table
+	transport Transport
+	duration  time.Duration
+
+	mux  sync.Mutex
+	held map[string]*heldLease // by resource, nil while the lease is being acquired
+}
+
+// NewElector returns the elector of the node, which grants its own requests from its table
+func NewElector(self string, table *Table, transport Transport, duration time.Duration) *Elector {
+	return &Elector{self: self, table: table, transport: transport, duration: duration, held: make(map[string]*heldLease)}
+}
+
+// Acquire asks the group for a lease of the resource and returns it once a majority of the group granted it.
+// The group should include the node itself. onLost is called if the lease expires before being released, as
+// the node could not renew it. It returns ErrHeld if the node already holds the lease or is acquiring it
+func (e *Elector) Acquire(ctx context.Context, resource string, group []string, task []byte, onLost func()) (*Lease, error) {
+	e.mux.Lock()
+	if _, held := e.held[resource]; held {
+		e.mux.Unlock()
+		return nil, ErrHeld
+	}
+	e.held[resource] = nil
+	e.mux.Unlock()
+
+	lease := &Lease{Resource: resource, Holder: e.self, Term: e.table.Term(resource) + 1, Duration: e.duration, Task: task}
+	start := time.Now()
+	granted, term := e.request(ctx, lease, group)
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if !quorum(granted, group) {
+		delete(e.held, resource)
+		// the nodes which granted the lease forget it, and the next election uses a later term
+		go e.release(lease, granted)
+		e.table.Observe(resource, term)
+		return nil, ErrNoQuorum
+	}
+	e.held[resource] = &heldLease{lease: *lease, group: group, expiry: start.Add(e.duration), onLost: onLost}
+	return lease, nil
+}
+
+// Renew renews the leases held by the node. The leases which expire before a majority of their group renews them
+// are lost
+func (e *Elector) Renew(ctx context.Context) {
+	e.mux.Lock()
+	held := make([]*heldLease, 0, len(e.held))
+	for _, h := range e.held {
+		if h != nil {
+			held = append(held, h)
+		}
+	}
+	e.mux.Unlock()
+
+	for _, h := range held {
+		start := time.Now()
+		granted, _ := e.request(ctx, &h.lease, h.group)
+
+		e.mux.Lock()
+		if e.held[h.lease.Resource] != h {
+			// released meanwhile
+			e.mux.Unlock()
+			continue
+		}
+		if quorum(granted, h.group) {
+			h.expiry = start.Add(e.duration)
+			e.mux.Unlock()
+			continue
+		}
+		lost := time.Now().After(h.expiry)
+		if lost {
+			delete(e.held, h.lease.Resource)
+		}
+		e.mux.Unlock()
+
+		if lost && h.onLost != nil {
+			h.onLost()
+		}
+	}
+}
+
+// Release releases a lease held by the node. It never waits for the group, so it can be called anywhere
+func (e *Elector) Release(resource string) {
+	e.mux.Lock()
+	h := e.held[resource]
+	if h == nil {
+		e.mux.Unlock()
+		return
+	}
+	delete(e.held, resource)
+	e.mux.Unlock()
+
+	go e.release(&h.lease, h.group)
+}
+
+// Holds tells whether the node holds the lease of a resource
+func (e *Elector) Holds(resource string) bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.held[resource] != nil
+}
+
+// Held returns the leases held by the node
+func (e *Elector) Held() []Lease {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	leases := make([]Lease, 0, len(e.held))
+	for _, h := range e.held {
+		if h != nil {
+			leases = append(leases, h.lease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Resource < leases[j].Resource })
+	return leases
+}
+
+// request asks the group for a lease, and returns the nodes which granted it and the highest term they know
+func (e *Elector) request(ctx context.Context, lease *Lease, group []string) ([]string, uint64) {
+	type answer struct {
+		address string
+		grant   *Grant
+	}
+	answers := make(chan answer, len(group))
+	for _, address := range group {
+		go func(address string) {
+			if address == e.self {
+				answers <- answer{address, e.table.Grant(lease, time.Now())}
+				return
+			}
+			grant, err := e.transport.Request(ctx, address, lease)
+			if err != nil {
+				grant = nil
+			}
+			answers <- answer{address, grant}
+		}(address)
+	}
+
+	var granted []string
+	var term uint64
+	for range group {
+		a := <-answers
+		if a.grant == nil {
+			continue
+		}
+		if a.grant.Granted {
+			granted = append(granted, a.address)
+		}
+		if a.grant.Term > term {
+			term = a.grant.Term
+		}
+	}
+	return granted, term
+}
+
+// release asks the nodes to forget a lease, again for the nodes which failed to, until the lease would have
+// expired. A node which never released it sees it expire, and checks that its task is still pending
+func (e *Elector) release(lease *Lease, nodes []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.duration)
+	defer cancel()
+
+	errs := make(map[string]error)
+	for attempt := 1; attempt <= releaseAttempts && ctx.Err() == nil; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				continue
+			case <-time.After(e.duration / releaseAttempts):
+			}
+		}
+
+		failed := make(map[string]error)
+		for _, address := range nodes {
+			if address == e.self {
+				e.table.Release(lease)
+				continue
+			}
+			if err := e.transport.Release(ctx, address, lease); err != nil {
+				failed[address] = err
+			}
+		}
+		errs = failed
+		if len(errs) == 0 {
+			return
+		}
+
+		nodes = make([]string, 0, len(errs))
+		for address := range errs {
+			nodes = append(nodes, address)
+		}
+	}
+
+	for address, err := range errs {
+		util.LogPrintf("Could not release the lease of %s with term %d on %s - %s", lease.Resource, lease.Term, address, err)
+	}
+}
+
+// quorum tells whether the nodes which granted a lease are a majority of the group
+func quorum(granted []string, group []string) bool {
+	return len(group) > 0 && 2*len(granted) > len(group)
+}
@@ -0,0 +1,196 @@
+package localstore
+
+import (
+	"io"
+	"strings"
+
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	unixfspb "github.com/ipfs/go-unixfs/pb"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// MaxLinks is the fan-out of the trees built by the default (balanced) IPFS layout
+const MaxLinks = 174
+
+// fileNode is a node of a DAG under construction, with the size of the file data below it
+type fileNode struct {
+	node     ipld.Node
+	fileSize uint64
+}
+
+// dagPrefixes returns the CID prefixes of the inner nodes and of the leaves of a file added with the options
+func dagPrefixes(opts ipfsconnector.AddOptions) (node cid.Prefix, leaf cid.Prefix, err error) {
+	err = opts.Validate()
+	if err != nil {
+		return
+	}
+	hash, ok := mh.Names[opts.Hash]
+	if !ok {
+		err = xerrors.Errorf("unknown hash function %s", opts.Hash)
+		return
+	}
+
+	node = cid.Prefix{Version: uint64(opts.CidVersion), Codec: cid.DagProtobuf, MhType: hash, MhLength: -1}
+	leaf = node
+	if opts.RawLeaves {
+		// raw blocks can only be addressed by CIDv1
+		leaf = cid.Prefix{Version: 1, Codec: cid.Raw, MhType: hash, MhLength: -1}
+	}
+	return node, leaf, nil
+}
+
+// BlockCID returns the CID of a single block of a file added with the options
+func BlockCID(data []byte, opts ipfsconnector.AddOptions, isLeaf bool) (string, error) {
+	nodePrefix, leafPrefix, err := dagPrefixes(opts)
+	if err != nil {
+		return "", err
+	}
+	prefix := nodePrefix
+	if isLeaf {
+		prefix = leafPrefix
+	}
+
+	blockCID, err := prefix.Sum(data)
+	if err != nil {
+		return "", xerrors.Errorf("fail to hash block: %w", err)
+	}
+	return blockCID.String(), nil
+}
+
+// checkChunker returns an error if the chunker is not supported: content defined chunkers are only run by IPFS
+func checkChunker(opts ipfsconnector.AddOptions) error {
+	if !strings.HasPrefix(opts.Chunker, "size-") {
+		return xerrors.Errorf("unsupported chunker %s. The local store only supports size-N", opts.Chunker)
+	}
+	return nil
+}
+
+// newLeaf wraps a chunk of the file into a leaf block
+func newLeaf(chunk []byte, opts ipfsconnector.AddOptions) (fileNode, error) {
+	nodePrefix, leafPrefix, err := dagPrefixes(opts)
+	if err != nil {
+		return fileNode{}, err
+	}
+
+	if opts.RawLeaves {
+		node, err := dag.NewRawNodeWPrefix(chunk, leafPrefix)
+		if err != nil {
+			return fileNode{}, err
+		}
+		return fileNode{node: node, fileSize: uint64(len(chunk))}, nil
+	}
+
+	fsn := unixfs.NewFSNode(unixfspb.Data_File)
+	if len(chunk) > 0 {
+		// IPFS leaves the data out of the leaf of an empty file
+		fsn.SetData(chunk)
+	}
+	data, err := fsn.GetBytes()
+	if err != nil {
+		return fileNode{}, err
+	}
+	node := dag.NodeWithData(data)
+	node.SetCidBuilder(nodePrefix)
+	return fileNode{node: node, fileSize: uint64(len(chunk))}, nil
+}
+
+// newParent creates the inner block linking to the children
+func newParent(children []fileNode, prefix cid.Prefix) (fileNode, error) {
+	fsn := unixfs.NewFSNode(unixfspb.Data_File)
+	var fileSize uint64
+	for _, child := range children {
+		fsn.AddBlockSize(child.fileSize)
+		fileSize += child.fileSize
+	}
+	data, err := fsn.GetBytes()
+	if err != nil {
+		return fileNode{}, err
+	}
+
+	node := dag.NodeWithData(data)
+	node.SetCidBuilder(prefix)
+	for _, child := range children {
+		err = node.AddNodeLink("", child.node)
+		if err != nil {
+			return fileNode{}, err
+		}
+	}
+	return fileNode{node: node, fileSize: fileSize}, nil
+}
+
+// BuildDAG chunks the reader and builds the balanced DAG IPFS builds for a file added with the options.
+// Every block is passed to put with its CID if put is not nil. It returns the root CID, the fan-out and the depth of the tree
+func BuildDAG(reader io.Reader, opts ipfsconnector.AddOptions, put func(blockCID string, data []byte) error) (string, int, int, error) {
+	if err := checkChunker(opts); err != nil {
+		return "", 0, 0, err
+	}
+	chunkSize, err := opts.MaxChunkSize()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	nodePrefix, _, err := dagPrefixes(opts)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if put == nil {
+		put = func(string, []byte) error { return nil }
+	}
+
+	// leaves. An empty file is a single empty leaf
+	var level []fileNode
+	for {
+		chunk := make([]byte, chunkSize)
+		n, err := io.ReadFull(reader, chunk)
+		if err == io.EOF && len(level) > 0 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", 0, 0, xerrors.Errorf("fail to read file: %w", err)
+		}
+
+		leaf, err := newLeaf(chunk[:n], opts)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		if err = put(leaf.node.Cid().String(), leaf.node.RawData()); err != nil {
+			return "", 0, 0, err
+		}
+		level = append(level, leaf)
+		if n < chunkSize {
+			break
+		}
+	}
+
+	// inner nodes, level by level
+	maxChildren, depth := 0, 1
+	for len(level) > 1 {
+		var parents []fileNode
+		for i := 0; i < len(level); i += MaxLinks {
+			end := i + MaxLinks
+			if end > len(level) {
+				end = len(level)
+			}
+			parent, err := newParent(level[i:end], nodePrefix)
+			if err != nil {
+				return "", 0, 0, err
+			}
+			if err = put(parent.node.Cid().String(), parent.node.RawData()); err != nil {
+				return "", 0, 0, err
+			}
+			if end-i > maxChildren {
+				maxChildren = end - i
+			}
+			parents = append(parents, parent)
+		}
+		level = parents
+		depth++
+	}
+
+	return level[0].node.Cid().String(), maxChildren, depth, nil
+}
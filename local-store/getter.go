@@ -0,0 +1,154 @@
+package localstore
+
+import (
+	"context"
+	"sync"
+
+	"ipfs-alpha-entanglement-code/entangler"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	"ipfs-alpha-entanglement-code/util"
+
+	"golang.org/x/xerrors"
+)
+
+// Getter gets the blocks of an entangled file from the local store for the lattice
+type Getter struct {
+	entangler.BlockGetter
+	store *Store
+
+	TreeCIDs   []string // strand CIDs. An empty CID makes the strand unavailable
+	DataFilter map[int]struct{}
+	ParentMap  map[int]int                          // maps lattice index of child to lattice index of parent
+	NodeMap    map[int]*ipfsconnector.EmptyTreeNode // maps lattice index of a certain block to its tree node
+
+	Verification map[int]ipfsconnector.VerificationStatus // last verification of the recovered data blocks, by index
+	lock         sync.Mutex
+}
+
+// CreateGetter creates the getter of a file whose tree is given by ipfsconnector.ConstructTree.
+// The CID of the root must be set, the CIDs of the other blocks are read from their parent
+func CreateGetter(store *Store, treeCIDs []string, parentMap map[int]int, nodeMap map[int]*ipfsconnector.EmptyTreeNode) *Getter {
+	return &Getter{
+		store:        store,
+		TreeCIDs:     treeCIDs,
+		DataFilter:   map[int]struct{}{},
+		ParentMap:    parentMap,
+		NodeMap:      nodeMap,
+		Verification: make(map[int]ipfsconnector.VerificationStatus),
+	}
+}
+
+// GetData returns the indexed (0-based) data block
+func (getter *Getter) GetData(ctx context.Context, index int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := getter.DataFilter[index]; ok {
+		return nil, xerrors.Errorf("no data exists")
+	}
+	blockCID := getter.GetDataCID(ctx, index)
+	if len(blockCID) == 0 {
+		return nil, xerrors.Errorf("unknown CID of data block %d", index)
+	}
+
+	data, err := getter.store.GetRawBlock(blockCID)
+	if err != nil {
+		return nil, xerrors.Errorf("fail to read data block %d: %w", index, err)
+	}
+	return data, nil
+}
+
+// GetDataCID returns the CID of the indexed data block, or an empty string if the blocks above it are missing
+func (getter *Getter) GetDataCID(ctx context.Context, index int) string {
+	getter.lock.Lock()
+	defer getter.lock.Unlock()
+
+	return getter.resolveDataCID(index)
+}
+
+// resolveDataCID reads the CID of the block from the links of its parent. The caller holds the lock
+func (getter *Getter) resolveDataCID(index int) string {
+	node, ok := getter.NodeMap[index]
+	if !ok {
+		return ""
+	}
+	if len(node.CID) > 0 {
+		return node.CID
+	}
+
+	// the root is its own parent
+	parentIndex, ok := getter.ParentMap[index]
+	if !ok || parentIndex == index {
+		return ""
+	}
+	parentCID := getter.resolveDataCID(parentIndex)
+	if len(parentCID) == 0 {
+		return ""
+	}
+	parent, err := getter.store.GetRawBlock(parentCID)
+	if err != nil {
+		return ""
+	}
+	getter.setChildrenCIDs(getter.NodeMap[parentIndex], parent)
+
+	return node.CID
+}
+
+// setChildrenCIDs sets the CIDs of the children of the tree node from the links of its block
+func (getter *Getter) setChildrenCIDs(node *ipfsconnector.EmptyTreeNode, block []byte) {
+	if len(node.Children) == 0 {
+		return
+	}
+	links, err := blockLinks(block)
+	if err != nil || len(links) != len(node.Children) {
+		util.LogPrintf("Fail to read the links of block %s", node.CID)
+		return
+	}
+	for i, link := range links {
+		node.Children[i].CID = link
+	}
+}
+
+// VerifyData checks the recovered data block against its CID, once its padding is removed
+func (getter *Getter) VerifyData(ctx context.Context, index int, data []byte, exact bool) error {
+	getter.lock.Lock()
+	defer getter.lock.Unlock()
+
+	blockCID := getter.resolveDataCID(index)
+	if len(blockCID) == 0 {
+		getter.Verification[index] = ipfsconnector.Unverified
+		return nil
+	}
+
+	block, err := ipfsconnector.VerifyRecovered(data, blockCID, exact)
+	if err != nil {
+		getter.Verification[index] = ipfsconnector.Corrupted
+		return err
+	}
+	getter.Verification[index] = ipfsconnector.Verified
+	if !ipfsconnector.IsRawCID(blockCID) {
+		getter.setChildrenCIDs(getter.NodeMap[index], block)
+	}
+	return nil
+}
+
+// GetParity returns the indexed (0-based) parity of the strand
+func (getter *Getter) GetParity(ctx context.Context, index int, strand int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if strand < 0 || strand >= len(getter.TreeCIDs) || len(getter.TreeCIDs[strand]) == 0 {
+		return nil, xerrors.Errorf("strand %d is unavailable", strand)
+	}
+
+	parity, err := getter.store.GetParity(getter.TreeCIDs[strand], index)
+	if err != nil {
+		return nil, xerrors.Errorf("fail to read parity %d of strand %d: %w", index, strand, err)
+	}
+	return parity, nil
+}
+
+// GetParityCID returns an empty string: the parities are stored by index, not by CID
+func (getter *Getter) GetParityCID(index int, strand int) string {
+	return ""
+}
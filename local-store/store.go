@@ -0,0 +1,336 @@
+package localstore
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+
+	"golang.org/x/xerrors"
+)
+
+// Store keeps files and their entanglement in a local directory, so that they can be uploaded,
+// downloaded and repaired without IPFS. The blocks of the files are stored in the blocks directory,
+// one file per block named by its CID. The parities of a strand are stored in a directory named by
+// the strand CID, one file per parity named by its index in the strand
+type Store struct {
+	root       string
+	addOptions ipfsconnector.AddOptions
+}
+
+// CreateStore opens the store in the root directory, creating it if needed
+func CreateStore(root string) (*Store, error) {
+	store := &Store{root: root, addOptions: ipfsconnector.DefaultAddOptions()}
+	for _, dir := range []string{store.blockDir(), store.strandDir("")} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, xerrors.Errorf("fail to create the local store: %w", err)
+		}
+	}
+	return store, nil
+}
+
+// Root returns the directory of the store
+func (s *Store) Root() string {
+	return s.root
+}
+
+// SetAddOptions sets the options used by AddFile
+func (s *Store) SetAddOptions(opts ipfsconnector.AddOptions) error {
+	if _, _, err := dagPrefixes(opts); err != nil {
+		return err
+	}
+	if err := checkChunker(opts); err != nil {
+		return err
+	}
+	s.addOptions = opts
+	return nil
+}
+
+// GetAddOptions returns the options used by AddFile
+func (s *Store) GetAddOptions() ipfsconnector.AddOptions {
+	return s.addOptions
+}
+
+func (s *Store) blockDir() string {
+	return filepath.Join(s.root, "blocks")
+}
+
+func (s *Store) strandDir(strandCID string) string {
+	return filepath.Join(s.root, "strands", strandCID)
+}
+
+// AddFile adds the file at path to the store and returns its root CID
+func (s *Store) AddFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return s.AddFileFromReader(file)
+}
+
+// AddFileFromMem adds the data as a file to the store and returns its root CID
+func (s *Store) AddFileFromMem(data []byte) (string, error) {
+	return s.AddFileFromReader(bytes.NewReader(data))
+}
+
+// AddFileFromReader adds the content of the reader as a file to the store and returns its root CID
+func (s *Store) AddFileFromReader(reader io.Reader) (string, error) {
+	rootCID, _, _, err := BuildDAG(reader, s.addOptions, s.writeBlock)
+	return rootCID, err
+}
+
+// PutBlock stores a single block of a file added with the options and returns its CID
+func (s *Store) PutBlock(chunk []byte, opts ipfsconnector.AddOptions, isLeaf bool) (string, error) {
+	blockCID, err := BlockCID(chunk, opts, isLeaf)
+	if err != nil {
+		return "", err
+	}
+	return blockCID, s.writeBlock(blockCID, chunk)
+}
+
+// writeBlock writes a block unless it is already stored. Blocks are content addressed,
+// so an existing block has the same data
+func (s *Store) writeBlock(blockCID string, data []byte) error {
+	path := filepath.Join(s.blockDir(), blockCID)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	// write then rename, so that a block is never read half written
+	tmp, err := os.CreateTemp(s.blockDir(), ".tmp-")
+	if err != nil {
+		return xerrors.Errorf("fail to store block %s: %w", blockCID, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return xerrors.Errorf("fail to store block %s: %w", blockCID, err)
+	}
+	return nil
+}
+
+// GetRawBlock returns the raw data of the block
+func (s *Store) GetRawBlock(blockCID string) ([]byte, error) {
+	if len(blockCID) == 0 {
+		return nil, xerrors.Errorf("empty block CID")
+	}
+	return os.ReadFile(filepath.Join(s.blockDir(), filepath.Base(blockCID)))
+}
+
+// HasBlock returns whether the block is stored
+func (s *Store) HasBlock(blockCID string) bool {
+	_, err := os.Stat(filepath.Join(s.blockDir(), filepath.Base(blockCID)))
+	return err == nil
+}
+
+// RemoveBlock deletes the block from the store, e.g. to simulate its loss
+func (s *Store) RemoveBlock(blockCID string) error {
+	return os.Remove(filepath.Join(s.blockDir(), filepath.Base(blockCID)))
+}
+
+// GetMerkleTree reads the DAG of the file from the store and returns its root node, fan-out and depth
+func (s *Store) GetMerkleTree(rootCID string) (*ipfsconnector.TreeNode, int, int, error) {
+	currIdx := 0
+	maxChildren := 0
+	var getMerkleNode func(string, int) (*ipfsconnector.TreeNode, int, error)
+
+	getMerkleNode = func(blockCID string, currentDepth int) (*ipfsconnector.TreeNode, int, error) {
+		data, err := s.GetRawBlock(blockCID)
+		if err != nil {
+			return nil, 0, err
+		}
+		var links []string
+		if !ipfsconnector.IsRawCID(blockCID) {
+			links, err = blockLinks(data)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+
+		node := ipfsconnector.CreateTreeNode(data)
+		node.CID = blockCID
+		node.PreOrderIdx = currIdx
+		currIdx++
+
+		if len(links) > maxChildren {
+			maxChildren = len(links)
+		}
+		if len(links) == 0 {
+			node.LeafSize = 1
+		}
+
+		maxDepth := currentDepth
+		for _, link := range links {
+			child, childDepth, err := getMerkleNode(link, currentDepth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			if childDepth > maxDepth {
+				maxDepth = childDepth
+			}
+			node.AddChild(child)
+		}
+		return node, maxDepth, nil
+	}
+
+	root, depth, err := getMerkleNode(rootCID, 1)
+	return root, maxChildren, depth, err
+}
+
+// GetFileToMem reads the whole file from the store
+func (s *Store) GetFileToMem(rootCID string) ([]byte, error) {
+	var data []byte
+	var walker func(string) error
+	walker = func(blockCID string) error {
+		block, err := s.GetRawBlock(blockCID)
+		if err != nil {
+			return err
+		}
+		if ipfsconnector.IsRawCID(blockCID) {
+			data = append(data, block...)
+			return nil
+		}
+
+		dagNode, err := ipfsconnector.DecodeDagNode(block)
+		if err != nil {
+			return xerrors.Errorf("fail to parse block %s: %w", blockCID, err)
+		}
+		links := dagNode.Links()
+		if len(links) == 0 {
+			fileData, err := ipfsconnector.FileDataFromDagNode(dagNode)
+			if err != nil {
+				return xerrors.Errorf("fail to parse file data of %s: %w", blockCID, err)
+			}
+			data = append(data, fileData...)
+		}
+		for _, link := range links {
+			err = walker(link.Cid.String())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := walker(rootCID)
+	if err != nil {
+		return nil, xerrors.Errorf("fail to read file %s: %w", rootCID, err)
+	}
+	return data, nil
+}
+
+// blockLinks returns the CIDs of the children of a dag-pb block
+func blockLinks(block []byte) ([]string, error) {
+	dagNode, err := ipfsconnector.DecodeDagNode(block)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]string, len(dagNode.Links()))
+	for i, link := range dagNode.Links() {
+		links[i] = link.Cid.String()
+	}
+	return links, nil
+}
+
+// AddStrand stores the parities of a strand, which are paritySize bytes each in the reader.
+// It returns the CID the strand has as an IPFS file, which names its parity directory, and the fan-out
+// of its tree. A strand already stored with the same CID is replaced
+func (s *Store) AddStrand(reader io.Reader, paritySize int) (string, int, error) {
+	if paritySize < 1 {
+		return "", 0, xerrors.Errorf("invalid parity size %d", paritySize)
+	}
+	tmpDir, err := os.MkdirTemp(s.strandDir(""), ".tmp-")
+	if err != nil {
+		return "", 0, xerrors.Errorf("fail to store strand: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// the strand is added to IPFS with the default options, so it gets the same CID here
+	writer := &parityWriter{dir: tmpDir, size: paritySize}
+	strandCID, maxChildren, _, err := BuildDAG(io.TeeReader(reader, writer), ipfsconnector.DefaultAddOptions(), nil)
+	if err == nil {
+		err = writer.flush()
+	}
+	if err != nil {
+		return "", 0, xerrors.Errorf("fail to store strand: %w", err)
+	}
+
+	err = os.RemoveAll(s.strandDir(strandCID))
+	if err == nil {
+		err = os.Rename(tmpDir, s.strandDir(strandCID))
+	}
+	if err != nil {
+		return "", 0, xerrors.Errorf("fail to store strand %s: %w", strandCID, err)
+	}
+	return strandCID, maxChildren, nil
+}
+
+func (s *Store) parityPath(strandCID string, index int) string {
+	return filepath.Join(s.strandDir(filepath.Base(strandCID)), strconv.Itoa(index))
+}
+
+// GetParity returns the indexed (0-based) parity of the strand
+func (s *Store) GetParity(strandCID string, index int) ([]byte, error) {
+	if len(strandCID) == 0 {
+		return nil, xerrors.Errorf("empty strand CID")
+	}
+	return os.ReadFile(s.parityPath(strandCID, index))
+}
+
+// RemoveParity deletes the indexed (0-based) parity of the strand, e.g. to simulate its loss
+func (s *Store) RemoveParity(strandCID string, index int) error {
+	return os.Remove(s.parityPath(strandCID, index))
+}
+
+// parityWriter splits a strand into its parities and writes one file per parity
+type parityWriter struct {
+	dir    string
+	size   int
+	index  int
+	buffer []byte
+}
+
+func (w *parityWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := w.size - len(w.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buffer = append(w.buffer, p[:n]...)
+		p = p[n:]
+
+		if len(w.buffer) == w.size {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the buffered parity, if any
+func (w *parityWriter) flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	err := os.WriteFile(filepath.Join(w.dir, strconv.Itoa(w.index)), w.buffer, 0644)
+	if err != nil {
+		return err
+	}
+	w.index++
+	w.buffer = w.buffer[:0]
+	return nil
+}
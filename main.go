@@ -2,6 +2,8 @@ package main
 
 import (
 	"ipfs-alpha-entanglement-code/cmd"
+	"log"
+	"os"
 )
 
 func main() {
@@ -10,11 +12,13 @@ func main() {
 
 	client, err := cmd.NewCommand()
 	if err != nil {
-		panic(err)
+		log.Println("Error:", err)
+		os.Exit(1)
 	}
 
 	err = client.Execute()
 	if err != nil {
-		panic(err)
+		log.Println("Error:", err)
+		os.Exit(1)
 	}
 }
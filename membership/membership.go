@@ -0,0 +1,485 @@
+package membership
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the state of a member as seen by the failure detector
+type State int
+
+const (
+	Alive   State = iota
+	Suspect       // missed a probe, declared dead unless it refutes the suspicion in time
+	Dead
+)
+
+func (state State) String() string {
+	switch state {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+func (state State) MarshalText() ([]byte, error) {
+	return []byte(state.String()), nil
+}
+
+func (state *State) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "alive":
+		*state = Alive
+	case "suspect":
+		*state = Suspect
+	case "dead":
+		*state = Dead
+	default:
+		return errors.New("unknown member state " + string(text))
+	}
+	return nil
+}
+
+var ErrProbeFailed = errors.New("member did not answer the probe")
+
+// Update is the state of a member gossiped between the members. The incarnation is only increased by the member
+// itself, to refute a suspicion: an update overrides those of lower incarnation
+type Update struct {
+	Address     string `json:"address"`
+	ClusterIP   string `json:"clusterIP,omitempty"`
+	State       State  `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// Message is a probe, a request to probe another member or an acknowledgement, carrying the updates gossiped
+// by its sender
+type Message struct {
+	Sender  Update   `json:"sender"`           // the sender itself, alive
+	Target  string   `json:"target,omitempty"` // member to probe, for a request to probe another member
+	Updates []Update `json:"updates,omitempty"`
+}
+
+// Member is a member known to the failure detector
+type Member struct {
+	Update
+	Since time.Time `json:"since"` // when the member entered its state, as seen by the detector
+}
+
+// Transport sends the messages of the failure detector to the other members
+type Transport interface {
+	// Ping probes a member and returns its acknowledgement
+	Ping(ctx context.Context, address string, msg *Message) (*Message, error)
+	// PingReq asks a member to probe the target of the message, and returns its acknowledgement if the target
+	// acknowledged the probe
+	PingReq(ctx context.Context, address string, msg *Message) (*Message, error)
+}
+
+// Config tunes the failure detector
+type Config struct {
+	ProbeTimeout     time.Duration // wait for the acknowledgement of a probe
+	IndirectProbes   int           // members asked to probe a member which did not acknowledge a probe
+	SuspicionTimeout time.Duration // time given to a suspected member to refute the suspicion
+	RetransmitMult   int           // an update is gossiped RetransmitMult * log10(members + 1) times
+	MaxPiggyback     int           // updates gossiped by a message
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ProbeTimeout:     500 * time.Millisecond,
+		IndirectProbes:   3,
+		SuspicionTimeout: 10 * time.Second,
+		RetransmitMult:   4,
+		MaxPiggyback:     8,
+	}
+}
+
+type broadcast struct {
+	update    Update
+	transmits int // times the update is still to be gossiped
+}
+
+// Detector is a SWIM failure detector: each protocol period it probes a member, asks other members to probe it
+// if it does not answer, and suspects it if none of them succeeds. A suspected member not refuting the
+// suspicion in time is declared dead. The changes of states are gossiped on the messages of the protocol.
+// It is safe for concurrent use
+type Detector struct {
+	self      string
+	clusterIP string
+	config    Config
+	transport Transport
+
+	lock        sync.Mutex
+	incarnation uint64
+	members     map[string]*Member
+	probeOrder  []string
+	probeIndex  int
+	broadcasts  map[string]*broadcast // by address of the member
+	listener    func(Member)
+}
+
+// NewDetector returns the failure detector of the member at the address. Its incarnation starts from the current
+// time, so that a member restarting overrides the updates declaring its previous run dead
+func NewDetector(self string, clusterIP string, config Config, transport Transport) *Detector {
+	d := &Detector{
+		self:        self,
+		clusterIP:   clusterIP,
+		config:      config,
+		transport:   transport,
+		incarnation: uint64(time.Now().Unix()),
+		members:     make(map[string]*Member),
+		broadcasts:  make(map[string]*broadcast),
+	}
+	d.enqueue(d.selfUpdate())
+	return d
+}
+
+// OnChange sets the function called when a member changes state, outside of the lock of the detector
+func (d *Detector) OnChange(listener func(Member)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.listener = listener
+}
+
+// Join adds the members not known yet as alive, with the lowest incarnation so that any update overrides it
+func (d *Detector) Join(members []Update) {
+	d.lock.Lock()
+	var changed []Member
+	for _, update := range members {
+		if _, known := d.members[update.Address]; known || update.Address == d.self || update.Address == "" {
+			continue
+		}
+		member := &Member{Update: Update{Address: update.Address, ClusterIP: update.ClusterIP, State: Alive}, Since: time.Now()}
+		d.members[update.Address] = member
+		changed = append(changed, *member)
+	}
+	d.lock.Unlock()
+	d.notify(changed)
+}
+
+// Members returns the members known to the detector, by address
+func (d *Detector) Members() []Member {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	members := make([]Member, 0, len(d.members))
+	for _, member := range d.members {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Address < members[j].Address })
+	return members
+}
+
+// Alive returns the addresses of the members believed alive, leaving out the suspected ones
+func (d *Detector) Alive() []string {
+	var alive []string
+	for _, member := range d.Members() {
+		if member.State == Alive {
+			alive = append(alive, member.Address)
+		}
+	}
+	return alive
+}
+
+// State returns the state of a member, false if it is not known
+func (d *Detector) State(address string) (State, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	member, ok := d.members[address]
+	if !ok {
+		return Dead, false
+	}
+	return member.State, true
+}
+
+// Probe runs a protocol period: it declares dead the suspected members which did not refute the suspicion in
+// time, then probes the next member
+func (d *Detector) Probe(ctx context.Context) {
+	d.ExpireSuspects(time.Now())
+
+	target, ok := d.nextTarget()
+	if !ok {
+		return
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, d.config.ProbeTimeout)
+	ack, err := d.transport.Ping(pingCtx, target, d.message(target, ""))
+	cancel()
+	if err == nil {
+		d.receive(ack)
+		return
+	}
+
+	if d.probeIndirectly(ctx, target) {
+		return
+	}
+	d.suspect(target)
+}
+
+// probeIndirectly asks random alive members to probe the target, and tells whether one of them succeeded
+func (d *Detector) probeIndirectly(ctx context.Context, target string) bool {
+	helpers := d.randomAlive(d.config.IndirectProbes, target)
+	if len(helpers) == 0 {
+		return false
+	}
+
+	// the helpers probe the target with their own timeout
+	reqCtx, cancel := context.WithTimeout(ctx, 2*d.config.ProbeTimeout)
+	defer cancel()
+
+	results := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			ack, err := d.transport.PingReq(reqCtx, helper, d.message(target, target))
+			if err == nil {
+				d.receive(ack)
+			}
+			results <- err == nil
+		}(helper)
+	}
+
+	for range helpers {
+		if <-results {
+			return true
+		}
+	}
+	return false
+}
+
+// HandlePing answers a probe of another member
+func (d *Detector) HandlePing(msg *Message) *Message {
+	d.receive(msg)
+	return d.message(msg.Sender.Address, "")
+}
+
+// HandlePingReq probes the target of the message for another member, and returns the acknowledgement to send
+// back if the target acknowledged the probe
+func (d *Detector) HandlePingReq(ctx context.Context, msg *Message) (*Message, error) {
+	d.receive(msg)
+	if msg.Target == "" || msg.Target == d.self {
+		return d.message(msg.Sender.Address, ""), nil
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, d.config.ProbeTimeout)
+	defer cancel()
+	ack, err := d.transport.Ping(pingCtx, msg.Target, d.message(msg.Target, ""))
+	if err != nil {
+		return nil, ErrProbeFailed
+	}
+	d.receive(ack)
+	return d.message(msg.Sender.Address, ""), nil
+}
+
+// ExpireSuspects declares dead the suspected members which did not refute the suspicion in time
+func (d *Detector) ExpireSuspects(now time.Time) {
+	d.lock.Lock()
+	var changed []Member
+	for _, member := range d.members {
+		if member.State == Suspect && now.Sub(member.Since) > d.config.SuspicionTimeout {
+			member.State = Dead
+			member.Since = now
+			d.enqueue(member.Update)
+			changed = append(changed, *member)
+		}
+	}
+	d.lock.Unlock()
+	d.notify(changed)
+}
+
+// suspect suspects an alive member which did not answer a probe
+func (d *Detector) suspect(address string) {
+	d.lock.Lock()
+	member, ok := d.members[address]
+	if !ok || member.State != Alive {
+		d.lock.Unlock()
+		return
+	}
+	member.State = Suspect
+	member.Since = time.Now()
+	d.enqueue(member.Update)
+	changed := *member
+	d.lock.Unlock()
+	d.notify([]Member{changed})
+}
+
+// receive applies the updates carried by a message
+func (d *Detector) receive(msg *Message) {
+	d.lock.Lock()
+	var changed []Member
+	for _, update := range append([]Update{msg.Sender}, msg.Updates...) {
+		if member, ok := d.apply(update); ok {
+			changed = append(changed, member)
+		}
+	}
+	d.lock.Unlock()
+	d.notify(changed)
+}
+
+// apply applies an update if it overrides the state known of the member, and returns the member if it changed
+// state. An update suspecting or declaring dead the detector itself is refuted. The caller holds the lock
+func (d *Detector) apply(update Update) (Member, bool) {
+	if update.Address == "" {
+		return Member{}, false
+	}
+	if update.Address == d.self {
+		if update.State != Alive && update.Incarnation >= d.incarnation {
+			d.incarnation = update.Incarnation + 1
+			d.enqueue(d.selfUpdate())
+		}
+		return Member{}, false
+	}
+
+	member, known := d.members[update.Address]
+	if !known {
+		member = &Member{Update: update, Since: time.Now()}
+		d.members[update.Address] = member
+		d.enqueue(update)
+		return *member, true
+	}
+	if member.ClusterIP == "" {
+		member.ClusterIP = update.ClusterIP
+	}
+
+	var overrides bool
+	switch update.State {
+	case Alive:
+		overrides = update.Incarnation > member.Incarnation
+	case Suspect:
+		overrides = (member.State == Alive && update.Incarnation >= member.Incarnation) ||
+			(member.State == Suspect && update.Incarnation > member.Incarnation)
+	case Dead:
+		overrides = member.State != Dead && update.Incarnation >= member.Incarnation
+	}
+	if !overrides {
+		return Member{}, false
+	}
+
+	changed := member.State != update.State
+	member.Incarnation = update.Incarnation
+	if changed {
+		member.State = update.State
+		member.Since = time.Now()
+	}
+	d.enqueue(member.Update)
+	return *member, changed
+}
+
+// nextTarget returns the next member to probe, going through the members not dead in a random order
+func (d *Detector) nextTarget() (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		for d.probeIndex < len(d.probeOrder) {
+			address := d.probeOrder[d.probeIndex]
+			d.probeIndex++
+			if member, ok := d.members[address]; ok && member.State != Dead {
+				return address, true
+			}
+		}
+
+		// start a new round
+		d.probeOrder = d.probeOrder[:0]
+		for address, member := range d.members {
+			if member.State != Dead {
+				d.probeOrder = append(d.probeOrder, address)
+			}
+		}
+		rand.Shuffle(len(d.probeOrder), func(i, j int) { d.probeOrder[i], d.probeOrder[j] = d.probeOrder[j], d.probeOrder[i] })
+		d.probeIndex = 0
+	}
+	return "", false
+}
+
+// randomAlive returns up to n random alive members other than the excluded one
+func (d *Detector) randomAlive(n int, excluded string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var alive []string
+	for address, member := range d.members {
+		if member.State == Alive && address != excluded {
+			alive = append(alive, address)
+		}
+	}
+	rand.Shuffle(len(alive), func(i, j int) { alive[i], alive[j] = alive[j], alive[i] })
+	if len(alive) > n {
+		alive = alive[:n]
+	}
+	return alive
+}
+
+// message returns a message to a member carrying the gossiped updates. A suspected recipient is always told
+// about the suspicion, so that it can refute it
+func (d *Detector) message(recipient string, target string) *Message {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	msg := &Message{Sender: d.selfUpdate(), Target: target, Updates: d.gossip()}
+	if member, ok := d.members[recipient]; ok && member.State == Suspect {
+		msg.Updates = append(msg.Updates, member.Update)
+	}
+	return msg
+}
+
+// gossip returns the updates to piggyback on a message, those gossiped the least first. The caller holds the lock
+func (d *Detector) gossip() []Update {
+	pending := make([]*broadcast, 0, len(d.broadcasts))
+	for _, b := range d.broadcasts {
+		pending = append(pending, b)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].transmits != pending[j].transmits {
+			return pending[i].transmits > pending[j].transmits
+		}
+		return pending[i].update.Address < pending[j].update.Address
+	})
+	if len(pending) > d.config.MaxPiggyback {
+		pending = pending[:d.config.MaxPiggyback]
+	}
+
+	updates := make([]Update, 0, len(pending))
+	for _, b := range pending {
+		updates = append(updates, b.update)
+		b.transmits--
+		if b.transmits <= 0 {
+			delete(d.broadcasts, b.update.Address)
+		}
+	}
+	return updates
+}
+
+// enqueue gossips an update, replacing the previous update of the member. The caller holds the lock
+func (d *Detector) enqueue(update Update) {
+	transmits := d.config.RetransmitMult * int(math.Ceil(math.Log10(float64(len(d.members)+2))))
+	d.broadcasts[update.Address] = &broadcast{update: update, transmits: transmits}
+}
+
+func (d *Detector) selfUpdate() Update {
+	return Update{Address: d.self, ClusterIP: d.clusterIP, State: Alive, Incarnation: d.incarnation}
+}
+
+func (d *Detector) notify(changed []Member) {
+	if len(changed) == 0 {
+		return
+	}
+	d.lock.Lock()
+	listener := d.listener
+	d.lock.Unlock()
+	if listener == nil {
+		return
+	}
+	for _, member := range changed {
+		listener(member)
+	}
+}
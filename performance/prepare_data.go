@@ -17,6 +17,7 @@ type Metadata struct {
 
 	DataCIDIndexMap map[string]int
 	ParityCIDs      [][]string
+	DataBlockSizes  []int // size of each data block in lattice order. Empty for older files
 }
 
 type PerfResult struct {
@@ -1,7 +1,7 @@
 package performance
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"ipfs-alpha-entanglement-code/entangler"
 	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
@@ -25,7 +25,7 @@ type RecoverGetter struct {
 	cache map[string][]byte
 }
 
-func CreateRecoverGetter(connector *ipfsconnector.IPFSConnector,
+func CreateRecoverGetter(ctx context.Context, connector *ipfsconnector.IPFSConnector,
 	CIDIndexMap map[string]int, parityCIDs [][]string) (*RecoverGetter, error) {
 
 	indexToDataCIDMap := *util.NewSafeMap()
@@ -38,16 +38,16 @@ func CreateRecoverGetter(connector *ipfsconnector.IPFSConnector,
 		cache:           map[string][]byte{},
 	}
 
-	err := getter.InitCache()
+	err := getter.InitCache(ctx)
 
 	return &getter, err
 }
 
-func (getter *RecoverGetter) InitCache() error {
+func (getter *RecoverGetter) InitCache(ctx context.Context) error {
 	// init data
 	for _, dataCID := range getter.DataIndexCIDMap.GetAll() {
 		// download from IPFS and store in cache
-		data, err := getter.GetRawBlock(dataCID)
+		data, err := getter.GetRawBlock(ctx, dataCID)
 		if err != nil {
 			return err
 		}
@@ -58,7 +58,7 @@ func (getter *RecoverGetter) InitCache() error {
 	for _, parities := range getter.Parity {
 		for _, parityCID := range parities {
 			// download from IPFS and store in cache
-			data, err := getter.GetFileToMem(parityCID)
+			data, err := getter.GetFileToMem(ctx, parityCID)
 			if err != nil {
 				return err
 			}
@@ -69,7 +69,7 @@ func (getter *RecoverGetter) InitCache() error {
 	return nil
 }
 
-func (getter *RecoverGetter) GetData(index int) ([]byte, error) {
+func (getter *RecoverGetter) GetData(ctx context.Context, index int) ([]byte, error) {
 	/* Get the target CID of the block */
 	cid, ok := getter.DataIndexCIDMap.Get(index)
 	if !ok {
@@ -92,7 +92,7 @@ func (getter *RecoverGetter) GetData(index int) ([]byte, error) {
 	return nil, xerrors.Errorf("no such data")
 }
 
-func (getter *RecoverGetter) GetParity(index int, strand int) ([]byte, error) {
+func (getter *RecoverGetter) GetParity(ctx context.Context, index int, strand int) ([]byte, error) {
 	if index < 1 || index > getter.BlockNum {
 		err := xerrors.Errorf("invalid index")
 		return nil, err
@@ -120,26 +120,39 @@ func (getter *RecoverGetter) GetParity(index int, strand int) ([]byte, error) {
 	return nil, xerrors.Errorf("no such parity")
 }
 
-var Recovery = func(fileinfo FileInfo, metaData Metadata, getter *RecoverGetter) (result PerfResult) {
+var Recovery = func(ctx context.Context, fileinfo FileInfo, metaData Metadata, getter *RecoverGetter) (result PerfResult) {
 	conn := getter.IPFSConnector
 	chunkNum := len(metaData.DataCIDIndexMap)
 
 	// create lattice
-	lattice := entangler.NewLattice(metaData.Alpha, metaData.S, metaData.P, chunkNum, getter, 2)
+	lattice, err := entangler.NewLattice(metaData.Alpha, metaData.S, metaData.P, chunkNum, getter, 2)
+	if err != nil {
+		return PerfResult{Err: err}
+	}
 	lattice.Init()
+	exact := len(metaData.DataBlockSizes) > 0
+	if exact {
+		// repaired chunks are truncated to their size
+		if err := lattice.SetDataSizes(metaData.DataBlockSizes); err != nil {
+			return PerfResult{Err: err}
+		}
+	}
 
 	// download & recover file from IPFS
 	successCount := 0
 	var walker func(string)
 	walker = func(cid string) {
-		chunk, hasRepaired, err := lattice.GetChunk(metaData.DataCIDIndexMap[cid])
+		chunk, hasRepaired, err := lattice.GetChunk(ctx, metaData.DataCIDIndexMap[cid])
 		if err != nil {
 			return
 		}
 
-		// remote the padding zero to ensure unmarshal correctness
+		// remove the padding of older files to ensure unmarshal correctness
 		if hasRepaired {
-			chunk = bytes.Trim(chunk, "\x00")
+			chunk, err = ipfsconnector.VerifyRecovered(chunk, cid, exact)
+			if err != nil {
+				return
+			}
 		}
 		successCount++
 
@@ -174,6 +187,7 @@ var Recovery = func(fileinfo FileInfo, metaData Metadata, getter *RecoverGetter)
 
 var RecoverWithFilter = func(fileinfo FileInfo, missNum int, iteration int, nbNodes int) (result PerfResult) {
 	avgResult := PerfResult{}
+	ctx := context.Background()
 
 	// create IPFS connector
 	conn, err := ipfsconnector.CreateIPFSConnector(0, "")
@@ -182,7 +196,7 @@ var RecoverWithFilter = func(fileinfo FileInfo, missNum int, iteration int, nbNo
 	}
 
 	// download metafile
-	data, err := conn.GetFileToMem(fileinfo.MetaCID)
+	data, err := conn.GetFileToMem(ctx, fileinfo.MetaCID)
 	if err != nil {
 		return PerfResult{Err: err}
 	}
@@ -193,7 +207,7 @@ var RecoverWithFilter = func(fileinfo FileInfo, missNum int, iteration int, nbNo
 	}
 
 	// create getter
-	getter, err := CreateRecoverGetter(conn, metaData.DataCIDIndexMap, metaData.ParityCIDs)
+	getter, err := CreateRecoverGetter(ctx, conn, metaData.DataCIDIndexMap, metaData.ParityCIDs)
 	if err != nil {
 		return PerfResult{Err: err}
 	}
@@ -261,7 +275,10 @@ var RecoverWithFilter = func(fileinfo FileInfo, missNum int, iteration int, nbNo
 		getter.DataFilter = missedDataIndexes
 		getter.ParityFilter = missedParityIndexes
 
-		result := Recovery(fileinfo, metaData, getter)
+		result := Recovery(ctx, fileinfo, metaData, getter)
+		if result.Err != nil {
+			return result
+		}
 		avgResult.RecoverRate += result.RecoverRate
 		avgResult.DownloadParity += result.DownloadParity
 		avgResult.PartialSuccessCnt += result.PartialSuccessCnt
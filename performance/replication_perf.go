@@ -1,6 +1,7 @@
 package performance
 
 import (
+	"context"
 	"encoding/json"
 	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
 	"ipfs-alpha-entanglement-code/util"
@@ -30,7 +31,7 @@ func CreateRepGetter(connector *ipfsconnector.IPFSConnector, CIDIndexMap map[str
 	}
 }
 
-func (getter *RepGetter) GetData(index int) (data []byte, err error) {
+func (getter *RepGetter) GetData(ctx context.Context, index int) (data []byte, err error) {
 	cid, ok := getter.DataIndexCIDMap.Get(index)
 	if !ok {
 		err := xerrors.Errorf("invalid index")
@@ -76,7 +77,7 @@ func (getter *RepGetter) GetData(index int) (data []byte, err error) {
 		return data, nil
 	}
 	// download from IPFS and store in cache
-	data, err = getter.GetRawBlock(cid)
+	data, err = getter.GetRawBlock(ctx, cid)
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +85,7 @@ func (getter *RepGetter) GetData(index int) (data []byte, err error) {
 	return data, nil
 }
 
-var RepRecover = func(fileinfo FileInfo,
+var RepRecover = func(ctx context.Context, fileinfo FileInfo,
 	metaData Metadata, getter *RepGetter) (result PerfResult) {
 
 	conn := getter.IPFSConnector
@@ -92,7 +93,7 @@ var RepRecover = func(fileinfo FileInfo,
 	successCount := 0
 	var walker func(string)
 	walker = func(cid string) {
-		chunk, err := getter.GetData(metaData.DataCIDIndexMap[cid])
+		chunk, err := getter.GetData(ctx, metaData.DataCIDIndexMap[cid])
 		if err != nil {
 			return
 		}
@@ -117,6 +118,7 @@ var RepRecover = func(fileinfo FileInfo,
 
 var RepRecoverWithFilter = func(fileinfo FileInfo, missNum int, repFactor int, iteration int) PerfResult {
 	avgResult := PerfResult{}
+	ctx := context.Background()
 
 	// create IPFS connector
 	conn, err := ipfsconnector.CreateIPFSConnector(0, "")
@@ -125,7 +127,7 @@ var RepRecoverWithFilter = func(fileinfo FileInfo, missNum int, repFactor int, i
 	}
 
 	// download metafile
-	data, err := conn.GetFileToMem(fileinfo.MetaCID)
+	data, err := conn.GetFileToMem(ctx, fileinfo.MetaCID)
 	if err != nil {
 		return PerfResult{Err: err}
 	}
@@ -177,7 +179,7 @@ var RepRecoverWithFilter = func(fileinfo FileInfo, missNum int, repFactor int, i
 		getter.DataFilter = missedDataIndexes
 		getter.RepFilter = missedRepIndexes
 
-		result := RepRecover(fileinfo, metaData, getter)
+		result := RepRecover(ctx, fileinfo, metaData, getter)
 		avgResult.RecoverRate += result.RecoverRate
 		avgResult.DownloadParity += result.DownloadParity
 		avgResult.PartialSuccessCnt += result.PartialSuccessCnt
@@ -1,28 +1,32 @@
 package integration
 
 import (
-	"github.com/stretchr/testify/require"
-	"ipfs-alpha-entanglement-code/client"
-	"ipfs-alpha-entanglement-code/performance"
+	"context"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func Test_Repair_Strand(t *testing.T) {
-	// util.EnableLogPrint()
-	repair := func(fileCID string, metaCID string, strand int) func(*testing.T) {
-		return func(t *testing.T) {
-			clientVar, err := client.NewClient()
-			require.NoError(t, err)
+	for _, testcase := range []string{"1MB", "5MB"} {
+		t.Run(testcase, func(t *testing.T) {
+			c, ipfs, cluster := mockEnv(t)
+			path, _ := randomFile(t, sizes[testcase])
+			rootCID, metaCID := upload(t, c, path)
 
-			err = clientVar.RepairStrand(fileCID, metaCID, strand)
+			// the peers holding the root of the first strand go down, and so does the strand
+			metaData, err := c.GetMetaData(context.Background(), metaCID)
 			require.NoError(t, err)
-		}
-	}
+			treeCID := metaData.TreeCIDs[1]
+			for _, peerID := range cluster.Allocations(treeCID) {
+				cluster.KillPeer(peerID)
+			}
+			require.False(t, ipfs.HasBlock(treeCID))
+			// the client still holds the metadata it uploaded
+			ipfs.SetAvailable(metaCID, true)
 
-	// for _, testcase := range []string{"5MB", "10MB", "20MB", "25MB"} {
-	for _, testcase := range []string{"25MB"} {
-		info := performance.InfoMap[testcase]
-		// We'll always have at least one strand so we're testing on the first strand
-		t.Run(testcase, repair(info.FileCID, info.MetaCID, 1))
+			require.NoError(t, c.RepairStrand(context.Background(), rootCID, metaCID, 1))
+			require.True(t, ipfs.HasBlock(treeCID))
+		})
 	}
 }
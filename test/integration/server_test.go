@@ -5,8 +5,9 @@ import (
 	"testing"
 )
 
-// Manual testing for now
+// Manual testing for now: the server runs until killed, against the local IPFS and IPFS Cluster nodes
 func Test_API(t *testing.T) {
+	t.Skip("manual test")
 	server := &Server.Server{}
-	server.RunServer(8080)
+	server.RunServer(8080, "", "localhost", 9094, "localhost", 5001, "", "")
 }
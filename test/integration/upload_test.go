@@ -1,36 +1,38 @@
 package integration
 
 import (
-	"fmt"
-	"ipfs-alpha-entanglement-code/client"
-	"ipfs-alpha-entanglement-code/performance"
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
 func Test_Upload(t *testing.T) {
-	// util.EnableLogPrint()
-	alpha, s, p := 3, 5, 5
-	upload := func(filepath string, expectedCID string, expectedMetaCID string) func(*testing.T) {
-		return func(t *testing.T) {
-			clientVar, err := client.NewClient()
-			require.NoError(t, err)
+	for _, testcase := range []string{"1MB", "5MB"} {
+		t.Run(testcase, func(t *testing.T) {
+			c, ipfs, cluster := mockEnv(t)
+			path, data := randomFile(t, sizes[testcase])
 
-			rootCID, metaCID, pinResult, err := clientVar.Upload(filepath, alpha, s, p, 3)
+			rootCID, metaCID := upload(t, c, path)
+			downloaded, err := c.GetFileToMem(context.Background(), rootCID)
 			require.NoError(t, err)
+			require.Equal(t, data, downloaded)
 
-			require.Equal(t, expectedCID, rootCID)
-			require.Equal(t, expectedMetaCID, metaCID)
-
-			err = pinResult()
+			// the strands are pinned in the cluster
+			metaData, err := c.GetMetaData(context.Background(), metaCID)
 			require.NoError(t, err)
-		}
-	}
+			require.Len(t, metaData.TreeCIDs, 3)
+			for _, treeCID := range metaData.TreeCIDs {
+				require.True(t, ipfs.HasBlock(treeCID))
+				require.NotEmpty(t, cluster.Allocations(treeCID))
+			}
 
-	for _, testcase := range []string{"5MB", "10MB", "20MB", "25MB"} {
-		filepath := fmt.Sprintf("../data/largefile_%s.txt", testcase)
-		info := performance.InfoMap[testcase]
-		t.Run(testcase, upload(filepath, info.FileCID, info.MetaCID))
+			// the same file gets the same CIDs, only the parity allocations change
+			sameRootCID, sameMetaCID := upload(t, c, path)
+			require.Equal(t, rootCID, sameRootCID)
+			sameMetaData, err := c.GetMetaData(context.Background(), sameMetaCID)
+			require.NoError(t, err)
+			require.Equal(t, metaData.TreeCIDs, sameMetaData.TreeCIDs)
+		})
 	}
 }
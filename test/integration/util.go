@@ -0,0 +1,46 @@
+package integration
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ipfs-alpha-entanglement-code/client"
+	"ipfs-alpha-entanglement-code/test/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sizes are the sizes of the generated test files
+var sizes = map[string]int{"1MB": 1 << 20, "5MB": 5 << 20}
+
+// mockEnv starts a mock IPFS node and a mock cluster of 10 peers, and returns a client connected to them
+func mockEnv(t *testing.T) (*client.Client, *mock.IPFS, *mock.Cluster) {
+	ipfs := mock.CreateIPFS()
+	t.Cleanup(ipfs.Close)
+	cluster := mock.CreateCluster(10, ipfs)
+	t.Cleanup(cluster.Close)
+
+	c, err := client.NewClient(context.Background(), cluster.Host(), cluster.Port(), ipfs.Host(), ipfs.Port())
+	require.NoError(t, err)
+	return c, ipfs, cluster
+}
+
+// randomFile writes a file of random data of the given size and returns its path
+func randomFile(t *testing.T, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "largefile")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path, data
+}
+
+// upload adds the file with its entanglement (alpha = 3, s = 5, p = 5) and waits for the pins
+func upload(t *testing.T, c *client.Client, path string) (rootCID string, metaCID string) {
+	rootCID, metaCID, pinResult, err := c.Upload(context.Background(), path, 3, 5, 5, 3, "")
+	require.NoError(t, err)
+	require.NoError(t, pinResult())
+	return rootCID, metaCID
+}
@@ -0,0 +1,434 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// peer is a member of the mock cluster
+type peer struct {
+	ID     string
+	Name   string
+	IPFSID string // peer ID of the IPFS daemon run by the peer
+	Region string
+	Alive  bool
+}
+
+// pin is a CID pinned in the mock cluster with the peers allocated to it
+type pin struct {
+	CID         string
+	Mode        string
+	Allocations []string
+}
+
+// Cluster is an in-process IPFS Cluster serving the REST endpoints used by ipfscluster.Connector:
+// /id, /peers, /pins and /monitor/metrics. The first peer is the one the connector talks to, and runs the
+// attached IPFS node unless told otherwise.
+// Pins are only recorded: when all the peers allocated to a pin are down, its CID becomes unavailable
+// in the attached IPFS node. The blocks below a recursive pin are not tracked
+type Cluster struct {
+	server *httptest.Server
+	ipfs   *IPFS
+
+	lock      sync.Mutex
+	peers     []*peer
+	pins      map[string]*pin
+	corrupted map[string]string // path -> raw body answered instead
+}
+
+// CreateCluster starts a mock cluster of the given number of peers on top of the IPFS node, which may be nil.
+// It must be closed after use
+func CreateCluster(peerNum int, ipfs *IPFS) *Cluster {
+	cluster := &Cluster{ipfs: ipfs, pins: make(map[string]*pin), corrupted: make(map[string]string)}
+	for i := 0; i < peerNum; i++ {
+		cluster.peers = append(cluster.peers, &peer{
+			ID:     fmt.Sprintf("12D3KooWMockPeer%03d", i),
+			Name:   fmt.Sprintf("cluster%d", i),
+			IPFSID: fmt.Sprintf("12D3KooWMockIPFS%03d", i),
+			Alive:  true,
+		})
+	}
+	if ipfs != nil && peerNum > 0 {
+		cluster.peers[0].IPFSID = ipfs.ID()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/id", cluster.handleID)
+	mux.HandleFunc("/peers", cluster.handlePeers)
+	mux.HandleFunc("/pins", cluster.handlePins)
+	mux.HandleFunc("/pins/", cluster.handlePin)
+	mux.HandleFunc("/monitor/metrics/", cluster.handleMetrics)
+	cluster.server = httptest.NewServer(cluster.corrupt(mux))
+
+	return cluster
+}
+
+// Host returns the host the REST API listens on
+func (cluster *Cluster) Host() string {
+	host, _ := splitHostPort(cluster.server.URL)
+	return host
+}
+
+// Port returns the port the REST API listens on
+func (cluster *Cluster) Port() int {
+	_, port := splitHostPort(cluster.server.URL)
+	return port
+}
+
+// Close stops the cluster
+func (cluster *Cluster) Close() {
+	cluster.server.Close()
+}
+
+// PeerIDs returns the IDs of all the peers, alive or not
+func (cluster *Cluster) PeerIDs() []string {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	var ids []string
+	for _, p := range cluster.peers {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// SetRegion sets the region tag reported by the peer
+func (cluster *Cluster) SetRegion(peerID string, region string) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	if p := cluster.findPeer(peerID); p != nil {
+		p.Region = region
+	}
+}
+
+// SetIPFSPeer makes the peer the one running the attached IPFS node
+func (cluster *Cluster) SetIPFSPeer(peerID string) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	target := cluster.findPeer(peerID)
+	if cluster.ipfs == nil || target == nil {
+		return
+	}
+	for _, p := range cluster.peers {
+		if p.IPFSID == cluster.ipfs.ID() {
+			p.IPFSID, target.IPFSID = target.IPFSID, p.IPFSID
+		}
+	}
+}
+
+// Allocations returns the peers allocated to the CID, or nil if it is not pinned
+func (cluster *Cluster) Allocations(pinCID string) []string {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	if p, ok := cluster.pins[normalizeCID(pinCID)]; ok {
+		return append([]string{}, p.Allocations...)
+	}
+	return nil
+}
+
+// Pins returns the pinned CIDs
+func (cluster *Cluster) Pins() []string {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	var cids []string
+	for pinCID := range cluster.pins {
+		cids = append(cids, pinCID)
+	}
+	sort.Strings(cids)
+	return cids
+}
+
+// KillPeer takes the peer down. The CIDs only pinned by down peers become unavailable
+func (cluster *Cluster) KillPeer(peerID string) {
+	cluster.setAlive(peerID, false)
+}
+
+// RevivePeer brings the peer back up with its pins
+func (cluster *Cluster) RevivePeer(peerID string) {
+	cluster.setAlive(peerID, true)
+}
+
+// Unpin removes the pin. Its CID becomes unavailable, as if the peers had garbage collected it
+func (cluster *Cluster) Unpin(pinCID string) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	pinCID = normalizeCID(pinCID)
+	if _, ok := cluster.pins[pinCID]; !ok {
+		return
+	}
+	delete(cluster.pins, pinCID)
+	if cluster.ipfs != nil {
+		cluster.ipfs.SetAvailable(pinCID, false)
+	}
+}
+
+// Corrupt makes the cluster answer the requests on the path with the raw body and a success status.
+// An empty body answers normally again
+func (cluster *Cluster) Corrupt(path string, body string) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	if body == "" {
+		delete(cluster.corrupted, path)
+		return
+	}
+	cluster.corrupted[path] = body
+}
+
+// corrupt serves the corrupted paths before handing the other requests to the handler
+func (cluster *Cluster) corrupt(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cluster.lock.Lock()
+		body, ok := cluster.corrupted[r.URL.Path]
+		cluster.lock.Unlock()
+
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	})
+}
+
+// setAlive changes the state of the peer and the availability of the CIDs allocated to it
+func (cluster *Cluster) setAlive(peerID string, alive bool) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	p := cluster.findPeer(peerID)
+	if p == nil || p.Alive == alive {
+		return
+	}
+	p.Alive = alive
+	if cluster.ipfs == nil {
+		return
+	}
+	for _, pinned := range cluster.pins {
+		if !contains(pinned.Allocations, peerID) {
+			continue
+		}
+		// only the pins losing (or getting back) their last peer change
+		if alive || len(cluster.aliveAllocations(pinned)) == 0 {
+			cluster.ipfs.SetAvailable(pinned.CID, alive)
+		}
+	}
+}
+
+// findPeer returns the peer with the ID. The caller holds the lock
+func (cluster *Cluster) findPeer(peerID string) *peer {
+	for _, p := range cluster.peers {
+		if p.ID == peerID {
+			return p
+		}
+	}
+	return nil
+}
+
+// aliveAllocations returns the alive peers allocated to the pin. The caller holds the lock
+func (cluster *Cluster) aliveAllocations(pinned *pin) []string {
+	var alive []string
+	for _, peerID := range pinned.Allocations {
+		if p := cluster.findPeer(peerID); p != nil && p.Alive {
+			alive = append(alive, peerID)
+		}
+	}
+	return alive
+}
+
+// allocate chooses the peers of a new pin: the user allocations if given, otherwise the least loaded
+// alive peers. A replication factor below 1 pins on every alive peer. The caller holds the lock
+func (cluster *Cluster) allocate(userAllocations []string, replication int) []string {
+	if len(userAllocations) > 0 {
+		if replication > 0 && len(userAllocations) > replication {
+			userAllocations = userAllocations[:replication]
+		}
+		return userAllocations
+	}
+
+	load := make(map[string]int)
+	for _, pinned := range cluster.pins {
+		for _, peerID := range pinned.Allocations {
+			load[peerID]++
+		}
+	}
+	var candidates []string
+	for _, p := range cluster.peers {
+		if p.Alive {
+			candidates = append(candidates, p.ID)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return load[candidates[i]] < load[candidates[j]]
+	})
+	if replication > 0 && len(candidates) > replication {
+		candidates = candidates[:replication]
+	}
+	return candidates
+}
+
+// pinInfo returns the status of the pin on every allocated peer. The caller holds the lock
+func (cluster *Cluster) pinInfo(pinned *pin) map[string]interface{} {
+	peerMap := make(map[string]interface{})
+	for _, peerID := range pinned.Allocations {
+		status, name := "cluster_error", ""
+		if p := cluster.findPeer(peerID); p != nil {
+			name = p.Name
+			if p.Alive {
+				status = "pinned"
+			}
+		}
+		peerMap[peerID] = map[string]interface{}{"peername": name, "status": status}
+	}
+	return map[string]interface{}{
+		"cid":         pinned.CID,
+		"name":        "",
+		"allocations": pinned.Allocations,
+		"peer_map":    peerMap,
+	}
+}
+
+func (cluster *Cluster) handleID(w http.ResponseWriter, r *http.Request) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	if len(cluster.peers) == 0 {
+		writeClusterError(w, http.StatusInternalServerError, "cluster has no peer")
+		return
+	}
+	self := cluster.peers[0]
+	writeJSON(w, peerInfo(self))
+}
+
+// handlePeers streams the alive peers
+func (cluster *Cluster) handlePeers(w http.ResponseWriter, r *http.Request) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	for _, p := range cluster.peers {
+		if p.Alive {
+			encoder.Encode(peerInfo(p))
+		}
+	}
+}
+
+// handlePins streams the status of every pin
+func (cluster *Cluster) handlePins(w http.ResponseWriter, r *http.Request) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	var cids []string
+	for pinCID := range cluster.pins {
+		cids = append(cids, pinCID)
+	}
+	sort.Strings(cids)
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	for _, pinCID := range cids {
+		encoder.Encode(cluster.pinInfo(cluster.pins[pinCID]))
+	}
+}
+
+// handlePin serves GET /pins/<cid>, POST /pins/ipfs/<cid> and DELETE /pins/<cid>
+func (cluster *Cluster) handlePin(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/pins/")
+	pinCID := normalizeCID(strings.TrimPrefix(path, "ipfs/"))
+
+	switch r.Method {
+	case http.MethodGet:
+		cluster.lock.Lock()
+		defer cluster.lock.Unlock()
+
+		pinned, ok := cluster.pins[pinCID]
+		if !ok {
+			writeClusterError(w, http.StatusNotFound, "pin not found: "+pinCID)
+			return
+		}
+		writeJSON(w, cluster.pinInfo(pinned))
+
+	case http.MethodPost:
+		query := r.URL.Query()
+		replication, _ := strconv.Atoi(query.Get("replication-max"))
+		var userAllocations []string
+		if allocations := query.Get("user-allocations"); allocations != "" {
+			userAllocations = strings.Split(allocations, ",")
+		}
+		mode := query.Get("mode")
+		if mode == "" {
+			mode = "recursive"
+		}
+
+		cluster.lock.Lock()
+		defer cluster.lock.Unlock()
+
+		pinned := &pin{CID: pinCID, Mode: mode, Allocations: cluster.allocate(userAllocations, replication)}
+		cluster.pins[pinCID] = pinned
+		if cluster.ipfs != nil && len(cluster.aliveAllocations(pinned)) == 0 {
+			cluster.ipfs.SetAvailable(pinCID, false)
+		}
+		writeJSON(w, cluster.pinInfo(pinned))
+
+	case http.MethodDelete:
+		cluster.Unpin(pinCID)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		writeClusterError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleMetrics serves the tag:region metric, the only one the connector reads
+func (cluster *Cluster) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/monitor/metrics/")
+	if name != "tag:region" {
+		writeClusterError(w, http.StatusNotFound, "unknown metric "+name)
+		return
+	}
+
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	metrics := []map[string]interface{}{}
+	for _, p := range cluster.peers {
+		if p.Alive && p.Region != "" {
+			metrics = append(metrics, map[string]interface{}{"name": name, "peer": p.ID, "value": p.Region, "valid": true})
+		}
+	}
+	writeJSON(w, metrics)
+}
+
+// peerInfo returns the description of the peer the Cluster REST API gives
+func peerInfo(p *peer) map[string]interface{} {
+	return map[string]interface{}{"id": p.ID, "peername": p.Name, "ipfs": map[string]interface{}{"id": p.IPFSID}}
+}
+
+// writeClusterError answers with an error the way the Cluster REST API does
+func writeClusterError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message})
+}
+
+// contains returns whether the peer ID is in the list
+func contains(peerIDs []string, peerID string) bool {
+	for _, id := range peerIDs {
+		if id == peerID {
+			return true
+		}
+	}
+	return false
+}
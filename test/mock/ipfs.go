@@ -0,0 +1,418 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	localstore "ipfs-alpha-entanglement-code/local-store"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// IPFS is an in-process IPFS node serving the subset of the Kubo RPC API used by ipfsconnector.IPFSConnector:
+// id, add, block/get, block/put, object/get, cat and files/stat. Files are chunked and linked as IPFS does
+// with the size-N chunkers, so that they get the same CIDs.
+// The node stands for the whole network: a block is available as long as it is stored and not made
+// unavailable, e.g. by the peers pinning it going down in a Cluster
+type IPFS struct {
+	server *httptest.Server
+	id     string
+
+	lock        sync.Mutex
+	blocks      map[string][]byte        // CID -> raw block
+	unavailable map[string]struct{}      // stored blocks that cannot be reached
+	failing     map[string]struct{}      // commands answered with an error
+	delays      map[string]time.Duration // commands answered late
+	calls       map[string]int           // number of requests by command
+}
+
+// CreateIPFS starts a mock IPFS node. It must be closed after use
+func CreateIPFS() *IPFS {
+	node := &IPFS{
+		id:          "12D3KooWMockIPFS",
+		blocks:      make(map[string][]byte),
+		unavailable: make(map[string]struct{}),
+		failing:     make(map[string]struct{}),
+		delays:      make(map[string]time.Duration),
+		calls:       make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/id", node.command("id", node.handleID))
+	mux.HandleFunc("/api/v0/add", node.command("add", node.handleAdd))
+	mux.HandleFunc("/api/v0/block/get", node.command("block/get", node.handleBlockGet))
+	mux.HandleFunc("/api/v0/block/put", node.command("block/put", node.handleBlockPut))
+	mux.HandleFunc("/api/v0/object/get", node.command("object/get", node.handleObjectGet))
+	mux.HandleFunc("/api/v0/cat", node.command("cat", node.handleCat))
+	mux.HandleFunc("/api/v0/files/stat", node.command("files/stat", node.handleFilesStat))
+	node.server = httptest.NewServer(mux)
+
+	return node
+}
+
+// Host returns the host the RPC API listens on
+func (node *IPFS) Host() string {
+	host, _ := splitHostPort(node.server.URL)
+	return host
+}
+
+// Port returns the port the RPC API listens on
+func (node *IPFS) Port() int {
+	_, port := splitHostPort(node.server.URL)
+	return port
+}
+
+// ID returns the peer ID of the node
+func (node *IPFS) ID() string {
+	return node.id
+}
+
+// Close stops the node
+func (node *IPFS) Close() {
+	node.server.Close()
+}
+
+// HasBlock returns whether the block is stored and available
+func (node *IPFS) HasBlock(blockCID string) bool {
+	_, err := node.getBlock(blockCID)
+	return err == nil
+}
+
+// DropBlock deletes the block from the node
+func (node *IPFS) DropBlock(blockCID string) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	delete(node.blocks, normalizeCID(blockCID))
+}
+
+// SetAvailable makes a stored block reachable or not, without deleting it
+func (node *IPFS) SetAvailable(blockCID string, available bool) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if available {
+		delete(node.unavailable, normalizeCID(blockCID))
+	} else {
+		node.unavailable[normalizeCID(blockCID)] = struct{}{}
+	}
+}
+
+// FailCommand makes every request of the command (e.g. block/get) fail, or succeed again
+func (node *IPFS) FailCommand(command string, fail bool) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if fail {
+		node.failing[command] = struct{}{}
+	} else {
+		delete(node.failing, command)
+	}
+}
+
+// DelayCommand makes every request of the command wait before being answered, e.g. to stand for
+// blocks that are slow to find in the network. A zero delay answers right away again
+func (node *IPFS) DelayCommand(command string, delay time.Duration) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if delay > 0 {
+		node.delays[command] = delay
+	} else {
+		delete(node.delays, command)
+	}
+}
+
+// Calls returns the number of requests of the command received so far
+func (node *IPFS) Calls(command string) int {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	return node.calls[command]
+}
+
+// command counts the requests of the command, and delays and fails them if asked to
+func (node *IPFS) command(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		node.lock.Lock()
+		node.calls[name]++
+		_, fail := node.failing[name]
+		delay := node.delays[name]
+		node.lock.Unlock()
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if fail {
+			writeRPCError(w, xerrors.Errorf("%s failed on purpose", name))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// putBlock stores the block, which becomes available again if it was not
+func (node *IPFS) putBlock(blockCID string, data []byte) error {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	blockCID = normalizeCID(blockCID)
+	node.blocks[blockCID] = append([]byte{}, data...)
+	delete(node.unavailable, blockCID)
+	return nil
+}
+
+// getBlock returns the block if it is stored and available
+func (node *IPFS) getBlock(blockCID string) ([]byte, error) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	blockCID = normalizeCID(blockCID)
+	data, ok := node.blocks[blockCID]
+	if _, down := node.unavailable[blockCID]; !ok || down {
+		return nil, xerrors.Errorf("block %s not found", blockCID)
+	}
+	return data, nil
+}
+
+// readFile concatenates the file data of the DAG below the block
+func (node *IPFS) readFile(blockCID string, out *bytes.Buffer) error {
+	block, err := node.getBlock(blockCID)
+	if err != nil {
+		return err
+	}
+	if ipfsconnector.IsRawCID(blockCID) {
+		out.Write(block)
+		return nil
+	}
+
+	dagNode, err := ipfsconnector.DecodeDagNode(block)
+	if err != nil {
+		return xerrors.Errorf("fail to decode block %s: %s", blockCID, err)
+	}
+	data, err := ipfsconnector.FileDataFromDagNode(dagNode)
+	if err != nil {
+		return xerrors.Errorf("block %s is not a file: %s", blockCID, err)
+	}
+	out.Write(data)
+	for _, link := range dagNode.Links() {
+		if err = node.readFile(link.Cid.String(), out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (node *IPFS) handleID(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{"ID": node.id})
+}
+
+func (node *IPFS) handleAdd(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := ipfsconnector.DefaultAddOptions()
+	if version := query.Get("cid-version"); version != "" {
+		opts.CidVersion, _ = strconv.Atoi(version)
+		// like IPFS, CIDv1 implies raw leaves unless told otherwise
+		opts.RawLeaves = opts.CidVersion == 1
+	}
+	if hash := query.Get("hash"); hash != "" {
+		opts.Hash = hash
+	}
+	if rawLeaves := query.Get("raw-leaves"); rawLeaves != "" {
+		opts.RawLeaves = rawLeaves == "true"
+	}
+	if chunker := query.Get("chunker"); chunker != "" {
+		opts.Chunker = chunker
+	}
+
+	file, err := readFilePart(r)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	defer file.Close()
+
+	rootCID, _, _, err := localstore.BuildDAG(file, opts, node.putBlock)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"Name": rootCID, "Hash": rootCID})
+}
+
+func (node *IPFS) handleBlockGet(w http.ResponseWriter, r *http.Request) {
+	block, err := node.getBlock(r.URL.Query().Get("arg"))
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(block)
+}
+
+func (node *IPFS) handleBlockPut(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: mh.SHA2_256, MhLength: -1}
+	switch query.Get("format") {
+	case "v0":
+		prefix.Version = 0
+	case "protobuf", "":
+	case "raw":
+		prefix.Codec = cid.Raw
+	default:
+		writeRPCError(w, xerrors.Errorf("unsupported block format %s", query.Get("format")))
+		return
+	}
+	if mhtype := query.Get("mhtype"); mhtype != "" {
+		hash, ok := mh.Names[mhtype]
+		if !ok {
+			writeRPCError(w, xerrors.Errorf("unknown hash function %s", mhtype))
+			return
+		}
+		prefix.MhType = hash
+	}
+
+	file, err := readFilePart(r)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+
+	blockCID, err := prefix.Sum(data)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	node.putBlock(blockCID.String(), data)
+	writeJSON(w, map[string]interface{}{"Key": blockCID.String(), "Size": len(data)})
+}
+
+func (node *IPFS) handleObjectGet(w http.ResponseWriter, r *http.Request) {
+	blockCID := r.URL.Query().Get("arg")
+	block, err := node.getBlock(blockCID)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	dagNode, err := ipfsconnector.DecodeDagNode(block)
+	if err != nil {
+		writeRPCError(w, xerrors.Errorf("block %s is not a dag-pb node: %s", blockCID, err))
+		return
+	}
+
+	type link struct {
+		Name string
+		Hash string
+		Size uint64
+	}
+	links := []link{}
+	for _, l := range dagNode.Links() {
+		links = append(links, link{Name: l.Name, Hash: l.Cid.String(), Size: l.Size})
+	}
+	writeJSON(w, map[string]interface{}{"Links": links, "Data": string(dagNode.Data())})
+}
+
+func (node *IPFS) handleCat(w http.ResponseWriter, r *http.Request) {
+	var data bytes.Buffer
+	err := node.readFile(strings.TrimPrefix(r.URL.Query().Get("arg"), "/ipfs/"), &data)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data.Bytes())
+}
+
+func (node *IPFS) handleFilesStat(w http.ResponseWriter, r *http.Request) {
+	blockCID := strings.TrimPrefix(r.URL.Query().Get("arg"), "/ipfs/")
+	block, err := node.getBlock(blockCID)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+
+	stat := map[string]interface{}{"Hash": normalizeCID(blockCID), "Type": "file",
+		"Blocks": 0, "Size": len(block), "CumulativeSize": len(block)}
+	if !ipfsconnector.IsRawCID(blockCID) {
+		dagNode, err := ipfsconnector.DecodeDagNode(block)
+		if err != nil {
+			writeRPCError(w, err)
+			return
+		}
+		cumulativeSize, _ := dagNode.Size()
+		var data bytes.Buffer
+		if err = node.readFile(blockCID, &data); err != nil {
+			writeRPCError(w, err)
+			return
+		}
+		stat["Blocks"], stat["Size"], stat["CumulativeSize"] = len(dagNode.Links()), data.Len(), cumulativeSize
+	}
+	writeJSON(w, stat)
+}
+
+// readFilePart returns the first file of the multipart body sent by the shell
+func readFilePart(r *http.Request) (io.ReadCloser, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, xerrors.Errorf("expect a multipart body: %s", err)
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		return nil, xerrors.Errorf("expect a file in the body: %s", err)
+	}
+	return part, nil
+}
+
+// writeRPCError answers with an error the way the Kubo RPC API does
+func writeRPCError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]interface{}{"Message": err.Error(), "Code": 0, "Type": "error"})
+}
+
+// writeJSON answers with the value encoded in JSON
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// normalizeCID returns the string form of the CID, so that paths and CIDs of other bases match the stored keys
+func normalizeCID(blockCID string) string {
+	decoded, err := cid.Decode(strings.TrimPrefix(blockCID, "/ipfs/"))
+	if err != nil {
+		return blockCID
+	}
+	return decoded.String()
+}
+
+// splitHostPort returns the host and the port of the server URL
+func splitHostPort(serverURL string) (string, int) {
+	parsed, err := url.Parse(serverURL)
+	if err != nil {
+		return "", 0
+	}
+	port, _ := strconv.Atoi(parsed.Port())
+	return parsed.Hostname(), port
+}
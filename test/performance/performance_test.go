@@ -1,12 +1,14 @@
 package test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
 	"ipfs-alpha-entanglement-code/performance"
 	"log"
 	"math/rand"
+	"net"
 	"strings"
 	"testing"
 	"time"
@@ -14,7 +16,17 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// requireIPFS skips the experiment if no IPFS node runs locally: the prepared files are read from the network
+func requireIPFS(t *testing.T) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", ipfsconnector.DefaultPort), time.Second)
+	if err != nil {
+		t.Skipf("no IPFS node: %s", err)
+	}
+	conn.Close()
+}
+
 func Test_Only_Data_Loss(t *testing.T) {
+	requireIPFS(t)
 	var allRates []string
 	var allOverhead []string
 	var accuRate float32
@@ -22,18 +34,18 @@ func Test_Only_Data_Loss(t *testing.T) {
 
 	onlyData := func(missNum int, fileinfo performance.FileInfo, try int) func(*testing.T) {
 		return func(*testing.T) {
-			conn, err := ipfsconnector.CreateIPFSConnector(0)
+			conn, err := ipfsconnector.CreateIPFSConnector(0, "")
 			require.NoError(t, err)
 
 			// download metafile
-			data, err := conn.GetFileToMem(fileinfo.MetaCID)
+			data, err := conn.GetFileToMem(context.Background(), fileinfo.MetaCID)
 			require.NoError(t, err)
 			var metaData performance.Metadata
 			err = json.Unmarshal(data, &metaData)
 			require.NoError(t, err)
 
 			// create getter
-			getter, err := performance.CreateRecoverGetter(conn, metaData.DataCIDIndexMap, metaData.ParityCIDs)
+			getter, err := performance.CreateRecoverGetter(context.Background(), conn, metaData.DataCIDIndexMap, metaData.ParityCIDs)
 			require.NoError(t, err)
 
 			// generate random miss and repeat tests
@@ -51,7 +63,7 @@ func Test_Only_Data_Loss(t *testing.T) {
 				}
 				getter.DataFilter = missedIndexes
 
-				result := performance.Recovery(fileinfo, metaData, getter)
+				result := performance.Recovery(context.Background(), fileinfo, metaData, getter)
 				accuRate += result.RecoverRate
 				accuOverhead += result.DownloadParity
 			}
@@ -80,6 +92,7 @@ func Test_Only_Data_Loss(t *testing.T) {
 }
 
 func Test_Only_Parity_Loss(t *testing.T) {
+	requireIPFS(t)
 	var partialRates []string
 	var fullRates []string
 	var allOverhead []string
@@ -126,6 +139,7 @@ func Test_Only_Parity_Loss(t *testing.T) {
 }
 
 func Test_Only_Parity_Loss_Node_Loss(t *testing.T) {
+	requireIPFS(t)
 	var partialRates []string
 	var fullRates []string
 	var allOverhead []string
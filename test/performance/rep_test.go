@@ -13,6 +13,7 @@ import (
 var repFactor = 7
 
 func Test_Rep_Only_Parity_Loss(t *testing.T) {
+	requireIPFS(t)
 	var partialRates []string
 	var fullRates []string
 
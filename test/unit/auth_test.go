@@ -0,0 +1,197 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ipfs-alpha-entanglement-code/auth"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "9a2b7e3c4d5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+
+func Test_Auth_Secret(t *testing.T) {
+	secret, err := auth.ParseSecret(testSecret + "\n")
+	require.NoError(t, err)
+	require.Len(t, secret, 32)
+
+	_, err = auth.ParseSecret("not hexadecimal")
+	require.Error(t, err)
+	_, err = auth.ParseSecret("0a1b2c")
+	require.Error(t, err)
+}
+
+func Test_Auth_Verify(t *testing.T) {
+	secret, err := auth.ParseSecret(testSecret)
+	require.NoError(t, err)
+	verifier := auth.NewVerifier(secret)
+	body := []byte(`{"fileCID":"cid"}`)
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	signer, err := auth.NewNodeSigner(secret, key)
+	require.NoError(t, err)
+
+	// the peer ID of the node signing the request is returned, empty for a client
+	req, err := signer.NewRequest("POST", "http://peer:7070/updateView?fileCID=cid", body)
+	require.NoError(t, err)
+	node, err := verifier.Verify(req, body, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, signer.Node(), node)
+	require.Equal(t, peerIDOf(t, key), node)
+
+	req, err = auth.NewSigner(secret).NewRequest("GET", "http://peer:7070/downloadFile?rootFileCID=cid", nil)
+	require.NoError(t, err)
+	node, err = verifier.Verify(req, nil, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "", node)
+
+	// a request is accepted once
+	_, err = verifier.Verify(req, nil, time.Now())
+	require.ErrorIs(t, err, auth.ErrReplayed)
+
+	// the signature covers the body, the query, the signing node and the time
+	sign := func() *http.Request {
+		req, err := signer.NewRequest("POST", "http://peer:7070/updateView?fileCID=cid", body)
+		require.NoError(t, err)
+		return req
+	}
+	_, err = verifier.Verify(sign(), []byte(`{"fileCID":"other"}`), time.Now())
+	require.ErrorIs(t, err, auth.ErrBadSignature)
+
+	req = sign()
+	req.URL.RawQuery = "fileCID=other"
+	_, err = verifier.Verify(req, body, time.Now())
+	require.ErrorIs(t, err, auth.ErrBadSignature)
+
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	req = sign()
+	req.Header.Set(auth.NodeHeader, peerIDOf(t, other))
+	_, err = verifier.Verify(req, body, time.Now())
+	require.ErrorIs(t, err, auth.ErrBadSignature)
+
+	_, err = verifier.Verify(sign(), body, time.Now().Add(auth.MaxClockSkew+time.Minute))
+	require.ErrorIs(t, err, auth.ErrExpired)
+
+	// requests without signature or signed with another secret are rejected
+	req, err = http.NewRequest("POST", "http://peer:7070/updateView", strings.NewReader(string(body)))
+	require.NoError(t, err)
+	_, err = verifier.Verify(req, body, time.Now())
+	require.ErrorIs(t, err, auth.ErrUnsigned)
+
+	otherSecret, err := auth.ParseSecret(strings.Repeat("ab", 32))
+	require.NoError(t, err)
+	req, err = auth.NewSigner(otherSecret).NewRequest("POST", "http://peer:7070/updateView?fileCID=cid", body)
+	require.NoError(t, err)
+	_, err = verifier.Verify(req, body, time.Now())
+	require.ErrorIs(t, err, auth.ErrBadSignature)
+
+	// a nil signer leaves the request unsigned
+	req, err = (*auth.Signer)(nil).NewRequest("POST", "http://peer:7070/updateView", body)
+	require.NoError(t, err)
+	require.Empty(t, req.Header.Get(auth.SignatureHeader))
+}
+
+func peerIDOf(t *testing.T, key crypto.PrivKey) string {
+	id, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+	return id.String()
+}
+
+// forge signs a request with the secret only, as a holder of the secret acting as the node would
+func forge(secret []byte, req *http.Request, node string, body []byte) {
+	timestamp := fmt.Sprint(time.Now().Unix())
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{req.Method, req.URL.RequestURI(), timestamp, "forged", node, hex.EncodeToString(bodyHash[:])}, "\n")))
+	req.Header.Set(auth.NodeHeader, node)
+	req.Header.Set(auth.TimestampHeader, timestamp)
+	req.Header.Set(auth.NonceHeader, "forged")
+	req.Header.Set(auth.SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func Test_Auth_Node_Identity(t *testing.T) {
+	secret, err := auth.ParseSecret(testSecret)
+	require.NoError(t, err)
+	body := []byte(`{"fileCID":"cid"}`)
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	node := peerIDOf(t, key)
+
+	// holding the secret is not enough to act as a node
+	req, err := http.NewRequest("POST", "http://peer:7070/updateView?fileCID=cid", strings.NewReader(string(body)))
+	require.NoError(t, err)
+	forge(secret, req, node, body)
+	_, err = auth.NewVerifier(secret).Verify(req, body, time.Now())
+	require.ErrorIs(t, err, auth.ErrBadSignature)
+
+	// nor to reuse the signature of the node with another peer ID
+	signer, err := auth.NewNodeSigner(secret, key)
+	require.NoError(t, err)
+	req, err = signer.NewRequest("POST", "http://peer:7070/updateView?fileCID=cid", body)
+	require.NoError(t, err)
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	signature := req.Header.Get(auth.NodeSignatureHeader)
+	forge(secret, req, peerIDOf(t, other), body)
+	req.Header.Set(auth.NodeSignatureHeader, signature)
+	_, err = auth.NewVerifier(secret).Verify(req, body, time.Now())
+	require.ErrorIs(t, err, auth.ErrBadSignature)
+
+	// the key of a peer ID which does not embed it is sent with the request
+	rsaKey, _, err := crypto.GenerateRSAKeyPair(2048, rand.Reader)
+	require.NoError(t, err)
+	signer, err = auth.NewNodeSigner(secret, rsaKey)
+	require.NoError(t, err)
+	req, err = signer.NewRequest("POST", "http://peer:7070/updateView?fileCID=cid", body)
+	require.NoError(t, err)
+	require.NotEmpty(t, req.Header.Get(auth.NodeKeyHeader))
+	verified, err := auth.NewVerifier(secret).Verify(req, body, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, peerIDOf(t, rsaKey), verified)
+
+	encoded, err := crypto.MarshalPublicKey(other.GetPublic())
+	require.NoError(t, err)
+	req, err = signer.NewRequest("POST", "http://peer:7070/updateView?fileCID=cid", body)
+	require.NoError(t, err)
+	req.Header.Set(auth.NodeKeyHeader, hex.EncodeToString(encoded))
+	_, err = auth.NewVerifier(secret).Verify(req, body, time.Now())
+	require.ErrorIs(t, err, auth.ErrBadSignature)
+}
+
+func Test_Auth_Identity_File(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	encoded, err := crypto.MarshalPrivateKey(key)
+	require.NoError(t, err)
+	write := func(id string) string {
+		path := filepath.Join(t.TempDir(), "identity.json")
+		content := fmt.Sprintf(`{"id":%q,"private_key":%q}`, id, base64.StdEncoding.EncodeToString(encoded))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	loaded, err := auth.LoadIdentity(write(peerIDOf(t, key)))
+	require.NoError(t, err)
+	require.True(t, key.Equals(loaded))
+
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	_, err = auth.LoadIdentity(write(peerIDOf(t, other)))
+	require.Error(t, err)
+	_, err = auth.LoadIdentity(filepath.Join(t.TempDir(), "missing.json"))
+	require.Error(t, err)
+}
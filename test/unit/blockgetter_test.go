@@ -1,137 +1,488 @@
 package test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"github.com/stretchr/testify/require"
-	"ipfs-alpha-entanglement-code/entangler"
-	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
-	"log"
+	"io"
+	"math/rand"
 	"os"
-	"sort"
-	"strings"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"ipfs-alpha-entanglement-code/client"
+	"ipfs-alpha-entanglement-code/entangler"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	"ipfs-alpha-entanglement-code/test/mock"
+
+	"github.com/stretchr/testify/require"
 )
 
-var blockgetterTest = func(filepath string) func(*testing.T) {
-	return func(t *testing.T) {
-		alpha, s, p := 3, 5, 5
-		c, err := ipfsconnector.CreateIPFSConnector(0)
-		if err != nil {
-			t.Fatal(err)
-		}
-		// add original file to ipfs
-		cid, err := c.AddFile(filepath)
-		if err != nil {
-			t.Fatal(err)
-		}
+// mockClient starts a mock IPFS node and a mock cluster of 10 peers, and returns a client connected to them
+func mockClient(t *testing.T) (*client.Client, *mock.IPFS, *mock.Cluster) {
+	ipfs := mock.CreateIPFS()
+	t.Cleanup(ipfs.Close)
+	cluster := mock.CreateCluster(10, ipfs)
+	t.Cleanup(cluster.Close)
 
-		// get merkle tree from IPFS and flatten the tree
-		root, err := c.GetMerkleTree(cid, &entangler.Lattice{})
-		if err != nil {
-			t.Fatal(err)
-		}
+	c, err := client.NewClient(context.Background(), cluster.Host(), cluster.Port(), ipfs.Host(), ipfs.Port())
+	require.NoError(t, err)
+	return c, ipfs, cluster
+}
 
-		nodesSwapped := root.GetFlattenedTree(s, p, true)
+// mockUpload uploads random data of the given size with small chunks through the client
+func mockUpload(t *testing.T, c *client.Client, size int) (data []byte, rootCID string, metaCID string) {
+	opts := ipfsconnector.DefaultAddOptions()
+	opts.Chunker = "size-1024"
+	require.NoError(t, c.SetAddOptions(opts))
 
-		// generate entanglement
-		data := make(chan []byte, len(nodesSwapped))
-		maxSize := 0
-		for _, node := range nodesSwapped {
-			nodeData, err := node.Data()
-			if err != nil {
-				t.Fatal(err)
-			}
-			data <- nodeData
-			if len(nodeData) > maxSize {
-				maxSize = len(nodeData)
-			}
-		}
-		close(data)
-		tangler := entangler.NewEntangler(alpha, s, p)
+	data = make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	rootCID, metaCID, pinResult, err := c.Upload(context.Background(), path, 3, 5, 5, 2, "")
+	require.NoError(t, err)
+	require.NoError(t, pinResult())
+	return data, rootCID, metaCID
+}
+
+func Test_Blockgetter_Basic(t *testing.T) {
+	EnableLog(true)
+	c, _, _ := mockClient(t)
+	_, rootCID, metaCID := mockUpload(t, c, 50*1024+100)
+
+	metaData, getter, _, _, _, err := c.PrepareRepair(context.Background(), rootCID, metaCID, 2)
+	require.NoError(t, err)
+
+	// the data blocks are read in lattice order
+	root, _, _, err := c.GetMerkleTree(context.Background(), rootCID, nil)
+	require.NoError(t, err)
+	nodes := root.GetFlattenedTree(metaData.S, metaData.P, true)
+	require.Len(t, nodes, metaData.NumBlocks)
+	for i, node := range nodes {
+		expected, err := node.Data(context.Background())
+		require.NoError(t, err)
+		actual, err := getter.GetData(context.Background(), i)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
 
-		outputPaths := make([]string, alpha)
-		for k := 0; k < alpha; k++ {
-			outputPaths[k] = fmt.Sprintf("%s_entanglement_%d", strings.Split(filepath, ".")[0], k)
-			defer os.Remove(outputPaths[k])
+	// the parities match the strands generated again from the data
+	tangler, err := entangler.NewEntangler(metaData.Alpha, metaData.S, metaData.P, []bool{})
+	require.NoError(t, err)
+	tangler.ParitySize = metaData.ParityBlockSize
+	readers := tangler.EntangleToReaders(len(nodes), func(index int) ([]byte, error) {
+		return nodes[index-1].Data(context.Background())
+	})
+	// the strands are generated together, so they are read concurrently
+	strands := make([][]byte, len(readers))
+	var wg sync.WaitGroup
+	for k, reader := range readers {
+		wg.Add(1)
+		go func(k int, reader io.ReadCloser) {
+			defer wg.Done()
+			defer reader.Close()
+			strands[k], _ = io.ReadAll(reader)
+		}(k, reader)
+	}
+	wg.Wait()
+	for k, strand := range strands {
+		require.Len(t, strand, metaData.NumBlocks*metaData.ParityBlockSize)
+		for i := 0; i < metaData.NumBlocks; i++ {
+			actual, err := getter.GetParity(context.Background(), i, k)
+			require.NoError(t, err)
+			expected := strand[i*metaData.ParityBlockSize : (i+1)*metaData.ParityBlockSize]
+			require.True(t, bytes.Equal(expected, actual), "parity %d of strand %d", i, k)
 		}
-		parityChan := make(chan entangler.EntangledBlock, alpha*len(nodesSwapped))
-		err = tangler.Entangle(data, parityChan)
-		if err != nil {
-			t.Fatal(err)
+	}
+}
+
+func Test_Blockgetter_Download_Recovery(t *testing.T) {
+	EnableLog(true)
+	c, ipfs, cluster := mockClient(t)
+	data, rootCID, metaCID := mockUpload(t, c, 50*1024+100)
+
+	root, _, _, err := c.GetMerkleTree(context.Background(), rootCID, nil)
+	require.NoError(t, err)
+	nodes := root.GetFlattenedTree(5, 5, true)
+
+	// lose a third of the data blocks below the root and the parities held by one peer
+	var lost []string
+	for i, node := range nodes {
+		if i%3 == 1 && node.CID != rootCID {
+			ipfs.DropBlock(node.CID)
+			lost = append(lost, node.CID)
 		}
-		err = tangler.WriteEntanglementToFile(maxSize, outputPaths, parityChan)
-		if err != nil {
-			t.Fatal(err)
+	}
+	cluster.KillPeer(cluster.PeerIDs()[3])
+	_, _, err = c.Download(context.Background(), rootCID, "", client.DownloadOption{}, 1)
+	require.Error(t, err)
+
+	for _, mode := range []entangler.RecoveryMode{entangler.SequentialRecovery, entangler.ParallelRecovery} {
+		option := client.DownloadOption{MetaCID: metaCID, UploadRecoverData: true, RecoveryMode: mode}
+		downloaded, _, err := c.Download(context.Background(), rootCID, "", option, 5)
+		require.NoError(t, err)
+		require.Equal(t, data, downloaded)
+	}
+	for _, blockCID := range lost {
+		require.True(t, ipfs.HasBlock(blockCID))
+	}
+
+	downloaded, _, err := c.Download(context.Background(), rootCID, "", client.DownloadOption{}, 1)
+	require.NoError(t, err)
+	require.Equal(t, data, downloaded)
+}
+
+func Test_Blockgetter_Repair_Strand(t *testing.T) {
+	EnableLog(true)
+	c, ipfs, cluster := mockClient(t)
+	_, rootCID, metaCID := mockUpload(t, c, 50*1024+100)
+
+	metaData, err := c.GetMetaData(context.Background(), metaCID)
+	require.NoError(t, err)
+	strand, _, _, err := c.GetMerkleTree(context.Background(), metaData.TreeCIDs[1], nil)
+	require.NoError(t, err)
+	var strandCIDs []string
+	var walker func(*ipfsconnector.TreeNode)
+	walker = func(node *ipfsconnector.TreeNode) {
+		strandCIDs = append(strandCIDs, node.CID)
+		for _, child := range node.Children {
+			walker(child)
 		}
+	}
+	walker(strand)
 
-		// upload entanglements to ipfs
-		var parityCIDs [][]string
-		var parityLeafNodes [][]*ipfsconnector.TreeNode
-		for _, entanglementFilename := range outputPaths {
-			cid, err := c.AddFile(entanglementFilename)
-			if err != nil {
-				t.Fatal(err)
-			}
-			// get merkle tree from IPFS and flatten the tree
-			root, err := c.GetMerkleTree(cid, &entangler.Lattice{})
-			if err != nil {
-				t.Fatal(err)
-			}
-			nodesLeaf := root.GetLeafNodes()
+	// the whole strand is lost
+	for _, blockCID := range strandCIDs {
+		cluster.Unpin(blockCID)
+		require.False(t, ipfs.HasBlock(blockCID))
+	}
+
+	require.NoError(t, c.RepairStrand(context.Background(), rootCID, metaCID, 1))
+	for _, blockCID := range strandCIDs {
+		require.True(t, ipfs.HasBlock(blockCID))
+	}
+}
+
+func Test_Blockgetter_Retrieve_Failed_Leaves(t *testing.T) {
+	EnableLog(false)
+	c, ipfs, _ := mockClient(t)
+	_, rootCID, metaCID := mockUpload(t, c, 50*1024+100)
 
-			var singleParityCIDs []string
-			for _, node := range nodesLeaf {
-				singleParityCIDs = append(singleParityCIDs, node.CID)
+	root, _, _, err := c.GetMerkleTree(context.Background(), rootCID, nil)
+	require.NoError(t, err)
+	nodes := root.GetFlattenedTree(5, 5, true)
+
+	// the root and a leaf are known to be lost
+	var missing []entangler.BlockRef
+	leaf := -1
+	for i, node := range nodes {
+		if node.CID == rootCID || (leaf < 0 && len(node.Children) == 0) {
+			if node.CID != rootCID {
+				leaf = i
 			}
-			parityCIDs = append(parityCIDs, singleParityCIDs)
-			parityLeafNodes = append(parityLeafNodes, nodesLeaf)
+			ipfs.DropBlock(node.CID)
+			missing = append(missing, entangler.BlockRef{Index: i + 1})
 		}
+	}
 
-		// Create getter
-		cidMap := make(map[string]int)
-		for i, node := range nodesSwapped {
-			cidMap[node.CID] = i
-		}
-		getter := ipfsconnector.CreateIPFSGetter(c, cidMap, parityCIDs)
+	// the root is repaired with a plan and uploaded again, the leaf is left to the repair units
+	leaves, _, err := c.RetrieveFailedLeaves(context.Background(), rootCID, metaCID, 2, missing)
+	require.NoError(t, err)
+	require.Equal(t, []int{leaf}, leaves)
+	require.True(t, ipfs.HasBlock(rootCID))
+	require.False(t, ipfs.HasBlock(nodes[leaf].CID))
+}
 
-		// Verify that we get the expected results
-		for i := 0; i < root.TreeSize; i++ {
-			actualData, err := getter.GetData(i)
-			if err != nil {
-				t.Fatal(err)
-			}
-			expectedData, _ := nodesSwapped[i].Data()
-			require.Equal(t, expectedData, actualData)
+func Test_Blockgetter_IPFS_Failure(t *testing.T) {
+	EnableLog(true)
+	c, ipfs, _ := mockClient(t)
+	_, rootCID, metaCID := mockUpload(t, c, 10*1024)
+
+	ipfs.FailCommand("block/get", true)
+	option := client.DownloadOption{MetaCID: metaCID}
+	_, _, err := c.Download(context.Background(), rootCID, "", option, 5)
+	require.Error(t, err)
+
+	ipfs.FailCommand("block/get", false)
+	_, _, err = c.Download(context.Background(), rootCID, "", option, 5)
+	require.NoError(t, err)
+}
+
+func Test_Blockgetter_Context(t *testing.T) {
+	EnableLog(true)
+	c, ipfs, _ := mockClient(t)
+	data, rootCID, metaCID := mockUpload(t, c, 10*1024)
+
+	// a cancelled download gives up without recovering
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := c.Download(ctx, rootCID, "", client.DownloadOption{MetaCID: metaCID}, 5)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// the deadline of the download bounds the requests to a slow node
+	ipfs.DelayCommand("cat", time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = c.Download(ctx, rootCID, "", client.DownloadOption{}, 1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+
+	// a request timing out leaves the operation going on
+	ctx = ipfsconnector.WithBlockTimeout(context.Background(), 50*time.Millisecond)
+	_, err = c.GetFileToMem(ctx, rootCID)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NoError(t, ctx.Err())
+	ipfs.DelayCommand("cat", 0)
+	downloaded, err := c.GetFileToMem(ctx, rootCID)
+	require.NoError(t, err)
+	require.Equal(t, data, downloaded)
+}
+
+func Test_Blockgetter_Concurrent(t *testing.T) {
+	EnableLog(false)
+	c, ipfs, _ := mockClient(t)
+	_, rootCID, metaCID := mockUpload(t, c, 50*1024+100)
+
+	metaData, sequential, _, _, _, err := c.PrepareRepair(context.Background(), rootCID, metaCID, 2)
+	require.NoError(t, err)
+	_, getter, _, _, _, err := c.PrepareRepair(context.Background(), rootCID, metaCID, 2)
+	require.NoError(t, err)
+
+	// the blocks read one by one are the reference
+	calls := ipfs.Calls("block/get")
+	data := make([][]byte, metaData.NumBlocks)
+	parities := make([][][]byte, metaData.Alpha)
+	for i := range data {
+		data[i], err = sequential.GetData(context.Background(), i)
+		require.NoError(t, err)
+	}
+	for k := range parities {
+		parities[k] = make([][]byte, metaData.NumBlocks)
+		for i := range parities[k] {
+			parities[k][i], err = sequential.GetParity(context.Background(), i, k)
+			require.NoError(t, err)
 		}
+	}
+	fetches := ipfs.Calls("block/get") - calls
 
-		for i := 0; i < alpha; i++ {
-			for j := 0; j < root.TreeSize; j++ {
-				actualData, err := getter.GetParity(j+1, i)
-				if err != nil {
-					t.Fatal(err)
+	// every block is read by several goroutines at once, and still fetched once
+	calls = ipfs.Calls("block/get")
+	const readers = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, readers*metaData.NumBlocks*(1+metaData.Alpha))
+	for r := 0; r < readers; r++ {
+		for i := 0; i < metaData.NumBlocks; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				actual, err := getter.GetData(context.Background(), i)
+				if err == nil && !bytes.Equal(data[i], actual) {
+					err = fmt.Errorf("data %d differs", i)
 				}
-				expectedData, _ := parityLeafNodes[i][j].Data()
-				require.Equal(t, expectedData, actualData)
+				errs <- err
+			}(i)
+			for k := 0; k < metaData.Alpha; k++ {
+				wg.Add(1)
+				go func(i int, k int) {
+					defer wg.Done()
+					actual, err := getter.GetParity(context.Background(), i, k)
+					if err == nil && !bytes.Equal(parities[k][i], actual) {
+						err = fmt.Errorf("parity %d of strand %d differs", i, k)
+					}
+					errs <- err
+				}(i, k)
 			}
 		}
 	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, fetches, ipfs.Calls("block/get")-calls)
+
+	metrics := getter.Metrics()
+	require.Zero(t, metrics.DataBlocksUnavailable+metrics.DataBlocksError)
+	require.Zero(t, metrics.ParityBlocksUnavailable+metrics.ParityBlocksError)
+	require.Equal(t, []bool{true, true, true}, metrics.ParityAvailable)
+	require.Equal(t, sequential.Metrics().DataBlocksFetched, metrics.DataBlocksFetched)
+	require.Equal(t, sequential.Metrics().ParityBlocksFetched, metrics.ParityBlocksFetched)
 }
 
-func Test_Blockgetter_Basic(t *testing.T) {
-	files, err := os.ReadDir("data")
-	if err != nil {
-		log.Fatal(err)
+func Test_Blockgetter_Cache_Eviction(t *testing.T) {
+	cache := ipfsconnector.NewBlockCache(100)
+	fetches := 0
+	fetch := func(size int) func(context.Context) (ipfsconnector.CachedBlock, error) {
+		return func(context.Context) (ipfsconnector.CachedBlock, error) {
+			fetches++
+			return ipfsconnector.CachedBlock{Data: make([]byte, size)}, nil
+		}
 	}
 
-	var fileNames []string
-	for _, file := range files {
-		if !file.IsDir() {
-			fileNames = append(fileNames, file.Name())
+	for _, cid := range []string{"a", "b", "c"} {
+		_, cached, err := cache.Fetch(context.Background(), cid, fetch(40))
+		require.NoError(t, err)
+		require.False(t, cached)
+	}
+	// the least recently used block makes room for the last one
+	require.Equal(t, 2, cache.Len())
+	require.Equal(t, 80, cache.Bytes())
+	_, ok := cache.Get("a")
+	require.False(t, ok)
+
+	// reading a block keeps it over the older ones
+	_, ok = cache.Get("b")
+	require.True(t, ok)
+	cache.Add("d", ipfsconnector.CachedBlock{Data: make([]byte, 40)})
+	_, ok = cache.Get("b")
+	require.True(t, ok)
+	_, ok = cache.Get("c")
+	require.False(t, ok)
+
+	// a block larger than the cache is fetched every time
+	for i := 0; i < 2; i++ {
+		_, cached, err := cache.Fetch(context.Background(), "e", fetch(200))
+		require.NoError(t, err)
+		require.False(t, cached)
+	}
+	require.Equal(t, 5, fetches)
+	require.Equal(t, 80, cache.Bytes())
+
+	// a failed fetch is not cached
+	_, cached, err := cache.Fetch(context.Background(), "f", func(context.Context) (ipfsconnector.CachedBlock, error) {
+		return ipfsconnector.CachedBlock{}, fmt.Errorf("unavailable")
+	})
+	require.Error(t, err)
+	require.False(t, cached)
+	_, ok = cache.Get("f")
+	require.False(t, ok)
+}
+
+func Test_Blockgetter_Cache_Shared_Fetch(t *testing.T) {
+	cache := ipfsconnector.NewBlockCache(100)
+	started, release := make(chan struct{}), make(chan struct{})
+	var fetches int32
+	fetch := func(ctx context.Context) (ipfsconnector.CachedBlock, error) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			close(started)
+		}
+		select {
+		case <-release:
+			return ipfsconnector.CachedBlock{Data: []byte("block")}, nil
+		case <-ctx.Done():
+			return ipfsconnector.CachedBlock{}, ctx.Err()
+		}
+	}
+
+	// the first caller gives up while another one waits for the same block
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, _, err := cache.Fetch(leaderCtx, "a", fetch)
+		leaderErr <- err
+	}()
+	<-started
+	type result struct {
+		block  ipfsconnector.CachedBlock
+		cached bool
+		err    error
+	}
+	waiter := make(chan result)
+	go func() {
+		block, cached, err := cache.Fetch(context.Background(), "a", fetch)
+		waiter <- result{block, cached, err}
+	}()
+	// let the waiter join the fetch
+	time.Sleep(20 * time.Millisecond)
+	cancelLeader()
+	require.ErrorIs(t, <-leaderErr, context.Canceled)
+
+	// the fetch goes on for the waiter
+	close(release)
+	r := <-waiter
+	require.NoError(t, r.err)
+	require.True(t, r.cached)
+	require.Equal(t, []byte("block"), r.block.Data)
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// a fetch nobody waits for anymore is cancelled, and the next caller fetches again
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan struct{})
+	go cache.Fetch(ctx, "b", func(ctx context.Context) (ipfsconnector.CachedBlock, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return ipfsconnector.CachedBlock{}, ctx.Err()
+	})
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-cancelled
+	block, cached, err := cache.Fetch(context.Background(), "b", func(context.Context) (ipfsconnector.CachedBlock, error) {
+		return ipfsconnector.CachedBlock{Data: []byte("b")}, nil
+	})
+	require.NoError(t, err)
+	require.False(t, cached)
+	require.Equal(t, []byte("b"), block.Data)
+}
+
+func Test_Blockgetter_Shared_CID(t *testing.T) {
+	EnableLog(false)
+	c, _, _ := mockClient(t)
+
+	// the leaves of a zero-filled file are the same block, and the parities of two equal blocks are zero-filled,
+	// so the leaves of the strands holding them are that block too
+	require.NoError(t, c.SetAddOptions(ipfsconnector.DefaultAddOptions()))
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, make([]byte, 12*ipfsconnector.DefaultParityLeafSize), 0600))
+	rootCID, metaCID, pinResult, err := c.Upload(context.Background(), path, 3, 5, 5, 2, "")
+	require.NoError(t, err)
+	require.NoError(t, pinResult())
+
+	root, _, _, err := c.GetMerkleTree(context.Background(), rootCID, nil)
+	require.NoError(t, err)
+	metaData, reference, _, _, _, err := c.PrepareRepair(context.Background(), rootCID, metaCID, 2)
+	require.NoError(t, err)
+	nodes := root.GetFlattenedTree(metaData.S, metaData.P, true)
+	leaf := len(nodes) - 1
+	leafData, err := nodes[leaf].Data(context.Background())
+	require.NoError(t, err)
+
+	// find a parity stored in a leaf of a strand with the CID of the data leaf
+	index, strand := -1, -1
+	for k := 0; k < metaData.Alpha && index < 0; k++ {
+		for i := 0; i < metaData.NumBlocks; i++ {
+			_, err := reference.GetParity(context.Background(), i, k)
+			require.NoError(t, err)
+			if reference.GetParityCID(i, k) == nodes[leaf].CID {
+				index, strand = i, k
+				break
+			}
 		}
 	}
-	sort.Strings(fileNames)
+	require.GreaterOrEqual(t, index, 0)
+	parity, err := reference.GetParity(context.Background(), index, strand)
+	require.NoError(t, err)
+	require.NotEqual(t, leafData, parity)
 
-	for _, fileName := range fileNames {
-		t.Run("basic_"+fileName, blockgetterTest("data/"+fileName))
+	// the block is read as a data block and as a parity whatever comes first
+	for _, dataFirst := range []bool{true, false} {
+		_, getter, _, _, _, err := c.PrepareRepair(context.Background(), rootCID, metaCID, 2)
+		require.NoError(t, err)
+		for _, readData := range []bool{dataFirst, !dataFirst} {
+			if readData {
+				data, err := getter.GetData(context.Background(), leaf)
+				require.NoError(t, err)
+				require.Equal(t, leafData, data)
+			} else {
+				data, err := getter.GetParity(context.Background(), index, strand)
+				require.NoError(t, err)
+				require.Equal(t, parity, data)
+			}
+		}
 	}
 }
@@ -1,65 +1,169 @@
 package test
 
 import (
-	"fmt"
-	ipfscluster "ipfs-alpha-entanglement-code/ipfs-cluster"
-	"ipfs-alpha-entanglement-code/util"
+	"context"
 	"testing"
+
+	ipfscluster "ipfs-alpha-entanglement-code/ipfs-cluster"
+	"ipfs-alpha-entanglement-code/test/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	clusterCID1 = "QmQqzMTavQgT4f4T5v6PWBp7XNKtoPmC9jvn12WPT3gkSE"
+	clusterCID2 = "bafkreidlgzgnujigow46cy6t6pru23hqcox5agypq7sala6fnvq4ggo4zu"
 )
 
+// mockClusterConnector starts a mock cluster of the given number of peers and connects to it
+func mockClusterConnector(t *testing.T, peerNum int) (*ipfscluster.Connector, *mock.Cluster) {
+	cluster := mock.CreateCluster(peerNum, nil)
+	t.Cleanup(cluster.Close)
+	conn, err := ipfscluster.CreateIPFSClusterConnector(context.Background(), cluster.Port(), cluster.Host())
+	require.NoError(t, err)
+	return conn, cluster
+}
+
 func Test_Cluster_Simple_Info(t *testing.T) {
-	util.EnableLogPrint()
-	for i := 0; i < 10; i++ {
-		/* Connect to different peers */
-		ipfscluster, _ := ipfscluster.CreateIPFSClusterConnector(9094 + i*100)
-		peerName, err := ipfscluster.PeerInfo()
-		if err != nil {
-			t.Fatal("fail to execute IPFS cluster peer info: ", err)
-		}
-		util.LogPrintf(fmt.Sprintf("Connected IPFS Cluster peer: %s", peerName))
-
-		nbPeer, err := ipfscluster.PeerLs()
-		if err != nil {
-			t.Fatal("fail to execute IPFS cluster peer ls: ", err)
-		}
-		util.LogPrintf(fmt.Sprintf("Number of IPFS Cluster peers: %d", nbPeer))
-	}
+	conn, cluster := mockClusterConnector(t, 10)
+
+	peerName, err := conn.PeerInfo(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "cluster0", peerName)
+
+	// the connected peer is not counted among the others
+	require.Len(t, conn.GetAllPeers(), 9)
+	require.Equal(t, cluster.PeerIDs()[1:], conn.GetPeerIDs())
+	require.Equal(t, "cluster4", conn.GetPeerName(context.Background(), cluster.PeerIDs()[4]))
 }
 
 func Test_Cluster_Pin(t *testing.T) {
-	util.EnableLogPrint()
-	ipfscluster, _ := ipfscluster.CreateIPFSClusterConnector(9094)
-	cid1 := "QmQqzMTavQgT4f4T5v6PWBp7XNKtoPmC9jvn12WPT3gkSE"
-	cid2 := "bafkreidlgzgnujigow46cy6t6pru23hqcox5agypq7sala6fnvq4ggo4zu"
-	replicationFactor := 1
-	err := ipfscluster.AddPin(cid1, replicationFactor)
-	if err != nil {
-		t.Fatalf("fail to execute IPFS cluster peer pin %s: %s\n", cid1, err)
-	}
-	util.LogPrintf(fmt.Sprintf("Pin new cid: %s", cid1))
-	err = ipfscluster.AddPin(cid2, replicationFactor)
-	if err != nil {
-		t.Fatalf("fail to execute IPFS cluster peer pin %s: %s\n", cid2, err)
+	conn, cluster := mockClusterConnector(t, 10)
+
+	require.NoError(t, conn.AddPin(context.Background(), clusterCID1, 3))
+	require.NoError(t, conn.AddPinDirect(context.Background(), clusterCID2, 1))
+	require.ElementsMatch(t, []string{clusterCID1, clusterCID2}, cluster.Pins())
+
+	// the allocations chosen by the placement policy are the ones of the cluster
+	for _, pinCID := range []string{clusterCID1, clusterCID2} {
+		allocations, err := conn.GetPinAllocations(context.Background(), pinCID)
+		require.NoError(t, err)
+		require.Len(t, allocations, len(cluster.Allocations(pinCID)))
+		require.Equal(t, conn.GetRecordedAllocations()[pinCID], cluster.Allocations(pinCID))
 	}
-	util.LogPrintf(fmt.Sprintf("Pin new cid: %s", cid2))
+	require.Len(t, cluster.Allocations(clusterCID1), 3)
 }
 
 func Test_Cluster_Pin_Info(t *testing.T) {
-	util.EnableLogPrint()
-	ipfscluster, _ := ipfscluster.CreateIPFSClusterConnector(9094)
-	pinStatus, err := ipfscluster.PinStatus("")
-	if err != nil {
-		t.Fatal("fail to execute IPFS cluster peer pin status: ", err)
-	}
-	util.LogPrintf(fmt.Sprintf("Pinned files: %s", pinStatus))
+	conn, cluster := mockClusterConnector(t, 10)
+	require.NoError(t, conn.AddPin(context.Background(), clusterCID1, 2))
+
+	pinStatus, err := conn.PinStatus(context.Background(), "")
+	require.NoError(t, err)
+	require.Contains(t, pinStatus, "Total number of pins: 1")
+	require.Contains(t, pinStatus, clusterCID1+" pinned by 2 peers")
+
+	// a peer going down no longer holds the pin
+	cluster.KillPeer(cluster.Allocations(clusterCID1)[0])
+	pinStatus, err = conn.PinStatus(context.Background(), "")
+	require.NoError(t, err)
+	require.Contains(t, pinStatus, clusterCID1+" pinned by 1 peers")
 }
 
 func Test_Cluster_Load_Check(t *testing.T) {
-	util.EnableLogPrint()
-	ipfscluster, _ := ipfscluster.CreateIPFSClusterConnector(9094)
-	peerLoad, err := ipfscluster.PeerLoad()
-	if err != nil {
-		t.Fatal("fail to execute IPFS cluster peer load: ", err)
+	conn, _ := mockClusterConnector(t, 4)
+	require.NoError(t, conn.AddPin(context.Background(), clusterCID1, 4))
+	require.NoError(t, conn.AddPin(context.Background(), clusterCID2, 2))
+
+	peerLoad, err := conn.PeerLoad(context.Background())
+	require.NoError(t, err)
+	// the placement policy leaves out the connected peer
+	require.Contains(t, peerLoad, "Total blocks in the cluster: 5")
+	require.Contains(t, peerLoad, "Min blocks: 1, Max blocks: 2")
+}
+
+func Test_Cluster_Regions(t *testing.T) {
+	conn, cluster := mockClusterConnector(t, 4)
+	for i, peerID := range cluster.PeerIDs() {
+		cluster.SetRegion(peerID, []string{"eu", "us"}[i%2])
+	}
+
+	regions, err := conn.GetPeerRegions(context.Background())
+	require.NoError(t, err)
+	require.Len(t, regions, 4)
+	region, err := conn.GetPeerRegionTag(context.Background(), "cluster3")
+	require.NoError(t, err)
+	require.Equal(t, "us", region)
+	require.Equal(t, "eu", regions[cluster.PeerIDs()[0]])
+}
+
+func Test_Cluster_Malformed_Response(t *testing.T) {
+	cluster := mock.CreateCluster(4, nil)
+	defer cluster.Close()
+
+	// the connector cannot be created from a broken peer
+	for _, body := range []string{"not json", `{"peername": "cluster0"}`, `{"id": 3, "peername": "cluster0"}`} {
+		cluster.Corrupt("/id", body)
+		_, err := ipfscluster.CreateIPFSClusterConnector(context.Background(), cluster.Port(), cluster.Host())
+		require.ErrorIs(t, err, ipfscluster.ErrMalformedResponse)
+	}
+	cluster.Corrupt("/id", "")
+	cluster.Corrupt("/peers", `{"id": "12D3KooWMockPeer001"}`)
+	_, err := ipfscluster.CreateIPFSClusterConnector(context.Background(), cluster.Port(), cluster.Host())
+	require.ErrorIs(t, err, ipfscluster.ErrMalformedResponse)
+	cluster.Corrupt("/peers", "")
+
+	conn, err := ipfscluster.CreateIPFSClusterConnector(context.Background(), cluster.Port(), cluster.Host())
+	require.NoError(t, err)
+	require.NoError(t, conn.AddPin(context.Background(), clusterCID1, 2))
+
+	// the known peers are kept when the cluster answers badly
+	cluster.Corrupt("/peers", `[1, 2]`)
+	peers, err := conn.GetLatestPeers(context.Background())
+	require.ErrorIs(t, err, ipfscluster.ErrMalformedResponse)
+	require.Len(t, peers, 3)
+
+	for _, body := range []string{`{"cid": "` + clusterCID1 + `"}`, `{"cid": "` + clusterCID1 + `", "peer_map": {"p": "pinned"}}`, "{"} {
+		cluster.Corrupt("/pins", body)
+		_, err = conn.PinStatus(context.Background(), "")
+		require.ErrorIs(t, err, ipfscluster.ErrMalformedResponse)
+		_, err = conn.PeerLoad(context.Background())
+		require.ErrorIs(t, err, ipfscluster.ErrMalformedResponse)
 	}
-	util.LogPrintf(fmt.Sprintf("Load on peers: %s", peerLoad))
+
+	cluster.Corrupt("/pins/"+clusterCID1, `{"allocations": "12D3KooWMockPeer001"}`)
+	_, err = conn.GetPinAllocations(context.Background(), clusterCID1)
+	require.ErrorIs(t, err, ipfscluster.ErrMalformedResponse)
+
+	cluster.Corrupt("/monitor/metrics/tag:region", `{"peer": "12D3KooWMockPeer001"}`)
+	_, err = conn.GetPeerRegionTag(context.Background(), "cluster1")
+	require.ErrorIs(t, err, ipfscluster.ErrMalformedResponse)
+}
+
+func Test_Cluster_Unreachable(t *testing.T) {
+	conn, cluster := mockClusterConnector(t, 4)
+
+	// an unknown pin is rejected by the cluster
+	_, err := conn.GetPinAllocations(context.Background(), clusterCID2)
+	require.ErrorIs(t, err, ipfscluster.ErrRequestRejected)
+
+	cluster.Close()
+	_, err = conn.PeerInfo(context.Background())
+	require.ErrorIs(t, err, ipfscluster.ErrPeerUnreachable)
+	err = conn.AddPin(context.Background(), clusterCID1, 2)
+	require.ErrorIs(t, err, ipfscluster.ErrPeerUnreachable)
+	_, err = conn.PinStatus(context.Background(), clusterCID1)
+	require.ErrorIs(t, err, ipfscluster.ErrPeerUnreachable)
+}
+
+func Test_Cluster_Cancelled(t *testing.T) {
+	conn, _ := mockClusterConnector(t, 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := conn.PeerInfo(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NotErrorIs(t, err, ipfscluster.ErrPeerUnreachable)
+	err = conn.AddPin(ctx, clusterCID1, 2)
+	require.ErrorIs(t, err, context.Canceled)
 }
@@ -0,0 +1,174 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"ipfs-alpha-entanglement-code/Server"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver answers the SRV and TXT lookups of the DNS discovery from maps
+type fakeResolver struct {
+	srv map[string][]*net.SRV
+	txt map[string][]string
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	records, ok := r.srv[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, records, nil
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.txt[name], nil
+}
+
+func Test_Discovery_Backends(t *testing.T) {
+	ctx := context.Background()
+	expected := Server.CommunitiesMap{
+		"community0:7070": {ClusterIP: "cluster0"},
+		"community1:7070": {ClusterIP: "cluster1"},
+	}
+
+	t.Run("HTTP", func(t *testing.T) {
+		var announced Server.CommunityNodeAnnouncement
+		mux := http.NewServeMux()
+		mux.HandleFunc("/announce", func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&announced)
+		})
+		mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(expected)
+		})
+		mux.HandleFunc("/cluster-to-community", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("clusterIP") == "cluster1" {
+				w.Write([]byte("community1:7070"))
+			}
+		})
+		service := httptest.NewServer(mux)
+		defer service.Close()
+
+		discovery, err := Server.NewDiscovery(Server.DiscoveryConfig{Address: service.Listener.Addr().String()})
+		require.NoError(t, err)
+
+		require.NoError(t, discovery.Announce(ctx, Server.CommunityNodeAnnouncement{CommunityIP: "community0:7070", ClusterIP: "cluster0"}))
+		require.Equal(t, "cluster0", announced.ClusterIP)
+		nodes, err := discovery.Peers(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, nodes)
+		address, err := discovery.CommunityAddress(ctx, "cluster1")
+		require.NoError(t, err)
+		require.Equal(t, "community1:7070", address)
+		_, err = discovery.CommunityAddress(ctx, "cluster2")
+		require.ErrorIs(t, err, Server.ErrUnknownCommunity)
+	})
+
+	t.Run("Static", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "peers.json")
+		data, err := json.Marshal(expected)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, data, 0644))
+
+		discovery, err := Server.NewDiscovery(Server.DiscoveryConfig{Backend: Server.StaticDiscoveryBackend, PeersFile: path})
+		require.NoError(t, err)
+		nodes, err := discovery.Peers(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, nodes)
+		address, err := discovery.CommunityAddress(ctx, "cluster0")
+		require.NoError(t, err)
+		require.Equal(t, "community0:7070", address)
+
+		// the file is read again on every lookup
+		require.NoError(t, os.WriteFile(path, []byte(`{"community2:7070": {"clusterIP": "cluster0"}}`), 0644))
+		address, err = discovery.CommunityAddress(ctx, "cluster0")
+		require.NoError(t, err)
+		require.Equal(t, "community2:7070", address)
+
+		require.NoError(t, os.WriteFile(path, []byte(`not json`), 0644))
+		_, err = discovery.Peers(ctx)
+		require.Error(t, err)
+	})
+
+	t.Run("DNS", func(t *testing.T) {
+		discovery := &Server.DNSDiscovery{
+			Service: "_community._tcp.example.org",
+			Resolver: &fakeResolver{
+				srv: map[string][]*net.SRV{"_community._tcp.example.org": {
+					{Target: "community0.", Port: 7070},
+					{Target: "community1.", Port: 7070},
+				}},
+				txt: map[string][]string{
+					"community0.": {"cluster=cluster0"},
+					"community1.": {"v=spf1 -all", "cluster=cluster1"},
+				},
+			},
+		}
+
+		nodes, err := discovery.Peers(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, nodes)
+		address, err := discovery.CommunityAddress(ctx, "cluster1")
+		require.NoError(t, err)
+		require.Equal(t, "community1:7070", address)
+		_, err = discovery.CommunityAddress(ctx, "cluster2")
+		require.ErrorIs(t, err, Server.ErrUnknownCommunity)
+
+		discovery.Service = "_other._tcp.example.org"
+		_, err = discovery.Peers(ctx)
+		require.Error(t, err)
+	})
+
+	t.Run("Cluster", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/id", func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]string{"id": "id0", "peername": "cluster0"})
+		})
+		mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+			encoder := json.NewEncoder(w)
+			encoder.Encode(map[string]string{"id": "id0", "peername": "cluster0"})
+			encoder.Encode(map[string]string{"id": "id1", "peername": "cluster1"})
+			encoder.Encode(map[string]string{"id": "id2", "peername": "cluster2"})
+		})
+		mux.HandleFunc("/monitor/metrics/tag:community", func(w http.ResponseWriter, r *http.Request) {
+			// the third peer runs no community node
+			json.NewEncoder(w).Encode([]map[string]string{
+				{"peer": "id0", "value": "community0:7070"},
+				{"peer": "id1", "value": "community1:7070"},
+			})
+		})
+		cluster := httptest.NewServer(mux)
+		defer cluster.Close()
+		clusterURL, err := url.Parse(cluster.URL)
+		require.NoError(t, err)
+		port, err := strconv.Atoi(clusterURL.Port())
+		require.NoError(t, err)
+
+		discovery, err := Server.NewDiscovery(Server.DiscoveryConfig{Backend: Server.ClusterDiscoveryBackend,
+			ClusterIP: clusterURL.Hostname(), ClusterPort: port})
+		require.NoError(t, err)
+		nodes, err := discovery.Peers(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, nodes)
+		address, err := discovery.CommunityAddress(ctx, "cluster1")
+		require.NoError(t, err)
+		require.Equal(t, "community1:7070", address)
+		_, err = discovery.CommunityAddress(ctx, "cluster2")
+		require.ErrorIs(t, err, Server.ErrUnknownCommunity)
+	})
+
+	_, err := Server.NewDiscovery(Server.DiscoveryConfig{Backend: "consul"})
+	require.Error(t, err)
+	_, err = Server.NewDiscovery(Server.DiscoveryConfig{Backend: Server.StaticDiscoveryBackend})
+	require.Error(t, err)
+}
@@ -3,6 +3,8 @@ package test
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
@@ -37,7 +39,8 @@ func Test_Entanglement(t *testing.T) {
 			close(dataChan)
 
 			alpha, s, p := 3, 5, 5
-			tangler := entangler.NewEntangler(alpha, s, p)
+			tangler, err := entangler.NewEntangler(alpha, s, p, []bool{})
+			require.NoError(t, err)
 
 			outputPaths := make([]string, 3)
 			for k := 0; k < alpha; k++ {
@@ -69,3 +72,163 @@ func Test_Entanglement(t *testing.T) {
 	t.Run("median", getTest("randomMedian"))
 	t.Run("large", getTest("randomLarge"))
 }
+
+func Test_Entanglement_Streaming(t *testing.T) {
+	EnableLog(true)
+	getTest := func(alpha int, s int, p int, blockNum int) func(*testing.T) {
+		return func(t *testing.T) {
+			blocks := make([][]byte, blockNum)
+			for i := range blocks {
+				blocks[i] = make([]byte, 32)
+				rand.Read(blocks[i])
+			}
+
+			// reference entanglement, reordered by left block index
+			dataChan := make(chan []byte, blockNum)
+			for _, block := range blocks {
+				dataChan <- block
+			}
+			close(dataChan)
+			parityChan := make(chan entangler.EntangledBlock, alpha*blockNum)
+			reference, err := entangler.NewEntangler(alpha, s, p, []bool{})
+			require.NoError(t, err)
+			err = reference.Entangle(dataChan, parityChan)
+			require.NoError(t, err)
+
+			parities := make([][][]byte, alpha)
+			for k := range parities {
+				parities[k] = make([][]byte, blockNum)
+			}
+			for parity := range parityChan {
+				parities[parity.Strand][parity.LeftBlockIndex-1] = parity.Data
+			}
+
+			// streamed entanglement
+			tangler, err := entangler.NewEntangler(alpha, s, p, []bool{})
+			require.NoError(t, err)
+			readers := tangler.EntangleToReaders(blockNum, func(index int) ([]byte, error) {
+				return blocks[index-1], nil
+			})
+			require.Len(t, readers, alpha)
+
+			results := make([][]byte, alpha)
+			errs := make([]error, alpha)
+			done := make(chan int, alpha)
+			for k, reader := range readers {
+				go func(k int, reader io.ReadCloser) {
+					results[k], errs[k] = io.ReadAll(reader)
+					done <- k
+				}(k, reader)
+			}
+			for range readers {
+				<-done
+			}
+
+			for k := 0; k < alpha; k++ {
+				require.NoError(t, errs[k])
+				require.Equal(t, bytes.Join(parities[k], nil), results[k])
+			}
+		}
+	}
+
+	t.Run("Alpha-3", getTest(3, 5, 5, 100))
+	t.Run("Alpha-5", getTest(5, 5, 5, 100))
+
+	t.Run("Error", func(t *testing.T) {
+		tangler, err := entangler.NewEntangler(3, 5, 5, []bool{})
+		require.NoError(t, err)
+		readers := tangler.EntangleToReaders(50, func(index int) ([]byte, error) {
+			if index == 40 {
+				return nil, fmt.Errorf("block %d unavailable", index)
+			}
+			return make([]byte, 32), nil
+		})
+
+		errs := make(chan error, len(readers))
+		for _, reader := range readers {
+			go func(reader io.ReadCloser) {
+				_, err := io.ReadAll(reader)
+				errs <- err
+			}(reader)
+		}
+		for range readers {
+			require.Error(t, <-errs)
+		}
+	})
+
+	t.Run("Padding", func(t *testing.T) {
+		alpha, blockNum, paritySize := 3, 50, 40
+		blocks := make([][]byte, blockNum)
+		for i := range blocks {
+			blocks[i] = make([]byte, 1+i%32)
+			rand.Read(blocks[i])
+		}
+
+		// reference entanglement, without padding
+		dataChan := make(chan []byte, blockNum)
+		for _, block := range blocks {
+			dataChan <- block
+		}
+		close(dataChan)
+		parityChan := make(chan entangler.EntangledBlock, alpha*blockNum)
+		reference, err := entangler.NewEntangler(alpha, 5, 5, []bool{})
+		require.NoError(t, err)
+		err = reference.Entangle(dataChan, parityChan)
+		require.NoError(t, err)
+		parities := make([][][]byte, alpha)
+		for k := range parities {
+			parities[k] = make([][]byte, blockNum)
+		}
+		for parity := range parityChan {
+			parities[parity.Strand][parity.LeftBlockIndex-1] = parity.Data
+		}
+
+		tangler, err := entangler.NewEntangler(alpha, 5, 5, []bool{})
+		require.NoError(t, err)
+		tangler.ParitySize = paritySize
+		readers := tangler.EntangleToReaders(blockNum, func(index int) ([]byte, error) {
+			return blocks[index-1], nil
+		})
+
+		results := make([][]byte, alpha)
+		done := make(chan error, alpha)
+		for k, reader := range readers {
+			go func(k int, reader io.ReadCloser) {
+				var err error
+				results[k], err = io.ReadAll(reader)
+				done <- err
+			}(k, reader)
+		}
+		for range readers {
+			require.NoError(t, <-done)
+		}
+
+		// every parity is located by its index in the strand
+		for k, result := range results {
+			require.Len(t, result, blockNum*paritySize)
+			for i, parity := range parities[k] {
+				padded := make([]byte, paritySize)
+				copy(padded, parity)
+				require.Equal(t, padded, result[i*paritySize:(i+1)*paritySize])
+			}
+		}
+	})
+}
+
+func Test_Entanglement_Parameters(t *testing.T) {
+	for _, params := range [][3]int{{0, 5, 5}, {1, 5, 5}, {3, 5, 4}, {4, 2, 5}, {5, 4, 5}} {
+		_, err := entangler.NewEntangler(params[0], params[1], params[2], []bool{})
+		require.ErrorIs(t, err, entangler.ErrInvalidParameters, "alpha=%d s=%d p=%d", params[0], params[1], params[2])
+
+		_, err = entangler.NewLattice(params[0], params[1], params[2], 10, nil, 1)
+		require.ErrorIs(t, err, entangler.ErrInvalidParameters)
+	}
+
+	_, err := entangler.NewEntangler(3, 5, 5, []bool{true})
+	require.ErrorIs(t, err, entangler.ErrInvalidParameters)
+
+	for _, params := range [][3]int{{1, 1, 0}, {3, 5, 5}, {4, 3, 5}, {5, 5, 5}} {
+		_, err := entangler.NewEntangler(params[0], params[1], params[2], []bool{})
+		require.NoError(t, err)
+	}
+}
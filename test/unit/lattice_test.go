@@ -2,12 +2,16 @@ package test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"ipfs-alpha-entanglement-code/entangler"
 	"ipfs-alpha-entanglement-code/util"
 	"math/rand"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"golang.org/x/xerrors"
@@ -21,33 +25,35 @@ type SimpleGetter struct {
 	ParityFilter []map[int]struct{}
 }
 
-func (getter *SimpleGetter) GetData(index int) (data []byte, err error) {
-	if index < 1 || index > len(getter.Data) {
+// GetData returns the data block with the given 0-based index
+func (getter *SimpleGetter) GetData(ctx context.Context, index int) (data []byte, err error) {
+	if index < 0 || index >= len(getter.Data) {
 		err = xerrors.Errorf("invalid index")
 	} else {
-		if _, ok := getter.DataFilter[index-1]; ok {
+		if _, ok := getter.DataFilter[index]; ok {
 			err = xerrors.Errorf("no data exists")
 		} else {
-			data = getter.Data[index-1]
+			data = getter.Data[index]
 		}
 	}
 	return data, err
 }
 
-func (getter *SimpleGetter) GetParity(index int, strand int) (parity []byte, err error) {
-	if index < 1 || index > len(getter.Data) {
+// GetParity returns the parity block with the given 0-based index on the given strand
+func (getter *SimpleGetter) GetParity(ctx context.Context, index int, strand int) (parity []byte, err error) {
+	if index < 0 || index >= len(getter.Data) {
 		err = xerrors.Errorf("invalid index")
 		return
 	}
-	if strand < 0 || strand > len(getter.Parity) {
+	if strand < 0 || strand >= len(getter.Parity) {
 		err = xerrors.Errorf("invalid strand")
 		return
 	}
 
-	if _, ok := getter.ParityFilter[strand][index-1]; ok {
+	if _, ok := getter.ParityFilter[strand][index]; ok {
 		err = xerrors.Errorf("no parity exists")
 	} else {
-		parity = getter.Parity[strand][index-1]
+		parity = getter.Parity[strand][index]
 	}
 
 	return parity, err
@@ -55,6 +61,14 @@ func (getter *SimpleGetter) GetParity(index int, strand int) (parity []byte, err
 
 var alpha, s, p int = 3, 5, 5
 var getTest = func(chunkNum int, chunkSize int, missingIndexes map[int]struct{}, missingParities []map[int]struct{}, failureExpected bool) func(*testing.T) {
+	return getAlphaTest(alpha, chunkNum, chunkSize, missingIndexes, missingParities, failureExpected)
+}
+
+var getAlphaTest = func(alpha int, chunkNum int, chunkSize int, missingIndexes map[int]struct{}, missingParities []map[int]struct{}, failureExpected bool) func(*testing.T) {
+	return getRecoveryTest(entangler.SequentialRecovery, alpha, chunkNum, chunkSize, missingIndexes, missingParities, failureExpected)
+}
+
+var getRecoveryTest = func(mode entangler.RecoveryMode, alpha int, chunkNum int, chunkSize int, missingIndexes map[int]struct{}, missingParities []map[int]struct{}, failureExpected bool) func(*testing.T) {
 	return func(t *testing.T) {
 		// generate data
 		data := make([][]byte, 0)
@@ -64,14 +78,15 @@ var getTest = func(chunkNum int, chunkSize int, missingIndexes map[int]struct{},
 		}
 
 		// generate parity
-		tangler := entangler.NewEntangler(alpha, s, p)
+		tangler, err := entangler.NewEntangler(alpha, s, p, []bool{})
+		require.NoError(t, err)
 		dataChan := make(chan []byte, len(data))
 		for _, chunk := range data {
 			dataChan <- chunk
 		}
 		close(dataChan)
 		parityChan := make(chan entangler.EntangledBlock, alpha*len(data))
-		err := tangler.Entangle(dataChan, parityChan)
+		err = tangler.Entangle(dataChan, parityChan)
 		require.NoError(t, err)
 
 		parities := make([][][]byte, alpha)
@@ -94,11 +109,19 @@ var getTest = func(chunkNum int, chunkSize int, missingIndexes map[int]struct{},
 			ParityFilter: missingParities}
 		util.LogPrintf(util.Green("Finish creating getter"))
 
-		lattice := entangler.NewLattice(alpha, s, p, chunkNum, &getter, 1)
+		// allow the recovery to go as deep as the whole lattice,
+		// unless the hybrid recovery should switch to parallel early
+		depth := uint(chunkNum * (alpha + 1))
+		if mode == entangler.HybridRecovery {
+			depth = 2
+		}
+		lattice, err := entangler.NewLattice(alpha, s, p, chunkNum, &getter, depth)
+		require.NoError(t, err)
+		lattice.SetRecoveryMode(mode, 8)
 		lattice.Init()
 		util.LogPrintf(util.Green("Finish generating lattice"))
 
-		myData, err := lattice.GetAllData()
+		myData, err := lattice.GetAllData(context.Background())
 		if !failureExpected {
 			require.NoError(t, err)
 		} else {
@@ -279,3 +302,522 @@ func Test_Lattice_Fail_Recovery(t *testing.T) {
 	}
 	t.Run("middle", missedFail(5, 32))
 }
+
+func Test_Lattice_Alpha_Strands(t *testing.T) {
+	EnableLog(true)
+	missedNM := func(alpha int, chunkNum int, chunkSize int, missNum int) func(*testing.T) {
+		missedIndexes := map[int]struct{}{}
+		missedParity := map[int]struct{}{}
+		for _, r := range rand.Perm(chunkNum)[:missNum] {
+			missedIndexes[r] = struct{}{}
+			missedParity[r] = struct{}{}
+		}
+		// lose the forward parities on the first three strands so that the extra strands are exercised
+		parityMiss := make([]map[int]struct{}, alpha)
+		for k := 0; k < alpha; k++ {
+			parityMiss[k] = map[int]struct{}{}
+			if k < 3 {
+				parityMiss[k] = missedParity
+			}
+		}
+		return getAlphaTest(alpha, chunkNum, chunkSize, missedIndexes, parityMiss, false)
+	}
+	t.Run("Alpha-4", missedNM(4, 50, 32, 3))
+	t.Run("Alpha-5", missedNM(5, 50, 32, 3))
+	t.Run("Alpha-5-Random", func(t *testing.T) {
+		parityMiss := make([]map[int]struct{}, 5)
+		for k := 0; k < 5; k++ {
+			parityMiss[k] = map[int]struct{}{}
+			for _, r := range rand.Perm(50)[:10] {
+				parityMiss[k][r] = struct{}{}
+			}
+		}
+		missedIndexes := map[int]struct{}{}
+		for _, r := range rand.Perm(50)[:20] {
+			missedIndexes[r] = struct{}{}
+		}
+		getAlphaTest(5, 50, 32, missedIndexes, parityMiss, false)(t)
+	})
+}
+
+func Test_Lattice_Recovery_Modes(t *testing.T) {
+	EnableLog(true)
+	for _, mode := range []entangler.RecoveryMode{entangler.SequentialRecovery, entangler.ParallelRecovery, entangler.HybridRecovery} {
+		t.Run(mode.String(), func(t *testing.T) {
+			parityMiss := make([]map[int]struct{}, alpha)
+			for k := 0; k < alpha; k++ {
+				parityMiss[k] = map[int]struct{}{3: {}, 11: {}, 17: {}}
+			}
+			t.Run("Single", getRecoveryTest(mode, alpha, 25, 32, map[int]struct{}{12: {}}, []map[int]struct{}{}, false))
+			t.Run("Two-Step", getRecoveryTest(mode, alpha, 25, 32, map[int]struct{}{3: {}, 11: {}, 17: {}}, parityMiss, false))
+			t.Run("Whole", func(t *testing.T) {
+				missedIndexes := map[int]struct{}{}
+				for i := 1; i < 10; i++ {
+					missedIndexes[i] = struct{}{}
+				}
+				getRecoveryTest(mode, alpha, 10, 32, missedIndexes, []map[int]struct{}{}, false)(t)
+			})
+			t.Run("Fail", func(t *testing.T) {
+				parityMiss := make([]map[int]struct{}, alpha)
+				for k := 0; k < alpha; k++ {
+					parityMiss[k] = map[int]struct{}{0: {}}
+				}
+				getRecoveryTest(mode, alpha, 5, 32, map[int]struct{}{0: {}}, parityMiss, true)(t)
+			})
+		})
+	}
+}
+
+// CountingGetter records the number of calls, the calls per data block and the maximum number of
+// concurrent calls to the wrapped getter
+type CountingGetter struct {
+	SimpleGetter
+	current int32
+	Max     int32
+	Calls   int32
+
+	lock      sync.Mutex
+	dataCalls map[int]int
+}
+
+// DataCalls returns the number of times the data block of the given index was requested
+func (getter *CountingGetter) DataCalls(index int) int {
+	getter.lock.Lock()
+	defer getter.lock.Unlock()
+	return getter.dataCalls[index]
+}
+
+func (getter *CountingGetter) track() func() {
+	atomic.AddInt32(&getter.Calls, 1)
+	current := atomic.AddInt32(&getter.current, 1)
+	for {
+		max := atomic.LoadInt32(&getter.Max)
+		if current <= max || atomic.CompareAndSwapInt32(&getter.Max, max, current) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return func() { atomic.AddInt32(&getter.current, -1) }
+}
+
+func (getter *CountingGetter) GetData(ctx context.Context, index int) ([]byte, error) {
+	getter.lock.Lock()
+	if getter.dataCalls == nil {
+		getter.dataCalls = make(map[int]int)
+	}
+	getter.dataCalls[index]++
+	getter.lock.Unlock()
+	defer getter.track()()
+	return getter.SimpleGetter.GetData(ctx, index)
+}
+
+func (getter *CountingGetter) GetParity(ctx context.Context, index int, strand int) ([]byte, error) {
+	defer getter.track()()
+	return getter.SimpleGetter.GetParity(ctx, index, strand)
+}
+
+func Test_Lattice_Parallel_Recovery(t *testing.T) {
+	EnableLog(true)
+	chunkNum := 25
+	newLattice := func() (*entangler.Lattice, *CountingGetter, [][]byte) {
+		data := make([][]byte, chunkNum)
+		dataChan := make(chan []byte, chunkNum)
+		for i := range data {
+			data[i] = []byte(strings.Repeat(fmt.Sprintf("%d", i%10), 32))
+			dataChan <- data[i]
+		}
+		close(dataChan)
+		parityChan := make(chan entangler.EntangledBlock, alpha*chunkNum)
+		tangler, err := entangler.NewEntangler(alpha, s, p, []bool{})
+		require.NoError(t, err)
+		require.NoError(t, tangler.Entangle(dataChan, parityChan))
+
+		parities := make([][][]byte, alpha)
+		parityMiss := make([]map[int]struct{}, alpha)
+		for k := 0; k < alpha; k++ {
+			parities[k] = make([][]byte, chunkNum)
+			parityMiss[k] = map[int]struct{}{}
+		}
+		for parity := range parityChan {
+			parities[parity.Strand][parity.LeftBlockIndex-1] = parity.Data
+		}
+
+		missedIndexes := map[int]struct{}{}
+		for i := 1; i < chunkNum; i++ {
+			missedIndexes[i] = struct{}{}
+		}
+		getter := &CountingGetter{SimpleGetter: SimpleGetter{
+			Data:         data,
+			DataFilter:   missedIndexes,
+			Parity:       parities,
+			ParityFilter: parityMiss}}
+		lattice, err := entangler.NewLattice(alpha, s, p, chunkNum, getter, 1)
+		require.NoError(t, err)
+		lattice.Init()
+		return lattice, getter, data
+	}
+
+	t.Run("Bounded-Fan-Out", func(t *testing.T) {
+		lattice, getter, data := newLattice()
+		lattice.SetRecoveryMode(entangler.ParallelRecovery, 2)
+		for i := 1; i <= chunkNum; i++ {
+			chunk, _, err := lattice.GetChunk(context.Background(), i)
+			require.NoError(t, err)
+			require.Equal(t, data[i-1], chunk)
+		}
+		// the caller plus the spawned goroutines
+		require.LessOrEqual(t, getter.Max, int32(3))
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		lattice, _, _ := newLattice()
+		lattice.SetRecoveryMode(entangler.HybridRecovery, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := lattice.GetChunk(ctx, chunkNum)
+		require.ErrorContains(t, err, context.Canceled.Error())
+	})
+
+	t.Run("Hybrid-Switch", func(t *testing.T) {
+		// the switch depth of 1 only allows the sequential recovery to download the block itself
+		lattice, getter, data := newLattice()
+		lattice.SetRecoveryMode(entangler.SequentialRecovery, 8)
+		_, _, err := lattice.GetChunk(context.Background(), chunkNum)
+		require.Error(t, err)
+		require.Equal(t, int32(1), getter.Max)
+
+		// the hybrid recovery repairs the block in parallel from there, without restarting from it
+		lattice, getter, data = newLattice()
+		lattice.SetRecoveryMode(entangler.HybridRecovery, 8)
+		chunk, _, err := lattice.GetChunk(context.Background(), chunkNum)
+		require.NoError(t, err)
+		require.Equal(t, data[chunkNum-1], chunk)
+		require.Greater(t, getter.Max, int32(1))
+		require.Equal(t, 1, getter.DataCalls(chunkNum-1))
+	})
+
+	t.Run("Depth-Stays-Sequential", func(t *testing.T) {
+		lattice, _, _ := newLattice()
+		lattice.SetRecoveryMode(entangler.ParallelRecovery, 0)
+		_, _, err := lattice.GetChunkDepth(context.Background(), chunkNum, 1)
+		require.Error(t, err)
+	})
+}
+
+func Test_Lattice_Repair_Planner(t *testing.T) {
+	EnableLog(true)
+	chunkNum := 25
+	newLattice := func(missedIndexes map[int]struct{}, parityMiss []map[int]struct{}) (*entangler.Lattice, *CountingGetter, [][]byte) {
+		data := make([][]byte, chunkNum)
+		dataChan := make(chan []byte, chunkNum)
+		for i := range data {
+			data[i] = []byte(strings.Repeat(fmt.Sprintf("%d", i%10), 32))
+			dataChan <- data[i]
+		}
+		close(dataChan)
+		parityChan := make(chan entangler.EntangledBlock, alpha*chunkNum)
+		tangler, err := entangler.NewEntangler(alpha, s, p, []bool{})
+		require.NoError(t, err)
+		require.NoError(t, tangler.Entangle(dataChan, parityChan))
+
+		parities := make([][][]byte, alpha)
+		for k := 0; k < alpha; k++ {
+			parities[k] = make([][]byte, chunkNum)
+		}
+		for parity := range parityChan {
+			parities[parity.Strand][parity.LeftBlockIndex-1] = parity.Data
+		}
+		for len(parityMiss) < alpha {
+			parityMiss = append(parityMiss, map[int]struct{}{})
+		}
+
+		getter := &CountingGetter{SimpleGetter: SimpleGetter{
+			Data:         data,
+			DataFilter:   missedIndexes,
+			Parity:       parities,
+			ParityFilter: parityMiss}}
+		lattice, err := entangler.NewLattice(alpha, s, p, chunkNum, getter, 1)
+		require.NoError(t, err)
+		lattice.Init()
+		return lattice, getter, data
+	}
+	// missingRefs converts the 0-based filters of the getter to lattice references
+	missingRefs := func(missedIndexes map[int]struct{}, parityMiss []map[int]struct{}) []entangler.BlockRef {
+		var refs []entangler.BlockRef
+		for index := range missedIndexes {
+			refs = append(refs, entangler.BlockRef{Index: index + 1})
+		}
+		for k, missed := range parityMiss {
+			for index := range missed {
+				refs = append(refs, entangler.BlockRef{Index: index + 1, IsParity: true, Strand: k})
+			}
+		}
+		return refs
+	}
+
+	t.Run("Single", func(t *testing.T) {
+		missedIndexes := map[int]struct{}{12: {}}
+		lattice, getter, data := newLattice(missedIndexes, nil)
+
+		plan := lattice.PlanRepair(nil, missingRefs(missedIndexes, nil))
+		require.Equal(t, 2, plan.Cost())
+		require.Len(t, plan.Steps, 1)
+		require.Equal(t, entangler.BlockRef{Index: 13}, plan.Steps[0].Target)
+		require.Empty(t, plan.Unrecoverable)
+
+		failed, err := lattice.ExecutePlan(context.Background(), plan)
+		require.NoError(t, err)
+		require.Empty(t, failed)
+		chunk, repaired, err := lattice.GetChunkDepth(context.Background(), 13, 1)
+		require.NoError(t, err)
+		require.True(t, repaired)
+		require.Equal(t, data[12], chunk)
+		require.Equal(t, int32(2), atomic.LoadInt32(&getter.Calls))
+	})
+
+	t.Run("Cheapest-Pair", func(t *testing.T) {
+		// the horizontal parities of the block are lost, another strand is as cheap
+		missedIndexes := map[int]struct{}{12: {}}
+		parityMiss := []map[int]struct{}{{11: {}, 12: {}}}
+		lattice, _, data := newLattice(missedIndexes, parityMiss)
+
+		plan := lattice.PlanRepair(nil, missingRefs(missedIndexes, parityMiss))
+		require.Equal(t, 2, plan.Cost())
+		for _, ref := range plan.Fetch {
+			require.False(t, ref.IsParity && ref.Strand == 0 && (ref.Index == 12 || ref.Index == 13))
+		}
+
+		_, err := lattice.ExecutePlan(context.Background(), plan)
+		require.NoError(t, err)
+		chunk, _, err := lattice.GetChunkDepth(context.Background(), 13, 1)
+		require.NoError(t, err)
+		require.Equal(t, data[12], chunk)
+	})
+
+	t.Run("Two-Step", func(t *testing.T) {
+		missedIndexes := map[int]struct{}{3: {}, 11: {}, 17: {}}
+		parityMiss := make([]map[int]struct{}, alpha)
+		for k := 0; k < alpha; k++ {
+			parityMiss[k] = map[int]struct{}{3: {}, 11: {}, 17: {}}
+		}
+		lattice, getter, data := newLattice(missedIndexes, parityMiss)
+
+		plan := lattice.PlanRepair(nil, missingRefs(missedIndexes, parityMiss))
+		require.Empty(t, plan.Unrecoverable)
+		require.Greater(t, len(plan.Steps), len(missedIndexes))
+
+		_, err := lattice.ExecutePlan(context.Background(), plan)
+		require.NoError(t, err)
+		require.Equal(t, int32(plan.Cost()), atomic.LoadInt32(&getter.Calls))
+		for index := range missedIndexes {
+			chunk, _, err := lattice.GetChunkDepth(context.Background(), index+1, 1)
+			require.NoError(t, err)
+			require.Equal(t, data[index], chunk)
+		}
+	})
+
+	t.Run("Unknown-Failures", func(t *testing.T) {
+		// the planner is only told about the data block, the failed downloads are planned around
+		missedIndexes := map[int]struct{}{12: {}}
+		parityMiss := []map[int]struct{}{{11: {}, 12: {}}, {12: {}}}
+		lattice, _, data := newLattice(missedIndexes, parityMiss)
+
+		plan, err := lattice.RecoverWithPlan(context.Background(), nil, missingRefs(missedIndexes, nil))
+		require.NoError(t, err)
+		require.Empty(t, plan.Unrecoverable)
+		chunk, _, err := lattice.GetChunkDepth(context.Background(), 13, 1)
+		require.NoError(t, err)
+		require.Equal(t, data[12], chunk)
+	})
+
+	t.Run("Unrecoverable", func(t *testing.T) {
+		// all the data and parities are lost, nothing can be recovered
+		missedIndexes := map[int]struct{}{}
+		parityMiss := make([]map[int]struct{}, alpha)
+		for k := 0; k < alpha; k++ {
+			parityMiss[k] = map[int]struct{}{}
+		}
+		for i := 0; i < chunkNum; i++ {
+			missedIndexes[i] = struct{}{}
+			for k := 0; k < alpha; k++ {
+				parityMiss[k][i] = struct{}{}
+			}
+		}
+		lattice, getter, _ := newLattice(missedIndexes, parityMiss)
+
+		plan := lattice.PlanRepair([]entangler.BlockRef{{Index: 1}}, missingRefs(missedIndexes, parityMiss))
+		require.Equal(t, []entangler.BlockRef{{Index: 1}}, plan.Unrecoverable)
+		_, err := lattice.RecoverWithPlan(context.Background(), []entangler.BlockRef{{Index: 1}}, missingRefs(missedIndexes, parityMiss))
+		require.Error(t, err)
+		require.Equal(t, int32(0), atomic.LoadInt32(&getter.Calls))
+	})
+}
+
+func Test_Lattice_Exact_Sizes(t *testing.T) {
+	EnableLog(true)
+	chunkNum := 25
+	// blocks of various sizes, starting and ending with zeros
+	data := make([][]byte, chunkNum)
+	sizes := make([]int, chunkNum)
+	dataChan := make(chan []byte, chunkNum)
+	for i := range data {
+		data[i] = make([]byte, 16+i)
+		rand.Read(data[i][2 : len(data[i])-2])
+		sizes[i] = len(data[i])
+		dataChan <- data[i]
+	}
+	close(dataChan)
+	parityChan := make(chan entangler.EntangledBlock, alpha*chunkNum)
+	tangler, err := entangler.NewEntangler(alpha, s, p, []bool{})
+	require.NoError(t, err)
+	require.NoError(t, tangler.Entangle(dataChan, parityChan))
+
+	parities := make([][][]byte, alpha)
+	for k := 0; k < alpha; k++ {
+		parities[k] = make([][]byte, chunkNum)
+	}
+	for parity := range parityChan {
+		// parities are stored padded to the largest block
+		padded := make([]byte, 16+chunkNum)
+		copy(padded, parity.Data)
+		parities[parity.Strand][parity.LeftBlockIndex-1] = padded
+	}
+
+	missedIndexes := map[int]struct{}{0: {}, 3: {}, 12: {}, 24: {}}
+	getter := SimpleGetter{
+		Data:         data,
+		DataFilter:   missedIndexes,
+		Parity:       parities,
+		ParityFilter: []map[int]struct{}{{}, {}, {}}}
+
+	lattice, err := entangler.NewLattice(alpha, s, p, chunkNum, &getter, 2)
+	require.NoError(t, err)
+	lattice.Init()
+	require.Error(t, lattice.SetDataSizes(sizes[1:]))
+	require.NoError(t, lattice.SetDataSizes(sizes))
+
+	for index := range missedIndexes {
+		chunk, repaired, err := lattice.GetChunk(context.Background(), index+1)
+		require.NoError(t, err)
+		require.True(t, repaired)
+		require.Equal(t, data[index], chunk)
+	}
+}
+
+// VerifyingGetter checks the recovered data blocks against the original data
+type VerifyingGetter struct {
+	SimpleGetter
+	Verified  int32
+	Corrupted int32
+	Padded    int32 // data verified before being truncated to the size of their block
+}
+
+func (getter *VerifyingGetter) VerifyData(ctx context.Context, index int, data []byte, exact bool) error {
+	if !exact {
+		atomic.AddInt32(&getter.Padded, 1)
+		if len(data) > len(getter.Data[index]) {
+			data = data[:len(getter.Data[index])]
+		}
+	}
+	if !bytes.Equal(data, getter.Data[index]) {
+		atomic.AddInt32(&getter.Corrupted, 1)
+		return xerrors.Errorf("data block %d is corrupted", index)
+	}
+	atomic.AddInt32(&getter.Verified, 1)
+	return nil
+}
+
+func Test_Lattice_Verification(t *testing.T) {
+	EnableLog(true)
+	chunkNum := 25
+	newGetter := func() *VerifyingGetter {
+		data := make([][]byte, chunkNum)
+		dataChan := make(chan []byte, chunkNum)
+		for i := range data {
+			data[i] = []byte(strings.Repeat(fmt.Sprintf("%d", i%10), 32))
+			dataChan <- data[i]
+		}
+		close(dataChan)
+		parityChan := make(chan entangler.EntangledBlock, alpha*chunkNum)
+		tangler, err := entangler.NewEntangler(alpha, s, p, []bool{})
+		require.NoError(t, err)
+		require.NoError(t, tangler.Entangle(dataChan, parityChan))
+
+		parities := make([][][]byte, alpha)
+		for k := 0; k < alpha; k++ {
+			parities[k] = make([][]byte, chunkNum)
+		}
+		for parity := range parityChan {
+			parities[parity.Strand][parity.LeftBlockIndex-1] = parity.Data
+		}
+
+		// the horizontal parity right of data block 13 is corrupted
+		parities[0][12] = append([]byte{}, parities[0][12]...)
+		parities[0][12][0] ^= 0xff
+
+		return &VerifyingGetter{SimpleGetter: SimpleGetter{
+			Data:         data,
+			DataFilter:   map[int]struct{}{12: {}},
+			Parity:       parities,
+			ParityFilter: []map[int]struct{}{{}, {}, {}}}}
+	}
+
+	for _, mode := range []entangler.RecoveryMode{entangler.SequentialRecovery, entangler.ParallelRecovery} {
+		t.Run(mode.String(), func(t *testing.T) {
+			getter := newGetter()
+			lattice, err := entangler.NewLattice(alpha, s, p, chunkNum, getter, 2)
+			require.NoError(t, err)
+			lattice.SetRecoveryMode(mode, 8)
+			lattice.Init()
+
+			chunk, repaired, err := lattice.GetChunk(context.Background(), 13)
+			require.NoError(t, err)
+			require.True(t, repaired)
+			require.Equal(t, getter.Data[12], chunk)
+			require.Equal(t, int32(1), atomic.LoadInt32(&getter.Verified))
+		})
+	}
+
+	t.Run("ExactSize", func(t *testing.T) {
+		// the data truncated to the known sizes are verified as they are
+		getter := newGetter()
+		lattice, err := entangler.NewLattice(alpha, s, p, chunkNum, getter, 2)
+		require.NoError(t, err)
+		lattice.Init()
+		sizes := make([]int, chunkNum)
+		for i := range sizes {
+			sizes[i] = len(getter.Data[i])
+		}
+		require.NoError(t, lattice.SetDataSizes(sizes))
+
+		chunk, _, err := lattice.GetChunk(context.Background(), 13)
+		require.NoError(t, err)
+		require.Equal(t, getter.Data[12], chunk)
+		require.Equal(t, int32(1), atomic.LoadInt32(&getter.Verified))
+		require.Equal(t, int32(0), atomic.LoadInt32(&getter.Padded))
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		getter := newGetter()
+		lattice, err := entangler.NewLattice(alpha, s, p, chunkNum, getter, 2)
+		require.NoError(t, err)
+		lattice.Init()
+
+		// the horizontal pair is tried first and rejected
+		_, _, err = lattice.GetChunk(context.Background(), 13)
+		require.NoError(t, err)
+		require.Equal(t, int32(1), atomic.LoadInt32(&getter.Corrupted))
+	})
+
+	t.Run("Unverified", func(t *testing.T) {
+		// without verification, the corrupted parity is accepted
+		getter := newGetter()
+		lattice, err := entangler.NewLattice(alpha, s, p, chunkNum, &getter.SimpleGetter, 2)
+		require.NoError(t, err)
+		lattice.Init()
+
+		chunk, _, err := lattice.GetChunk(context.Background(), 13)
+		require.NoError(t, err)
+		require.NotEqual(t, getter.Data[12], chunk)
+	})
+}
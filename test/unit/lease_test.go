@@ -0,0 +1,191 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ipfs-alpha-entanglement-code/lease"
+
+	"github.com/stretchr/testify/require"
+)
+
+// leaseNetwork connects the lease tables of nodes in memory, where a node can be stopped
+type leaseNetwork struct {
+	lock     sync.Mutex
+	tables   map[string]*lease.Table
+	electors map[string]*lease.Elector
+	down     map[string]bool
+}
+
+type leaseTransport struct {
+	network *leaseNetwork
+	from    string
+}
+
+func (n *leaseNetwork) reachable(from string, to string) (*lease.Table, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.down[from] || n.down[to] {
+		return nil, errors.New("unreachable")
+	}
+	return n.tables[to], nil
+}
+
+func (n *leaseNetwork) stop(address string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.down[address] = true
+}
+
+func (n *leaseNetwork) start(address string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.down, address)
+}
+
+// holder returns the holder of the lease of the resource granted by the node, empty if none
+func (n *leaseNetwork) holder(address string, resource string) string {
+	for _, granted := range n.tables[address].Leases() {
+		if granted.Resource == resource {
+			return granted.Holder
+		}
+	}
+	return ""
+}
+
+func (t *leaseTransport) Request(ctx context.Context, address string, l *lease.Lease) (*lease.Grant, error) {
+	table, err := t.network.reachable(t.from, address)
+	if err != nil {
+		return nil, err
+	}
+	return table.Grant(l, time.Now()), nil
+}
+
+func (t *leaseTransport) Release(ctx context.Context, address string, l *lease.Lease) error {
+	table, err := t.network.reachable(t.from, address)
+	if err != nil {
+		return err
+	}
+	table.Release(l)
+	return nil
+}
+
+func newLeaseNetwork(duration time.Duration, addresses ...string) *leaseNetwork {
+	network := &leaseNetwork{tables: make(map[string]*lease.Table), electors: make(map[string]*lease.Elector), down: make(map[string]bool)}
+	for _, address := range addresses {
+		network.tables[address] = lease.NewTable()
+		network.electors[address] = lease.NewElector(address, network.tables[address], &leaseTransport{network, address}, duration)
+	}
+	return network
+}
+
+func Test_Lease_Election(t *testing.T) {
+	ctx := context.Background()
+	group := []string{"a:7070", "b:7070", "c:7070"}
+	network := newLeaseNetwork(time.Minute, group...)
+	a, b := network.electors["a:7070"], network.electors["b:7070"]
+
+	// a single node of the group holds the lease
+	held, err := a.Acquire(ctx, "collab/file", group, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), held.Term)
+	require.True(t, a.Holds("collab/file"))
+	_, err = a.Acquire(ctx, "collab/file", group, nil, nil)
+	require.ErrorIs(t, err, lease.ErrHeld)
+	_, err = b.Acquire(ctx, "collab/file", group, nil, nil)
+	require.ErrorIs(t, err, lease.ErrNoQuorum)
+	require.False(t, b.Holds("collab/file"))
+
+	// other resources are elected on their own
+	_, err = b.Acquire(ctx, "strand/file/1", group, nil, nil)
+	require.NoError(t, err)
+
+	// once released, the lease is granted to another node with a later term
+	a.Release("collab/file")
+	require.False(t, a.Holds("collab/file"))
+	require.Eventually(t, func() bool {
+		for _, table := range network.tables {
+			for _, granted := range table.Leases() {
+				if granted.Resource == "collab/file" {
+					return false
+				}
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+	held, err = b.Acquire(ctx, "collab/file", group, nil, nil)
+	require.NoError(t, err)
+	require.Greater(t, held.Term, uint64(1))
+
+	// without a majority of the group reachable, no node is elected
+	network.stop("b:7070")
+	network.stop("c:7070")
+	_, err = a.Acquire(ctx, "collab/other", group, nil, nil)
+	require.ErrorIs(t, err, lease.ErrNoQuorum)
+}
+
+func Test_Lease_Failover(t *testing.T) {
+	ctx := context.Background()
+	group := []string{"a:7070", "b:7070", "c:7070"}
+	duration := 100 * time.Millisecond
+	network := newLeaseNetwork(duration, group...)
+	a, b := network.electors["a:7070"], network.electors["b:7070"]
+
+	var lost atomic.Bool
+	_, err := a.Acquire(ctx, "collab/file", group, []byte(`{"collab":{"FileCID":"file"}}`), func() { lost.Store(true) })
+	require.NoError(t, err)
+
+	// the lease is kept as long as it is renewed
+	for i := 0; i < 3; i++ {
+		time.Sleep(duration / 2)
+		a.Renew(ctx)
+	}
+	require.True(t, a.Holds("collab/file"))
+	require.Empty(t, network.tables["b:7070"].Expire(time.Now(), 0))
+
+	// the holder fails: the lease expires on the other nodes, which find its task to take over
+	network.stop("a:7070")
+	time.Sleep(duration + duration/2)
+	expired := network.tables["b:7070"].Expire(time.Now(), 0)
+	require.Len(t, expired, 1)
+	require.Equal(t, "a:7070", expired[0].Holder)
+	require.JSONEq(t, `{"collab":{"FileCID":"file"}}`, string(expired[0].Task))
+
+	held, err := b.Acquire(ctx, "collab/file", group, expired[0].Task, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), held.Term)
+
+	// the failed holder cannot renew its lease, and learns it lost it
+	a.Renew(ctx)
+	require.True(t, lost.Load())
+	require.False(t, a.Holds("collab/file"))
+}
+
+func Test_Lease_Release_Retry(t *testing.T) {
+	ctx := context.Background()
+	group := []string{"a:7070", "b:7070", "c:7070"}
+	duration := 200 * time.Millisecond
+	network := newLeaseNetwork(duration, group...)
+	a := network.electors["a:7070"]
+
+	_, err := a.Acquire(ctx, "collab/file", group, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "a:7070", network.holder("c:7070", "collab/file"))
+
+	// a node unreachable when the lease is released is asked again once it is back
+	network.stop("c:7070")
+	a.Release("collab/file")
+	require.Eventually(t, func() bool {
+		return network.holder("b:7070", "collab/file") == ""
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, "a:7070", network.holder("c:7070", "collab/file"))
+
+	network.start("c:7070")
+	require.Eventually(t, func() bool {
+		return network.holder("c:7070", "collab/file") == ""
+	}, duration, 5*time.Millisecond)
+}
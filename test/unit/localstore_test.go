@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ipfs-alpha-entanglement-code/client"
+	"ipfs-alpha-entanglement-code/entangler"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	localstore "ipfs-alpha-entanglement-code/local-store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Local_Store(t *testing.T) {
+	EnableLog(true)
+	getTest := func(opts ipfsconnector.AddOptions, size int) func(*testing.T) {
+		return func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := localstore.CreateStore(filepath.Join(dir, "store"))
+			require.NoError(t, err)
+			require.NoError(t, store.SetAddOptions(opts))
+
+			data := make([]byte, size)
+			rand.Read(data)
+			path := filepath.Join(dir, "file")
+			require.NoError(t, os.WriteFile(path, data, 0600))
+
+			rootCID, metaCID, err := client.UploadLocal(context.Background(), store, path, 3, 5, 5)
+			require.NoError(t, err)
+			option := client.DownloadOption{MetaCID: metaCID, UploadRecoverData: true}
+
+			downloaded, _, err := client.DownloadLocal(context.Background(), store, rootCID, option, 1)
+			require.NoError(t, err)
+			require.Equal(t, data, downloaded)
+
+			// lose a third of the blocks below the root
+			root, _, _, err := store.GetMerkleTree(rootCID)
+			require.NoError(t, err)
+			nodes := root.GetFlattenedTree(5, 5, true)
+			var lost []string
+			for i, node := range nodes {
+				if i%3 == 1 && node.CID != rootCID {
+					require.NoError(t, store.RemoveBlock(node.CID))
+					lost = append(lost, node.CID)
+				}
+			}
+			_, err = store.GetFileToMem(rootCID)
+			require.Error(t, err)
+
+			for _, mode := range []entangler.RecoveryMode{entangler.SequentialRecovery, entangler.ParallelRecovery} {
+				option.RecoveryMode = mode
+				downloaded, _, err = client.DownloadLocal(context.Background(), store, rootCID, option, 5)
+				require.NoError(t, err)
+				require.Equal(t, data, downloaded)
+			}
+			for _, blockCID := range lost {
+				require.True(t, store.HasBlock(blockCID))
+			}
+
+			// regenerate a lost strand
+			raw, err := store.GetFileToMem(metaCID)
+			require.NoError(t, err)
+			metaData, err := client.ParseMetadata(raw)
+			require.NoError(t, err)
+			parity, err := store.GetParity(metaData.TreeCIDs[1], 0)
+			require.NoError(t, err)
+			require.Len(t, parity, metaData.ParityBlockSize)
+			for i := 0; i < metaData.NumBlocks; i++ {
+				require.NoError(t, store.RemoveParity(metaData.TreeCIDs[1], i))
+			}
+
+			require.NoError(t, client.RepairStrandLocal(context.Background(), store, metaCID, 1))
+			repaired, err := store.GetParity(metaData.TreeCIDs[1], 0)
+			require.NoError(t, err)
+			require.Equal(t, parity, repaired)
+		}
+	}
+
+	t.Run("Default", getTest(ipfsconnector.DefaultAddOptions(), 600000))
+
+	opts := ipfsconnector.DefaultAddOptions()
+	opts.Chunker = "size-1024"
+	t.Run("SmallChunks", getTest(opts, 200*1024+100))
+
+	opts.CidVersion, opts.RawLeaves, opts.Hash = 1, true, "blake2b-256"
+	t.Run("RawLeaves", getTest(opts, 200*1024+100))
+
+	t.Run("SameCIDsAsIPFS", func(t *testing.T) {
+		store, err := localstore.CreateStore(t.TempDir())
+		require.NoError(t, err)
+		// CIDs given by ipfs add with the default options
+		rootCID, err := store.AddFileFromMem([]byte("hello world\n"))
+		require.NoError(t, err)
+		require.Equal(t, "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o", rootCID)
+		rootCID, err = store.AddFileFromMem(nil)
+		require.NoError(t, err)
+		require.Equal(t, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH", rootCID)
+	})
+
+	t.Run("UnsupportedChunker", func(t *testing.T) {
+		store, err := localstore.CreateStore(t.TempDir())
+		require.NoError(t, err)
+		opts := ipfsconnector.DefaultAddOptions()
+		opts.Chunker = "rabin"
+		require.Error(t, store.SetAddOptions(opts))
+	})
+}
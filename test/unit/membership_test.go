@@ -0,0 +1,145 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"ipfs-alpha-entanglement-code/membership"
+
+	"github.com/stretchr/testify/require"
+)
+
+// swimNetwork connects failure detectors in memory, with links that can be cut
+type swimNetwork struct {
+	lock  sync.Mutex
+	nodes map[string]*membership.Detector
+	cut   map[[2]string]bool
+}
+
+type swimTransport struct {
+	network *swimNetwork
+	from    string
+}
+
+func (n *swimNetwork) reachable(from string, to string) (*membership.Detector, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	// a link cut from a node to itself isolates the node
+	if n.cut[[2]string{from, to}] || n.cut[[2]string{to, from}] || n.cut[[2]string{to, to}] || n.cut[[2]string{from, from}] {
+		return nil, errors.New("unreachable")
+	}
+	return n.nodes[to], nil
+}
+
+func (n *swimNetwork) cutLink(from string, to string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.cut[[2]string{from, to}] = true
+}
+
+func (t *swimTransport) Ping(ctx context.Context, address string, msg *membership.Message) (*membership.Message, error) {
+	node, err := t.network.reachable(t.from, address)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandlePing(msg), nil
+}
+
+func (t *swimTransport) PingReq(ctx context.Context, address string, msg *membership.Message) (*membership.Message, error) {
+	node, err := t.network.reachable(t.from, address)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandlePingReq(ctx, msg)
+}
+
+func newSwimNetwork(addresses ...string) *swimNetwork {
+	network := &swimNetwork{nodes: make(map[string]*membership.Detector), cut: make(map[[2]string]bool)}
+	config := membership.DefaultConfig()
+	config.ProbeTimeout = 100 * time.Millisecond
+	for _, address := range addresses {
+		network.nodes[address] = membership.NewDetector(address, "cluster-"+address, config, &swimTransport{network, address})
+	}
+	for _, node := range network.nodes {
+		var seeds []membership.Update
+		for _, address := range addresses {
+			seeds = append(seeds, membership.Update{Address: address})
+		}
+		node.Join(seeds)
+	}
+	return network
+}
+
+// probeRounds runs a protocol period on every node, enough times for each node to probe every other node
+func (n *swimNetwork) probeRounds(rounds int) {
+	for i := 0; i < rounds; i++ {
+		for _, node := range n.nodes {
+			node.Probe(context.Background())
+		}
+	}
+}
+
+func stateOf(t *testing.T, node *membership.Detector, address string) membership.State {
+	state, ok := node.State(address)
+	require.True(t, ok)
+	return state
+}
+
+func Test_Membership_Failure(t *testing.T) {
+	network := newSwimNetwork("a", "b", "c", "d")
+	a, b := network.nodes["a"], network.nodes["b"]
+	require.ElementsMatch(t, []string{"b", "c", "d"}, a.Alive())
+
+	// the cluster IPs are learnt from the messages
+	network.probeRounds(3)
+	require.Equal(t, "cluster-b", a.Members()[0].ClusterIP)
+
+	// a node not answering anyone is suspected, then declared dead once the suspicion times out
+	network.cutLink("c", "c")
+	network.probeRounds(3)
+	require.Equal(t, membership.Suspect, stateOf(t, a, "c"))
+	require.NotContains(t, a.Alive(), "c")
+
+	var changes []membership.Member
+	a.OnChange(func(member membership.Member) { changes = append(changes, member) })
+	a.ExpireSuspects(time.Now().Add(membership.DefaultConfig().SuspicionTimeout + time.Second))
+	require.Equal(t, membership.Dead, stateOf(t, a, "c"))
+	require.Len(t, changes, 1)
+	require.Equal(t, "c", changes[0].Address)
+	a.OnChange(nil)
+
+	// the death is gossiped to the other nodes
+	network.probeRounds(3)
+	require.Equal(t, membership.Dead, stateOf(t, b, "c"))
+	require.ElementsMatch(t, []string{"b", "d"}, a.Alive())
+}
+
+func Test_Membership_IndirectProbe(t *testing.T) {
+	network := newSwimNetwork("a", "b", "c")
+	a := network.nodes["a"]
+
+	// a node reachable through another node is not suspected
+	network.cutLink("a", "c")
+	network.probeRounds(4)
+	require.Equal(t, membership.Alive, stateOf(t, a, "c"))
+}
+
+func Test_Membership_Refute(t *testing.T) {
+	network := newSwimNetwork("a", "b")
+	a, b := network.nodes["a"], network.nodes["b"]
+	network.probeRounds(2)
+	incarnation := a.Members()[0].Incarnation
+
+	// b suspects a while the link is cut, and a refutes the suspicion once b probes it again
+	network.cutLink("a", "b")
+	b.Probe(context.Background())
+	require.Equal(t, membership.Suspect, stateOf(t, b, "a"))
+
+	network.cut = make(map[[2]string]bool)
+	b.Probe(context.Background())
+	require.Equal(t, membership.Alive, stateOf(t, b, "a"))
+	require.Greater(t, b.Members()[0].Incarnation, incarnation)
+}
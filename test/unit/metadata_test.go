@@ -0,0 +1,168 @@
+package test
+
+import (
+	"encoding/json"
+	"ipfs-alpha-entanglement-code/client"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyMetadata is a metadata file written before the schema was versioned
+const legacyMetadata = `{"Alpha":3,"S":5,"P":5,"OriginalFileCID":"QmOriginal",
+"TreeCIDs":["QmStrand0","QmStrand1","QmStrand2"],"NumBlocks":25,"MaxChildren":5,"Leaves":20,"Depth":3,
+"MaxParityChildren":174,"RootCID":"","DataCIDIndexMap":null,"ParityCIDs":null}`
+
+func Test_Metadata_Schema(t *testing.T) {
+	t.Run("LegacyMigration", func(t *testing.T) {
+		metadata, err := client.ParseMetadata([]byte(legacyMetadata))
+		require.NoError(t, err)
+		require.Equal(t, client.MetadataVersion, metadata.Version)
+		require.Equal(t, ipfsconnector.DefaultChunkSize, metadata.ChunkSize)
+		require.Equal(t, ipfsconnector.DefaultParityBlockSize, metadata.ParityBlockSize)
+		require.Equal(t, ipfsconnector.DefaultParityLeafSize, metadata.ParityLeafSize)
+		require.Equal(t, client.NewStrandLayouts(3), metadata.Strands)
+		require.Equal(t, ipfsconnector.DefaultAddOptions(), metadata.AddOptions())
+		// same as the previously hard-coded (25*262158 + 262143) / 262144
+		require.Equal(t, 26, metadata.ParityLeafNum())
+	})
+
+	t.Run("V1Migration", func(t *testing.T) {
+		metadata, err := client.ParseMetadata([]byte(legacyMetadata))
+		require.NoError(t, err)
+		metadata.Version = 1
+		metadata.CidVersion, metadata.Hash, metadata.Chunker = 0, "", ""
+
+		raw, err := json.Marshal(metadata)
+		require.NoError(t, err)
+		parsed, err := client.ParseMetadata(raw)
+		require.NoError(t, err)
+		require.Equal(t, client.MetadataVersion, parsed.Version)
+		require.Equal(t, ipfsconnector.DefaultAddOptions(), parsed.AddOptions())
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		metadata, err := client.ParseMetadata([]byte(legacyMetadata))
+		require.NoError(t, err)
+		metadata.ToolVersion = "test"
+
+		raw, err := json.Marshal(metadata)
+		require.NoError(t, err)
+		parsed, err := client.ParseMetadata(raw)
+		require.NoError(t, err)
+		require.Equal(t, metadata, parsed)
+	})
+
+	t.Run("FutureVersion", func(t *testing.T) {
+		metadata, err := client.ParseMetadata([]byte(legacyMetadata))
+		require.NoError(t, err)
+		metadata.Version = client.MetadataVersion + 1
+
+		raw, err := json.Marshal(metadata)
+		require.NoError(t, err)
+		_, err = client.ParseMetadata(raw)
+		require.Error(t, err)
+	})
+
+	t.Run("Inconsistent", func(t *testing.T) {
+		corruptions := map[string]func(m *client.Metadata){
+			"NumBlocks":     func(m *client.Metadata) { m.NumBlocks = 24 },
+			"Depth":         func(m *client.Metadata) { m.Depth = 4 },
+			"TreeCIDs":      func(m *client.Metadata) { m.TreeCIDs = m.TreeCIDs[:2] },
+			"SGreaterThanP": func(m *client.Metadata) { m.S = 6 },
+			"StrandLayout":  func(m *client.Metadata) { m.Strands[1].Pitch = 2 },
+			"BlockSizes":    func(m *client.Metadata) { m.ParityLeafSize = 0 },
+			"OriginalCID":   func(m *client.Metadata) { m.OriginalFileCID = "" },
+			"ChunkSize":     func(m *client.Metadata) { m.Chunker = "size-1024" },
+			"Hash":          func(m *client.Metadata) { m.Hash = "blake2b-256" },
+		}
+		for name, corrupt := range corruptions {
+			t.Run(name, func(t *testing.T) {
+				metadata, err := client.ParseMetadata([]byte(legacyMetadata))
+				require.NoError(t, err)
+				corrupt(metadata)
+
+				raw, err := json.Marshal(metadata)
+				require.NoError(t, err)
+				_, err = client.ParseMetadata(raw)
+				require.Error(t, err)
+			})
+		}
+	})
+}
+
+func Test_Add_Options(t *testing.T) {
+	chunkSizes := map[string]int{
+		"size-262144":            262144,
+		"size-1024":              1024,
+		"rabin":                  393216,
+		"rabin-1000":             1500,
+		"rabin-100-1000-2000":    2000,
+		"buzhash":                524288,
+		"size-0":                 -1,
+		"size-2000000":           -1,
+		"rabin-300-200-1000":     -1,
+		"rabin-100-200":          -1,
+		"buzhash-1024":           -1,
+		"fixed-1024":             -1,
+		"":                       -1,
+		"size-1024-1024":         -1,
+		"rabin-100-1000-2000000": -1,
+	}
+	for chunker, expected := range chunkSizes {
+		opts := ipfsconnector.DefaultAddOptions()
+		opts.Chunker = chunker
+		size, err := opts.MaxChunkSize()
+		if expected < 0 {
+			require.Error(t, err, chunker)
+			continue
+		}
+		require.NoError(t, err, chunker)
+		require.Equal(t, expected, size, chunker)
+	}
+
+	opts := ipfsconnector.DefaultAddOptions()
+	require.NoError(t, opts.Validate())
+	opts.Hash = "blake2b-256"
+	require.Error(t, opts.Validate())
+	opts.CidVersion = 1
+	require.NoError(t, opts.Validate())
+	opts.RawLeaves = true
+	require.NoError(t, opts.Validate())
+	opts.Hash = "md5"
+	require.Error(t, opts.Validate())
+	opts.Hash, opts.CidVersion = "sha2-256", 2
+	require.Error(t, opts.Validate())
+}
+
+func Test_Block_Verification(t *testing.T) {
+	block := []byte{0, 1, 2, 0, 3, 0, 0}
+	prefix := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: 0x12, MhLength: -1} // sha2-256
+	blockCID, err := prefix.Sum(block)
+	require.NoError(t, err)
+
+	require.NoError(t, ipfsconnector.VerifyBlock(block, blockCID.String()))
+	require.Error(t, ipfsconnector.VerifyBlock(block[:6], blockCID.String()))
+	require.Error(t, ipfsconnector.VerifyBlock(block, "not a cid"))
+
+	// the padding is removed, but not the zeros of the block
+	padded := append(append([]byte{}, block...), make([]byte, 10)...)
+	trimmed, err := ipfsconnector.TrimToCID(padded, blockCID.String())
+	require.NoError(t, err)
+	require.Equal(t, block, trimmed)
+
+	_, err = ipfsconnector.TrimToCID([]byte{4, 5, 0}, blockCID.String())
+	require.Error(t, err)
+
+	// data of a known size are not trimmed
+	verified, err := ipfsconnector.VerifyRecovered(block, blockCID.String(), true)
+	require.NoError(t, err)
+	require.Equal(t, block, verified)
+	_, err = ipfsconnector.VerifyRecovered(padded, blockCID.String(), true)
+	require.Error(t, err)
+	trimmed, err = ipfsconnector.VerifyRecovered(padded, blockCID.String(), false)
+	require.NoError(t, err)
+	require.Equal(t, block, trimmed)
+}
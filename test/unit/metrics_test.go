@@ -0,0 +1,94 @@
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"ipfs-alpha-entanglement-code/Server"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	"ipfs-alpha-entanglement-code/membership"
+	"ipfs-alpha-entanglement-code/metrics"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeMetrics(t *testing.T, registry *metrics.Registry) string {
+	var out bytes.Buffer
+	n, err := registry.WriteTo(&out)
+	require.NoError(t, err)
+	require.Equal(t, int64(out.Len()), n)
+	return out.String()
+}
+
+func Test_Metrics_Exposition(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounter("test_total", "Counted things", "kind")
+	gauge := registry.NewGauge("test_gauge", "A gauge")
+	histogram := registry.NewHistogram("test_seconds", "Durations", []float64{1, 10}, "kind")
+
+	counter.Inc("b")
+	counter.Add(2, "a")
+	counter.Add(-1, "a") // counters only go up
+	counter.Inc(`quote"d`)
+	gauge.Set(0.5)
+	histogram.Observe(0.5, "x")
+	histogram.Observe(5, "x")
+	histogram.Observe(50, "x")
+
+	require.Equal(t, `# HELP test_total Counted things
+# TYPE test_total counter
+test_total{kind="a"} 2
+test_total{kind="b"} 1
+test_total{kind="quote\"d"} 1
+# HELP test_gauge A gauge
+# TYPE test_gauge gauge
+test_gauge 0.5
+# HELP test_seconds Durations
+# TYPE test_seconds histogram
+test_seconds_bucket{kind="x",le="1"} 1
+test_seconds_bucket{kind="x",le="10"} 2
+test_seconds_bucket{kind="x",le="+Inf"} 3
+test_seconds_sum{kind="x"} 55.5
+test_seconds_count{kind="x"} 3
+`, writeMetrics(t, registry))
+
+	gauge.Reset()
+	require.NotContains(t, writeMetrics(t, registry), "test_gauge 0.5")
+	require.Panics(t, func() { registry.NewGauge("test_gauge", "again") })
+	require.Panics(t, func() { counter.Inc() })
+}
+
+func Test_Metrics_Server(t *testing.T) {
+	m := Server.NewServerMetrics()
+	m.ObserveGetter(Server.DownloadGetter, ipfsconnector.GetterMetrics{DataBlocksFetched: 3, ParityBlocksUnavailable: 2})
+	m.ObserveRepair(Server.CollabRepairKind, Server.SUCCESS, 2*time.Second)
+	m.ObserveInspection(true, "missing")
+	m.ObservePeer("peer:8080", "accepted", time.Unix(100, 0))
+	m.ObservePeer("peer:8080", "expired", time.Unix(200, 0))
+	m.ObserveRejected("collab")
+	// the failure detector takes a peer down whatever its last request
+	m.ObservePeer("dead:8080", "reported", time.Unix(100, 0))
+	m.ObserveMember(membership.Member{Update: membership.Update{Address: "dead:8080", State: membership.Dead}})
+	m.ObserveMember(membership.Member{Update: membership.Update{Address: "alive:8080", State: membership.Alive}, Since: time.Unix(300, 0)})
+
+	out := writeMetrics(t, m.Registry)
+	for _, line := range []string{
+		`community_getter_blocks_total{getter="download",kind="data",result="fetched"} 3`,
+		`community_getter_blocks_total{getter="download",kind="parity",result="unavailable"} 2`,
+		`community_repairs_total{kind="collaborative",status="success"} 1`,
+		`community_repair_duration_seconds_bucket{kind="collaborative",status="success",le="5"} 1`,
+		`community_inspections_total{kind="data",result="missing"} 1`,
+		`community_peer_requests_total{peer="peer:8080",result="expired"} 1`,
+		`community_peer_up{peer="peer:8080"} 0`,
+		`community_peer_last_seen_timestamp_seconds{peer="peer:8080"} 100`,
+		`community_worker_rejected_total{pool="collab"} 1`,
+		`community_peer_up{peer="dead:8080"} 0`,
+		`community_peer_last_seen_timestamp_seconds{peer="dead:8080"} 100`,
+		`community_peer_up{peer="alive:8080"} 1`,
+		`community_peer_last_seen_timestamp_seconds{peer="alive:8080"} 300`,
+	} {
+		require.Contains(t, strings.Split(out, "\n"), line)
+	}
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"ipfs-alpha-entanglement-code/Server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MonitorAPI_MissingBlockIntervals(t *testing.T) {
+	require.Equal(t, Server.MissingBlockStats{}, Server.MissingBlockIntervals(nil))
+
+	start := time.Unix(1000, 0)
+	stats := Server.MissingBlockIntervals([]int64{start.UnixNano()})
+	require.Equal(t, 0, stats.Count)
+	require.True(t, start.Equal(stats.Since))
+	require.True(t, stats.LastDetected.IsZero())
+
+	stats = Server.MissingBlockIntervals([]int64{
+		start.UnixNano(),
+		start.Add(2 * time.Second).UnixNano(),
+		start.Add(3 * time.Second).UnixNano(),
+		start.Add(9 * time.Second).UnixNano(),
+	})
+	require.Equal(t, 3, stats.Count)
+	require.True(t, start.Add(9*time.Second).Equal(stats.LastDetected))
+	require.Equal(t, 3.0, stats.AverageIntervalSeconds)
+	require.Equal(t, 1.0, stats.MinIntervalSeconds)
+	require.Equal(t, 6.0, stats.MaxIntervalSeconds)
+}
+
+func Test_MonitorAPI_OpenAPI(t *testing.T) {
+	var spec struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal(Server.OpenAPISpec, &spec))
+	require.Equal(t, "3.0.3", spec.OpenAPI)
+
+	for path, method := range map[string]string{
+		"/listMonitor":        "get",
+		"/checkFileStatus":    "get",
+		"/checkClusterStatus": "get",
+		"/updateView":         "post",
+		"/recomputeHealth":    "get",
+		"/repairs/{id}":       "delete",
+	} {
+		require.Contains(t, spec.Paths[path], method, path)
+	}
+
+	// every referenced schema is described
+	refs := regexp.MustCompile(`"#/components/schemas/([A-Za-z]+)"`).FindAllStringSubmatch(string(Server.OpenAPISpec), -1)
+	require.NotEmpty(t, refs)
+	for _, ref := range refs {
+		require.Contains(t, spec.Components.Schemas, ref[1])
+	}
+}
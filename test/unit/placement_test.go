@@ -0,0 +1,162 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ipfs-alpha-entanglement-code/client"
+	ipfscluster "ipfs-alpha-entanglement-code/ipfs-cluster"
+	ipfsconnector "ipfs-alpha-entanglement-code/ipfs-connector"
+	"ipfs-alpha-entanglement-code/test/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newPlacementCluster starts a mock cluster of a peer the connector talks to and of peers in the given regions
+func newPlacementCluster(t *testing.T, regions []string) (*ipfscluster.Connector, *mock.Cluster, []string) {
+	cluster := mock.CreateCluster(len(regions)+1, nil)
+	t.Cleanup(cluster.Close)
+	peers := cluster.PeerIDs()[1:]
+	for i, region := range regions {
+		cluster.SetRegion(peers[i], region)
+	}
+
+	conn, err := ipfscluster.CreateIPFSClusterConnector(context.Background(), cluster.Port(), cluster.Host())
+	require.NoError(t, err)
+	return conn, cluster, peers
+}
+
+func Test_Placement_Policies(t *testing.T) {
+	regions := []string{"eu", "eu", "us", "asia"}
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		conn, cluster, peers := newPlacementCluster(t, regions)
+		for i := 0; i < 5; i++ {
+			require.NoError(t, conn.AddPinDirect(context.Background(), fmt.Sprintf("parity%d", i), 1))
+		}
+		require.Equal(t, []string{peers[0]}, cluster.Allocations("parity0"))
+		require.Equal(t, []string{peers[3]}, cluster.Allocations("parity3"))
+		require.Equal(t, []string{peers[0]}, cluster.Allocations("parity4"))
+		require.Equal(t, []string{peers[1]}, conn.GetRecordedAllocations()["parity1"])
+	})
+
+	t.Run("Neighbour", func(t *testing.T) {
+		conn, cluster, peers := newPlacementCluster(t, regions)
+		policy, err := ipfscluster.NewPlacementPolicy("neighbour")
+		require.NoError(t, err)
+		conn.SetPlacementPolicy(policy)
+
+		for i := 0; i < 6; i++ {
+			cid := fmt.Sprintf("parity%d", i)
+			require.NoError(t, conn.AddPinDirectWithNeighbours(context.Background(), cid, 1, []string{peers[0], peers[2]}))
+			require.NotContains(t, []string{peers[0], peers[2]}, cluster.Allocations(cid)[0])
+		}
+
+		// placed parities are neighbours too
+		parity0 := conn.GetRecordedAllocations()["parity0"][0]
+		require.NoError(t, conn.AddPinDirectWithNeighbours(context.Background(), "parity6", 2, []string{peers[0], parity0}))
+		require.NotContains(t, conn.GetRecordedAllocations()["parity6"], peers[0])
+		require.NotContains(t, conn.GetRecordedAllocations()["parity6"], parity0)
+	})
+
+	t.Run("Region", func(t *testing.T) {
+		conn, _, peers := newPlacementCluster(t, regions)
+		policy, err := ipfscluster.NewPlacementPolicy("region")
+		require.NoError(t, err)
+		conn.SetPlacementPolicy(policy)
+
+		for i := 0; i < 4; i++ {
+			cid := fmt.Sprintf("parity%d", i)
+			require.NoError(t, conn.AddPinDirectWithNeighbours(context.Background(), cid, 1, []string{peers[0]}))
+			// never in the region of the neighbour
+			require.Contains(t, []string{peers[2], peers[3]}, conn.GetRecordedAllocations()[cid][0])
+		}
+
+		// replicas are spread over distinct regions before reusing one
+		require.NoError(t, conn.AddPinDirect(context.Background(), "tree", 3))
+		allocation := conn.GetRecordedAllocations()["tree"]
+		require.Len(t, allocation, 3)
+		seen := make(map[string]struct{})
+		for _, peer := range allocation {
+			for i := range peers {
+				if peers[i] == peer {
+					seen[regions[i]] = struct{}{}
+				}
+			}
+		}
+		require.Len(t, seen, 3)
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		_, err := ipfscluster.NewPlacementPolicy("random")
+		require.Error(t, err)
+	})
+}
+
+func Test_Placement_Upload(t *testing.T) {
+	EnableLog(true)
+	ipfs := mock.CreateIPFS()
+	t.Cleanup(ipfs.Close)
+	cluster := mock.CreateCluster(6, ipfs)
+	t.Cleanup(cluster.Close)
+	// the client adds the file through the IPFS daemon of a peer which can be allocated pins
+	ipfsPeer := cluster.PeerIDs()[2]
+	cluster.SetIPFSPeer(ipfsPeer)
+
+	c, err := client.NewClient(context.Background(), cluster.Host(), cluster.Port(), ipfs.Host(), ipfs.Port())
+	require.NoError(t, err)
+	opts := ipfsconnector.DefaultAddOptions()
+	opts.Chunker = "size-1024"
+	require.NoError(t, c.SetAddOptions(opts))
+	policy, err := ipfscluster.NewPlacementPolicy("neighbour")
+	require.NoError(t, err)
+	c.IPFSClusterConnector.SetPlacementPolicy(policy)
+
+	data := make([]byte, 100*1024+100)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	// the file is already pinned on another peer
+	require.NoError(t, c.DirectUploadWithReplication(context.Background(), path, 1))
+	rootCID, metaCID, pinResult, err := c.Upload(context.Background(), path, 3, 5, 5, 2, "")
+	require.NoError(t, err)
+	require.NoError(t, pinResult())
+	dataPeers := append([]string{ipfsPeer}, cluster.Allocations(rootCID)...)
+	require.Len(t, dataPeers, 2)
+	require.NotEqual(t, dataPeers[0], dataPeers[1])
+
+	raw, err := c.GetFileToMem(context.Background(), metaCID)
+	require.NoError(t, err)
+	metaData, err := client.ParseMetadata(raw)
+	require.NoError(t, err)
+
+	// no parity is held by a peer holding the data it protects
+	var leaves int
+	var check func(node *ipfsconnector.TreeNode)
+	check = func(node *ipfsconnector.TreeNode) {
+		if len(node.Children) > 0 {
+			for _, child := range node.Children {
+				check(child)
+			}
+			return
+		}
+		leaves++
+		allocation := cluster.Allocations(node.CID)
+		require.NotEmpty(t, allocation)
+		require.Equal(t, allocation, metaData.ParityAllocations[node.CID])
+		for _, peer := range dataPeers {
+			require.NotContains(t, allocation, peer)
+		}
+	}
+	for _, treeCID := range metaData.TreeCIDs {
+		tree, _, _, err := c.GetMerkleTree(context.Background(), treeCID, nil)
+		require.NoError(t, err)
+		check(tree)
+	}
+	require.Greater(t, leaves, len(metaData.TreeCIDs))
+}
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"ipfs-alpha-entanglement-code/Server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RepairAPI_View(t *testing.T) {
+	job := newRepairJob([]int{1, 2, 3, 4, 5}, 2)
+	job.FileCID, job.StartTime = "file", time.Now()
+	job.Peers = make(map[string]*Server.CollabPeerInfo)
+	first, second := job.Units[job.JobID+"-0"], job.Units[job.JobID+"-1"]
+	job.Assign(first, "a", time.Now())
+	job.Assign(second, "b", time.Now())
+	job.Peers["a"] = &Server.CollabPeerInfo{Name: "a", AllocatedBlocks: map[int]bool{1: true, 2: false}}
+	job.Peers["b"] = &Server.CollabPeerInfo{Name: "b", AllocatedBlocks: map[int]bool{3: false, 4: false, 5: false}}
+	require.True(t, job.Report(first.ID, "a", map[int]bool{1: true, 2: false}))
+
+	view := Server.CollabRepairView(job)
+	require.Equal(t, job.JobID, view.ID)
+	require.Equal(t, Server.CollabRepairKind, view.Kind)
+	require.Equal(t, "pending", view.State)
+	require.False(t, view.Finished())
+	require.Equal(t, map[int]Server.LeafStatus{
+		1: {Unit: first.ID, Peer: "a", Status: Server.SUCCESS},
+		2: {Unit: first.ID, Peer: "a", Status: Server.FAILURE},
+		3: {Unit: second.ID, Peer: "b", Status: Server.PENDING},
+		4: {Unit: second.ID, Peer: "b", Status: Server.PENDING},
+		5: {Unit: second.ID, Peer: "b", Status: Server.PENDING},
+	}, view.Leaves)
+
+	// the view is a copy, left untouched by the daemon
+	job.Peers["b"].AllocatedBlocks[3] = true
+	second.Status = Server.SUCCESS
+	require.False(t, view.Peers["b"].AllocatedBlocks[3])
+	require.Equal(t, Server.PENDING, view.Units[second.ID].Status)
+
+	strand := Server.StrandRepairView(&Server.StrandRepairData{JobID: "strand", Strand: 2, Status: Server.CANCELLED})
+	require.Equal(t, "cancelled", strand.State)
+	require.Equal(t, 2, strand.Strand)
+	require.True(t, strand.Finished())
+}
+
+func Test_RepairAPI_Registry(t *testing.T) {
+	registry := Server.NewRepairRegistry()
+	_, ok := registry.Get("a")
+	require.False(t, ok)
+
+	start := time.Now()
+	registry.Publish(&Server.RepairView{ID: "a", StartTime: start, Status: Server.PENDING})
+	registry.Publish(&Server.RepairView{ID: "b", StartTime: start.Add(time.Second), Status: Server.PENDING,
+		Leaves: map[int]Server.LeafStatus{1: {}}})
+	registry.Publish(&Server.RepairView{StartTime: start, Status: Server.PENDING})
+
+	// the list holds summaries, latest first
+	list := registry.List()
+	require.Len(t, list, 2)
+	require.Equal(t, "b", list[0].ID)
+	require.Nil(t, list[0].Leaves)
+	view, ok := registry.Get("b")
+	require.True(t, ok)
+	require.Len(t, view.Leaves, 1)
+
+	// a subscriber starts with the current snapshot and only keeps the latest one
+	updates, unsubscribe := registry.Subscribe("a")
+	require.Equal(t, Server.PENDING, (<-updates).Status)
+	require.False(t, registry.Publish(&Server.RepairView{ID: "a", StartTime: start, Status: Server.PENDING}))
+	require.True(t, registry.Publish(&Server.RepairView{ID: "a", StartTime: start, Status: Server.SUCCESS}))
+	require.Equal(t, Server.SUCCESS, (<-updates).Status)
+	unsubscribe()
+	registry.Publish(&Server.RepairView{ID: "a", StartTime: start, Status: Server.FAILURE})
+	require.Empty(t, updates)
+
+	// the operation of a repair is cancelled until it is done
+	ctx, cancel := context.WithCancel(context.Background())
+	done := registry.SetCancel("b", cancel)
+	registry.Cancel("b")
+	require.Error(t, ctx.Err())
+	done()
+	registry.Cancel("b")
+
+	// only the latest finished repairs are kept
+	for i := 0; i < Server.MaxRepairHistory+10; i++ {
+		registry.Publish(&Server.RepairView{ID: fmt.Sprint("old", i), StartTime: start, Status: Server.SUCCESS})
+	}
+	require.Len(t, registry.List(), Server.MaxRepairHistory+1)
+	_, ok = registry.Get("a")
+	require.False(t, ok)
+	_, ok = registry.Get("b")
+	require.True(t, ok)
+}
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"ipfs-alpha-entanglement-code/Server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newRepairJob(leaves []int, numUnits int) *Server.CollaborativeRepairData {
+	job := &Server.CollaborativeRepairData{JobID: Server.NewRepairJobID(), Status: Server.PENDING}
+	job.SplitUnits(leaves, numUnits)
+	return job
+}
+
+func Test_RepairJob_Units(t *testing.T) {
+	job := newRepairJob([]int{1, 2, 3, 4, 5, 6, 7}, 3)
+	require.Len(t, job.Units, 3)
+
+	leaves := 0
+	for _, unit := range job.Units {
+		require.Equal(t, Server.PENDING, unit.Status)
+		require.Contains(t, unit.ID, job.JobID)
+		leaves += len(unit.FailedIndices)
+	}
+	require.Equal(t, 7, leaves)
+	require.NotEqual(t, job.JobID, Server.NewRepairJobID())
+
+	// the peers never given the unit come first
+	unit := job.Units[job.JobID+"-0"]
+	job.Assign(unit, "b", time.Now())
+	require.Equal(t, []string{"c", "a", "b"}, unit.CandidatePeers([]string{"a", "b", "c"}, 1))
+}
+
+func Test_RepairJob_Withdraw(t *testing.T) {
+	job := newRepairJob([]int{1, 2}, 1)
+	unit := job.Units[job.JobID+"-0"]
+	job.Assign(unit, "a", time.Now())
+
+	// a unit offered to a peer which did not accept it is as if it was never offered
+	job.Assign(unit, "b", time.Now())
+	job.Withdraw(unit, "b")
+	require.Equal(t, "", unit.Peer)
+	require.Equal(t, []string{"a"}, unit.Assignees)
+	require.Equal(t, 1, unit.Attempts)
+
+	// only the current peer of a pending unit is withdrawn
+	job.Assign(unit, "c", time.Now())
+	job.Withdraw(unit, "a")
+	require.Equal(t, "c", unit.Peer)
+	require.True(t, job.Report(unit.ID, "c", map[int]bool{1: true, 2: true}))
+	job.Withdraw(unit, "c")
+	require.Equal(t, "c", unit.Peer)
+	require.Equal(t, Server.SUCCESS, unit.Status)
+}
+
+func Test_RepairJob_Deadline(t *testing.T) {
+	job := newRepairJob([]int{1, 2}, 1)
+	unit := job.Units[job.JobID+"-0"]
+	now := time.Now()
+
+	// a unit waiting for a peer is ready right away
+	expired, ready := job.Expire(now)
+	require.Empty(t, expired)
+	require.Equal(t, []*Server.RepairUnit{unit}, ready)
+
+	job.Assign(unit, "a", now)
+	expired, ready = job.Expire(now.Add(Server.UnitRepairDeadline / 2))
+	require.Empty(t, expired)
+	require.Empty(t, ready)
+
+	// the peer missing its deadline is given up on, and the unit waits for its backoff
+	now = now.Add(Server.UnitRepairDeadline + time.Second)
+	expired, ready = job.Expire(now)
+	require.Equal(t, []string{"a"}, expired)
+	require.Empty(t, ready)
+	require.Equal(t, "", unit.Peer)
+	_, ready = job.Expire(now.Add(Server.RepairBackoff(1)))
+	require.Equal(t, []*Server.RepairUnit{unit}, ready)
+
+	// the backoff grows with the attempts up to its maximum
+	require.Equal(t, Server.UnitRepairBackoff, Server.RepairBackoff(1))
+	require.Equal(t, 4*Server.UnitRepairBackoff, Server.RepairBackoff(3))
+	require.Equal(t, Server.UnitRepairBackoffMax, Server.RepairBackoff(100))
+
+	// the unit fails once it was tried too many times
+	for unit.Attempts < Server.MaxUnitRepairAttempts {
+		job.DispatchFailed(unit, now)
+	}
+	require.Equal(t, Server.FAILURE, unit.Status)
+	done, success := job.Done()
+	require.True(t, done)
+	require.False(t, success)
+}
+
+func Test_RepairJob_Reports(t *testing.T) {
+	job := newRepairJob([]int{1, 2, 3, 4}, 2)
+	first, second := job.Units[job.JobID+"-0"], job.Units[job.JobID+"-1"]
+	now := time.Now()
+	job.Assign(first, "a", now)
+	job.Assign(second, "b", now)
+
+	// reports of unknown units or from peers never given the unit are ignored
+	require.False(t, job.Report("unknown", "a", map[int]bool{1: true}))
+	require.False(t, job.Report(first.ID, "c", map[int]bool{1: true, 2: true}))
+
+	require.True(t, job.Report(first.ID, "a", map[int]bool{1: true, 2: true}))
+	require.Equal(t, Server.SUCCESS, first.Status)
+	done, _ := job.Done()
+	require.False(t, done)
+
+	// a repeated report does not settle the unit again
+	require.False(t, job.Report(first.ID, "a", map[int]bool{1: false, 2: false}))
+	require.Equal(t, Server.SUCCESS, first.Status)
+
+	// once the unit is given to another peer, the previous one may still settle it with a success only
+	job.Expire(now.Add(Server.UnitRepairDeadline + time.Second))
+	job.Assign(second, "c", now.Add(Server.UnitRepairDeadline+Server.UnitRepairBackoff))
+	require.False(t, job.Report(second.ID, "b", map[int]bool{3: true, 4: false}))
+	require.True(t, job.Report(second.ID, "b", map[int]bool{3: true, 4: true}))
+	require.False(t, job.Report(second.ID, "c", map[int]bool{3: true, 4: true}))
+
+	done, success := job.Done()
+	require.True(t, done)
+	require.True(t, success)
+}
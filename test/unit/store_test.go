@@ -0,0 +1,105 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"ipfs-alpha-entanglement-code/Server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Store_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Server.OpenStore(dir)
+	require.NoError(t, err)
+
+	block := Server.WatchedBlock{CID: "block", Peer: Server.ClusterPeer{Name: "peer", Region: "eu"}, Probability: 0.33}
+	require.NoError(t, store.Put("files", "a", block))
+	require.NoError(t, store.Put("files", "b", block))
+	block.Probability = 0.11
+	require.NoError(t, store.Put("files", "a", block))
+	require.NoError(t, store.Delete("files", "b"))
+	require.NoError(t, store.Put("repairs", "a", Server.PENDING))
+	require.NoError(t, store.Close())
+	require.Error(t, store.Put("files", "c", block))
+
+	// the last record is torn by a crash in the middle of a write
+	file, err := os.OpenFile(filepath.Join(dir, Server.StoreFileName), os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"put","bucket":"files","key":"c","val`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	store, err = Server.OpenStore(dir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	files := store.Load("files")
+	require.Len(t, files, 1)
+	var restored Server.WatchedBlock
+	require.NoError(t, json.Unmarshal(files["a"], &restored))
+	require.Equal(t, block, restored)
+	require.Len(t, store.Load("repairs"), 1)
+	require.Empty(t, store.Load("unknown"))
+
+	// the store keeps working after recovering from the torn record
+	require.NoError(t, store.Put("files", "c", block))
+	require.Len(t, store.Load("files"), 2)
+}
+
+func Test_Store_Compaction(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Server.OpenStore(dir)
+	require.NoError(t, err)
+
+	for i := 0; i < 3*Server.StoreCompactionRecords; i++ {
+		require.NoError(t, store.Put("files", "a", i))
+	}
+	require.NoError(t, store.Close())
+
+	// the overwritten records are dropped from the log
+	content, err := os.ReadFile(filepath.Join(dir, Server.StoreFileName))
+	require.NoError(t, err)
+	require.Less(t, len(content), 100*Server.StoreCompactionRecords)
+
+	store, err = Server.OpenStore(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	require.Equal(t, json.RawMessage("3071"), store.Load("files")["a"])
+}
+
+func Test_Store_Concurrent_Writes(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Server.OpenStore(dir)
+	require.NoError(t, err)
+
+	// the writes are visible before they reach the disk, and the last value of a key is kept
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				require.NoError(t, store.Put("files", fmt.Sprintf("%d-%d", w, i%50), i))
+			}
+			for i := 0; i < 25; i++ {
+				require.NoError(t, store.Delete("files", fmt.Sprintf("%d-%d", w, i)))
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.Len(t, store.Load("files"), 100)
+	require.NoError(t, store.Close())
+
+	store, err = Server.OpenStore(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	files := store.Load("files")
+	require.Len(t, files, 100)
+	require.Equal(t, json.RawMessage("499"), files["3-49"])
+}
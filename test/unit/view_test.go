@@ -0,0 +1,124 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"ipfs-alpha-entanglement-code/Server"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sendView returns the view as received by another monitor
+func sendView(t *testing.T, view *Server.View) *Server.View {
+	data, err := json.Marshal(view)
+	require.NoError(t, err)
+	var received Server.View
+	require.NoError(t, json.Unmarshal(data, &received))
+	return &received
+}
+
+func Test_View_Merge(t *testing.T) {
+	missing := func(cid string) *Server.WatchedBlock {
+		return &Server.WatchedBlock{CID: cid, Probability: 0.33}
+	}
+
+	a, b, c := Server.NewView(), Server.NewView(), Server.NewView()
+	a.Observe("a:7070", true, 1, missing("data1"))
+	a.Observe("a:7070", false, 2, missing("parity2"))
+	a.Estimate("a:7070", 0.9)
+	b.Observe("b:7070", true, 1, missing("data1"))
+	b.Observe("b:7070", true, 3, missing("data3"))
+	b.Estimate("b:7070", 0.6)
+	c.Observe("c:7070", false, 2, nil)
+	c.Estimate("c:7070", 0.75)
+
+	// every order of the merges gives the same view
+	views := []*Server.View{sendView(t, a), sendView(t, b), sendView(t, c)}
+	orders := [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+	var expected []byte
+	for _, order := range orders {
+		merged := Server.NewView()
+		for _, i := range order {
+			merged.Merge(views[i])
+		}
+		// merging again changes nothing
+		require.False(t, merged.Merge(views[order[0]]))
+
+		data, err := json.Marshal(merged)
+		require.NoError(t, err)
+		if expected == nil {
+			expected = data
+		}
+		require.JSONEq(t, string(expected), string(data))
+
+		prob, ok := merged.EstimatedBlockProb()
+		require.True(t, ok)
+		require.InDelta(t, 0.75, prob, 1e-6)
+	}
+
+	merged := Server.NewView()
+	for _, view := range views {
+		merged.Merge(view)
+	}
+	require.Len(t, merged.MissingBlocks(true), 2)
+	require.Equal(t, "data3", merged.MissingBlocks(true)[3].CID)
+	// the parity block was found available after being found missing
+	require.Empty(t, merged.MissingBlocks(false))
+}
+
+func Test_View_Stale(t *testing.T) {
+	a, b := Server.NewView(), Server.NewView()
+	a.Observe("a:7070", true, 4, &Server.WatchedBlock{CID: "data4", Probability: 0.33})
+	stale := sendView(t, a)
+
+	// b learns the block is missing, then finds it repaired
+	require.True(t, b.Merge(stale))
+	require.Len(t, b.MissingBlocks(true), 1)
+	b.Observe("b:7070", true, 4, nil)
+
+	// the stale view of a does not bring the block back, whenever it arrives
+	require.False(t, b.Merge(stale))
+	require.Empty(t, b.MissingBlocks(true))
+
+	// and a learns the repair
+	require.True(t, a.Merge(sendView(t, b)))
+	require.Empty(t, a.MissingBlocks(true))
+
+	// an observation made after merging a view is after all of its observations, whatever the clocks
+	future := Server.NewView()
+	future.Merge(&Server.View{Blocks: map[string]*Server.BlockObservation{
+		"d5": {Missing: true, Block: Server.WatchedBlock{CID: "data5"}, Time: 1 << 62, Observer: "c:7070"},
+	}})
+	future.Observe("a:7070", true, 5, nil)
+	require.Empty(t, future.MissingBlocks(true))
+}
+
+func Test_View_Delta(t *testing.T) {
+	a, b := Server.NewView(), Server.NewView()
+	a.Observe("a:7070", true, 1, &Server.WatchedBlock{CID: "data1"})
+	a.Estimate("a:7070", 0.8)
+	require.True(t, b.Merge(sendView(t, a)))
+	acked := a.Seq()
+
+	// nothing changed since the view was acknowledged
+	require.True(t, a.Delta(acked).Empty())
+
+	a.Observe("a:7070", true, 1, nil)
+	a.Observe("a:7070", false, 7, &Server.WatchedBlock{CID: "parity7"})
+	delta := a.Delta(acked)
+	require.Len(t, delta.Blocks, 2)
+	require.Empty(t, delta.Estimates)
+
+	// the changes bring the other monitor to the same view as the whole view
+	require.True(t, b.Merge(sendView(t, delta)))
+	full := Server.NewView()
+	full.Merge(sendView(t, a))
+	require.Equal(t, full.MissingBlocks(true), b.MissingBlocks(true))
+	require.Equal(t, full.MissingBlocks(false), b.MissingBlocks(false))
+	require.Empty(t, b.MissingBlocks(true))
+	require.Equal(t, "parity7", b.MissingBlocks(false)[7].CID)
+
+	// observations with an unknown block key are ignored
+	require.False(t, b.Merge(&Server.View{Blocks: map[string]*Server.BlockObservation{"x1": {Missing: true, Time: 1}}}))
+}
@@ -0,0 +1,36 @@
+package test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"ipfs-alpha-entanglement-code/Server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Workers_Pool(t *testing.T) {
+	pool := Server.NewWorkerPool("test", 1, 1)
+	require.Equal(t, "test", pool.Name())
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var done atomic.Int64
+	require.NoError(t, pool.Submit(func() {
+		close(started)
+		<-release
+		done.Add(1)
+	}))
+	<-started
+	require.Equal(t, 1, pool.Busy())
+
+	// the queue holds a single task while the worker is busy, the next one is rejected
+	require.NoError(t, pool.Submit(func() { done.Add(1) }))
+	require.Equal(t, 1, pool.Queued())
+	require.ErrorIs(t, pool.Submit(func() { done.Add(1) }), Server.ErrQueueFull)
+
+	// closing the pool waits for the queued tasks
+	close(release)
+	pool.Close()
+	require.Equal(t, int64(2), done.Load())
+	require.Equal(t, 0, pool.Busy())
+}
@@ -7,16 +7,6 @@ import (
 	"strings"
 )
 
-func CheckError(err error, msg string, args ...interface{}) {
-	if err != nil {
-		ThrowError(msg+": %s", args, err)
-	}
-}
-
-func ThrowError(msg string, args ...interface{}) {
-	panic(fmt.Errorf(msg, args...))
-}
-
 var GlobalLogPrint = false
 var GlobalInfoPrint = false
 
@@ -0,0 +1,5 @@
+package util
+
+// Version is the version of the tool recorded in the metadata of uploaded files.
+// It can be set at build time with -ldflags "-X ipfs-alpha-entanglement-code/util.Version=..."
+var Version = "0.1.0"